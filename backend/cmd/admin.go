@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"backend/internal"
+)
+
+const adminUsage = "Использование: admin create <логин> <operator|department_head|superadmin> | passwd <логин> | disable <логин> | enable <логин> | list | invite <роль> [id службы]"
+
+// runAdmin обрабатывает подкоманду `admin ...` — управление учётками веб-админки
+// с сервера, в том числе создание первого суперадмина, и приглашения сотрудников в боте.
+// Пароль читается из ADMIN_PASSWORD или первой строкой stdin.
+func runAdmin(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		log.Fatal(adminUsage)
+	}
+
+	cfg := internal.LoadDatabaseConfig()
+	db := internal.NewDB(ctx, cfg.DatabaseURL)
+	defer db.Close()
+
+	switch args[0] {
+	case "create":
+		if len(args) != 3 {
+			log.Fatal(adminUsage)
+		}
+		acc, err := db.CreateAdminAccount(ctx, internal.NewAdminAccount{
+			Login:    args[1],
+			Password: readPassword(),
+			Role:     internal.AdminRole(args[2]),
+		})
+		if err != nil {
+			log.Fatalf("Ошибка создания учётной записи: %v", err)
+		}
+		fmt.Fprintf(os.Stdout, "Создана учётная запись %s (%s), id %d\n", acc.Login, acc.Role, acc.ID)
+	case "passwd":
+		if len(args) != 2 {
+			log.Fatal(adminUsage)
+		}
+		acc := mustAdminAccount(ctx, db, args[1])
+		if err := db.SetAdminPassword(ctx, acc.ID, readPassword()); err != nil {
+			log.Fatalf("Ошибка смены пароля: %v", err)
+		}
+		fmt.Fprintln(os.Stdout, "Пароль изменён, все сессии завершены")
+	case "disable", "enable":
+		if len(args) != 2 {
+			log.Fatal(adminUsage)
+		}
+		acc := mustAdminAccount(ctx, db, args[1])
+		if err := db.SetAdminAccountDisabled(ctx, acc.ID, args[0] == "disable"); err != nil {
+			log.Fatalf("Ошибка изменения учётной записи: %v", err)
+		}
+		fmt.Fprintln(os.Stdout, "Готово")
+	case "list":
+		list, err := db.ListAdminAccounts(ctx)
+		if err != nil {
+			log.Fatalf("Ошибка получения учётных записей: %v", err)
+		}
+		for _, a := range list {
+			state := "активна"
+			if a.DisabledAt != nil {
+				state = "заблокирована"
+			}
+			fmt.Fprintf(os.Stdout, "%d\t%s\t%s\t%s\n", a.ID, a.Login, a.Role, state)
+		}
+	case "invite":
+		if len(args) < 2 || len(args) > 3 {
+			log.Fatal(adminUsage)
+		}
+		in := internal.NewStaffInvite{Role: internal.AdminRole(args[1]), TTL: cfg.StaffInviteTTL}
+		if len(args) == 3 {
+			id, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				log.Fatal(adminUsage)
+			}
+			in.DepartmentID = &id
+		}
+		token, inv, err := db.CreateStaffInvite(ctx, in)
+		if err != nil {
+			log.Fatalf("Ошибка создания приглашения: %v", err)
+		}
+		fmt.Fprintf(os.Stdout, "Приглашение #%d (%s) действует до %s.\nОтправьте боту: /start invite_%s\nили откройте https://t.me/<имя бота>?start=invite_%s\n",
+			inv.ID, inv.Role, inv.ExpiresAt.Local().Format("2006-01-02 15:04"), token, token)
+	default:
+		log.Fatal(adminUsage)
+	}
+}
+
+func mustAdminAccount(ctx context.Context, db *internal.DB, login string) *internal.AdminAccount {
+	acc, err := db.GetAdminAccountByLogin(ctx, login)
+	if err != nil {
+		log.Fatalf("Учётная запись %q: %v", login, err)
+	}
+	return acc
+}
+
+func readPassword() string {
+	if p := os.Getenv("ADMIN_PASSWORD"); p != "" {
+		return p
+	}
+	fmt.Fprint(os.Stderr, "Пароль: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("Не удалось прочитать пароль: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"backend/internal"
+)
+
+const blobsUsage = "Использование: blobs migrate [каталог, относительно которого записан local_path; по умолчанию LEGACY_FILES_DIR]"
+
+// runBlobs обрабатывает подкоманду `blobs migrate` — перенос вложений,
+// сохранённых до BlobStore, с диска в настроенное хранилище (BLOB_STORE).
+// Запускать можно повторно: перенесённые вложения пропускаются.
+func runBlobs(ctx context.Context, args []string) {
+	if len(args) == 0 || args[0] != "migrate" || len(args) > 2 {
+		log.Fatal(blobsUsage)
+	}
+	cfg := internal.LoadDatabaseConfig()
+	root := cfg.LegacyDir
+	if len(args) == 2 {
+		root = args[1]
+	}
+	db := internal.NewDB(ctx, cfg.DatabaseURL)
+	defer db.Close()
+
+	store, err := internal.NewBlobStore(cfg)
+	if err != nil {
+		log.Fatalf("Ошибка хранилища вложений: %v", err)
+	}
+
+	list, err := db.ListLegacyAttachments(ctx)
+	if err != nil {
+		log.Fatalf("Ошибка получения вложений: %v", err)
+	}
+	var moved, failed int
+	for _, a := range list {
+		if err := migrateBlob(ctx, db, store, root, &a); err != nil {
+			log.Printf("вложение %d (%s): %v", a.ID, a.LocalPath, err)
+			failed++
+			continue
+		}
+		moved++
+	}
+	fmt.Fprintf(os.Stdout, "Перенесено вложений: %d, с ошибкой: %d\n", moved, failed)
+}
+
+func migrateBlob(ctx context.Context, db *internal.DB, store internal.BlobStore, root string, a *internal.Attachment) error {
+	rc, err := internal.OpenAttachment(ctx, store, root, a)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	key, size, err := internal.PutBlob(ctx, store, rc, "")
+	if err != nil {
+		return err
+	}
+	return db.SetAttachmentBlob(ctx, a.ID, key, size)
+}
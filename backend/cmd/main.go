@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"backend/internal"
 
@@ -15,11 +16,31 @@ import (
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		runAdmin(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "blobs" {
+		runBlobs(ctx, os.Args[2:])
+		return
+	}
+
 	cfg := internal.LoadConfig()
 
 	db := internal.NewDB(ctx, cfg.DatabaseURL)
 	defer db.Close()
 
+	statuses, err := internal.ParseStatusTransitions(cfg.StatusTransitions)
+	if err != nil {
+		log.Fatalf("Ошибка в STATUS_TRANSITIONS: %v", err)
+	}
+	db.Statuses = statuses
+
 	log.Println("Инициализация схемы базы данных...")
 	if err := db.InitSchema(ctx); err != nil {
 		log.Fatalf("Ошибка при инициализации базы данных: %v", err)
@@ -33,8 +54,31 @@ func main() {
 	}
 	api.Debug = false
 
-	bot := internal.NewBot(api, db, cfg, svc)
+	state := internal.NewPgStateStore(db)
+	go state.RunJanitor(ctx, time.Hour)
+
+	blobs, err := internal.NewBlobStore(cfg)
+	if err != nil {
+		log.Fatalf("Ошибка хранилища вложений: %v", err)
+	}
+
+	bot := internal.NewBot(api, db, cfg, svc, state, blobs)
 	web := internal.NewWeb(cfg, db, svc, bot)
+	bot.StartWorkers(ctx)
+
+	go internal.NewSLAScheduler(db, cfg.SLACheckInterval).Run(ctx)
+	go bot.Media.Run(ctx)
+
+	// побочные эффекты изменений заявок — через outbox
+	events := internal.NewEventBus(db, cfg)
+	events.Subscribe(bot.Notify, internal.EventIssueCreated, internal.EventIssueStatusChanged, internal.EventIssueCommented)
+	events.Subscribe(bot.AdminDigest(), internal.EventIssueCreated)
+	events.Subscribe(bot.SLAAlerts(), internal.EventIssueOverdue)
+	events.Subscribe(bot.AssigneeAlerts(), internal.EventIssueAssigned)
+	events.Subscribe(&internal.WebhookHandler{DB: db}, internal.EventIssueCreated, internal.EventIssueStatusChanged,
+		internal.EventIssueCommented, internal.EventIssueAttachmentAdded)
+	go events.Run(ctx)
+	go internal.NewWebhookSender(db, cfg).Run(ctx)
 
 	if cfg.UseWebhook {
 		webhookURL := cfg.PublicBaseURL + cfg.WebhookPath
@@ -76,4 +120,5 @@ func main() {
 	log.Println("✅ Приложение успешно запущено.")
 	<-ctx.Done()
 	log.Println("Завершение работы приложения...")
+	bot.Wait()
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"backend/internal"
+	"backend/migrations"
+)
+
+const migrateUsage = "Использование: migrate up | down [N] | status"
+
+// runMigrate обрабатывает подкоманду `migrate up|down [N]|status`.
+func runMigrate(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		log.Fatal(migrateUsage)
+	}
+
+	cfg := internal.LoadDatabaseConfig()
+	db := internal.NewDB(ctx, cfg.DatabaseURL)
+	defer db.Close()
+
+	m, err := internal.NewMigrator(db, migrations.FS)
+	if err != nil {
+		log.Fatalf("Ошибка загрузки миграций: %v", err)
+	}
+
+	switch args[0] {
+	case "up":
+		if err := m.Up(ctx); err != nil {
+			log.Fatalf("Ошибка применения миграций: %v", err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatal(migrateUsage)
+			}
+		}
+		if err := m.Down(ctx, steps); err != nil {
+			log.Fatalf("Ошибка отката миграций: %v", err)
+		}
+	case "status":
+		list, err := m.Status(ctx)
+		if err != nil {
+			log.Fatalf("Ошибка получения статуса миграций: %v", err)
+		}
+		for _, st := range list {
+			state := "ожидает"
+			if st.Applied && st.AppliedAt != nil {
+				state = "применена " + st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(os.Stdout, "%04d_%s\t%s\n", st.Version, st.Name, state)
+		}
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
@@ -1,13 +1,16 @@
 document.addEventListener('DOMContentLoaded', () => {
   const authOverlay = document.getElementById('authOverlay');
-  const authSecretInput = document.getElementById('authSecretInput');
+  const authLoginInput = document.getElementById('authLoginInput');
+  const authPasswordInput = document.getElementById('authPasswordInput');
   const authSubmitBtn = document.getElementById('authSubmitBtn');
   const authStatus = document.getElementById('authStatus');
 
   const adminLayout = document.getElementById('adminLayout');
-  const changeSecretBtn = document.getElementById('changeSecretBtn');
+  const logoutBtn = document.getElementById('logoutBtn');
+  const accountInfo = document.getElementById('accountInfo');
 
   const statusFilter = document.getElementById('statusFilter');
+  const overdueFilter = document.getElementById('overdueFilter');
   const refreshBtn = document.getElementById('refreshBtn');
 
   const exportFrom = document.getElementById('exportFrom');
@@ -25,20 +28,57 @@ document.addEventListener('DOMContentLoaded', () => {
 
   const state = {
     token: '',
+    account: null,
     issues: [],
     selectedId: null,
     loading: false,
+    departments: [],
+    staff: [],
   };
 
+  // токен сессии живёт только до закрытия вкладки; сервер может отозвать его раньше
   function setToken(token) {
     state.token = (token || '').trim();
     if (state.token) {
-      localStorage.setItem('adminSecret112', state.token);
+      sessionStorage.setItem('adminSession112', state.token);
     } else {
-      localStorage.removeItem('adminSecret112');
+      sessionStorage.removeItem('adminSession112');
     }
   }
 
+  const roleLabels = {
+    operator: 'Оператор',
+    department_head: 'Руководитель службы',
+    superadmin: 'Суперадминистратор',
+  };
+
+  function setAccount(account) {
+    state.account = account || null;
+    if (!accountInfo) return;
+    if (!state.account) {
+      accountInfo.textContent = '';
+      return;
+    }
+    const login = state.account.Login ?? state.account.login ?? '';
+    const role = state.account.Role ?? state.account.role ?? '';
+    accountInfo.textContent = `${login} · ${roleLabels[role] || role}`;
+  }
+
+  // apiFetch добавляет заголовок Authorization; на 401 сессия сбрасывается
+  async function apiFetch(url, options = {}) {
+    const headers = Object.assign({}, options.headers, {
+      Authorization: 'Bearer ' + state.token,
+    });
+    const resp = await fetch(url, Object.assign({ cache: 'no-store' }, options, { headers }));
+    if (resp.status === 401) {
+      setToken('');
+      setAccount(null);
+      showAuthStatus('Сессия истекла, войдите заново.', 'warning');
+      showAuthOverlay();
+    }
+    return resp;
+  }
+
   function showAuthOverlay() {
     if (authOverlay) authOverlay.style.display = 'flex';
     if (adminLayout) adminLayout.style.display = 'none';
@@ -100,6 +140,10 @@ document.addEventListener('DOMContentLoaded', () => {
     }
   }
 
+  function isFinalStatus(status) {
+    return status === 'Завершено' || status === 'Отклонено';
+  }
+
   function clearDetails() {
     detailsTitle.textContent = 'Не выбрана';
     detailsStatusPill.textContent = '—';
@@ -128,10 +172,14 @@ document.addEventListener('DOMContentLoaded', () => {
       const text = issue.text || '';
       const district = issue.district || '—';
       const category = issue.category || '—';
+      const overdue = overdueLabel(issue);
 
       tr.innerHTML = `
         <td class="cell-id">#${issue.id}</td>
-        <td><span class="status-pill ${statusToClass(issue.status)}">${issue.status}</span></td>
+        <td>
+          <span class="status-pill ${statusToClass(issue.status)}">${issue.status}</span>
+          ${overdue ? `<span class="status-pill status-pill-rejected" title="${overdue}">⏰</span>` : ''}
+        </td>
         <td>${district}</td>
         <td>${category}</td>
         <td class="cell-text">${trimText(text, 80)}</td>
@@ -157,40 +205,36 @@ document.addEventListener('DOMContentLoaded', () => {
       .replace(/'/g, '&#39;');
   }
 
-  async function pingToken(token) {
-    if (!token) {
-      showAuthStatus('Введите admin_secret.', 'warning');
-      return false;
+  async function handleAuthSubmit() {
+    const login = (authLoginInput.value || '').trim();
+    const password = authPasswordInput.value || '';
+    if (!login || !password) {
+      showAuthStatus('Введите логин и пароль.', 'warning');
+      return;
     }
+    showAuthStatus('Проверка…', 'info');
     try {
-      const resp = await fetch('/admin/ping?token=' + encodeURIComponent(token), {
-        method: 'GET',
-        cache: 'no-store',
+      const resp = await fetch('/admin/login', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ login, password }),
       });
-      if (resp.ok) {
-        return true;
-      }
-      if (resp.status === 401) {
-        showAuthStatus('Неверный admin_secret.', 'error');
-        return false;
+      if (!resp.ok) {
+        const text = await resp.text();
+        showAuthStatus(text || ('Ошибка входа: ' + resp.status), 'error');
+        return;
       }
-      showAuthStatus('Ошибка проверки доступа: ' + resp.status, 'error');
-      return false;
+      const data = await resp.json();
+      setToken(data.token);
+      setAccount(data.account);
     } catch (e) {
       console.error(e);
-      showAuthStatus('Сетевая ошибка при проверке доступа.', 'error');
-      return false;
-    }
-  }
-
-  async function handleAuthSubmit() {
-    const secret = authSecretInput.value || '';
-    showAuthStatus('Проверка…', 'info');
-    const ok = await pingToken(secret);
-    if (!ok) {
+      showAuthStatus('Сетевая ошибка при входе.', 'error');
       return;
     }
-    setToken(secret);
+    authPasswordInput.value = '';
     showAuthStatus('Доступ разрешён.', 'success');
     hideAuthOverlay();
     await fetchIssues();
@@ -210,6 +254,14 @@ document.addEventListener('DOMContentLoaded', () => {
 
     const created_at = raw.created_at ?? raw.createdAt ?? raw.CreatedAt ?? null;
     const updated_at = raw.updated_at ?? raw.updatedAt ?? raw.UpdatedAt ?? null;
+    const version = raw.version ?? raw.Version ?? null;
+    const response_overdue_at = raw.response_overdue_at ?? raw.ResponseOverdueAt ?? null;
+    const resolution_overdue_at = raw.resolution_overdue_at ?? raw.ResolutionOverdueAt ?? null;
+    const department_id = raw.department_id ?? raw.DepartmentID ?? null;
+    const assignee_id = raw.assignee_id ?? raw.AssigneeID ?? null;
+    const priority = raw.priority ?? raw.Priority ?? 'normal';
+    const contact_phone = raw.contact_phone ?? raw.ContactPhone ?? null;
+    const citizen_id = raw.citizen_id ?? raw.CitizenID ?? null;
 
     return {
       id,
@@ -221,12 +273,70 @@ document.addEventListener('DOMContentLoaded', () => {
       longitude,
       created_at,
       updated_at,
+      version,
+      response_overdue_at,
+      resolution_overdue_at,
+      department_id,
+      assignee_id,
+      priority,
+      contact_phone,
+      citizen_id,
     };
   }
 
+  const priorityLabels = {
+    low: 'Низкий',
+    normal: 'Обычный',
+    high: 'Высокий',
+    urgent: 'Срочный',
+  };
+
+  function staffName(member) {
+    const first = member.FirstName ?? member.first_name ?? '';
+    const last = member.LastName ?? member.last_name ?? '';
+    const username = member.Username ?? member.username ?? '';
+    const name = [first, last].filter(Boolean).join(' ');
+    if (name) return name;
+    if (username) return '@' + username;
+    return String(member.TGUserID ?? member.tg_user_id ?? '');
+  }
+
+  // справочники служб и сотрудников для блока назначения
+  async function fetchDirectory() {
+    try {
+      const [deptResp, staffResp] = await Promise.all([
+        apiFetch('/admin/departments'),
+        apiFetch('/admin/staff'),
+      ]);
+      if (deptResp.ok) {
+        const data = await deptResp.json();
+        state.departments = (Array.isArray(data) ? data : []).map((d) => ({
+          id: d.ID ?? d.id,
+          name: d.Name ?? d.name,
+        }));
+      }
+      if (staffResp.ok) {
+        const data = await staffResp.json();
+        state.staff = (Array.isArray(data) ? data : []).map((s) => ({
+          id: s.UserID ?? s.user_id,
+          name: staffName(s),
+          departments: s.Departments ?? s.departments ?? [],
+        }));
+      }
+    } catch (e) {
+      console.error(e);
+    }
+  }
+
+  function overdueLabel(issue) {
+    if (issue.resolution_overdue_at) return 'Просрочено решение';
+    if (issue.response_overdue_at) return 'Нет ответа в срок';
+    return '';
+  }
+
 async function fetchIssues() {
     if (!state.token) {
-      setListStatus('Укажите admin_secret для загрузки заявок.', 'warning');
+      setListStatus('Войдите, чтобы загрузить заявки.', 'warning');
       state.issues = [];
       renderIssues();
       clearDetails();
@@ -240,16 +350,18 @@ async function fetchIssues() {
 
     const status = statusFilter.value;
     const params = new URLSearchParams();
-    params.set('token', state.token);
     if (status && status !== 'all') {
       params.set('status', status);
     }
+    if (overdueFilter && overdueFilter.checked) {
+      params.set('overdue', '1');
+    }
 
     try {
-      const resp = await fetch('/admin/issues?' + params.toString(), { cache: 'no-store' });
+      const resp = await apiFetch('/admin/issues?' + params.toString());
       if (!resp.ok) {
         if (resp.status === 401) {
-          setListStatus('Неверный admin_secret. Попробуйте войти заново.', 'error');
+          setListStatus('Сессия истекла. Войдите заново.', 'error');
           showAuthOverlay();
           return;
         }
@@ -271,6 +383,7 @@ async function fetchIssues() {
       }
 
       state.issues = data.map(normalizeIssue);
+      await fetchDirectory();
       setListStatus('Заявки успешно загружены.', 'success');
       renderIssues();
       clearDetails();
@@ -331,6 +444,31 @@ async function fetchIssues() {
         <p class="admin-details-meta">
           Создано: <strong>${created}</strong>${updated ? ' · Обновлено: <strong>' + updated + '</strong>' : ''}
         </p>
+        <p class="admin-details-meta">
+          Приоритет: <strong>${priorityLabels[issue.priority] || issue.priority}</strong>
+        </p>
+        ${issue.contact_phone ? `<p class="admin-details-meta">Телефон: <strong>${escapeHTML(issue.contact_phone)}</strong></p>` : ''}
+        ${overdueLabel(issue) ? `<p class="admin-details-meta">⏰ <strong>${overdueLabel(issue)}</strong> (SLA)</p>` : ''}
+      </div>
+
+      <div class="admin-details-section">
+        <h3 class="admin-details-section-title">Назначение</h3>
+        <label class="admin-label" for="assignDepartment">Служба</label>
+        <select id="assignDepartment" class="field admin-input">
+          <option value="0">Не назначена</option>
+          ${state.departments.map((d) => `<option value="${d.id}" ${d.id === issue.department_id ? 'selected' : ''}>${escapeHTML(d.name)}</option>`).join('')}
+        </select>
+        <label class="admin-label" for="assignAssignee">Исполнитель</label>
+        <select id="assignAssignee" class="field admin-input">
+          <option value="">Не назначен</option>
+          ${state.staff.map((s) => `<option value="${s.id}" ${s.id === issue.assignee_id ? 'selected' : ''}>${escapeHTML(s.name)}</option>`).join('')}
+        </select>
+        <div class="status-comment-row">
+          <button id="assignBtn" type="button" class="ghost-button admin-ghost-button status-comment-btn">
+            Назначить
+          </button>
+        </div>
+        <p id="assignResult" class="admin-hint"></p>
       </div>
 
       <div class="admin-details-section">
@@ -340,6 +478,35 @@ async function fetchIssues() {
 
       ${locationBlock}
 
+      ${issue.citizen_id ? `
+      <div class="admin-details-section">
+        <h3 class="admin-details-section-title">Житель</h3>
+        <div id="citizenContainer">
+          <p class="admin-details-text muted">Загрузка…</p>
+        </div>
+      </div>` : ''}
+
+      <div class="admin-details-section">
+        <h3 class="admin-details-section-title">Переписка с жителем</h3>
+        <div id="threadContainer" class="admin-thread">
+          <p class="admin-details-text muted">Загрузка…</p>
+        </div>
+      </div>
+
+      <div class="admin-details-section">
+        <h3 class="admin-details-section-title">Уведомления жителю</h3>
+        <div id="notificationsContainer">
+          <p class="admin-details-text muted">Загрузка…</p>
+        </div>
+      </div>
+
+      <div class="admin-details-section">
+        <h3 class="admin-details-section-title">Маршрутизация</h3>
+        <div id="routingContainer">
+          <p class="admin-details-text muted">Загрузка…</p>
+        </div>
+      </div>
+
       <div class="admin-details-section" id="attachmentsSection">
         <h3 class="admin-details-section-title">Вложения</h3>
         <div id="attachmentsContainer" class="attachments-grid">
@@ -355,12 +522,15 @@ async function fetchIssues() {
           <button class="status-btn status-btn-done" data-status="Завершено">Завершено</button>
           <button class="status-btn status-btn-rejected" data-status="Отклонено">Отклонено</button>
         </div>
-        <label class="admin-label" for="statusComment">Комментарий администратора (необязательно)</label>
+        <label class="admin-label" for="statusComment">Комментарий администратора (для отклонения — обязательно)</label>
         <textarea id="statusComment" class="field admin-input admin-textarea" rows="3" placeholder="Кратко опишите, что сделано по обращению…"></textarea>
         <div class="status-comment-row">
           <button id="sendCommentBtn" type="button" class="ghost-button admin-ghost-button status-comment-btn">
             Отправить комментарий пользователю
           </button>
+          <button id="sendNoteBtn" type="button" class="ghost-button admin-ghost-button status-comment-btn">
+            🔒 Сохранить как внутреннюю заметку
+          </button>
         </div>
         <p id="statusResult" class="admin-hint"></p>
       </div>
@@ -374,41 +544,68 @@ async function fetchIssues() {
       btn.addEventListener('click', async () => {
         const newStatus = btn.dataset.status;
         if (!newStatus) return;
+
+        const comment = (commentInput.value || '').trim();
+        if (newStatus === 'Отклонено' && !comment) {
+          statusResult.textContent = 'Укажите причину отклонения в поле комментария.';
+          statusResult.dataset.type = 'warning';
+          commentInput.focus();
+          return;
+        }
+
+        let reopen = false;
+        if (isFinalStatus(issue.status) && newStatus !== issue.status) {
+          if (!window.confirm(`Заявка #${issue.id} закрыта. Переоткрыть её со статусом «${newStatus}»?`)) {
+            return;
+          }
+          reopen = true;
+        }
+
         statusResult.textContent = 'Отправка…';
         statusResult.dataset.type = 'info';
 
         try {
-          const resp = await fetch('/admin/status', {
+          const resp = await apiFetch('/admin/status', {
             method: 'POST',
             headers: {
               'Content-Type': 'application/json',
             },
             body: JSON.stringify({
-              token: state.token,
               issue_id: issue.id,
               status: newStatus,
-              comment: commentInput.value ? commentInput.value : null,
-              admin_tg: null,
+              comment: comment || null,
+              reopen,
+              expected_version: issue.version,
             }),
           });
 
           if (!resp.ok) {
             if (resp.status === 401) {
-              statusResult.textContent = 'Неверный admin_secret. Попробуйте войти заново.';
+              statusResult.textContent = 'Сессия истекла. Войдите заново.';
               statusResult.dataset.type = 'error';
               showAuthOverlay();
               return;
             }
+            if (resp.status === 409) {
+              statusResult.textContent = 'Заявку уже изменил другой администратор. Обновите список и проверьте текущий статус.';
+              statusResult.dataset.type = 'warning';
+              return;
+            }
             const text = await resp.text();
             statusResult.textContent = 'Ошибка: ' + (text || resp.status);
             statusResult.dataset.type = 'error';
             return;
           }
 
+          const result = await resp.json().catch(() => ({}));
+
           statusResult.textContent = 'Статус обновлён.';
           statusResult.dataset.type = 'success';
 
           issue.status = newStatus;
+          if (result.version) {
+            issue.version = result.version;
+          }
           renderIssues();
           selectIssue(issue.id);
         } catch (e) {
@@ -420,59 +617,273 @@ async function fetchIssues() {
     });
 
 
-    const sendCommentBtn = detailsBody.querySelector('#sendCommentBtn');
-    if (sendCommentBtn) {
-      sendCommentBtn.addEventListener('click', async () => {
-        if (!state.token) {
-          statusResult.textContent = 'admin_secret не задан.';
-          statusResult.dataset.type = 'warning';
-          showAuthOverlay();
-          return;
-        }
-        const text = (commentInput.value || '').trim();
-        if (!text) {
-          statusResult.textContent = 'Введите текст комментария.';
-          statusResult.dataset.type = 'warning';
-          return;
-        }
-        statusResult.textContent = 'Отправка комментария…';
-        statusResult.dataset.type = 'info';
+    const assignBtn = detailsBody.querySelector('#assignBtn');
+    if (assignBtn) {
+      assignBtn.addEventListener('click', async () => {
+        const assignResult = detailsBody.querySelector('#assignResult');
+        const departmentId = Number(detailsBody.querySelector('#assignDepartment').value) || 0;
+        const assigneeValue = detailsBody.querySelector('#assignAssignee').value;
+        const assigneeId = assigneeValue ? Number(assigneeValue) : null;
+
+        assignResult.textContent = 'Отправка…';
+        assignResult.dataset.type = 'info';
+
         try {
-          const resp = await fetch('/admin/comment', {
+          const resp = await apiFetch('/admin/assign', {
             method: 'POST',
             headers: {
               'Content-Type': 'application/json',
             },
             body: JSON.stringify({
-              token: state.token,
               issue_id: issue.id,
-              text,
+              department_id: departmentId,
+              assignee_id: assigneeId,
+              expected_version: issue.version,
             }),
           });
+
           if (!resp.ok) {
             if (resp.status === 401) {
-              statusResult.textContent = 'Неверный admin_secret. Попробуйте войти заново.';
-              statusResult.dataset.type = 'error';
+              assignResult.textContent = 'Сессия истекла. Войдите заново.';
+              assignResult.dataset.type = 'error';
               showAuthOverlay();
               return;
             }
-            const textResp = await resp.text();
-            statusResult.textContent = 'Ошибка отправки комментария: ' + (textResp || resp.status);
-            statusResult.dataset.type = 'error';
+            if (resp.status === 409) {
+              assignResult.textContent = 'Заявку уже изменил другой администратор. Обновите список.';
+              assignResult.dataset.type = 'warning';
+              return;
+            }
+            const text = await resp.text();
+            assignResult.textContent = 'Ошибка: ' + (text || resp.status);
+            assignResult.dataset.type = 'error';
             return;
           }
-          statusResult.textContent = 'Комментарий отправлен пользователю.';
-          statusResult.dataset.type = 'success';
-          commentInput.value = '';
+
+          const result = await resp.json().catch(() => ({}));
+          issue.department_id = result.department_id ?? null;
+          issue.assignee_id = result.assignee_id ?? null;
+          if (result.version) {
+            issue.version = result.version;
+          }
+          selectIssue(issue.id);
+          const refreshed = detailsBody.querySelector('#assignResult');
+          if (refreshed) {
+            refreshed.textContent = 'Назначение сохранено.';
+            refreshed.dataset.type = 'success';
+          }
         } catch (e) {
           console.error(e);
-          statusResult.textContent = 'Сетевая ошибка при отправке комментария.';
-          statusResult.dataset.type = 'error';
+          assignResult.textContent = 'Сетевая ошибка при назначении.';
+          assignResult.dataset.type = 'error';
         }
       });
     }
 
+    // visibility: 'public' — ответ уходит жителю, 'internal' — заметка только для сотрудников
+    async function sendComment(visibility) {
+      if (!state.token) {
+        statusResult.textContent = 'Нужно войти.';
+        statusResult.dataset.type = 'warning';
+        showAuthOverlay();
+        return;
+      }
+      const text = (commentInput.value || '').trim();
+      if (!text) {
+        statusResult.textContent = 'Введите текст комментария.';
+        statusResult.dataset.type = 'warning';
+        return;
+      }
+      statusResult.textContent = 'Отправка комментария…';
+      statusResult.dataset.type = 'info';
+      try {
+        const resp = await apiFetch('/admin/comment', {
+          method: 'POST',
+          headers: {
+            'Content-Type': 'application/json',
+          },
+          body: JSON.stringify({
+            issue_id: issue.id,
+            text,
+            visibility,
+          }),
+        });
+        if (!resp.ok) {
+          if (resp.status === 401) {
+            statusResult.textContent = 'Сессия истекла. Войдите заново.';
+            statusResult.dataset.type = 'error';
+            showAuthOverlay();
+            return;
+          }
+          const textResp = await resp.text();
+          statusResult.textContent = 'Ошибка отправки комментария: ' + (textResp || resp.status);
+          statusResult.dataset.type = 'error';
+          return;
+        }
+        statusResult.textContent = visibility === 'internal'
+          ? 'Внутренняя заметка сохранена.'
+          : 'Комментарий отправлен пользователю.';
+        statusResult.dataset.type = 'success';
+        commentInput.value = '';
+        loadThread(issue.id);
+      } catch (e) {
+        console.error(e);
+        statusResult.textContent = 'Сетевая ошибка при отправке комментария.';
+        statusResult.dataset.type = 'error';
+      }
+    }
+
+    const sendCommentBtn = detailsBody.querySelector('#sendCommentBtn');
+    if (sendCommentBtn) {
+      sendCommentBtn.addEventListener('click', () => sendComment('public'));
+    }
+    const sendNoteBtn = detailsBody.querySelector('#sendNoteBtn');
+    if (sendNoteBtn) {
+      sendNoteBtn.addEventListener('click', () => sendComment('internal'));
+    }
+
         loadAttachments(issue.id);
+        loadRouting(issue.id);
+        loadThread(issue.id);
+        loadNotifications(issue.id);
+        if (issue.citizen_id) loadCitizen(issue.id);
+  }
+
+  const channelLabels = { telegram: 'Telegram', email: 'E-mail' };
+  const deliveryLabels = { pending: 'отправляется', sent: 'доставлено', failed: 'ошибка' };
+
+  async function loadNotifications(issueId) {
+    const container = detailsBody.querySelector('#notificationsContainer');
+    if (!container || !state.token) return;
+
+    try {
+      const resp = await apiFetch(`/admin/issues/${issueId}/notifications`);
+      if (!resp.ok) {
+        container.innerHTML = '<p class="admin-details-text error">Ошибка загрузки уведомлений.</p>';
+        return;
+      }
+      const data = await resp.json();
+      if (!Array.isArray(data) || !data.length) {
+        container.innerHTML = '<p class="admin-details-text muted">Уведомлений не было.</p>';
+        return;
+      }
+      container.innerHTML = data.map((d) => {
+        const channel = d.Channel ?? d.channel;
+        const status = d.Status ?? d.status;
+        const error = d.Error ?? d.error;
+        const subject = d.Subject ?? d.subject ?? '';
+        const created = formatDate(d.CreatedAt ?? d.created_at);
+        return `<p class="admin-details-meta">${created} · <strong>${channelLabels[channel] || escapeHTML(channel)}</strong>`
+          + ` → ${escapeHTML(d.Recipient ?? d.recipient)} · ${escapeHTML(subject)} · `
+          + `<strong>${deliveryLabels[status] || escapeHTML(status)}</strong>`
+          + `${error ? ': ' + escapeHTML(error) : ''}</p>`;
+      }).join('');
+    } catch (e) {
+      console.error(e);
+      container.innerHTML = '<p class="admin-details-text error">Сетевая ошибка при загрузке уведомлений.</p>';
+    }
+  }
+
+  async function loadCitizen(issueId) {
+    const container = detailsBody.querySelector('#citizenContainer');
+    if (!container || !state.token) return;
+
+    try {
+      const resp = await apiFetch(`/admin/issues/${issueId}/citizen`);
+      if (!resp.ok) {
+        container.innerHTML = '<p class="admin-details-text error">Ошибка загрузки профиля жителя.</p>';
+        return;
+      }
+      const data = await resp.json();
+      const c = data.citizen || {};
+      const name = c.Name ?? c.name;
+      const phone = c.Phone ?? c.phone;
+      const email = c.Email ?? c.email;
+      const emailVerifiedAt = c.EmailVerifiedAt ?? c.email_verified_at;
+      const linkedAt = c.LinkedAt ?? c.linked_at;
+      const others = (data.issues || []).map(normalizeIssue).filter((x) => x.id !== issueId);
+      container.innerHTML = `
+        ${name ? `<p class="admin-details-meta">Имя: <strong>${escapeHTML(name)}</strong></p>` : ''}
+        ${phone ? `<p class="admin-details-meta">Телефон: <strong>${escapeHTML(phone)}</strong></p>` : ''}
+        ${email ? `<p class="admin-details-meta">E-mail: <strong>${escapeHTML(email)}</strong>${emailVerifiedAt ? '' : ' (не подтверждён)'}</p>` : ''}
+        <p class="admin-details-meta">Telegram: <strong>${linkedAt ? 'привязан ' + formatDate(linkedAt) : 'не привязан'}</strong></p>
+        ${others.length
+          ? `<p class="admin-details-meta">Другие заявки: ${others.map((x) => `#${x.id} (${escapeHTML(x.status)})`).join(', ')}</p>`
+          : ''}
+      `;
+    } catch (e) {
+      console.error(e);
+      container.innerHTML = '<p class="admin-details-text error">Сетевая ошибка при загрузке профиля жителя.</p>';
+    }
+  }
+
+  async function loadThread(issueId) {
+    const container = detailsBody.querySelector('#threadContainer');
+    if (!container || !state.token) return;
+
+    try {
+      const resp = await apiFetch(`/admin/issues/${issueId}/thread`);
+      if (!resp.ok) {
+        container.innerHTML = '<p class="admin-details-text error">Ошибка загрузки переписки.</p>';
+        return;
+      }
+      const data = await resp.json();
+      if (!Array.isArray(data) || !data.length) {
+        container.innerHTML = '<p class="admin-details-text muted">Сообщений пока нет.</p>';
+        return;
+      }
+      container.innerHTML = data.map((m) => {
+        const author = m.Author ?? m.author;
+        const internal = (m.Visibility ?? m.visibility) === 'internal';
+        const firstName = m.FirstName ?? m.first_name;
+        const text = m.Text ?? m.text ?? '';
+        const created = formatDate(m.CreatedAt ?? m.created_at);
+        let who = author === 'staff'
+          ? 'Администрация' + (firstName ? ` (${escapeHTML(firstName)})` : '')
+          : 'Житель';
+        if (internal) {
+          who = '🔒 ' + who + ' · внутренняя заметка';
+        }
+        const body = text ? escapeHTML(text).replace(/\n/g, '<br/>') : '<span class="muted">вложение без текста</span>';
+        return `
+          <div class="admin-thread-item admin-thread-${author === 'staff' ? 'staff' : 'citizen'}${internal ? ' admin-thread-internal' : ''}">
+            <p class="admin-details-meta">${created} · <strong>${who}</strong></p>
+            <p class="admin-details-text">${body}</p>
+          </div>
+        `;
+      }).join('');
+    } catch (e) {
+      console.error(e);
+      container.innerHTML = '<p class="admin-details-text error">Сетевая ошибка при загрузке переписки.</p>';
+    }
+  }
+
+  async function loadRouting(issueId) {
+    const container = detailsBody.querySelector('#routingContainer');
+    if (!container || !state.token) return;
+
+    try {
+      const resp = await apiFetch(`/admin/issues/${issueId}/routing`);
+      if (!resp.ok) {
+        container.innerHTML = '<p class="admin-details-text error">Ошибка загрузки журнала маршрутизации.</p>';
+        return;
+      }
+      const data = await resp.json();
+      if (!Array.isArray(data) || !data.length) {
+        container.innerHTML = '<p class="admin-details-text muted">Записей нет.</p>';
+        return;
+      }
+      container.innerHTML = data.map((d) => {
+        const ruleName = d.RuleName ?? d.rule_name;
+        const reason = d.Reason ?? d.reason ?? '';
+        const created = formatDate(d.CreatedAt ?? d.created_at);
+        const head = ruleName ? `Правило «${escapeHTML(ruleName)}»` : 'Без правила';
+        return `<p class="admin-details-meta">${created} · <strong>${head}</strong>: ${escapeHTML(reason)}</p>`;
+      }).join('');
+    } catch (e) {
+      console.error(e);
+      container.innerHTML = '<p class="admin-details-text error">Сетевая ошибка при загрузке журнала.</p>';
+    }
   }
 
   async function loadAttachments(issueId) {
@@ -482,15 +893,15 @@ async function fetchIssues() {
     container.innerHTML = '<p class="admin-details-text muted">Загрузка вложений…</p>';
 
     if (!state.token) {
-      container.innerHTML = '<p class="admin-details-text muted">admin_secret не задан.</p>';
+      container.innerHTML = '<p class="admin-details-text muted">Нужно войти.</p>';
       return;
     }
 
     try {
-      const resp = await fetch(`/admin/issues/${issueId}/attachments?token=${encodeURIComponent(state.token)}`, { cache: 'no-store' });
+      const resp = await apiFetch(`/admin/issues/${issueId}/attachments`);
       if (!resp.ok) {
         if (resp.status === 401) {
-          container.innerHTML = '<p class="admin-details-text error">Неверный admin_secret.</p>';
+          container.innerHTML = '<p class="admin-details-text error">Сессия истекла.</p>';
           showAuthOverlay();
           return;
         }
@@ -508,21 +919,32 @@ async function fetchIssues() {
       data.forEach((att) => {
         const item = document.createElement('div');
         item.className = 'attachment-item';
-        const path = att.local_path || att.LocalPath || '';
         const type = att.file_type || att.FileType || '';
+        // подписанная ссылка живёт недолго (FILE_URL_TTL), при повторном открытии карточки выдаётся новая
+        const url = att.url || att.URL || '';
+        if (!url) return;
+        // pending-файлы сервер отдаёт прямо из Telegram, пока они скачиваются в хранилище
+        if ((att.download_status ?? att.DownloadStatus) === 'failed') {
+          item.innerHTML = '<p class="admin-details-text muted">Файл из Telegram не удалось сохранить.</p>';
+          container.appendChild(item);
+          return;
+        }
 
-        const url = path.startsWith('/') ? path : '/' + path;
-
-        if (type.startsWith('image/')) {
+        if (type === 'photo' || type.startsWith('image/')) {
           item.innerHTML = `
             <a href="${url}" target="_blank" rel="noopener noreferrer">
               <img src="${url}" alt="Вложение" />
             </a>
           `;
-        } else if (type.startsWith('video/')) {
+        } else if (type === 'video' || type === 'video_note' || type.startsWith('video/')) {
           item.innerHTML = `
             <video src="${url}" controls></video>
           `;
+        } else if (type === 'voice' || type === 'audio' || type.startsWith('audio/')) {
+          item.innerHTML = `
+            <p class="admin-details-text muted">${type === 'voice' ? 'Голосовое сообщение' : 'Аудио'}</p>
+            <audio src="${url}" controls></audio>
+          `;
         } else {
           const label = type || 'файл';
           item.innerHTML = `
@@ -540,15 +962,27 @@ async function fetchIssues() {
     }
   }
 
-  function initFromStorage() {
-    const saved = localStorage.getItem('adminSecret112');
+  async function initFromStorage() {
+    const saved = sessionStorage.getItem('adminSession112');
     if (!saved) {
       showAuthOverlay();
-      showAuthStatus('Введите admin_secret, чтобы войти.', 'info');
+      showAuthStatus('Введите логин и пароль, чтобы войти.', 'info');
       return;
     }
-    authSecretInput.value = saved;
     setToken(saved);
+    try {
+      const resp = await apiFetch('/admin/me');
+      if (!resp.ok) {
+        return;
+      }
+      const data = await resp.json();
+      setAccount(data.account);
+    } catch (e) {
+      console.error(e);
+      showAuthOverlay();
+      showAuthStatus('Сетевая ошибка при проверке сессии.', 'error');
+      return;
+    }
     hideAuthOverlay();
     fetchIssues();
   }
@@ -561,20 +995,26 @@ async function fetchIssues() {
     });
   }
 
-  if (authSecretInput) {
-    authSecretInput.addEventListener('keydown', (e) => {
+  [authLoginInput, authPasswordInput].forEach((input) => {
+    if (!input) return;
+    input.addEventListener('keydown', (e) => {
       if (e.key === 'Enter') {
         e.preventDefault();
         handleAuthSubmit();
       }
     });
-  }
-
-  if (changeSecretBtn) {
-    changeSecretBtn.addEventListener('click', () => {
+  });
+
+  if (logoutBtn) {
+    logoutBtn.addEventListener('click', async () => {
+      try {
+        await apiFetch('/admin/logout', { method: 'POST' });
+      } catch (e) {
+        console.error(e);
+      }
       setToken('');
-      if (authSecretInput) authSecretInput.value = '';
-      showAuthStatus('Введите новый admin_secret.', 'info');
+      setAccount(null);
+      showAuthStatus('Вы вышли из админ‑панели.', 'info');
       showAuthOverlay();
     });
   }
@@ -585,31 +1025,57 @@ async function fetchIssues() {
     });
   }
 
+  if (overdueFilter) {
+    overdueFilter.addEventListener('change', () => {
+      fetchIssues();
+    });
+  }
+
   if (refreshBtn) {
     refreshBtn.addEventListener('click', () => {
       fetchIssues();
     });
   }
 
+  // CSV скачивается через fetch: токен идёт в заголовке, а не в адресе
   if (exportBtn) {
-    exportBtn.addEventListener('click', () => {
+    exportBtn.addEventListener('click', async () => {
       if (!state.token) {
-        showAuthStatus('Сначала введите admin_secret.', 'warning');
+        showAuthStatus('Сначала войдите.', 'warning');
         showAuthOverlay();
         return;
       }
       const from = exportFrom.value;
       const to = exportTo.value;
       if (!from || !to) {
-        showAuthStatus('Укажите период для экспорта.', 'warning');
+        setListStatus('Укажите период для экспорта.', 'warning');
         return;
       }
       const params = new URLSearchParams();
-      params.set('token', state.token);
       params.set('from', from);
       params.set('to', to);
-      const url = '/export?' + params.toString();
-      window.open(url, '_blank');
+      try {
+        const resp = await apiFetch('/export?' + params.toString());
+        if (!resp.ok) {
+          if (resp.status === 403) {
+            setListStatus('Экспорт недоступен для вашей роли.', 'error');
+          } else if (resp.status !== 401) {
+            setListStatus('Ошибка экспорта: ' + ((await resp.text()) || resp.status), 'error');
+          }
+          return;
+        }
+        const blob = await resp.blob();
+        const link = document.createElement('a');
+        link.href = URL.createObjectURL(blob);
+        link.download = `export_${from}..${to}.csv`;
+        document.body.appendChild(link);
+        link.click();
+        link.remove();
+        URL.revokeObjectURL(link.href);
+      } catch (e) {
+        console.error(e);
+        setListStatus('Сетевая ошибка при экспорте.', 'error');
+      }
     });
   }
 
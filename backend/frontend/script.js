@@ -87,6 +87,40 @@ if (form) {
     }
   }
 
+  // Привязка Telegram: бот присылает код в Telegram, где житель подтвердил
+  // свой номер командой /link, а код вводится здесь.
+  async function linkTelegram(issueId, token) {
+    if (!confirm('Получать уведомления по заявке в Telegram? Для этого номер из заявки должен быть подтверждён в боте командой /link.')) {
+      return;
+    }
+    const post = (path, body) =>
+      fetch(`/api/issues/${issueId}/link-telegram${path}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'X-Issue-Token': token },
+        body: JSON.stringify(body || {}),
+      });
+    try {
+      const res = await post('');
+      if (!res.ok) {
+        const errJson = await res.json().catch(() => ({}));
+        alert(errJson.error || 'Не удалось отправить код');
+        return;
+      }
+      const code = prompt('Бот прислал вам код. Введите его:');
+      if (!code) return;
+      const resConfirm = await post('/confirm', { code: code.trim() });
+      const result = await resConfirm.json().catch(() => ({}));
+      if (!resConfirm.ok) {
+        alert(result.error || 'Не удалось привязать Telegram');
+        return;
+      }
+      alert('Telegram привязан: уведомления по этой заявке будут приходить в бот.');
+    } catch (err) {
+      console.error('Ошибка привязки Telegram:', err);
+      alert('Не удалось привязать Telegram: ' + err.message);
+    }
+  }
+
   form.addEventListener('submit', async (e) => {
     e.preventDefault();
 
@@ -144,6 +178,16 @@ if (form) {
 
       const issue = await resIssue.json();
       const issueId = issue.id;
+      // токен автора заявки: только по нему житель потом увидит свои вложения
+      if (issue.access_token) {
+        try {
+          const tokens = JSON.parse(localStorage.getItem('issueTokens112') || '{}');
+          tokens[issueId] = issue.access_token;
+          localStorage.setItem('issueTokens112', JSON.stringify(tokens));
+        } catch (e) {
+          console.error(e);
+        }
+      }
 
       if (files.length && issueId) {
         const fd = new FormData();
@@ -151,11 +195,14 @@ if (form) {
 
         const resFiles = await fetch(`/api/issues/${issueId}/attachments`, {
           method: 'POST',
+          headers: { 'X-Issue-Token': issue.access_token || '' },
           body: fd,
         });
 
         if (!resFiles.ok) {
-          console.error('Ошибка загрузки файлов', await resFiles.text());
+          const errJson = await resFiles.json().catch(() => ({}));
+          console.error('Ошибка загрузки файлов', errJson);
+          alert(`Заявка создана, но файлы не прикреплены: ${errJson.error || resFiles.status}`);
         }
       }
 
@@ -165,9 +212,14 @@ if (form) {
           `Район: ${district || 'не указан'}\n` +
           `Категория: ${category || 'не указана'}\n` +
           (files.length ? `Прикреплено файлов: ${files.length}\n` : '') +
+          (issue.tracking_code ? `Следить за статусом: ${window.location.origin}/track/${issue.tracking_code}\n` : '') +
           '\nМы свяжемся с вами в ближайшее время.'
       );
 
+      if (issue.access_token && !contact.includes('@')) {
+        await linkTelegram(issueId, issue.access_token);
+      }
+
       form.reset();
 
       if (geoButton) {
@@ -0,0 +1,84 @@
+// страница заявки по коду отслеживания: /track/<код>
+(function () {
+  const title = document.getElementById('trackTitle');
+  const body = document.getElementById('trackBody');
+
+  function escapeHTML(str) {
+    return String(str)
+      .replace(/&/g, '&amp;')
+      .replace(/</g, '&lt;')
+      .replace(/>/g, '&gt;')
+      .replace(/"/g, '&quot;')
+      .replace(/'/g, '&#39;');
+  }
+
+  function formatDate(iso) {
+    if (!iso) return '';
+    const d = new Date(iso);
+    if (Number.isNaN(d.getTime())) return iso;
+    return d.toLocaleString('ru-RU', {
+      year: 'numeric',
+      month: '2-digit',
+      day: '2-digit',
+      hour: '2-digit',
+      minute: '2-digit',
+    });
+  }
+
+  function showError(text) {
+    body.innerHTML = `<p class="track-meta track-error">${escapeHTML(text)}</p>`;
+  }
+
+  async function load() {
+    const code = decodeURIComponent(window.location.pathname.split('/').filter(Boolean).pop() || '');
+    if (!code) {
+      showError('В ссылке нет кода заявки.');
+      return;
+    }
+
+    try {
+      const resp = await fetch(`/api/track/${encodeURIComponent(code)}`);
+      if (resp.status === 404) {
+        showError('Заявка не найдена. Проверьте ссылку.');
+        return;
+      }
+      if (!resp.ok) {
+        showError('Не удалось загрузить заявку, попробуйте позже.');
+        return;
+      }
+      const t = await resp.json();
+
+      title.textContent = `Заявка №${t.id}`;
+      const statuses = (t.statuses || []).map((s) => `
+        <li class="track-item">
+          <span class="track-date">${formatDate(s.at)}</span>
+          <strong>${escapeHTML(s.status)}</strong>
+        </li>`).join('');
+      const comments = (t.comments || []).map((c) => `
+        <li class="track-item">
+          <span class="track-date">${formatDate(c.at)}</span>
+          ${escapeHTML(c.text).replace(/\n/g, '<br/>')}
+        </li>`).join('');
+
+      body.innerHTML = `
+        <p class="track-meta">Текущий статус: <strong>${escapeHTML(t.status)}</strong></p>
+        <p class="track-meta">
+          Район: <strong>${escapeHTML(t.district || 'не указан')}</strong> ·
+          Категория: <strong>${escapeHTML(t.category || 'не указана')}</strong>
+        </p>
+        <p class="track-meta">Подана: ${formatDate(t.created_at)} · Обновлена: ${formatDate(t.updated_at)}</p>
+
+        <h2 class="track-subtitle">История статусов</h2>
+        <ul class="track-list">${statuses}</ul>
+
+        <h2 class="track-subtitle">Ответы администрации</h2>
+        ${comments ? `<ul class="track-list">${comments}</ul>` : '<p class="track-meta">Ответов пока нет.</p>'}
+      `;
+    } catch (e) {
+      console.error(e);
+      showError('Сетевая ошибка, попробуйте позже.');
+    }
+  }
+
+  load();
+})();
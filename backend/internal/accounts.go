@@ -0,0 +1,497 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type AdminRole string
+
+const (
+	RoleOperator       AdminRole = "operator"        // работа с заявками
+	RoleDepartmentHead AdminRole = "department_head" // плюс состав службы и выгрузки
+	RoleSuperadmin     AdminRole = "superadmin"      // плюс справочники, правила и учётные записи
+)
+
+// roleRank — роли упорядочены: старшая роль может всё, что младшая.
+var roleRank = map[AdminRole]int{
+	RoleOperator:       1,
+	RoleDepartmentHead: 2,
+	RoleSuperadmin:     3,
+}
+
+const minPasswordLength = 10
+
+var (
+	ErrInvalidCredentials = errors.New("неверный логин или пароль")
+	ErrSessionInvalid     = errors.New("сессия недействительна или истекла")
+	ErrSessionExpired     = fmt.Errorf("%w: сессия завершена", ErrSessionInvalid) // токен выдавался, но больше не действует
+	ErrInvalidAccount     = errors.New("некорректная учётная запись")
+	ErrAccountNotFound    = errors.New("учётная запись не найдена")
+	ErrLastSuperadmin     = errors.New("это последний действующий суперадмин без ограничения области")
+)
+
+func ParseAdminRole(s string) (AdminRole, error) {
+	r := AdminRole(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleRank[r]; !ok {
+		return "", fmt.Errorf("%w: неизвестная роль %q", ErrInvalidAccount, s)
+	}
+	return r, nil
+}
+
+// Allows — роль не ниже min.
+func (r AdminRole) Allows(min AdminRole) bool {
+	return roleRank[r] >= roleRank[min]
+}
+
+// dummyPasswordHash сравнивается при входе с несуществующим логином,
+// чтобы по времени ответа нельзя было понять, есть ли такая учётка.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+	if len([]rune(password)) < minPasswordLength {
+		return "", fmt.Errorf("%w: пароль короче %d символов", ErrInvalidAccount, minPasswordLength)
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// hashSessionToken — в базе лежит только хеш токена, утечка таблицы
+// не даёт готовых сессий.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionTokenRe — так выглядит токен из newSessionToken: 32 байта в base64url.
+var sessionTokenRe = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+const adminAccountColumns = `id, login, role, department_id, district, tg_user_id, disabled_at, last_login_at, created_at`
+
+func scanAdminAccount(row pgx.Row, a *AdminAccount) error {
+	return row.Scan(&a.ID, &a.Login, &a.Role, &a.DepartmentID, &a.District, &a.TGUserID, &a.DisabledAt, &a.LastLoginAt, &a.CreatedAt)
+}
+
+// NewAdminAccount — данные для создания учётной записи.
+type NewAdminAccount struct {
+	Login        string
+	Password     string
+	Role         AdminRole
+	DepartmentID *int64
+	District     *string
+	TGUserID     *int64
+}
+
+func (db *DB) CreateAdminAccount(ctx context.Context, in NewAdminAccount) (*AdminAccount, error) {
+	login := strings.TrimSpace(in.Login)
+	if login == "" {
+		return nil, fmt.Errorf("%w: не указан логин", ErrInvalidAccount)
+	}
+	role, err := ParseAdminRole(string(in.Role))
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(in.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	var a AdminAccount
+	err = scanAdminAccount(db.Pool.QueryRow(ctx, `
+		insert into admin_accounts (login, password_hash, role, department_id, district, tg_user_id)
+		values ($1, $2, $3, $4, $5, $6)
+		returning `+adminAccountColumns,
+		login, hash, role, in.DepartmentID, strPtrTrimToNil(in.District), in.TGUserID), &a)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23505":
+			return nil, fmt.Errorf("%w: логин %q уже занят", ErrInvalidAccount, login)
+		case "23503":
+			return nil, fmt.Errorf("%w: %v", ErrInvalidAccount, ErrDepartmentNotFound)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (db *DB) ListAdminAccounts(ctx context.Context) ([]AdminAccount, error) {
+	rows, err := db.Pool.Query(ctx, `select `+adminAccountColumns+` from admin_accounts order by login`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []AdminAccount
+	for rows.Next() {
+		var a AdminAccount
+		if err := scanAdminAccount(rows, &a); err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) GetAdminAccount(ctx context.Context, id int64) (*AdminAccount, error) {
+	var a AdminAccount
+	err := scanAdminAccount(db.Pool.QueryRow(ctx,
+		`select `+adminAccountColumns+` from admin_accounts where id = $1`, id), &a)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (db *DB) GetAdminAccountByLogin(ctx context.Context, login string) (*AdminAccount, error) {
+	var a AdminAccount
+	err := scanAdminAccount(db.Pool.QueryRow(ctx,
+		`select `+adminAccountColumns+` from admin_accounts where lower(login) = lower($1)`,
+		strings.TrimSpace(login)), &a)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// AdminAccountUpdate — изменения учётной записи из PUT /admin/accounts/:id.
+// Служба, район и Telegram заменяются целиком; пустой Password не меняет
+// пароль, nil Disabled не меняет блокировку.
+type AdminAccountUpdate struct {
+	Role         AdminRole
+	DepartmentID *int64
+	District     *string
+	TGUserID     *int64
+	Password     string
+	Disabled     *bool
+}
+
+// UpdateAdminAccount применяет все изменения одной транзакцией: либо все,
+// либо ни одного. Смена роли, пароля и блокировка завершают все сессии
+// учётки, чтобы изменения применились сразу. Понизить, ограничить областью
+// или заблокировать последнего действующего суперадмина без области нельзя —
+// ErrLastSuperadmin. Права by проверяются под блокировкой строки и на
+// текущие роль и область учётки, и на новые (ErrForbidden).
+func (db *DB) UpdateAdminAccount(ctx context.Context, by *Principal, id int64, in AdminAccountUpdate) (*AdminAccount, error) {
+	role, err := ParseAdminRole(string(in.Role))
+	if err != nil {
+		return nil, err
+	}
+	var hash string
+	if in.Password != "" {
+		if hash, err = hashPassword(in.Password); err != nil {
+			return nil, err
+		}
+	}
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockSuperadmins(ctx, tx); err != nil {
+		return nil, err
+	}
+	var (
+		prev         AdminRole
+		prevDept     *int64
+		prevDistrict *string
+	)
+	err = tx.QueryRow(ctx, `select role, department_id, district from admin_accounts where id = $1 for update`, id).
+		Scan(&prev, &prevDept, &prevDistrict)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := by.Grants(prev, prevDept, prevDistrict); err != nil {
+		return nil, err
+	}
+	district := strPtrTrimToNil(in.District)
+	if err := by.Grants(role, in.DepartmentID, district); err != nil {
+		return nil, err
+	}
+
+	var a AdminAccount
+	err = scanAdminAccount(tx.QueryRow(ctx, `
+		update admin_accounts
+		set role = $2, department_id = $3, district = $4, tg_user_id = $5,
+		    password_hash = coalesce(nullif($6, ''), password_hash),
+		    disabled_at = case
+		        when $7::boolean is null then disabled_at
+		        when $7 then coalesce(disabled_at, now())
+		    end
+		where id = $1
+		returning `+adminAccountColumns,
+		id, role, in.DepartmentID, district, in.TGUserID, hash, in.Disabled), &a)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAccount, ErrDepartmentNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureSuperadminLeft(ctx, tx); err != nil {
+		return nil, err
+	}
+	if prev != role || hash != "" || a.DisabledAt != nil {
+		if _, err := revokeAccountSessions(ctx, tx, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// superadminCond — действующий суперадмин без области: только он управляет
+// всем, включая учётные записи других суперадминов.
+const superadminCond = `role = 'superadmin' and department_id is null and district is null and disabled_at is null`
+
+// lockSuperadmins блокирует строки действующих суперадминов без области до
+// конца транзакции, чтобы два параллельных изменения не сняли права с двух
+// последних сразу: второе дождётся первого и увидит его результат.
+func lockSuperadmins(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, `select id from admin_accounts where `+superadminCond+` order by id for update`)
+	return err
+}
+
+// ensureSuperadminLeft проверяет, что после изменений в транзакции остался
+// хотя бы один действующий суперадмин без области.
+func ensureSuperadminLeft(ctx context.Context, tx pgx.Tx) error {
+	var ok bool
+	if err := tx.QueryRow(ctx, `select exists(select 1 from admin_accounts where `+superadminCond+`)`).Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLastSuperadmin
+	}
+	return nil
+}
+
+// SetAdminPassword меняет пароль и завершает все сессии учётки.
+func (db *DB) SetAdminPassword(ctx context.Context, id int64, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	cmd, err := tx.Exec(ctx, `update admin_accounts set password_hash = $2 where id = $1`, id, hash)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrAccountNotFound
+	}
+	if _, err := revokeAccountSessions(ctx, tx, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SetAdminAccountDisabled блокирует (с завершением сессий) или разблокирует учётку.
+// Последнего действующего суперадмина без области заблокировать нельзя.
+func (db *DB) SetAdminAccountDisabled(ctx context.Context, id int64, disabled bool) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockSuperadmins(ctx, tx); err != nil {
+		return err
+	}
+	cmd, err := tx.Exec(ctx, `
+		update admin_accounts
+		set disabled_at = case when $2 then coalesce(disabled_at, now()) end
+		where id = $1
+	`, id, disabled)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrAccountNotFound
+	}
+	if disabled {
+		if err := ensureSuperadminLeft(ctx, tx); err != nil {
+			return err
+		}
+		if _, err := revokeAccountSessions(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// AdminLogin проверяет логин и пароль и открывает сессию на ttl.
+// Возвращает токен, который клиент передаёт в заголовке Authorization.
+func (db *DB) AdminLogin(ctx context.Context, login, password string, ttl time.Duration, userAgent, ip string) (string, *AdminAccount, *AdminSession, error) {
+	var a AdminAccount
+	var hash string
+	err := db.Pool.QueryRow(ctx, `
+		select `+adminAccountColumns+`, password_hash
+		from admin_accounts
+		where lower(login) = lower($1)
+	`, strings.TrimSpace(login)).Scan(
+		&a.ID, &a.Login, &a.Role, &a.DepartmentID, &a.District, &a.TGUserID, &a.DisabledAt, &a.LastLoginAt, &a.CreatedAt, &hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", nil, nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || a.DisabledAt != nil {
+		return "", nil, nil, ErrInvalidCredentials
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	s := AdminSession{AccountID: a.ID}
+	err = db.Pool.QueryRow(ctx, `
+		insert into admin_sessions (account_id, token_hash, user_agent, ip, expires_at)
+		values ($1, $2, $3, $4, $5)
+		returning id, user_agent, ip, created_at, last_seen_at, expires_at
+	`, a.ID, hashSessionToken(token), strPtrEmptyToNil(userAgent), strPtrEmptyToNil(ip), time.Now().Add(ttl),
+	).Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if _, err := db.Pool.Exec(ctx, `update admin_accounts set last_login_at = now() where id = $1`, a.ID); err != nil {
+		return "", nil, nil, err
+	}
+	return token, &a, &s, nil
+}
+
+// SessionAccount находит действующую сессию по токену и её учётку.
+// Для токена, который был выдан, но больше не действует, возвращает
+// ErrSessionExpired, для неизвестного — ErrSessionInvalid.
+func (db *DB) SessionAccount(ctx context.Context, token string) (*AdminAccount, *AdminSession, error) {
+	if token == "" {
+		return nil, nil, ErrSessionInvalid
+	}
+	var a AdminAccount
+	var s AdminSession
+	err := db.Pool.QueryRow(ctx, `
+		update admin_sessions s
+		set last_seen_at = now()
+		from admin_accounts a
+		where a.id = s.account_id
+		  and s.token_hash = $1
+		  and s.revoked_at is null
+		  and s.expires_at > now()
+		  and a.disabled_at is null
+		returning s.id, s.account_id, s.user_agent, s.ip, s.created_at, s.last_seen_at, s.expires_at,
+		          a.id, a.login, a.role, a.department_id, a.district, a.tg_user_id, a.disabled_at, a.last_login_at, a.created_at
+	`, hashSessionToken(token)).Scan(
+		&s.ID, &s.AccountID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt,
+		&a.ID, &a.Login, &a.Role, &a.DepartmentID, &a.District, &a.TGUserID, &a.DisabledAt, &a.LastLoginAt, &a.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		var known bool
+		if err := db.Pool.QueryRow(ctx,
+			`select exists(select 1 from admin_sessions where token_hash = $1)`, hashSessionToken(token),
+		).Scan(&known); err != nil {
+			return nil, nil, err
+		}
+		if known {
+			return nil, nil, ErrSessionExpired
+		}
+		return nil, nil, ErrSessionInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &a, &s, nil
+}
+
+// RevokeAdminSession завершает одну сессию (выход).
+func (db *DB) RevokeAdminSession(ctx context.Context, sessionID int64) error {
+	_, err := db.Pool.Exec(ctx,
+		`update admin_sessions set revoked_at = now() where id = $1 and revoked_at is null`, sessionID)
+	return err
+}
+
+// RevokeAdminSessions завершает все действующие сессии учётки и возвращает их число.
+func (db *DB) RevokeAdminSessions(ctx context.Context, accountID int64) (int64, error) {
+	return revokeAccountSessions(ctx, db.Pool, accountID)
+}
+
+func revokeAccountSessions(ctx context.Context, q querier, accountID int64) (int64, error) {
+	cmd, err := q.Exec(ctx, `
+		update admin_sessions set revoked_at = now()
+		where account_id = $1 and revoked_at is null and expires_at > now()
+	`, accountID)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
+
+// ListAdminSessions — действующие сессии учётки, новые сверху.
+func (db *DB) ListAdminSessions(ctx context.Context, accountID int64) ([]AdminSession, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select id, account_id, user_agent, ip, created_at, last_seen_at, expires_at, revoked_at
+		from admin_sessions
+		where account_id = $1 and revoked_at is null and expires_at > now()
+		order by created_at desc
+	`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []AdminSession
+	for rows.Next() {
+		var s AdminSession
+		if err := rows.Scan(&s.ID, &s.AccountID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.RevokedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// IsAccountValidationError — ошибка в данных учётки, а не сбой базы.
+func IsAccountValidationError(err error) bool {
+	return errors.Is(err, ErrInvalidAccount)
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxAlbumSize — больше сообщений в одном альбоме Telegram не бывает.
+const maxAlbumSize = 10
+
+// albumCollector собирает альбомы (media group): Telegram присылает каждое
+// фото или видео альбома отдельным сообщением с общим MediaGroupID.
+// Сообщения копятся, пока в альбом приходят новые, и через window после
+// последнего отдаются flush одним списком.
+//
+// Буфер живёт в памяти процесса: при нескольких экземплярах бота
+// апдейты одного чата должны приходить в один экземпляр.
+type albumCollector struct {
+	window time.Duration
+	flush  func(msgs []*tgbotapi.Message)
+
+	mu     sync.Mutex
+	albums map[string]*pendingAlbum
+}
+
+type pendingAlbum struct {
+	msgs  []*tgbotapi.Message
+	timer *time.Timer
+}
+
+func newAlbumCollector(window time.Duration, flush func(msgs []*tgbotapi.Message)) *albumCollector {
+	return &albumCollector{window: window, flush: flush, albums: make(map[string]*pendingAlbum)}
+}
+
+// Add добавляет сообщение в альбом и откладывает его обработку на window.
+func (c *albumCollector) Add(m *tgbotapi.Message) {
+	key := fmt.Sprintf("%d:%s", m.Chat.ID, m.MediaGroupID)
+
+	c.mu.Lock()
+	a, ok := c.albums[key]
+	if !ok {
+		a = &pendingAlbum{}
+		c.albums[key] = a
+		a.timer = time.AfterFunc(c.window, func() { c.fire(key) })
+	} else {
+		a.timer.Reset(c.window)
+	}
+	a.msgs = append(a.msgs, m)
+	full := len(a.msgs) >= maxAlbumSize
+	if full {
+		a.timer.Stop()
+	}
+	c.mu.Unlock()
+
+	if full {
+		c.fire(key)
+	}
+}
+
+func (c *albumCollector) fire(key string) {
+	c.mu.Lock()
+	a := c.albums[key]
+	delete(c.albums, key)
+	c.mu.Unlock()
+	if a == nil {
+		return
+	}
+	// апдейты могут прийти не по порядку
+	sort.Slice(a.msgs, func(i, j int) bool { return a.msgs[i].MessageID < a.msgs[j].MessageID })
+	c.flush(a.msgs)
+}
+
+// flushAlbum ставит собранный альбом в очередь его чата, как обычный апдейт.
+func (b *Bot) flushAlbum(msgs []*tgbotapi.Message) {
+	chatID := msgs[0].Chat.ID
+	err := b.updates.Submit(context.Background(), chatID, func(ctx context.Context) {
+		b.handleAlbum(ctx, msgs)
+	})
+	if err != nil {
+		log.Printf("альбом из %d сообщений в чате %d не обработан: %v", len(msgs), chatID, err)
+	}
+}
+
+// handleAlbum обрабатывает альбом как одно сообщение: текстом служит подпись
+// (Telegram ставит её у одного из сообщений), а вложения собираются со всех.
+func (b *Bot) handleAlbum(ctx context.Context, msgs []*tgbotapi.Message) {
+	primary := msgs[0]
+	for _, m := range msgs {
+		if strings.TrimSpace(m.Caption) != "" {
+			primary = m
+			break
+		}
+	}
+	b.handleMessage(withAlbum(ctx, msgs), primary)
+}
+
+type albumCtxKey struct{}
+
+// withAlbum помечает, что обрабатываемое сообщение — подпись альбома msgs.
+func withAlbum(ctx context.Context, msgs []*tgbotapi.Message) context.Context {
+	return context.WithValue(ctx, albumCtxKey{}, msgs)
+}
+
+// inAlbum — сообщение уже собрано из альбома, копить его снова не нужно.
+func inAlbum(ctx context.Context) bool {
+	_, ok := ctx.Value(albumCtxKey{}).([]*tgbotapi.Message)
+	return ok
+}
+
+// albumMessages — все сообщения, вложения которых относятся к m:
+// весь альбом, если m его подпись, иначе само m.
+func albumMessages(ctx context.Context, m *tgbotapi.Message) []*tgbotapi.Message {
+	if msgs, ok := ctx.Value(albumCtxKey{}).([]*tgbotapi.Message); ok {
+		for _, x := range msgs {
+			if x == m {
+				return msgs
+			}
+		}
+	}
+	return []*tgbotapi.Message{m}
+}
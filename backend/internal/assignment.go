@@ -0,0 +1,519 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrDepartmentNotFound      = errors.New("служба не найдена")
+	ErrDepartmentInUse         = errors.New("служба задана областью доступа сотрудников, сначала измените их область")
+	ErrAssigneeNotStaff        = errors.New("исполнитель должен быть администратором")
+	ErrAssigneeNotInDepartment = errors.New("исполнитель не состоит в выбранной службе")
+)
+
+// IsAssignmentValidationError — назначение отклонено по правилам, а не из-за сбоя базы.
+func IsAssignmentValidationError(err error) bool {
+	return errors.Is(err, ErrDepartmentNotFound) ||
+		errors.Is(err, ErrAssigneeNotStaff) ||
+		errors.Is(err, ErrAssigneeNotInDepartment)
+}
+
+func (db *DB) ListDepartments(ctx context.Context) ([]Department, error) {
+	rows, err := db.Pool.Query(ctx, `select id, name, created_at from departments order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Department
+	for rows.Next() {
+		var d Department
+		if err := rows.Scan(&d.ID, &d.Name, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) CreateDepartment(ctx context.Context, name string) (*Department, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("не указано название службы")
+	}
+	d := Department{Name: name}
+	err := db.Pool.QueryRow(ctx,
+		`insert into departments (name) values ($1) returning id, created_at`, name,
+	).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// DeleteDepartment удаляет службу; у её заявок служба сбрасывается.
+func (db *DB) DeleteDepartment(ctx context.Context, id int64) error {
+	cmd, err := db.Pool.Exec(ctx, `delete from departments where id = $1`, id)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return ErrDepartmentInUse
+	}
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrDepartmentNotFound
+	}
+	return nil
+}
+
+// AddDepartmentMember включает администратора с tg id tgUserID в службу.
+func (db *DB) AddDepartmentMember(ctx context.Context, departmentID, tgUserID int64) error {
+	var userID int64
+	var isAdmin bool
+	err := db.Pool.QueryRow(ctx, `select id, is_admin from users where tg_user_id = $1`, tgUserID).Scan(&userID, &isAdmin)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !isAdmin) {
+		return ErrAssigneeNotStaff
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd, err := db.Pool.Exec(ctx, `
+		insert into department_members (department_id, user_id)
+		select id, $2 from departments where id = $1
+		on conflict do nothing
+	`, departmentID, userID)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		var exists bool
+		if err := db.Pool.QueryRow(ctx, `select exists(select 1 from departments where id = $1)`, departmentID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrDepartmentNotFound
+		}
+	}
+	return nil
+}
+
+func (db *DB) RemoveDepartmentMember(ctx context.Context, departmentID, tgUserID int64) error {
+	cmd, err := db.Pool.Exec(ctx, `
+		delete from department_members
+		where department_id = $1
+		  and user_id = (select id from users where tg_user_id = $2)
+	`, departmentID, tgUserID)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ListStaff возвращает администраторов вместе с их службами.
+// departmentID != nil — только сотрудники этой службы.
+func (db *DB) ListStaff(ctx context.Context, departmentID *int64) ([]StaffMember, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select u.id, u.tg_user_id, u.username, u.first_name, u.last_name,
+		       coalesce(array_agg(m.department_id order by m.department_id)
+		                filter (where m.department_id is not null), '{}')
+		from users u
+		left join department_members m on m.user_id = u.id
+		where u.is_admin = true
+		  and ($1::bigint is null or exists (
+		      select 1 from department_members dm where dm.user_id = u.id and dm.department_id = $1))
+		group by u.id
+		order by u.first_name nulls last, u.id
+	`, departmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []StaffMember
+	for rows.Next() {
+		var s StaffMember
+		if err := rows.Scan(&s.UserID, &s.TGUserID, &s.Username, &s.FirstName, &s.LastName, &s.Departments); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// DisplayName — имя сотрудника для кнопок и уведомлений.
+func (s StaffMember) DisplayName() string {
+	var parts []string
+	if s.FirstName != nil && *s.FirstName != "" {
+		parts = append(parts, *s.FirstName)
+	}
+	if s.LastName != nil && *s.LastName != "" {
+		parts = append(parts, *s.LastName)
+	}
+	if len(parts) == 0 && s.Username != nil && *s.Username != "" {
+		return "@" + *s.Username
+	}
+	if len(parts) == 0 {
+		return strconv.FormatInt(s.TGUserID, 10)
+	}
+	return strings.Join(parts, " ")
+}
+
+// AssignIssue назначает заявке службу и исполнителя в транзакции под
+// блокировкой строки заявки. Исполнитель должен быть администратором и,
+// если служба указана, состоять в ней. Если служба не указана, остаётся
+// текущая, а если исполнитель в ней не состоит — берётся его служба
+// (когда он состоит ровно в одной). Вместе с изменением пишется событие
+// issue.assigned, по нему исполнитель получает заявку (см. Bot.AssigneeAlerts).
+// Итоговая служба проверяется по области a.By: увести заявку из своей
+// службы нельзя — ErrForbidden. Возвращает обновлённую заявку.
+func (db *DB) AssignIssue(ctx context.Context, a IssueAssignment) (*Issue, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var version int
+	var current *int64
+	switch err := tx.QueryRow(ctx,
+		`select version, department_id from issues where id = $1 for update`, a.IssueID,
+	).Scan(&version, &current); err {
+	case nil:
+	case pgx.ErrNoRows:
+		return nil, ErrIssueNotFound
+	default:
+		return nil, err
+	}
+	if err := checkVersion(a.ExpectedVersion, version); err != nil {
+		return nil, err
+	}
+
+	explicit := a.DepartmentID != nil && !a.ClearDepartment
+	if explicit {
+		var exists bool
+		if err := tx.QueryRow(ctx, `select exists(select 1 from departments where id = $1)`, *a.DepartmentID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrDepartmentNotFound
+		}
+	}
+
+	var assigneeDepts []int64
+	if a.AssigneeID != nil {
+		var isAdmin bool
+		err := tx.QueryRow(ctx, `
+			select u.is_admin,
+			       coalesce(array_agg(m.department_id) filter (where m.department_id is not null), '{}')
+			from users u
+			left join department_members m on m.user_id = u.id
+			where u.id = $1
+			group by u.id
+		`, *a.AssigneeID).Scan(&isAdmin, &assigneeDepts)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && !isAdmin) {
+			return nil, ErrAssigneeNotStaff
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	departmentID, err := assignmentDepartment(a, current, assigneeDepts)
+	if err != nil {
+		return nil, err
+	}
+	if !a.By.KeepsDepartment(departmentID) {
+		return nil, ErrForbidden
+	}
+
+	row := tx.QueryRow(ctx, `
+		update issues
+		set department_id = $2,
+		    assignee_id = $3,
+		    updated_at = now(),
+		    version = version + 1
+		where id = $1
+		returning `+issueColumns+`
+	`, a.IssueID, departmentID, a.AssigneeID)
+
+	var iss Issue
+	if err := scanIssue(row, &iss); err != nil {
+		return nil, err
+	}
+	if err := publishEvent(ctx, tx, EventIssueAssigned, iss.ID, eventAssignment{
+		Issue:        newEventIssue(&iss),
+		AssigneeID:   iss.AssigneeID,
+		AssignedByTG: a.AssignedByTG,
+	}); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &iss, nil
+}
+
+// assignmentDepartment возвращает службу, в которой окажется заявка после
+// назначения a: явно указанную, текущую или службу исполнителя assigneeDepts.
+func assignmentDepartment(a IssueAssignment, current *int64, assigneeDepts []int64) (*int64, error) {
+	explicit := a.DepartmentID != nil && !a.ClearDepartment
+	departmentID := current
+	if explicit {
+		departmentID = a.DepartmentID
+	}
+	if a.ClearDepartment {
+		departmentID = nil
+	}
+	if a.AssigneeID == nil {
+		return departmentID, nil
+	}
+	member := departmentID != nil && slices.Contains(assigneeDepts, *departmentID)
+	switch {
+	case member:
+	case explicit:
+		return nil, ErrAssigneeNotInDepartment
+	case a.ClearDepartment:
+	case len(assigneeDepts) == 1:
+		departmentID = &assigneeDepts[0]
+	case len(assigneeDepts) > 1:
+		// служба неоднозначна — пусть её выберут явно
+		departmentID = nil
+	}
+	return departmentID, nil
+}
+
+// issueAssignmentLabels возвращает название службы и имя исполнителя заявки
+// (пустые строки, если не назначены).
+func (db *DB) issueAssignmentLabels(ctx context.Context, iss *Issue) (department, assignee string) {
+	if iss.DepartmentID != nil {
+		_ = db.Pool.QueryRow(ctx, `select name from departments where id = $1`, *iss.DepartmentID).Scan(&department)
+	}
+	if iss.AssigneeID != nil {
+		var s StaffMember
+		err := db.Pool.QueryRow(ctx,
+			`select tg_user_id, username, first_name, last_name from users where id = $1`, *iss.AssigneeID,
+		).Scan(&s.TGUserID, &s.Username, &s.FirstName, &s.LastName)
+		if err == nil {
+			assignee = s.DisplayName()
+		}
+	}
+	return department, assignee
+}
+
+// UserIDByTG возвращает users.id по tg id.
+func (db *DB) UserIDByTG(ctx context.Context, tgUserID int64) (int64, error) {
+	var id int64
+	err := db.Pool.QueryRow(ctx, `select id from users where tg_user_id = $1`, tgUserID).Scan(&id)
+	return id, err
+}
+
+// assignmentErrorText — текст ошибки назначения для администратора.
+func assignmentErrorText(err error) string {
+	if errors.Is(err, ErrForbidden) {
+		return "Нет прав"
+	}
+	if errors.Is(err, ErrIssueNotFound) || errors.Is(err, ErrVersionConflict) || IsAssignmentValidationError(err) {
+		return err.Error()
+	}
+	log.Printf("AssignIssue error: %v", err)
+	return "Ошибка назначения"
+}
+
+// sendAssignMenu предлагает выбрать исполнителя заявки среди администраторов;
+// сотруднику службы — только среди коллег по службе.
+func (b *Bot) sendAssignMenu(ctx context.Context, p *Principal, chatID int64, issueID int64) {
+	staff, err := b.DB.ListStaff(ctx, p.DepartmentID)
+	if err != nil {
+		b.reply(chatID, "Не удалось загрузить список сотрудников: "+err.Error())
+		return
+	}
+	depts, _ := b.DB.ListDepartments(ctx)
+	deptNames := make(map[int64]string, len(depts))
+	for _, d := range depts {
+		deptNames[d.ID] = d.Name
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🙋 Взять себе", fmt.Sprintf("assign:%d:me", issueID)),
+	))
+	for _, s := range staff {
+		label := s.DisplayName()
+		if len(s.Departments) > 0 {
+			var names []string
+			for _, id := range s.Departments {
+				if n, ok := deptNames[id]; ok {
+					names = append(names, n)
+				}
+			}
+			if len(names) > 0 {
+				label += " (" + strings.Join(names, ", ") + ")"
+			}
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(trim(label, 60), fmt.Sprintf("assign:%d:%d", issueID, s.UserID)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("✖️ Снять исполнителя", fmt.Sprintf("assign:%d:none", issueID)),
+	))
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Кому назначить заявку #%d?", issueID))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	b.API.Send(msg)
+}
+
+// handleAssignCallback обрабатывает assign:<id> (показать меню) и
+// assign:<id>:<users.id|me|none> (назначить).
+func (b *Bot) handleAssignCallback(ctx context.Context, cq *tgbotapi.CallbackQuery) {
+	parts := strings.Split(cq.Data, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return
+	}
+	issueID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return
+	}
+	p := b.principal(ctx, cq.From.ID)
+	if _, err := b.Auth.AuthorizeIssue(ctx, p, PermAssign, issueID); err != nil {
+		b.answerCallback(cq, "Нет прав")
+		return
+	}
+	if len(parts) == 2 {
+		b.answerCallback(cq, "")
+		b.sendAssignMenu(ctx, p, cq.Message.Chat.ID, issueID)
+		return
+	}
+
+	var assignee *int64
+	switch parts[2] {
+	case "none":
+	case "me":
+		id, err := b.DB.UserIDByTG(ctx, cq.From.ID)
+		if err != nil {
+			b.answerCallback(cq, "Ошибка назначения")
+			return
+		}
+		assignee = &id
+	default:
+		id, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return
+		}
+		assignee = &id
+	}
+
+	_, err = b.DB.AssignIssue(ctx, IssueAssignment{
+		IssueID:      issueID,
+		AssigneeID:   assignee,
+		AssignedByTG: &cq.From.ID,
+		By:           p,
+	})
+	if err != nil {
+		b.answerCallback(cq, assignmentErrorText(err))
+		return
+	}
+	if assignee == nil {
+		b.answerCallback(cq, fmt.Sprintf("С заявки #%d снят исполнитель", issueID))
+		return
+	}
+	b.answerCallback(cq, fmt.Sprintf("Заявка #%d назначена", issueID))
+}
+
+// AssigneeAlerts — подписчик EventBus на issue.assigned: присылает исполнителю
+// назначенную ему заявку, если он назначен не сам себе.
+func (b *Bot) AssigneeAlerts() EventHandler { return assigneeAlerts{b} }
+
+type assigneeAlerts struct{ bot *Bot }
+
+func (a assigneeAlerts) Name() string { return "assignee_alerts" }
+
+func (a assigneeAlerts) Handle(ctx context.Context, ev *DomainEvent) error {
+	var as eventAssignment
+	if err := json.Unmarshal(ev.Payload, &as); err != nil {
+		return err
+	}
+	if as.AssigneeID == nil {
+		return nil
+	}
+	return a.bot.notifyAssignee(ctx, ev.IssueID, *as.AssigneeID, as.AssignedByTG)
+}
+
+// notifyAssignee присылает исполнителю assigneeID заявку issueID. Если
+// исполнителя с тех пор сменили, молчит: о новом назначении будет своё событие.
+func (b *Bot) notifyAssignee(ctx context.Context, issueID, assigneeID int64, assignedByTG *int64) error {
+	iss, err := b.DB.GetIssueByID(ctx, issueID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if iss.AssigneeID == nil || *iss.AssigneeID != assigneeID {
+		return nil
+	}
+	var tgUserID int64
+	if err := b.DB.Pool.QueryRow(ctx, `select tg_user_id from users where id = $1`, assigneeID).Scan(&tgUserID); err != nil {
+		return err
+	}
+	if assignedByTG != nil && tgUserID == *assignedByTG {
+		return nil
+	}
+	if _, err := b.API.Send(tgbotapi.NewMessage(tgUserID, fmt.Sprintf("Вам назначена заявка #%d", iss.ID))); err != nil {
+		return err
+	}
+	b.sendIssueToChat(ctx, tgUserID, iss)
+	return nil
+}
+
+// sendMineIssues показывает администратору открытые заявки, назначенные на него.
+func (b *Bot) sendMineIssues(ctx context.Context, chatID int64, tgUserID int64) {
+	userID, err := b.DB.UserIDByTG(ctx, tgUserID)
+	if err != nil {
+		b.reply(chatID, "Не удалось найти пользователя: "+err.Error())
+		return
+	}
+
+	var prevIDs []int
+	if b.loadState(ctx, stateLastIssuesMessages, chatID, &prevIDs) && len(prevIDs) > 0 {
+		b.deleteMessages(chatID, prevIDs)
+	}
+	var sentIDs []int
+	defer func() { b.saveState(ctx, stateLastIssuesMessages, chatID, sentIDs) }()
+
+	list, err := b.DB.ListIssues(ctx, IssueFilter{
+		Statuses:   statusStrings([]IssueStatus{StatusNew, StatusInProgress}),
+		AssigneeID: &userID,
+	}, 20, 0)
+	if err != nil {
+		sent, _ := b.API.Send(tgbotapi.NewMessage(chatID, "Ошибка загрузки заявок: "+err.Error()))
+		sentIDs = append(sentIDs, sent.MessageID)
+		return
+	}
+	if len(list) == 0 {
+		sent, _ := b.API.Send(tgbotapi.NewMessage(chatID, "На вас не назначено открытых заявок."))
+		sentIDs = append(sentIDs, sent.MessageID)
+		return
+	}
+
+	sent, _ := b.API.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Назначенные вам заявки: %d", len(list))))
+	sentIDs = append(sentIDs, sent.MessageID)
+	for i := range list {
+		sentIDs = append(sentIDs, b.sendIssueToChat(ctx, chatID, &list[i])...)
+	}
+}
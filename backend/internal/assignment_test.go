@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAssignmentDepartmentScopedOperator(t *testing.T) {
+	id := func(v int64) *int64 { return &v }
+	operator := &Principal{Role: RoleOperator, DepartmentID: id(1)}
+	cases := []struct {
+		name          string
+		a             IssueAssignment
+		current       *int64
+		assigneeDepts []int64
+		wantDept      *int64
+		wantErr       error
+		allowed       bool
+	}{
+		{
+			name:          "коллега по службе",
+			a:             IssueAssignment{AssigneeID: id(10)},
+			current:       id(1),
+			assigneeDepts: []int64{1, 2},
+			wantDept:      id(1),
+			allowed:       true,
+		},
+		{
+			name:          "исполнитель из другой службы уводит заявку",
+			a:             IssueAssignment{AssigneeID: id(10)},
+			current:       id(1),
+			assigneeDepts: []int64{2},
+			wantDept:      id(2),
+		},
+		{
+			name:          "исполнитель в нескольких чужих службах снимает службу",
+			a:             IssueAssignment{AssigneeID: id(10)},
+			current:       id(1),
+			assigneeDepts: []int64{2, 3},
+		},
+		{
+			name:     "явная передача в другую службу",
+			a:        IssueAssignment{DepartmentID: id(2)},
+			current:  id(1),
+			wantDept: id(2),
+		},
+		{
+			name:    "снять службу",
+			a:       IssueAssignment{ClearDepartment: true},
+			current: id(1),
+		},
+		{
+			name:     "снять исполнителя",
+			a:        IssueAssignment{},
+			current:  id(1),
+			wantDept: id(1),
+			allowed:  true,
+		},
+		{
+			name:          "исполнитель не из указанной службы",
+			a:             IssueAssignment{DepartmentID: id(1), AssigneeID: id(10)},
+			current:       id(1),
+			assigneeDepts: []int64{2},
+			wantErr:       ErrAssigneeNotInDepartment,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dept, err := assignmentDepartment(tc.a, tc.current, tc.assigneeDepts)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("ошибка %v, ожидалась %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (dept == nil) != (tc.wantDept == nil) || (dept != nil && *dept != *tc.wantDept) {
+				t.Fatalf("служба %v, ожидалась %v", dept, tc.wantDept)
+			}
+			if got := operator.KeepsDepartment(dept); got != tc.allowed {
+				t.Fatalf("KeepsDepartment = %v, ожидалось %v", got, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestKeepsDepartment(t *testing.T) {
+	id := func(v int64) *int64 { return &v }
+	district := "Центральный"
+	var nobody *Principal
+	if nobody.KeepsDepartment(id(1)) {
+		t.Fatal("без прав заявку можно назначить")
+	}
+	super := &Principal{Role: RoleSuperadmin}
+	if !super.KeepsDepartment(id(2)) || !super.KeepsDepartment(nil) {
+		t.Fatal("суперадмин без области ограничен службой")
+	}
+	byDistrict := &Principal{Role: RoleOperator, District: &district}
+	if !byDistrict.KeepsDepartment(id(2)) || !byDistrict.KeepsDepartment(nil) {
+		t.Fatal("область по району не ограничивает службу")
+	}
+}
@@ -0,0 +1,284 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Permission — отдельное действие, которое проверяет Authorizer.
+type Permission string
+
+const (
+	PermViewIssues     Permission = "issues.view"     // списки, карточки, переписка, вложения
+	PermChangeStatus   Permission = "issues.status"   // смена статуса
+	PermComment        Permission = "issues.comment"  // ответы жителю и внутренние заметки
+	PermAssign         Permission = "issues.assign"   // служба и исполнитель
+	PermExport         Permission = "export"          // выгрузка CSV
+	PermBroadcast      Permission = "broadcast"       // массовая рассылка
+	PermManageStaff    Permission = "staff.manage"    // состав служб
+	PermManageUsers    Permission = "users.manage"    // роли сотрудников и учётки админки
+	PermManageSettings Permission = "settings.manage" // службы, правила маршрутизации и SLA
+)
+
+var rolePermissions = map[AdminRole][]Permission{
+	RoleOperator: {
+		PermViewIssues, PermChangeStatus, PermComment, PermAssign,
+	},
+	RoleDepartmentHead: {
+		PermViewIssues, PermChangeStatus, PermComment, PermAssign,
+		PermExport, PermManageStaff,
+	},
+	RoleSuperadmin: {
+		PermViewIssues, PermChangeStatus, PermComment, PermAssign,
+		PermExport, PermManageStaff, PermBroadcast, PermManageUsers, PermManageSettings,
+	},
+}
+
+var ErrForbidden = errors.New("недостаточно прав")
+
+// Principal — сотрудник, от имени которого выполняется действие:
+// пользователь Telegram с ролью или учётная запись веб-админки.
+// Область (служба и/или район) ограничивает заявки, с которыми он работает.
+type Principal struct {
+	Role         AdminRole
+	DepartmentID *int64  // только заявки этой службы
+	District     *string // только заявки этого района
+	TGUserID     *int64  // от чьего имени писать в Telegram и в историю заявки
+	AccountID    *int64  // учётка админки, если действие из веба
+}
+
+// Can — у роли есть право perm (без учёта области).
+func (p *Principal) Can(perm Permission) bool {
+	if p == nil {
+		return false
+	}
+	for _, x := range rolePermissions[p.Role] {
+		if x == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Scoped — права ограничены службой или районом.
+func (p *Principal) Scoped() bool {
+	return p != nil && (p.DepartmentID != nil || p.District != nil)
+}
+
+// Covers — заявка попадает в область сотрудника.
+func (p *Principal) Covers(iss *Issue) bool {
+	if p == nil {
+		return false
+	}
+	if p.DepartmentID != nil && (iss.DepartmentID == nil || *iss.DepartmentID != *p.DepartmentID) {
+		return false
+	}
+	if p.District != nil && (iss.District == nil || !strings.EqualFold(*iss.District, *p.District)) {
+		return false
+	}
+	return true
+}
+
+// CanIssue — право perm на конкретную заявку.
+func (p *Principal) CanIssue(perm Permission, iss *Issue) bool {
+	return p.Can(perm) && p.Covers(iss)
+}
+
+// NarrowFilter сужает выборку заявок до области сотрудника.
+// false — запрошенный фильтр целиком вне области.
+func (p *Principal) NarrowFilter(f *IssueFilter) bool {
+	if p.DepartmentID != nil {
+		if f.DepartmentID != nil && *f.DepartmentID != *p.DepartmentID {
+			return false
+		}
+		f.DepartmentID = p.DepartmentID
+	}
+	if p.District != nil {
+		if f.District != nil && *f.District != "" && !strings.EqualFold(*f.District, *p.District) {
+			return false
+		}
+		f.District = p.District
+	}
+	return true
+}
+
+// StaffScope — область, которой ограничены списки сотрудников и приглашений.
+// Пустая — видно всех.
+type StaffScope struct {
+	DepartmentID *int64
+	District     *string
+}
+
+// StaffScope — сотрудник видит только тех сотрудников и приглашения, чья
+// область не шире его собственной (тех, кем он может распоряжаться, см. Grants).
+func (p *Principal) StaffScope() StaffScope {
+	return StaffScope{DepartmentID: p.DepartmentID, District: p.District}
+}
+
+// CoversDepartment — сотрудник может распоряжаться службой departmentID
+// (составом, назначением на неё заявок).
+func (p *Principal) CoversDepartment(departmentID int64) bool {
+	return p != nil && (p.DepartmentID == nil || *p.DepartmentID == departmentID)
+}
+
+// KeepsDepartment — заявка со службой departmentID (nil — без службы)
+// остаётся в области сотрудника. Сотрудник службы не может передать заявку
+// в другую службу или снять с неё службу.
+func (p *Principal) KeepsDepartment(departmentID *int64) bool {
+	if p == nil {
+		return false
+	}
+	if departmentID == nil {
+		return p.DepartmentID == nil
+	}
+	return p.CoversDepartment(*departmentID)
+}
+
+// Grants проверяет, что сотрудник может выдать роль role с областью
+// departmentID/district (или распоряжаться тем, у кого она уже есть):
+// роль не выше своей, область не шире своей.
+func (p *Principal) Grants(role AdminRole, departmentID *int64, district *string) error {
+	if !p.Can(PermManageUsers) {
+		return ErrForbidden
+	}
+	if !p.Role.Allows(role) {
+		return fmt.Errorf("%w: нельзя выдать роль выше своей", ErrForbidden)
+	}
+	if p.DepartmentID != nil && (departmentID == nil || *departmentID != *p.DepartmentID) {
+		return fmt.Errorf("%w: область не может быть шире своей", ErrForbidden)
+	}
+	if p.District != nil && (district == nil || !strings.EqualFold(*district, *p.District)) {
+		return fmt.Errorf("%w: область не может быть шире своей", ErrForbidden)
+	}
+	return nil
+}
+
+// Authorizer — единая проверка прав для бота и HTTP API.
+type Authorizer struct {
+	DB *DB
+}
+
+func NewAuthorizer(db *DB) *Authorizer {
+	return &Authorizer{DB: db}
+}
+
+// TelegramPrincipal возвращает сотрудника по tg id; nil — пользователь без роли.
+func (a *Authorizer) TelegramPrincipal(ctx context.Context, tgUserID int64) (*Principal, error) {
+	p := Principal{TGUserID: &tgUserID}
+	var role *AdminRole
+	err := a.DB.Pool.QueryRow(ctx, `
+		select role, scope_department_id, scope_district
+		from users
+		where tg_user_id = $1
+	`, tgUserID).Scan(&role, &p.DepartmentID, &p.District)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && role == nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Role = *role
+	return &p, nil
+}
+
+// AccountPrincipal — сотрудник, вошедший в веб-админку.
+func AccountPrincipal(acc *AdminAccount) *Principal {
+	id := acc.ID
+	return &Principal{
+		Role:         acc.Role,
+		DepartmentID: acc.DepartmentID,
+		District:     acc.District,
+		TGUserID:     acc.TGUserID,
+		AccountID:    &id,
+	}
+}
+
+// AuthorizeIssue загружает заявку и проверяет право perm на неё.
+// Заявку вне области не отличить от несуществующей: обе дают ErrIssueNotFound.
+func (a *Authorizer) AuthorizeIssue(ctx context.Context, p *Principal, perm Permission, issueID int64) (*Issue, error) {
+	if !p.Can(perm) {
+		return nil, ErrForbidden
+	}
+	iss, err := a.DB.GetIssueByID(ctx, issueID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrIssueNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !p.Covers(iss) {
+		return nil, ErrIssueNotFound
+	}
+	return iss, nil
+}
+
+// StaffFor возвращает tg id сотрудников с правом perm, в область которых попадает заявка.
+func (a *Authorizer) StaffFor(ctx context.Context, perm Permission, iss *Issue) ([]int64, error) {
+	list, err := a.ListStaffPrincipals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res []int64
+	for _, p := range list {
+		if p.CanIssue(perm, iss) {
+			res = append(res, *p.TGUserID)
+		}
+	}
+	return res, nil
+}
+
+// ListStaffPrincipals — все пользователи Telegram с ролью.
+func (a *Authorizer) ListStaffPrincipals(ctx context.Context) ([]Principal, error) {
+	rows, err := a.DB.Pool.Query(ctx, `
+		select tg_user_id, role, scope_department_id, scope_district
+		from users
+		where role is not null
+		order by id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Principal
+	for rows.Next() {
+		var p Principal
+		var tg int64
+		if err := rows.Scan(&tg, &p.Role, &p.DepartmentID, &p.District); err != nil {
+			return nil, err
+		}
+		p.TGUserID = &tg
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+// principal — роль пользователя Telegram; nil — не сотрудник или ошибка базы.
+func (b *Bot) principal(ctx context.Context, tgUserID int64) *Principal {
+	p, err := b.Auth.TelegramPrincipal(ctx, tgUserID)
+	if err != nil {
+		log.Printf("права пользователя %d: %v", tgUserID, err)
+		return nil
+	}
+	return p
+}
+
+// can проверяет право perm пользователя Telegram без учёта области.
+func (b *Bot) can(ctx context.Context, tgUserID int64, perm Permission) (*Principal, bool) {
+	p := b.principal(ctx, tgUserID)
+	return p, p.Can(perm)
+}
+
+// canIssue проверяет право perm пользователя Telegram на заявку issueID.
+func (b *Bot) canIssue(ctx context.Context, tgUserID int64, perm Permission, issueID int64) bool {
+	_, err := b.Auth.AuthorizeIssue(ctx, b.principal(ctx, tgUserID), perm, issueID)
+	if err != nil && !errors.Is(err, ErrForbidden) && !errors.Is(err, ErrIssueNotFound) {
+		log.Printf("права на заявку #%d: %v", issueID, err)
+	}
+	return err == nil
+}
@@ -0,0 +1,396 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("файл не найден в хранилище")
+
+// BlobStore — хранилище файлов вложений. Бот и веб кладут туда файлы
+// через PutBlob, а в attachments запоминают только ключ.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get открывает файл; если его нет — ErrBlobNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBlobStore создаёт хранилище по настройкам BLOB_STORE.
+func NewBlobStore(cfg *Config) (BlobStore, error) {
+	switch cfg.BlobStore {
+	case "", "local":
+		return NewLocalBlobStore(cfg.BlobDir)
+	case "s3":
+		return NewS3BlobStore(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey)
+	}
+	return nil, fmt.Errorf("неизвестное хранилище BLOB_STORE=%q (local или s3)", cfg.BlobStore)
+}
+
+// blobKeyRe — ключи, которые выдаёт PutBlob: sha256/<2 символа>/<64 символа>.
+var blobKeyRe = regexp.MustCompile(`^sha256/[0-9a-f]{2}/[0-9a-f]{64}$`)
+
+// PutBlob сохраняет содержимое r в хранилище под ключом из его sha256
+// и возвращает ключ и размер. Одинаковые файлы хранятся один раз:
+// если такой ключ уже есть, повторно он не загружается.
+func PutBlob(ctx context.Context, store BlobStore, r io.Reader, contentType string) (string, int64, error) {
+	// S3 нужен размер заранее, а ключ известен только после чтения всего файла,
+	// поэтому содержимое сначала пишется во временный файл.
+	tmp, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	key := "sha256/" + sum[:2] + "/" + sum
+
+	exists, err := store.Exists(ctx, key)
+	if err != nil {
+		return "", 0, err
+	}
+	if exists {
+		return key, size, nil
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	if err := store.Put(ctx, key, tmp, size, contentType); err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+// OpenAttachment открывает файл вложения: из хранилища, а у старых
+// вложений без blob_key — с диска, путь local_path считается от legacyRoot.
+func OpenAttachment(ctx context.Context, store BlobStore, legacyRoot string, a *Attachment) (io.ReadCloser, error) {
+	if a.BlobKey != nil {
+		return store.Get(ctx, *a.BlobKey)
+	}
+	p, ok := legacyAttachmentPath(legacyRoot, a.LocalPath)
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+// legacyAttachmentPath — путь к старому файлу; принимаются только файлы внутри root/uploads.
+func legacyAttachmentPath(root, localPath string) (string, bool) {
+	if localPath == "" || filepath.IsAbs(localPath) {
+		return "", false
+	}
+	uploads := filepath.Join(root, "uploads")
+	p := filepath.Join(root, filepath.Clean(localPath))
+	return p, strings.HasPrefix(p, uploads+string(filepath.Separator))
+}
+
+// LocalBlobStore хранит файлы в каталоге на диске.
+type LocalBlobStore struct {
+	Root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{Root: abs}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !blobKeyRe.MatchString(key) {
+		return "", fmt.Errorf("некорректный ключ файла %q", key)
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+// Put пишет во временный файл рядом и переименовывает его, чтобы
+// читатель никогда не увидел файл наполовину.
+func (s *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// S3BlobStore хранит файлы в S3-совместимом хранилище (AWS S3, MinIO и т.п.).
+// Адресация path-style (endpoint/bucket/key), запросы подписываются AWS Signature V4.
+type S3BlobStore struct {
+	Endpoint  *url.URL
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey string) (*S3BlobStore, error) {
+	if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, errors.New("для BLOB_STORE=s3 нужны S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY и S3_SECRET_KEY")
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("некорректный S3_ENDPOINT %q", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3BlobStore{
+		Endpoint:  u,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	// без длины запрос уйдёт chunked, а S3 такой PUT не принимает
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do(req)
+	if errors.Is(err, ErrBlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	if !blobKeyRe.MatchString(key) {
+		return nil, fmt.Errorf("некорректный ключ файла %q", key)
+	}
+	u := *s.Endpoint
+	u.Path = u.Path + "/" + s.Bucket + "/" + key
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do подписывает и выполняет запрос. 404 превращается в ErrBlobNotFound,
+// остальные ответы не 2xx — в ошибку с началом тела ответа.
+func (s *S3BlobStore) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now())
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 %s: %w", req.Method, err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("S3 %s %s: %s %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign добавляет заголовки AWS Signature V4. Тело не хешируется
+// (UNSIGNED-PAYLOAD): целостность файла и так проверяется его ключом.
+func (s *S3BlobStore) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // query
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// ListLegacyAttachments — вложения, которые ещё лежат на диске по local_path.
+func (db *DB) ListLegacyAttachments(ctx context.Context) ([]Attachment, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select `+attachmentColumns+`
+		from attachments
+		where blob_key is null and local_path <> ''
+		order by id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+// SetAttachmentBlob переносит вложение в хранилище: запоминает ключ и размер.
+func (db *DB) SetAttachmentBlob(ctx context.Context, id int64, key string, size int64) error {
+	_, err := db.Pool.Exec(ctx,
+		`update attachments set blob_key = $2, size = $3 where id = $1`, id, key, size)
+	return err
+}
@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testS3Bucket    = "bot112"
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testS3Region    = "us-east-1"
+)
+
+// fakeS3 — S3-совместимый сервер в памяти: проверяет подпись SigV4 так,
+// как это делает S3 (по заголовкам из SignedHeaders), и path-style адрес
+// /<бакет>/<ключ>.
+type fakeS3 struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+	puts    int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, objects: map[string][]byte{}, types: map[string]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if msg := f.checkSignature(r); msg != "" {
+		f.t.Logf("fake S3: %s", msg)
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testS3Bucket+"/")
+	if !ok || !blobKeyRe.MatchString(key) {
+		f.t.Errorf("путь %q не в формате /%s/<ключ>", r.URL.Path, testS3Bucket)
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 || len(r.TransferEncoding) > 0 {
+			http.Error(w, "<Error><Code>MissingContentLength</Code></Error>", http.StatusLengthRequired)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+		f.types[key] = r.Header.Get("Content-Type")
+		f.puts++
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case http.MethodDelete:
+		if _, ok := f.objects[key]; !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) object(key string) (body []byte, contentType string, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok = f.objects[key]
+	return body, f.types[key], ok
+}
+
+func (f *fakeS3) stats() (puts, objects int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.puts, len(f.objects)
+}
+
+// checkSignature заново собирает канонический запрос из того, что пришло
+// на сервер, и сверяет подпись. Пустая строка — подпись верна.
+func (f *fakeS3) checkSignature(r *http.Request) string {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "нет заголовка Authorization"
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(auth, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[k] = v
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return "некорректный X-Amz-Date"
+	}
+	scope := amzDate[:8] + "/" + testS3Region + "/s3/aws4_request"
+	if fields["Credential"] != testS3AccessKey+"/"+scope {
+		return "неверный Credential " + fields["Credential"]
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	var headers []string
+	for _, h := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		found := false
+		for _, s := range signed {
+			found = found || s == h
+		}
+		if !found {
+			return "заголовок " + h + " не подписан"
+		}
+	}
+	for _, h := range signed {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers = append(headers, h+":"+strings.TrimSpace(v))
+	}
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		strings.Join(headers, "\n"),
+		"",
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+testS3SecretKey), amzDate[:8])
+	for _, p := range []string{testS3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, p)
+	}
+	if want := hex.EncodeToString(hmacSHA256(key, stringToSign)); fields["Signature"] != want {
+		return "подпись не совпала"
+	}
+	return ""
+}
+
+func newTestS3Store(t *testing.T, endpoint, secret string) *S3BlobStore {
+	s, err := NewS3BlobStore(endpoint, testS3Region, testS3Bucket, testS3AccessKey, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testBlobKey(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	s := hex.EncodeToString(sum[:])
+	return "sha256/" + s[:2] + "/" + s
+}
+
+// Подпись сверяется с посчитанной независимо (по описанию SigV4 от AWS).
+func TestS3BlobStoreSignsRequest(t *testing.T) {
+	s := newTestS3Store(t, "http://s3.test:9000", testS3SecretKey)
+	req, err := s.newRequest(context.Background(), http.MethodGet, "sha256/ab/"+strings.Repeat("ab", 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://s3.test:9000/bot112/sha256/ab/" + strings.Repeat("ab", 32); req.URL.String() != want {
+		t.Fatalf("адрес %s, ожидался %s", req.URL, want)
+	}
+	s.sign(req, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240301/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+		"Signature=0563df8a6a7ad3f5dd9a8cd00e67adf16354fb6aec72513afa57148c0a0e460e"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("Authorization:\n%s\nожидался:\n%s", got, want)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20240301T120000Z" {
+		t.Fatalf("X-Amz-Date = %s", got)
+	}
+}
+
+func TestS3BlobStorePutGetExistsDelete(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv.URL, testS3SecretKey)
+	ctx := context.Background()
+	const content = "фото ямы во дворе"
+	key := testBlobKey(content)
+
+	if ok, err := s.Exists(ctx, key); err != nil || ok {
+		t.Fatalf("Exists до загрузки: %v, %v", ok, err)
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Get до загрузки: %v, ожидался ErrBlobNotFound", err)
+	}
+
+	if err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	body, contentType, _ := fake.object(key)
+	if string(body) != content {
+		t.Fatalf("в хранилище %q", body)
+	}
+	if contentType != "image/jpeg" {
+		t.Fatalf("Content-Type %q", contentType)
+	}
+
+	if ok, err := s.Exists(ctx, key); err != nil || !ok {
+		t.Fatalf("Exists после загрузки: %v, %v", ok, err)
+	}
+	rc, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(got) != content {
+		t.Fatalf("Get: %q, %v", got, err)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Get после удаления: %v, ожидался ErrBlobNotFound", err)
+	}
+	// повторное удаление — не ошибка
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("повторный Delete: %v", err)
+	}
+}
+
+func TestS3BlobStoreEmptyPut(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv.URL, testS3SecretKey)
+	key := testBlobKey("")
+	if err := s.Put(context.Background(), key, bytes.NewReader(nil), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if body, _, ok := fake.object(key); !ok || len(body) != 0 {
+		t.Fatalf("пустой файл не сохранён: %v %q", ok, body)
+	}
+}
+
+func TestS3BlobStoreRejectedSignature(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv.URL, "неверный-секрет")
+	key := testBlobKey("x")
+
+	err := s.Put(context.Background(), key, strings.NewReader("x"), 1, "")
+	if err == nil || errors.Is(err, ErrBlobNotFound) || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Put с неверным ключом: %v", err)
+	}
+	if _, n := fake.stats(); n != 0 {
+		t.Fatal("объект сохранён без верной подписи")
+	}
+	if _, err := s.Exists(context.Background(), key); err == nil {
+		t.Fatal("Exists с неверным ключом не вернул ошибку")
+	}
+}
+
+func TestS3BlobStoreRejectsBadKey(t *testing.T) {
+	s := newTestS3Store(t, "http://s3.test:9000", testS3SecretKey)
+	for _, key := range []string{"", "../etc/passwd", "sha256/ab/" + strings.Repeat("AB", 32), "sha256/ab/../../x"} {
+		if _, err := s.Get(context.Background(), key); err == nil || errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("ключ %q принят: %v", key, err)
+		}
+	}
+}
+
+func TestPutBlobSkipsExistingContent(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	s := newTestS3Store(t, srv.URL, testS3SecretKey)
+	ctx := context.Background()
+	const content = "одно и то же видео"
+
+	key, size, err := PutBlob(ctx, s, strings.NewReader(content), "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testBlobKey(content) || size != int64(len(content)) {
+		t.Fatalf("PutBlob вернул %s, %d", key, size)
+	}
+	key2, size2, err := PutBlob(ctx, s, strings.NewReader(content), "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key2 != key || size2 != size {
+		t.Fatalf("повторный PutBlob вернул %s, %d", key2, size2)
+	}
+	if puts, _ := fake.stats(); puts != 1 {
+		t.Fatalf("PUT выполнен %d раз, ожидался один", puts)
+	}
+
+	if _, _, err := PutBlob(ctx, s, strings.NewReader(content+"!"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if puts, n := fake.stats(); puts != 2 || n != 2 {
+		t.Fatalf("другой файл не загружен: PUT %d, объектов %d", puts, n)
+	}
+}
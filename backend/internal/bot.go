@@ -7,9 +7,6 @@ import (
 	"io"
 	"log"
 	"math/rand"
-	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	time "time"
@@ -56,21 +53,33 @@ type issueWizardState struct {
 	Category string
 }
 
+// pendingStatusChange — смена статуса, для которой ждём от админа причину.
+type pendingStatusChange struct {
+	IssueID int64
+	Reopen  bool
+}
+
+// pendingComment — админ нажал «Ответить жителю» или «Заметка» и пишет текст.
+type pendingComment struct {
+	IssueID    int64
+	Visibility string // CommentInternal или CommentPublic
+}
+
 type Bot struct {
-	API              *tgbotapi.BotAPI
-	Cfg              *Config
-	DB               *DB
-	Services         *Services
-	pendingComments  map[int64]int64  // adminTGUserID -> issueID
-	pendingBroadcast map[int64]string // adminTGUserID -> broadcast
-
-	myPage             map[int64]int    // chatID -> текущая страница /my
-	issuesPage         map[int64]int    // chatID -> текущая страница /issues
-	lastMode           map[int64]string // chatID -> "my" или "issues"
-	lastMyMessages     map[int64][]int  // какие сообщения удалить при смене страницы /my
-	lastIssuesMessages map[int64][]int  // какие сообщения удалить при смене страницы /issues
-	wizard             map[int64]*issueWizardState
-	issuesFilter       map[int64]*issuesFilterState
+	API      *tgbotapi.BotAPI
+	Cfg      *Config
+	DB       *DB
+	Services *Services
+	State    StateStore     // мастер заявки, черновики, пагинация (см. state.go)
+	Auth     *Authorizer    // права сотрудников (см. authz.go)
+	Guard    *AuthGuard     // защита от перебора (см. security.go)
+	Blobs    BlobStore      // файлы вложений (см. blobstore.go)
+	Media    *MediaFetcher  // фоновое скачивание файлов из Telegram (см. media.go)
+	Notify   *Notifications // уведомления жителю: Telegram, e-mail (см. notify.go)
+
+	updates     *UpdateDispatcher // упорядоченная по чатам обработка апдейтов
+	adminDigest *quarterlyGate    // периодичность сводки для админов
+	albums      *albumCollector   // сборка альбомов из отдельных сообщений
 }
 
 type issuesFilterState struct {
@@ -78,22 +87,39 @@ type issuesFilterState struct {
 	Category string
 }
 
-func NewBot(api *tgbotapi.BotAPI, db *DB, cfg *Config, svc *Services) *Bot {
-	return &Bot{
-		API:                api,
-		DB:                 db,
-		Cfg:                cfg,
-		pendingComments:    make(map[int64]int64),
-		Services:           svc,
-		pendingBroadcast:   map[int64]string{},
-		myPage:             make(map[int64]int),
-		issuesPage:         make(map[int64]int),
-		lastMode:           make(map[int64]string),
-		lastMyMessages:     make(map[int64][]int),
-		lastIssuesMessages: make(map[int64][]int),
-		wizard:             make(map[int64]*issueWizardState),
-		issuesFilter:       make(map[int64]*issuesFilterState),
-	}
+func NewBot(api *tgbotapi.BotAPI, db *DB, cfg *Config, svc *Services, state StateStore, blobs BlobStore) *Bot {
+	b := &Bot{
+		API:      api,
+		DB:       db,
+		Cfg:      cfg,
+		Services: svc,
+		State:    state,
+		Auth:     NewAuthorizer(db),
+		Blobs:    blobs,
+
+		updates:     NewUpdateDispatcher(cfg.BotWorkers, cfg.BotQueueSize),
+		adminDigest: newQuarterlyGate(),
+	}
+	b.Guard = NewAuthGuard(db, b.alertSuperadmins)
+	b.Media = NewMediaFetcher(db, api, blobs, cfg)
+	b.albums = newAlbumCollector(cfg.AlbumWindow, b.flushAlbum)
+	notifiers := []Notifier{&TelegramNotifier{Bot: b}}
+	if cfg.SMTPAddr != "" {
+		notifiers = append(notifiers, NewSMTPNotifier(db, cfg))
+	}
+	b.Notify = NewNotifications(db, cfg, notifiers...)
+	return b
+}
+
+// StartWorkers запускает воркеры обработки апдейтов. Должен быть вызван
+// до StartLongPolling и до приёма webhook-апдейтов.
+func (b *Bot) StartWorkers(ctx context.Context) {
+	b.updates.Start(ctx)
+}
+
+// Wait дожидается, пока воркеры доделают текущие апдейты после остановки.
+func (b *Bot) Wait() {
+	b.updates.Wait()
 }
 
 func (b *Bot) StartLongPolling(ctx context.Context) error {
@@ -108,13 +134,24 @@ func (b *Bot) StartLongPolling(ctx context.Context) error {
 			if upd.UpdateID == 0 && upd.Message == nil && upd.CallbackQuery == nil {
 				continue
 			}
-			b.handleUpdate(ctx, upd)
+			if err := b.enqueueUpdate(ctx, upd); err != nil {
+				return err
+			}
 		}
 	}
 }
 
-func (b *Bot) HandleWebhookUpdate(ctx context.Context, upd tgbotapi.Update) {
-	b.handleUpdate(ctx, upd)
+// HandleWebhookUpdate ставит апдейт в очередь чата и сразу возвращается.
+// ctx ограничивает только ожидание места в очереди: сам апдейт обрабатывается
+// с контекстом приложения, а не HTTP-запроса.
+func (b *Bot) HandleWebhookUpdate(ctx context.Context, upd tgbotapi.Update) error {
+	return b.enqueueUpdate(ctx, upd)
+}
+
+func (b *Bot) enqueueUpdate(ctx context.Context, upd tgbotapi.Update) error {
+	return b.updates.Submit(ctx, updateChatKey(upd), func(workerCtx context.Context) {
+		b.handleUpdate(workerCtx, upd)
+	})
 }
 
 func (b *Bot) handleUpdate(ctx context.Context, upd tgbotapi.Update) {
@@ -175,6 +212,12 @@ func (b *Bot) handleMessage(ctx context.Context, m *tgbotapi.Message) {
 		return
 	}
 
+	// альбом обрабатывается целиком, когда придут все его сообщения (см. album.go)
+	if m.MediaGroupID != "" && !inAlbum(ctx) {
+		b.albums.Add(m)
+		return
+	}
+
 	txt := strings.TrimSpace(m.Text)
 
 	//1. Главное меню и пагинация
@@ -185,48 +228,59 @@ func (b *Bot) handleMessage(ctx context.Context, m *tgbotapi.Message) {
 		return
 
 	case "FAQ / Помощь":
-		b.reply(m.Chat.ID, "Справка: отправьте текст проблемы, по желанию фото/видео и геолокацию.\n/my — мои обращения.\n/issues — просмотр активных заявок (для админов).")
+		b.reply(m.Chat.ID, "Справка: отправьте текст проблемы, по желанию фото/видео, документы, голосовое сообщение и геолокацию. "+
+			"Чтобы оставить телефон для связи, после заявки поделитесь контактом.\n/my — мои обращения.\n/link — уведомления по заявкам, поданным на сайте.\n/issues — просмотр активных заявок (для админов).")
 		return
 
 	case "⬅ Предыдущая":
-		switch b.lastMode[m.Chat.ID] {
+		var mode string
+		b.loadState(ctx, stateLastMode, m.Chat.ID, &mode)
+		switch mode {
 		case "my":
-			page := b.myPage[m.Chat.ID]
+			var page int
+			b.loadState(ctx, stateMyPage, m.Chat.ID, &page)
 			if page > 1 {
 				page--
 			}
 			b.sendMyIssuesPage(ctx, m.Chat.ID, m.From.ID, page)
 		case "issues":
-			if ok, _ := b.DB.IsAdmin(ctx, m.From.ID); !ok {
+			p, ok := b.can(ctx, m.From.ID, PermViewIssues)
+			if !ok {
 				b.reply(m.Chat.ID, "Недостаточно прав")
 				n := rand.Intn(2)
 				b.API.Send(Stickers[n+5])
 				return
 			}
-			page := b.issuesPage[m.Chat.ID]
+			var page int
+			b.loadState(ctx, stateIssuesPage, m.Chat.ID, &page)
 			if page > 1 {
 				page--
 			}
-			b.sendIssuesPage(ctx, m.Chat.ID, page)
+			b.sendIssuesPage(ctx, p, m.Chat.ID, page)
 		}
 		return
 
 	case "Следующая ➡":
-		switch b.lastMode[m.Chat.ID] {
+		var mode string
+		b.loadState(ctx, stateLastMode, m.Chat.ID, &mode)
+		switch mode {
 		case "my":
-			page := b.myPage[m.Chat.ID]
+			var page int
+			b.loadState(ctx, stateMyPage, m.Chat.ID, &page)
 			page++
 			b.sendMyIssuesPage(ctx, m.Chat.ID, m.From.ID, page)
 		case "issues":
-			if ok, _ := b.DB.IsAdmin(ctx, m.From.ID); !ok {
+			p, ok := b.can(ctx, m.From.ID, PermViewIssues)
+			if !ok {
 				b.reply(m.Chat.ID, "Недостаточно прав")
 				n := rand.Intn(2)
 				b.API.Send(Stickers[n+5])
 				return
 			}
-			page := b.issuesPage[m.Chat.ID]
+			var page int
+			b.loadState(ctx, stateIssuesPage, m.Chat.ID, &page)
 			page++
-			b.sendIssuesPage(ctx, m.Chat.ID, page)
+			b.sendIssuesPage(ctx, p, m.Chat.ID, page)
 		}
 		return
 	}
@@ -251,6 +305,9 @@ func (b *Bot) handleMessage(ctx context.Context, m *tgbotapi.Message) {
 				return
 			}
 
+			if err := b.DB.RouteIssue(ctx, iss); err != nil {
+				log.Printf("маршрутизация заявки #%d: %v", iss.ID, err)
+			}
 			b.reply(m.Chat.ID, fmt.Sprintf("Геопозиция добавлена к заявке #%d", iss.ID))
 			return
 		}
@@ -258,17 +315,18 @@ func (b *Bot) handleMessage(ctx context.Context, m *tgbotapi.Message) {
 		return
 	}
 
+	//1.6. Контакт — телефон для связи по последней заявке
+	if m.Contact != nil {
+		b.attachContactPhone(ctx, m, u)
+		return
+	}
+
 	//2. Выбор РАЙОНА
 
 	for _, d := range districts {
 		if txt == d {
-			st := b.wizard[m.From.ID]
-			if st == nil {
-				st = &issueWizardState{}
-				b.wizard[m.From.ID] = st
-			}
-			st.District = d
-			st.Category = ""
+			st := issueWizardState{District: d}
+			b.saveState(ctx, stateWizard, m.From.ID, st)
 
 			msg := tgbotapi.NewMessage(m.Chat.ID,
 				fmt.Sprintf("Район: %s\nТеперь выберите категорию проблемы.", d),
@@ -283,12 +341,13 @@ func (b *Bot) handleMessage(ctx context.Context, m *tgbotapi.Message) {
 
 	for _, c := range categories {
 		if txt == c {
-			st := b.wizard[m.From.ID]
-			if st == nil || st.District == "" {
+			var st issueWizardState
+			if !b.loadState(ctx, stateWizard, m.From.ID, &st) || st.District == "" {
 				b.reply(m.Chat.ID, "Сначала выберите район командой /add или /start.")
 				return
 			}
 			st.Category = c
+			b.saveState(ctx, stateWizard, m.From.ID, st)
 
 			msg := tgbotapi.NewMessage(
 				m.Chat.ID,
@@ -303,28 +362,70 @@ func (b *Bot) handleMessage(ctx context.Context, m *tgbotapi.Message) {
 		}
 	}
 
-	//4. Режим комментария для админа
-	if issueID, ok := b.pendingComments[m.From.ID]; ok {
-		if isAdmin, _ := b.DB.IsAdmin(ctx, m.From.ID); isAdmin {
-			if err := b.DB.AddComment(ctx, issueID, m.From.ID, m.Text); err != nil {
-				b.reply(m.Chat.ID, "Не удалось сохранить комментарий: "+err.Error())
+	//4. Причина отклонения заявки
+	var rej pendingStatusChange
+	if b.loadState(ctx, statePendingReject, m.From.ID, &rej) {
+		if b.canIssue(ctx, m.From.ID, PermChangeStatus, rej.IssueID) {
+			reason := strings.TrimSpace(m.Text)
+			if reason == "" {
+				b.reply(m.Chat.ID, "Причина не может быть пустой. Напишите её текстом.")
 				return
 			}
-			b.reply(m.Chat.ID, fmt.Sprintf("Комментарий добавлен к заявке #%d", issueID))
-			delete(b.pendingComments, m.From.ID)
+			b.clearState(ctx, statePendingReject, m.From.ID)
+			err := b.changeIssueStatus(ctx, StatusUpdate{
+				IssueID:     rej.IssueID,
+				Status:      string(StatusRejected),
+				ChangedByTG: &m.From.ID,
+				Comment:     &reason,
+				Reopen:      rej.Reopen,
+			})
+			if err != nil {
+				b.reply(m.Chat.ID, "Не удалось отклонить заявку: "+statusErrorText(err))
+				return
+			}
+			b.reply(m.Chat.ID, fmt.Sprintf("Заявка #%d отклонена", rej.IssueID))
+			return
+		}
+	}
 
+	//5. Режим комментария для админа
+	var pc pendingComment
+	if b.loadState(ctx, statePendingComment, m.From.ID, &pc) {
+		if b.canIssue(ctx, m.From.ID, PermComment, pc.IssueID) {
+			text := strings.TrimSpace(m.Text)
+			if text == "" {
+				b.reply(m.Chat.ID, "Комментарий должен быть текстом.")
+				return
+			}
+			b.clearState(ctx, statePendingComment, m.From.ID)
+			if err := b.addStaffComment(ctx, pc.IssueID, m.From.ID, text, pc.Visibility); err != nil {
+				b.reply(m.Chat.ID, "Не удалось сохранить комментарий: "+err.Error())
+				return
+			}
+			if pc.Visibility == CommentPublic {
+				b.reply(m.Chat.ID, fmt.Sprintf("Ответ по заявке #%d отправлен жителю", pc.IssueID))
+			} else {
+				b.reply(m.Chat.ID, fmt.Sprintf("Внутренняя заметка добавлена к заявке #%d", pc.IssueID))
+			}
 			return
 		}
 	}
 
-	//5. Завершение мастера создания заявки
-	if st, ok := b.wizard[m.From.ID]; ok && st.District != "" && st.Category != "" {
+	//5.7. Сообщение жителя по существующей заявке (reply или кнопка «Ответить»)
+	if threadIssueID := b.threadIssueForMessage(ctx, m); threadIssueID != 0 {
+		b.addCitizenReply(ctx, m, u, threadIssueID)
+		return
+	}
+
+	//6. Завершение мастера создания заявки
+	var st issueWizardState
+	if b.loadState(ctx, stateWizard, m.From.ID, &st) && st.District != "" && st.Category != "" {
 		b.createIssueFromMessageWithMeta(ctx, m, st.District, st.Category)
-		delete(b.wizard, m.From.ID)
+		b.clearState(ctx, stateWizard, m.From.ID)
 		return
 	}
 
-	//6. Обычное создание заявки (без мастера)
+	//7. Обычное создание заявки (без мастера)
 	b.createIssueFromMessage(ctx, m)
 }
 
@@ -375,7 +476,7 @@ func (b *Bot) createIssueFromMessageWithMeta(ctx context.Context, m *tgbotapi.Me
 		Text:      text,
 		Latitude:  lat,
 		Longitude: lon,
-		Status:    "Новая",
+		Status:    string(StatusNew),
 		District:  &d,
 		Category:  &c,
 	})
@@ -388,68 +489,58 @@ func (b *Bot) createIssueFromMessageWithMeta(ctx context.Context, m *tgbotapi.Me
 
 	//Вложения
 
-	if len(m.Photo) > 0 {
-		ph := m.Photo[len(m.Photo)-1]
-		filename := fmt.Sprintf("issue_%d_photo_%d.jpg", iss.ID, time.Now().UnixNano())
-		localPath, err := b.saveTelegramFile(ph.FileID, filename)
-		if err != nil {
-			log.Printf("save photo failed: %v", err)
-		} else {
-			_ = b.DB.AddAttachment(ctx, &Attachment{
-				IssueID:   iss.ID,
-				FileID:    ph.FileID,
-				FileType:  "photo",
-				LocalPath: localPath,
-			})
-		}
+	b.saveMessageAttachments(ctx, iss.ID, m)
+
+	n := rand.Intn(len(issueAccess) - 1)
+	if err := b.sendToCitizen(ctx, m.Chat.ID, iss.ID, fmt.Sprintln(issueAccess[n], iss.ID)+b.trackingLine(iss)); err != nil {
+		log.Printf("send confirmation: %v", err)
 	}
+	n = rand.Intn(2)
+	b.API.Send(Stickers[n+4])
+}
 
-	if m.Video != nil {
-		ext := ".mp4"
-		if m.Video.FileName != "" {
-			if e := filepath.Ext(m.Video.FileName); e != "" {
-				ext = e
-			}
+// saveMessageAttachments сохраняет файлы из сообщения (фото, видео, документ, голосовое,
+// видеосообщение, аудио) как вложения заявки,
+// а если сообщение — подпись альбома, то из всех сообщений альбома.
+func (b *Bot) saveMessageAttachments(ctx context.Context, issueID int64, m *tgbotapi.Message) {
+	for _, part := range albumMessages(ctx, m) {
+		if len(part.Photo) > 0 {
+			ph := part.Photo[len(part.Photo)-1]
+			b.saveTelegramAttachment(ctx, issueID, ph.FileID, "photo")
 		}
-		filename := fmt.Sprintf("issue_%d_video_%d%s", iss.ID, time.Now().UnixNano(), ext)
-		localPath, err := b.saveTelegramFile(m.Video.FileID, filename)
-		if err != nil {
-			log.Printf("save video failed: %v", err)
-		} else {
-			_ = b.DB.AddAttachment(ctx, &Attachment{
-				IssueID:   iss.ID,
-				FileID:    m.Video.FileID,
-				FileType:  "video",
-				LocalPath: localPath,
-			})
+		if part.Video != nil {
+			b.saveTelegramAttachment(ctx, issueID, part.Video.FileID, "video")
 		}
-	}
-
-	if m.Document != nil {
-		filename := m.Document.FileName
-		if filename == "" {
-			filename = fmt.Sprintf("issue_%d_doc_%d", iss.ID, time.Now().UnixNano())
+		if part.Document != nil {
+			b.saveTelegramAttachment(ctx, issueID, part.Document.FileID, "document")
 		}
-		localPath, err := b.saveTelegramFile(m.Document.FileID, filename)
-		if err != nil {
-			log.Printf("save document failed: %v", err)
-		} else {
-			_ = b.DB.AddAttachment(ctx, &Attachment{
-				IssueID:   iss.ID,
-				FileID:    m.Document.FileID,
-				FileType:  "document",
-				LocalPath: localPath,
-			})
+		if part.Voice != nil {
+			b.saveTelegramAttachment(ctx, issueID, part.Voice.FileID, "voice")
+		}
+		if part.VideoNote != nil {
+			b.saveTelegramAttachment(ctx, issueID, part.VideoNote.FileID, "video_note")
+		}
+		if part.Audio != nil {
+			b.saveTelegramAttachment(ctx, issueID, part.Audio.FileID, "audio")
 		}
 	}
+}
 
-	n := rand.Intn(len(issueAccess) - 1)
-	b.reply(m.Chat.ID, fmt.Sprintln(issueAccess[n], iss.ID))
-	n = rand.Intn(2)
-	b.API.Send(Stickers[n+4])
-	// Периодическое уведомление админам
-	if shouldExecuteQuarterly() {
-		b.notifyAdminsNewIssue(ctx)
+// saveTelegramAttachment добавляет к заявке вложение из Telegram. Сам файл
+// скачивается в хранилище в фоне (см. MediaFetcher), а до тех пор бот
+// пересылает его по file_id, поэтому ответ жителю не ждёт скачивания.
+func (b *Bot) saveTelegramAttachment(ctx context.Context, issueID int64, fileID, fileType string) {
+	if err := b.DB.AddAttachment(ctx, &Attachment{
+		IssueID:        issueID,
+		FileID:         fileID,
+		FileType:       fileType,
+		DownloadStatus: DownloadPending,
+	}); err != nil {
+		log.Printf("add %s to #%d: %v", fileType, issueID, err)
+		return
+	}
+	if b.Media != nil {
+		b.Media.Wake()
 	}
 }
 
@@ -473,7 +564,11 @@ func (b *Bot) handleCommand(ctx context.Context, m *tgbotapi.Message) {
 
 	switch m.Command() {
 	case "start":
-		delete(b.wizard, m.From.ID)
+		if token, ok := strings.CutPrefix(strings.TrimSpace(m.CommandArguments()), invitePrefix); ok {
+			b.handleInviteStart(ctx, m, token)
+			return
+		}
+		b.clearState(ctx, stateWizard, m.From.ID)
 		n := rand.Intn(6)
 		text := greetings[n]
 		msg := tgbotapi.NewMessage(m.Chat.ID, text)
@@ -486,30 +581,15 @@ func (b *Bot) handleCommand(ctx context.Context, m *tgbotapi.Message) {
 		b.API.Send(msg)
 		return
 	case "help":
-		b.reply(m.Chat.ID, "Справка: отправьте текст проблемы, фото/видео и геолокацию. В группах бот сообщения не обрабатывает. Для администраторов: /admin <секрет>, /export <период>, /broadcast \"текст\".")
+		b.reply(m.Chat.ID, "Справка: отправьте текст проблемы, фото/видео и геолокацию. В группах бот сообщения не обрабатывает. /link — получать уведомления по заявкам с сайта. Для сотрудников: /issues, /mine, /export <период>, /broadcast \"текст\", /staff.")
 	case "my":
 		b.sendMyIssuesPage(ctx, m.Chat.ID, m.From.ID, 1)
+	case "link":
+		b.handleLinkCommand(m)
 	case "admin":
-		args := strings.TrimSpace(m.CommandArguments())
-		if args == "" {
-			b.reply(m.Chat.ID, "Укажите секрет: /admin <секрет>")
-			return
-		}
-		if args != b.Cfg.AdminSecret {
-			b.reply(m.Chat.ID, "Неверный секрет")
-			n := rand.Intn(2)
-			b.API.Send(Stickers[n+5])
-			return
-		}
-		if err := b.DB.PromoteToAdmin(ctx, m.From.ID); err != nil {
-			b.reply(m.Chat.ID, "Не удалось выдать права: "+err.Error())
-			n := rand.Intn(2)
-			b.API.Send(Stickers[n+5])
-			return
-		}
-		b.reply(m.Chat.ID, "Права администратора выданы. Доступны команды /export, /broadcast, /issues. Новые заявки будут приходить автоматически.")
-		n := rand.Intn(2)
-		b.API.Send(Stickers[n+4])
+		b.reply(m.Chat.ID, "Права сотрудника выдаются только по приглашению: попросите ссылку у администратора.")
+	case "staff", "invite", "setrole", "revoke":
+		b.handleStaffCommand(ctx, m)
 	case "export":
 		period := strings.TrimSpace(m.CommandArguments())
 		from, to, err := parsePeriod(period)
@@ -517,22 +597,25 @@ func (b *Bot) handleCommand(ctx context.Context, m *tgbotapi.Message) {
 			b.reply(m.Chat.ID, "Формат: /export YYYY-MM-DD..YYYY-MM-DD")
 			return
 		}
-		if ok, _ := b.DB.IsAdmin(ctx, m.From.ID); !ok {
+		p, ok := b.can(ctx, m.From.ID, PermExport)
+		if !ok {
 			b.reply(m.Chat.ID, "Недостаточно прав")
 			n := rand.Intn(2)
 			b.API.Send(Stickers[n+6])
 			return
 		}
+		var scope IssueFilter
+		p.NarrowFilter(&scope)
 		var sb strings.Builder
 		sb.WriteString("id,created_at,status,user_id,tg_user_id,text,latitude,longitude\n")
-		if err := b.Services.ExportCSV(ctx, from, to, &sb); err != nil {
+		if err := b.Services.ExportCSV(ctx, from, to, scope, &sb); err != nil {
 			b.reply(m.Chat.ID, "Ошибка экспорта: "+err.Error())
 			return
 		}
 		b.reply(m.Chat.ID, "Экспорт за период: "+from.Format("2006-01-02")+".."+to.Add(-time.Nanosecond).Format("2006-01-02"))
 		b.API.Send(tgbotapi.NewDocument(m.Chat.ID, tgbotapi.FileBytes{Name: "export.csv", Bytes: []byte(sb.String())}))
 	case "broadcast":
-		if ok, _ := b.DB.IsAdmin(ctx, m.From.ID); !ok {
+		if _, ok := b.can(ctx, m.From.ID, PermBroadcast); !ok {
 			b.reply(m.Chat.ID, "Недостаточно прав")
 			n := rand.Intn(2)
 			b.API.Send(Stickers[n+6])
@@ -543,7 +626,7 @@ func (b *Bot) handleCommand(ctx context.Context, m *tgbotapi.Message) {
 			b.reply(m.Chat.ID, "Использование: /broadcast \"Текст\" — будет предпросмотр и подтверждение.")
 			return
 		}
-		b.pendingBroadcast[m.From.ID] = text
+		b.saveState(ctx, statePendingBroadcast, m.From.ID, text)
 		msg := tgbotapi.NewMessage(m.Chat.ID, "Предпросмотр рассылки:\n\n"+text)
 		kb := tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
@@ -554,24 +637,32 @@ func (b *Bot) handleCommand(ctx context.Context, m *tgbotapi.Message) {
 		msg.ReplyMarkup = kb
 		b.API.Send(msg)
 	case "issues":
-		if ok, _ := b.DB.IsAdmin(ctx, m.From.ID); !ok {
+		p, ok := b.can(ctx, m.From.ID, PermViewIssues)
+		if !ok {
 			b.reply(m.Chat.ID, "Недостаточно прав")
 			return
 		}
 
-		delete(b.issuesFilter, m.Chat.ID)
+		b.clearState(ctx, stateIssuesFilter, m.Chat.ID)
 
-		b.sendIssuesPage(ctx, m.Chat.ID, 1)
+		b.sendIssuesPage(ctx, p, m.Chat.ID, 1)
+		return
+	case "mine":
+		if _, ok := b.can(ctx, m.From.ID, PermViewIssues); !ok {
+			b.reply(m.Chat.ID, "Недостаточно прав")
+			return
+		}
+		b.sendMineIssues(ctx, m.Chat.ID, m.From.ID)
 		return
 	case "issues_filter":
-		if ok, _ := b.DB.IsAdmin(ctx, m.From.ID); !ok {
+		if _, ok := b.can(ctx, m.From.ID, PermViewIssues); !ok {
 			b.reply(m.Chat.ID, "Недостаточно прав")
 			return
 		}
 		b.sendIssuesFilterDistrictMenu(m.Chat.ID)
 		return
 	case "add":
-		delete(b.wizard, m.From.ID)
+		b.clearState(ctx, stateWizard, m.From.ID)
 
 		msg := tgbotapi.NewMessage(m.Chat.ID,
 			"Создаём новое обращение.\nСначала выберите район, в котором возникла проблема.",
@@ -630,21 +721,24 @@ func (b *Bot) sendMyIssuesPage(ctx context.Context, chatID int64, tgUserID int64
 	if page < 1 {
 		page = 1
 	}
-	b.lastMode[chatID] = "my"
-	b.myPage[chatID] = page
+	b.saveState(ctx, stateLastMode, chatID, "my")
+	b.saveState(ctx, stateMyPage, chatID, page)
 
-	if ids := b.lastMyMessages[chatID]; len(ids) > 0 {
-		b.deleteMessages(chatID, ids)
-		b.lastMyMessages[chatID] = nil
+	var prevIDs []int
+	if b.loadState(ctx, stateLastMyMessages, chatID, &prevIDs) && len(prevIDs) > 0 {
+		b.deleteMessages(chatID, prevIDs)
 	}
 
+	var sentIDs []int
+	defer func() { b.saveState(ctx, stateLastMyMessages, chatID, sentIDs) }()
+
 	row := b.DB.Pool.QueryRow(ctx, `select id from users where tg_user_id=$1`, tgUserID)
 	var uid int64
 	if err := row.Scan(&uid); err != nil {
 		msg := tgbotapi.NewMessage(chatID, "Нет обращений")
 		msg.ReplyMarkup = makeUserPagingKeyboard()
 		sent, _ := b.API.Send(msg)
-		b.lastMyMessages[chatID] = append(b.lastMyMessages[chatID], sent.MessageID)
+		sentIDs = append(sentIDs, sent.MessageID)
 		return
 	}
 
@@ -654,7 +748,7 @@ func (b *Bot) sendMyIssuesPage(ctx context.Context, chatID int64, tgUserID int64
 		msg := tgbotapi.NewMessage(chatID, "Ошибка загрузки обращений: "+err.Error())
 		msg.ReplyMarkup = makeUserPagingKeyboard()
 		sent, _ := b.API.Send(msg)
-		b.lastMyMessages[chatID] = append(b.lastMyMessages[chatID], sent.MessageID)
+		sentIDs = append(sentIDs, sent.MessageID)
 		return
 	}
 	if len(issues) == 0 {
@@ -665,14 +759,14 @@ func (b *Bot) sendMyIssuesPage(ctx context.Context, chatID int64, tgUserID int64
 		msg := tgbotapi.NewMessage(chatID, text)
 		msg.ReplyMarkup = makeUserPagingKeyboard()
 		sent, _ := b.API.Send(msg)
-		b.lastMyMessages[chatID] = append(b.lastMyMessages[chatID], sent.MessageID)
+		sentIDs = append(sentIDs, sent.MessageID)
 		return
 	}
 
 	header := tgbotapi.NewMessage(chatID, fmt.Sprintf("Ваши обращения (страница %d):", page))
 	header.ReplyMarkup = makeUserPagingKeyboard()
 	sentHeader, _ := b.API.Send(header)
-	b.lastMyMessages[chatID] = append(b.lastMyMessages[chatID], sentHeader.MessageID)
+	sentIDs = append(sentIDs, sentHeader.MessageID)
 
 	for _, is := range issues {
 		text := "(без текста)"
@@ -689,7 +783,7 @@ func (b *Bot) sendMyIssuesPage(ctx context.Context, chatID int64, tgUserID int64
 		}
 
 		var lastCommentText string
-		if comments, err := b.DB.ListCommentsByIssue(ctx, is.ID); err == nil && len(comments) > 0 {
+		if comments, err := b.DB.ListCommentsByIssue(ctx, is.ID, true); err == nil && len(comments) > 0 {
 			last := comments[len(comments)-1]
 			lastCommentText = last.Text
 		}
@@ -719,76 +813,81 @@ func (b *Bot) sendMyIssuesPage(ctx context.Context, chatID int64, tgUserID int64
 		}
 
 		if mainPhoto != nil {
-			var msg tgbotapi.Message
-			if mainPhoto.LocalPath != "" {
-				photo := tgbotapi.NewPhoto(chatID, tgbotapi.FilePath(mainPhoto.LocalPath))
-				photo.Caption = caption
-				msg, _ = b.API.Send(photo)
-			} else {
-				photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(mainPhoto.FileID))
-				photo.Caption = caption
-				msg, _ = b.API.Send(photo)
-			}
+			photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(mainPhoto.FileID))
+			photo.Caption = caption
+			photo.ReplyMarkup = citizenIssueKeyboard(is.ID)
+			msg, _ := b.API.Send(photo)
 			if msg.MessageID != 0 {
-				b.lastMyMessages[chatID] = append(b.lastMyMessages[chatID], msg.MessageID)
+				sentIDs = append(sentIDs, msg.MessageID)
+				b.linkIssueMessage(ctx, chatID, msg.MessageID, is.ID)
 			}
 
 			if len(rest) > 0 {
-				ids := b.sendAttachmentsList(chatID, rest)
+				ids := b.sendAttachmentsList(ctx, chatID, rest)
 				if len(ids) > 0 {
-					b.lastMyMessages[chatID] = append(b.lastMyMessages[chatID], ids...)
+					sentIDs = append(sentIDs, ids...)
 				}
 			}
 		} else {
 			msg := tgbotapi.NewMessage(chatID, caption)
+			msg.ReplyMarkup = citizenIssueKeyboard(is.ID)
 			sent, _ := b.API.Send(msg)
 			if sent.MessageID != 0 {
-				b.lastMyMessages[chatID] = append(b.lastMyMessages[chatID], sent.MessageID)
+				sentIDs = append(sentIDs, sent.MessageID)
+				b.linkIssueMessage(ctx, chatID, sent.MessageID, is.ID)
 			}
 
 			ids := b.sendIssueAttachments(ctx, chatID, is.ID)
 			if len(ids) > 0 {
-				b.lastMyMessages[chatID] = append(b.lastMyMessages[chatID], ids...)
+				sentIDs = append(sentIDs, ids...)
 			}
 		}
 	}
 }
 
-// sendIssuesPage показывает администратору страницу page заявок со статусами Новая/В обработке.
-func (b *Bot) sendIssuesPage(ctx context.Context, chatID int64, page int) {
+// sendIssuesPage показывает страницу page открытых заявок (Новая/В обработке)
+// в области сотрудника p.
+func (b *Bot) sendIssuesPage(ctx context.Context, p *Principal, chatID int64, page int) {
 	if page < 1 {
 		page = 1
 	}
-	b.lastMode[chatID] = "issues"
-	b.issuesPage[chatID] = page
+	b.saveState(ctx, stateLastMode, chatID, "issues")
+	b.saveState(ctx, stateIssuesPage, chatID, page)
 
-	if ids := b.lastIssuesMessages[chatID]; len(ids) > 0 {
-		b.deleteMessages(chatID, ids)
-		b.lastIssuesMessages[chatID] = nil
+	var prevIDs []int
+	if b.loadState(ctx, stateLastIssuesMessages, chatID, &prevIDs) && len(prevIDs) > 0 {
+		b.deleteMessages(chatID, prevIDs)
 	}
 
-	var districtPtr, categoryPtr *string
-	filter, hasFilter := b.issuesFilter[chatID]
+	var sentIDs []int
+	defer func() { b.saveState(ctx, stateLastIssuesMessages, chatID, sentIDs) }()
+
+	f := IssueFilter{Statuses: statusStrings([]IssueStatus{StatusNew, StatusInProgress})}
+	var filter issuesFilterState
+	hasFilter := b.loadState(ctx, stateIssuesFilter, chatID, &filter)
 	if hasFilter {
 		if filter.District != "" {
 			d := filter.District
-			districtPtr = &d
+			f.District = &d
 		}
 		if filter.Category != "" {
 			c := filter.Category
-			categoryPtr = &c
+			f.Category = &c
 		}
 	}
 
-	statuses := []string{"Новая", "В обработке"}
 	offset := (page - 1) * issuesPageSize
 
-	list, err := b.DB.ListIssuesByStatusFilterPage(ctx, statuses, districtPtr, categoryPtr, issuesPageSize, offset)
+	var list []Issue
+	var err error
+	if p.NarrowFilter(&f) {
+		list, err = b.DB.ListIssues(ctx, f, issuesPageSize, offset)
+	}
 	if err != nil {
 		msg := tgbotapi.NewMessage(chatID, "Ошибка загрузки заявок: "+err.Error())
 		msg.ReplyMarkup = makeAdminPagingKeyboard()
 		sent, _ := b.API.Send(msg)
-		b.lastIssuesMessages[chatID] = append(b.lastIssuesMessages[chatID], sent.MessageID)
+		sentIDs = append(sentIDs, sent.MessageID)
 		return
 	}
 	if len(list) == 0 {
@@ -799,7 +898,7 @@ func (b *Bot) sendIssuesPage(ctx context.Context, chatID int64, page int) {
 		msg := tgbotapi.NewMessage(chatID, text)
 		msg.ReplyMarkup = makeAdminPagingKeyboard()
 		sent, _ := b.API.Send(msg)
-		b.lastIssuesMessages[chatID] = append(b.lastIssuesMessages[chatID], sent.MessageID)
+		sentIDs = append(sentIDs, sent.MessageID)
 		return
 	}
 
@@ -820,13 +919,13 @@ func (b *Bot) sendIssuesPage(ctx context.Context, chatID int64, page int) {
 	header := tgbotapi.NewMessage(chatID, headerText)
 	header.ReplyMarkup = makeAdminPagingKeyboard()
 	sentHeader, _ := b.API.Send(header)
-	b.lastIssuesMessages[chatID] = append(b.lastIssuesMessages[chatID], sentHeader.MessageID)
+	sentIDs = append(sentIDs, sentHeader.MessageID)
 
 	for i := range list {
 		iss := list[i]
 		ids := b.sendIssueToChat(ctx, chatID, &iss)
 		if len(ids) > 0 {
-			b.lastIssuesMessages[chatID] = append(b.lastIssuesMessages[chatID], ids...)
+			sentIDs = append(sentIDs, ids...)
 		}
 	}
 }
@@ -837,36 +936,34 @@ func (b *Bot) sendIssueAttachments(ctx context.Context, chatID int64, issueID in
 	if err != nil || len(atts) == 0 {
 		return nil
 	}
-	return b.sendAttachmentsList(chatID, atts)
+	return b.sendAttachmentsList(ctx, chatID, atts)
 }
 
 // sendAttachmentsList отправляет вложения и возвращает id созданных сообщений.
-func (b *Bot) sendAttachmentsList(chatID int64, atts []Attachment) []int {
+func (b *Bot) sendAttachmentsList(ctx context.Context, chatID int64, atts []Attachment) []int {
 	var ids []int
 
 	for _, a := range atts {
-		usePath := a.LocalPath != ""
+		file, err := b.attachmentFile(ctx, &a)
+		if err != nil {
+			log.Printf("вложение %d: %v", a.ID, err)
+			continue
+		}
 		var msg tgbotapi.Message
 
 		switch a.FileType {
 		case "photo":
-			if usePath {
-				msg, _ = b.API.Send(tgbotapi.NewPhoto(chatID, tgbotapi.FilePath(a.LocalPath)))
-			} else {
-				msg, _ = b.API.Send(tgbotapi.NewPhoto(chatID, tgbotapi.FileID(a.FileID)))
-			}
+			msg, _ = b.API.Send(tgbotapi.NewPhoto(chatID, file))
 		case "video":
-			if usePath {
-				msg, _ = b.API.Send(tgbotapi.NewVideo(chatID, tgbotapi.FilePath(a.LocalPath)))
-			} else {
-				msg, _ = b.API.Send(tgbotapi.NewVideo(chatID, tgbotapi.FileID(a.FileID)))
-			}
+			msg, _ = b.API.Send(tgbotapi.NewVideo(chatID, file))
+		case "voice":
+			msg, _ = b.API.Send(tgbotapi.NewVoice(chatID, file))
+		case "video_note":
+			msg, _ = b.API.Send(tgbotapi.NewVideoNote(chatID, 0, file))
+		case "audio":
+			msg, _ = b.API.Send(tgbotapi.NewAudio(chatID, file))
 		default:
-			if usePath {
-				msg, _ = b.API.Send(tgbotapi.NewDocument(chatID, tgbotapi.FilePath(a.LocalPath)))
-			} else {
-				msg, _ = b.API.Send(tgbotapi.NewDocument(chatID, tgbotapi.FileID(a.FileID)))
-			}
+			msg, _ = b.API.Send(tgbotapi.NewDocument(chatID, file))
 		}
 
 		if msg.MessageID != 0 {
@@ -924,153 +1021,103 @@ func (b *Bot) createIssueFromMessage(ctx context.Context, m *tgbotapi.Message) {
 		return
 	}
 
-	if len(m.Photo) > 0 {
-		ph := m.Photo[len(m.Photo)-1]
-		filename := fmt.Sprintf("issue_%d_photo_%d.jpg", iss.ID, time.Now().UnixNano())
-		localPath, err := b.saveTelegramFile(ph.FileID, filename)
-		if err != nil {
-			log.Printf("save photo failed: %v", err)
-		} else {
-			_ = b.DB.AddAttachment(ctx, &Attachment{
-				IssueID:   iss.ID,
-				FileID:    ph.FileID,
-				FileType:  "photo",
-				LocalPath: localPath,
-			})
-		}
-	}
-
-	if m.Video != nil {
-		ext := ".mp4"
-		if m.Video.FileName != "" {
-			if e := filepath.Ext(m.Video.FileName); e != "" {
-				ext = e
-			}
-		}
-		filename := fmt.Sprintf("issue_%d_video_%d%s", iss.ID, time.Now().UnixNano(), ext)
-		localPath, err := b.saveTelegramFile(m.Video.FileID, filename)
-		if err != nil {
-			log.Printf("save video failed: %v", err)
-		} else {
-			_ = b.DB.AddAttachment(ctx, &Attachment{
-				IssueID:   iss.ID,
-				FileID:    m.Video.FileID,
-				FileType:  "video",
-				LocalPath: localPath,
-			})
-		}
-	}
+	b.saveMessageAttachments(ctx, iss.ID, m)
 
-	if m.Document != nil {
-		filename := m.Document.FileName
-		if filename == "" {
-			filename = fmt.Sprintf("issue_%d_doc_%d", iss.ID, time.Now().UnixNano())
-		}
-		localPath, err := b.saveTelegramFile(m.Document.FileID, filename)
-		if err != nil {
-			log.Printf("save document failed: %v", err)
-		} else {
-			_ = b.DB.AddAttachment(ctx, &Attachment{
-				IssueID:   iss.ID,
-				FileID:    m.Document.FileID,
-				FileType:  "document",
-				LocalPath: localPath,
-			})
-		}
+	if err := b.sendToCitizen(ctx, m.Chat.ID, iss.ID, fmt.Sprintf("Заявка принята, номер %d\n", iss.ID)+b.trackingLine(iss)); err != nil {
+		log.Printf("send confirmation: %v", err)
 	}
-
-	b.reply(m.Chat.ID, fmt.Sprintf("Заявка принята, номер %d", iss.ID))
 	n := rand.Intn(2)
 	b.API.Send(Stickers[n+4])
-	if shouldExecuteQuarterly() {
-		b.notifyAdminsNewIssue(ctx)
-	}
 }
 
 // GetIssueByID возвращает заявку по id.
 func (db *DB) GetIssueByID(ctx context.Context, id int64) (*Issue, error) {
 	row := db.Pool.QueryRow(ctx, `
-		select id, user_id, chat_id, text, latitude, longitude,
-		       status, district, category, created_at, updated_at
+		select `+issueColumns+`
 		from issues
 		where id = $1
 	`, id)
 
 	var iss Issue
-	if err := row.Scan(
-		&iss.ID,
-		&iss.UserID,
-		&iss.ChatID,
-		&iss.Text,
-		&iss.Latitude,
-		&iss.Longitude,
-		&iss.Status,
-		&iss.District,
-		&iss.Category,
-		&iss.CreatedAt,
-		&iss.UpdatedAt,
-	); err != nil {
+	if err := scanIssue(row, &iss); err != nil {
 		return nil, err
 	}
 	return &iss, nil
 }
 
-var lastExecutionMinute = -1
+// AdminDigest — подписчик EventBus на issue.created: не чаще раза в четверть
+// часа присылает администраторам сводку по новым заявкам (см. quarterlyGate).
+func (b *Bot) AdminDigest() EventHandler { return adminDigest{b} }
 
-func shouldExecuteQuarterly() bool {
-	now := time.Now()
-	minute := now.Minute()
+type adminDigest struct{ bot *Bot }
 
-	if (minute == 0 || minute == 15 || minute == 30 || minute == 45) &&
-		minute != lastExecutionMinute {
-		lastExecutionMinute = minute
-		return true
-	}
-	if !(minute == 0 || minute == 15 || minute == 30 || minute == 45) {
-		lastExecutionMinute = -1
-	}
+func (d adminDigest) Name() string { return "admin_digest" }
 
-	return false
+func (d adminDigest) Handle(ctx context.Context, ev *DomainEvent) error {
+	if d.bot.adminDigest.shouldFire(time.Now()) {
+		d.bot.notifyAdminsNewIssue(ctx)
+	}
+	return nil
 }
 
+// notifyAdminsNewIssue присылает каждому сотруднику сводку по новым заявкам
+// из его области (та же проверка, что в Authorizer.StaffFor). Тем, у кого в
+// области за последние 15 минут новых заявок не было, сводка не приходит.
 func (b *Bot) notifyAdminsNewIssue(ctx context.Context) {
-	rows, err := b.DB.Pool.Query(ctx, `SELECT tg_user_id FROM users WHERE is_admin = true`)
+	staff, err := b.Auth.ListStaffPrincipals(ctx)
 	if err != nil {
+		log.Printf("сводка по новым заявкам: %v", err)
 		return
 	}
-	defer rows.Close()
 
-	var totalNew int
-	err = b.DB.Pool.QueryRow(ctx,
-		`SELECT COUNT(*) FROM issues WHERE status = 'Новая'`,
-	).Scan(&totalNew)
-	if err != nil {
-		return
+	type newIssues struct {
+		scope         Issue // район и служба группы
+		total, recent int
 	}
-
-	var recentNew int
 	since := time.Now().Add(-15 * time.Minute)
-	err = b.DB.Pool.QueryRow(ctx,
-		`SELECT COUNT(*) FROM issues WHERE status = 'Новая' AND created_at >= $1`,
-		since,
-	).Scan(&recentNew)
+	rows, err := b.DB.Pool.Query(ctx, `
+		SELECT district, department_id, COUNT(*), COUNT(*) FILTER (WHERE created_at >= $1)
+		FROM issues
+		WHERE status = 'Новая'
+		GROUP BY district, department_id
+	`, since)
 	if err != nil {
+		log.Printf("сводка по новым заявкам: %v", err)
 		return
 	}
-
-	text := fmt.Sprintf(
-		"Общее количество заявок со статусом \"Новая\": %d\n"+
-			"Количество новых заявок за последние 15 минут: %d",
-		totalNew, recentNew,
-	)
-
+	var groups []newIssues
 	for rows.Next() {
-		var adminTG int64
-		if err := rows.Scan(&adminTG); err != nil {
+		var g newIssues
+		if err := rows.Scan(&g.scope.District, &g.scope.DepartmentID, &g.total, &g.recent); err != nil {
+			rows.Close()
+			log.Printf("сводка по новым заявкам: %v", err)
+			return
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("сводка по новым заявкам: %v", err)
+		return
+	}
+
+	for _, p := range staff {
+		var totalNew, recentNew int
+		for _, g := range groups {
+			if p.CanIssue(PermViewIssues, &g.scope) {
+				totalNew += g.total
+				recentNew += g.recent
+			}
+		}
+		if recentNew == 0 {
 			continue
 		}
-		msg := tgbotapi.NewMessage(adminTG, text)
-		b.API.Send(msg)
+		text := fmt.Sprintf(
+			"Общее количество заявок со статусом \"Новая\": %d\n"+
+				"Количество новых заявок за последние 15 минут: %d",
+			totalNew, recentNew,
+		)
+		b.API.Send(tgbotapi.NewMessage(*p.TGUserID, text))
 	}
 }
 
@@ -1093,11 +1140,33 @@ func (b *Bot) sendIssueToChat(ctx context.Context, chatID int64, iss *Issue) []i
 	if iss.Latitude != nil && iss.Longitude != nil {
 		extra += fmt.Sprintf("\nКоординаты: %.6f, %.6f", *iss.Latitude, *iss.Longitude)
 	}
+	if iss.ContactPhone != nil {
+		extra += "\nТелефон: " + *iss.ContactPhone
+	}
+	if iss.CitizenID != nil {
+		extra += citizenCardLine(ctx, b.DB, *iss.CitizenID)
+	}
+	if iss.Priority != "" && IssuePriority(iss.Priority) != PriorityNormal {
+		extra += "\nПриоритет: " + IssuePriority(iss.Priority).Label()
+	}
+	department, assignee := b.DB.issueAssignmentLabels(ctx, iss)
+	if department != "" {
+		extra += "\nСлужба: " + department
+	}
+	if assignee != "" {
+		extra += "\nИсполнитель: " + assignee
+	}
 
-	var lastCommentText string
-	if comments, err := b.DB.ListCommentsByIssue(ctx, iss.ID); err == nil && len(comments) > 0 {
-		last := comments[len(comments)-1]
-		lastCommentText = last.Text
+	// последние ответ жителю и внутренняя заметка показываем раздельно
+	var lastPublic, lastInternal string
+	if comments, err := b.DB.ListCommentsByIssue(ctx, iss.ID, false); err == nil {
+		for _, c := range comments {
+			if c.Visibility == CommentPublic {
+				lastPublic = c.Text
+			} else {
+				lastInternal = c.Text
+			}
+		}
 	}
 
 	caption := fmt.Sprintf(
@@ -1107,20 +1176,14 @@ func (b *Bot) sendIssueToChat(ctx context.Context, chatID int64, iss *Issue) []i
 		extra,
 		trim(textBody, 200),
 	)
-	if lastCommentText != "" {
-		caption += "\n\nКомментарий администратора:\n" + lastCommentText
+	if lastPublic != "" {
+		caption += "\n\nОтвет жителю:\n" + trim(lastPublic, 300)
+	}
+	if lastInternal != "" {
+		caption += "\n\n🔒 Внутренняя заметка:\n" + trim(lastInternal, 300)
 	}
 
-	kb := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("В обработке", fmt.Sprintf("status:%d:%s", iss.ID, "В обработке")),
-			tgbotapi.NewInlineKeyboardButtonData("Завершено", fmt.Sprintf("status:%d:%s", iss.ID, "Завершено")),
-			tgbotapi.NewInlineKeyboardButtonData("Отклонено", fmt.Sprintf("status:%d:%s", iss.ID, "Отклонено")),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("💬 Комментарий", fmt.Sprintf("comment:%d", iss.ID)),
-		),
-	)
+	kb := b.issueKeyboard(iss)
 
 	atts, _ := b.DB.ListAttachmentsByIssue(ctx, iss.ID)
 
@@ -1136,24 +1199,16 @@ func (b *Bot) sendIssueToChat(ctx context.Context, chatID int64, iss *Issue) []i
 	}
 
 	if mainPhoto != nil {
-		var msg tgbotapi.Message
-		if mainPhoto.LocalPath != "" {
-			photo := tgbotapi.NewPhoto(chatID, tgbotapi.FilePath(mainPhoto.LocalPath))
-			photo.Caption = caption
-			photo.ReplyMarkup = kb
-			msg, _ = b.API.Send(photo)
-		} else {
-			photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(mainPhoto.FileID))
-			photo.Caption = caption
-			photo.ReplyMarkup = kb
-			msg, _ = b.API.Send(photo)
-		}
+		photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(mainPhoto.FileID))
+		photo.Caption = caption
+		photo.ReplyMarkup = kb
+		msg, _ := b.API.Send(photo)
 		if msg.MessageID != 0 {
 			ids = append(ids, msg.MessageID)
 		}
 
 		if len(rest) > 0 {
-			restIDs := b.sendAttachmentsList(chatID, rest)
+			restIDs := b.sendAttachmentsList(ctx, chatID, rest)
 			ids = append(ids, restIDs...)
 		}
 	} else {
@@ -1197,18 +1252,19 @@ func (b *Bot) handleCallback(ctx context.Context, cq *tgbotapi.CallbackQuery) {
 		if err != nil || page < 1 {
 			page = 1
 		}
-		if ok, _ := b.DB.IsAdmin(ctx, cq.From.ID); !ok {
+		p, ok := b.can(ctx, cq.From.ID, PermViewIssues)
+		if !ok {
 			b.answerCallback(cq, "Нет прав")
 			return
 		}
 		chatID := cq.Message.Chat.ID
-		b.sendIssuesPage(ctx, chatID, page)
+		b.sendIssuesPage(ctx, p, chatID, page)
 		b.answerCallback(cq, fmt.Sprintf("Страница %d", page))
 		return
 	}
 
 	if strings.HasPrefix(data, "if:d:") {
-		if ok, _ := b.DB.IsAdmin(ctx, cq.From.ID); !ok {
+		if _, ok := b.can(ctx, cq.From.ID, PermViewIssues); !ok {
 			b.answerCallback(cq, "Нет прав")
 			return
 		}
@@ -1216,18 +1272,11 @@ func (b *Bot) handleCallback(ctx context.Context, cq *tgbotapi.CallbackQuery) {
 		choice := strings.TrimPrefix(data, "if:d:")
 		chatID := cq.Message.Chat.ID
 
-		st := b.issuesFilter[chatID]
-		if st == nil {
-			st = &issuesFilterState{}
-		}
-
-		if choice == "ALL" {
-			st.District = ""
-		} else {
+		var st issuesFilterState
+		if choice != "ALL" {
 			st.District = choice
 		}
-		st.Category = ""
-		b.issuesFilter[chatID] = st
+		b.saveState(ctx, stateIssuesFilter, chatID, st)
 
 		var rows [][]tgbotapi.InlineKeyboardButton
 		for _, c := range categories {
@@ -1249,7 +1298,8 @@ func (b *Bot) handleCallback(ctx context.Context, cq *tgbotapi.CallbackQuery) {
 	}
 
 	if strings.HasPrefix(data, "if:c:") {
-		if ok, _ := b.DB.IsAdmin(ctx, cq.From.ID); !ok {
+		p, ok := b.can(ctx, cq.From.ID, PermViewIssues)
+		if !ok {
 			b.answerCallback(cq, "Нет прав")
 			return
 		}
@@ -1257,83 +1307,181 @@ func (b *Bot) handleCallback(ctx context.Context, cq *tgbotapi.CallbackQuery) {
 		choice := strings.TrimPrefix(data, "if:c:")
 		chatID := cq.Message.Chat.ID
 
-		st := b.issuesFilter[chatID]
-		if st == nil {
-			st = &issuesFilterState{}
-		}
-
+		var st issuesFilterState
+		b.loadState(ctx, stateIssuesFilter, chatID, &st)
 		if choice == "ALL" {
 			st.Category = ""
 		} else {
 			st.Category = choice
 		}
-		b.issuesFilter[chatID] = st
+		b.saveState(ctx, stateIssuesFilter, chatID, st)
 
-		b.sendIssuesPage(ctx, chatID, 1)
+		b.sendIssuesPage(ctx, p, chatID, 1)
 		b.answerCallback(cq, "Фильтр применён")
 		return
 	}
 
 	if strings.HasPrefix(data, "status:") {
+		// status:<id>:<статус>[:reopen]
 		parts := strings.Split(data, ":")
-		if len(parts) != 3 {
+		if len(parts) != 3 && len(parts) != 4 {
 			return
 		}
 		issueID, _ := strconv.ParseInt(parts[1], 10, 64)
-		newStatus := parts[2]
-		if ok, _ := b.DB.IsAdmin(ctx, cq.From.ID); !ok {
+		newStatus, err := ParseIssueStatus(parts[2])
+		if err != nil {
+			b.answerCallback(cq, "Неизвестный статус")
+			return
+		}
+		reopen := len(parts) == 4 && parts[3] == "reopen"
+		if !b.canIssue(ctx, cq.From.ID, PermChangeStatus, issueID) {
 			b.answerCallback(cq, "Нет прав")
 			return
 		}
-		if err := b.DB.SetIssueStatus(ctx, issueID, newStatus, &cq.From.ID, nil); err != nil {
-			log.Printf("SetIssueStatus error: %v", err)
-			b.answerCallback(cq, "Ошибка статуса")
+		if newStatus == StatusRejected {
+			b.saveState(ctx, statePendingReject, cq.From.ID, pendingStatusChange{IssueID: issueID, Reopen: reopen})
+			b.answerCallback(cq, "Укажите причину отклонения")
+			b.reply(cq.Message.Chat.ID, fmt.Sprintf("Напишите причину отклонения заявки #%d одним сообщением.", issueID))
+			return
+		}
+		if err := b.changeIssueStatus(ctx, StatusUpdate{
+			IssueID:     issueID,
+			Status:      string(newStatus),
+			ChangedByTG: &cq.From.ID,
+			Reopen:      reopen,
+		}); err != nil {
+			b.answerCallback(cq, statusErrorText(err))
 			return
 		}
 		b.answerCallback(cq, fmt.Sprintf("Статус #%d: %s", issueID, newStatus))
-		row := b.DB.Pool.QueryRow(ctx, `select chat_id from issues where id=$1`, issueID)
-		var userChat int64
-		if err := row.Scan(&userChat); err == nil {
-			b.reply(userChat, fmt.Sprintf("Статус вашей заявки #%d изменён на: %s", issueID, newStatus))
+		return
+	}
+
+	if strings.HasPrefix(data, "reply:") {
+		// житель хочет написать по своей заявке; принадлежность проверим при получении сообщения
+		issueID, err := strconv.ParseInt(strings.TrimPrefix(data, "reply:"), 10, 64)
+		if err != nil {
+			return
 		}
+		b.saveState(ctx, statePendingReply, cq.From.ID, issueID)
+		b.answerCallback(cq, fmt.Sprintf("Напишите сообщение по заявке #%d", issueID))
+		return
+	}
+
+	if strings.HasPrefix(data, "thread:") {
+		issueID, err := strconv.ParseInt(strings.TrimPrefix(data, "thread:"), 10, 64)
+		if err != nil {
+			return
+		}
+		if !b.canIssue(ctx, cq.From.ID, PermViewIssues, issueID) {
+			b.answerCallback(cq, "Нет прав")
+			return
+		}
+		b.answerCallback(cq, "")
+		b.sendIssueThread(ctx, cq.Message.Chat.ID, issueID)
+		return
+	}
+
+	if strings.HasPrefix(data, "assign:") {
+		b.handleAssignCallback(ctx, cq)
 		return
 	}
 
 	if strings.HasPrefix(data, "comment:") {
+		// comment:<id>:<internal|public>; у старых кнопок без видимости — заметка
 		parts := strings.Split(data, ":")
-		if len(parts) != 2 {
+		if len(parts) != 2 && len(parts) != 3 {
 			return
 		}
 		issueID, _ := strconv.ParseInt(parts[1], 10, 64)
-		if ok, _ := b.DB.IsAdmin(ctx, cq.From.ID); !ok {
+		visibility := CommentInternal
+		if len(parts) == 3 && parts[2] == CommentPublic {
+			visibility = CommentPublic
+		}
+		if !b.canIssue(ctx, cq.From.ID, PermComment, issueID) {
 			b.answerCallback(cq, "Нет прав")
 			return
 		}
-		b.pendingComments[cq.From.ID] = issueID
-		b.answerCallback(cq, fmt.Sprintf("Напишите комментарий к заявке #%d", issueID))
+		b.saveState(ctx, statePendingComment, cq.From.ID, pendingComment{IssueID: issueID, Visibility: visibility})
+		if visibility == CommentPublic {
+			b.answerCallback(cq, fmt.Sprintf("Напишите ответ жителю по заявке #%d", issueID))
+		} else {
+			b.answerCallback(cq, fmt.Sprintf("Напишите внутреннюю заметку к заявке #%d — житель её не увидит", issueID))
+		}
 		return
 	}
 
 	if strings.HasPrefix(data, "broadcast:") {
+		if _, ok := b.can(ctx, cq.From.ID, PermBroadcast); !ok {
+			b.answerCallback(cq, "Нет прав")
+			return
+		}
 		if strings.HasSuffix(data, "confirm") {
-			text, ok := b.pendingBroadcast[cq.From.ID]
-			if !ok {
+			var text string
+			if !b.loadState(ctx, statePendingBroadcast, cq.From.ID, &text) {
 				b.answerCallback(cq, "Нет черновика")
 				return
 			}
 			go b.sendBroadcast(ctx, cq.From.ID, text)
-			delete(b.pendingBroadcast, cq.From.ID)
+			b.clearState(ctx, statePendingBroadcast, cq.From.ID)
 			b.answerCallback(cq, "Рассылка запущена")
 			return
 		}
 		if strings.HasSuffix(data, "cancel") {
-			delete(b.pendingBroadcast, cq.From.ID)
+			b.clearState(ctx, statePendingBroadcast, cq.From.ID)
 			b.answerCallback(cq, "Отменено")
 			return
 		}
 	}
 }
 
+// changeIssueStatus меняет статус заявки; автор узнает об этом по событию
+// issue.status_changed (см. Notifications).
+func (b *Bot) changeIssueStatus(ctx context.Context, upd StatusUpdate) error {
+	_, err := b.DB.SetIssueStatus(ctx, upd)
+	return err
+}
+
+// statusErrorText — текст ошибки смены статуса для администратора.
+func statusErrorText(err error) string {
+	if errors.Is(err, ErrIssueNotFound) || errors.Is(err, ErrVersionConflict) || IsStatusValidationError(err) {
+		return err.Error()
+	}
+	log.Printf("SetIssueStatus error: %v", err)
+	return "Ошибка статуса"
+}
+
+// issueKeyboard — кнопки смены статуса (только разрешённые переходы), ответа жителю,
+// внутренней заметки, переписки и назначения.
+func (b *Bot) issueKeyboard(iss *Issue) tgbotapi.InlineKeyboardMarkup {
+	current := IssueStatus(iss.Status)
+
+	var statusRow []tgbotapi.InlineKeyboardButton
+	for _, next := range b.DB.Statuses.Next(current) {
+		label := string(next)
+		data := fmt.Sprintf("status:%d:%s", iss.ID, next)
+		if current.IsFinal() {
+			label = "🔄 " + label
+			data += ":reopen"
+		}
+		statusRow = append(statusRow, tgbotapi.NewInlineKeyboardButtonData(label, data))
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	if len(statusRow) > 0 {
+		rows = append(rows, statusRow)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("✉️ Ответить жителю", fmt.Sprintf("comment:%d:%s", iss.ID, CommentPublic)),
+		tgbotapi.NewInlineKeyboardButtonData("🔒 Заметка", fmt.Sprintf("comment:%d:%s", iss.ID, CommentInternal)),
+	))
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🧵 Переписка", fmt.Sprintf("thread:%d", iss.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("👤 Назначить", fmt.Sprintf("assign:%d", iss.ID)),
+	))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
 func (b *Bot) sendBroadcast(ctx context.Context, adminTG int64, text string) {
 	ids, err := b.DB.ListAllChatIDs(ctx)
 	if err != nil {
@@ -1366,6 +1514,14 @@ func strPtrEmptyToNil(s string) *string {
 	return &s
 }
 
+// derefString — значение s или "", если s == nil.
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 func trim(s string, n int) string {
 	r := []rune(s)
 	if len(r) <= n {
@@ -1374,47 +1530,22 @@ func trim(s string, n int) string {
 	return string(r[:n]) + "…"
 }
 
-// saveTelegramFile скачивает файл по file_id и сохраняет его в папку uploads
-// Возвращает относительный путь
-func (b *Bot) saveTelegramFile(fileID string, suggestedName string) (string, error) {
-	cfg := tgbotapi.FileConfig{FileID: fileID}
-	tgFile, err := b.API.GetFile(cfg)
-	if err != nil {
-		return "", err
+// attachmentFile — чем отправить вложение в Telegram. Файлы из Telegram
+// пересылаются по file_id, файлы с сайта выгружаются из хранилища.
+func (b *Bot) attachmentFile(ctx context.Context, a *Attachment) (tgbotapi.RequestFileData, error) {
+	if !strings.Contains(a.FileType, "/") && a.FileID != "" {
+		return tgbotapi.FileID(a.FileID), nil
 	}
-
-	url := tgFile.Link(b.API.Token)
-
-	resp, err := http.Get(url)
+	rc, err := OpenAttachment(ctx, b.Blobs, b.Cfg.LegacyDir, a)
 	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if err := os.MkdirAll("uploads", 0755); err != nil {
-		return "", err
-	}
-
-	if suggestedName == "" {
-		suggestedName = filepath.Base(tgFile.FilePath)
-		if suggestedName == "" {
-			suggestedName = fmt.Sprintf("%d.bin", time.Now().UnixNano())
-		}
+		return nil, err
 	}
-
-	path := filepath.Join("uploads", suggestedName)
-
-	out, err := os.Create(path)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
 	if err != nil {
-		return "", err
-	}
-	defer out.Close()
-
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		return "", err
+		return nil, err
 	}
-
-	return path, nil
+	return tgbotapi.FileBytes{Name: a.FileID, Bytes: data}, nil
 }
 
 func makeDistrictKeyboard() tgbotapi.ReplyKeyboardMarkup {
@@ -1471,6 +1602,43 @@ func makeAdminPagingKeyboard() tgbotapi.ReplyKeyboardMarkup {
 	)
 }
 
+// attachContactPhone записывает телефон из присланного контакта в последнюю
+// заявку жителя, как геопозицию: контакт нельзя отправить вместе с текстом.
+// Собственный контакт жителя (Telegram подтверждает, что номер его) ещё и
+// запоминается: по нему привязываются заявки с сайта (см. RequestCitizenLink).
+func (b *Bot) attachContactPhone(ctx context.Context, m *tgbotapi.Message, u *User) {
+	phone := strings.TrimSpace(m.Contact.PhoneNumber)
+	if u == nil || phone == "" {
+		b.reply(m.Chat.ID, "Не удалось прочитать номер телефона из контакта.")
+		return
+	}
+
+	verified := false
+	if m.From != nil && m.Contact.UserID == m.From.ID {
+		if p, ok := normalizePhone(phone); ok {
+			if err := b.DB.SetUserVerifiedPhone(ctx, u.ID, p); err != nil {
+				log.Printf("подтверждение телефона пользователя %d: %v", u.ID, err)
+			} else {
+				verified = true
+			}
+		}
+	}
+
+	iss, err := b.DB.SetLastIssueContactPhone(ctx, u.ID, phone)
+	if err != nil {
+		b.reply(m.Chat.ID, "Не удалось сохранить телефон: "+err.Error())
+		return
+	}
+	switch {
+	case iss != nil:
+		b.reply(m.Chat.ID, fmt.Sprintf("Телефон %s добавлен к заявке #%d", phone, iss.ID))
+	case verified:
+		b.reply(m.Chat.ID, "Номер подтверждён. Теперь заявки с сайта с этим номером можно привязать к Telegram: на странице заявки нажмите «Привязать Telegram».")
+	default:
+		b.reply(m.Chat.ID, "Не нашёл недавнее обращение. Сначала отправьте описание проблемы, потом контакт.")
+	}
+}
+
 // hasIssueContent проверяет есть ли в сообщении содержимое для заявки
 // текст, подпись к медиа или сами медиа. Геопозиция сюда НЕ входит.
 func hasIssueContent(m *tgbotapi.Message) bool {
@@ -1483,7 +1651,7 @@ func hasIssueContent(m *tgbotapi.Message) bool {
 	if len(m.Photo) > 0 {
 		return true
 	}
-	if m.Document != nil || m.Video != nil || m.Audio != nil || m.Voice != nil || m.Animation != nil {
+	if m.Document != nil || m.Video != nil || m.Audio != nil || m.Voice != nil || m.VideoNote != nil || m.Animation != nil {
 		return true
 	}
 	return false
@@ -0,0 +1,456 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/mail"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrInvalidContact     = errors.New("укажите телефон или e-mail для связи")
+	ErrCitizenNotFound    = errors.New("житель не найден")
+	ErrNoVerifiedTelegram = errors.New("нет Telegram с подтверждённым номером: отправьте боту /link и поделитесь своим контактом")
+	ErrInvalidLinkCode    = errors.New("неверный или просроченный код")
+	ErrLinkCodeTooSoon    = errors.New("код уже отправлен, новый можно запросить через минуту")
+	ErrEmailConfirmSent   = errors.New("письмо-подтверждение уже отправлено")
+	ErrInvalidEmailToken  = errors.New("ссылка недействительна или устарела")
+)
+
+const (
+	citizenLinkCodeTTL      = 10 * time.Minute
+	citizenLinkCodeAttempts = 5
+	citizenLinkCodeInterval = time.Minute // не чаще одного кода в минуту, чтобы не заваливать бота
+
+	citizenEmailTokenTTL      = 7 * 24 * time.Hour
+	citizenEmailConfirmPeriod = 24 * time.Hour // не чаще одного письма-подтверждения в сутки на адрес
+)
+
+// citizenColumns — столбцы citizens (c) и привязанного пользователя (u)
+// в порядке, который ожидает scanCitizen.
+const citizenColumns = `c.id, c.name, c.phone, c.email, c.email_verified_at, c.user_id, u.tg_user_id, c.linked_at, c.created_at, c.updated_at`
+
+func scanCitizen(row pgx.Row, c *Citizen) error {
+	return row.Scan(&c.ID, &c.Name, &c.Phone, &c.Email, &c.EmailVerifiedAt, &c.UserID, &c.TGUserID, &c.LinkedAt, &c.CreatedAt, &c.UpdatedAt)
+}
+
+// normalizePhone приводит номер к виду +<цифры>. Российские номера
+// принимаются и в привычных записях: 8 900…, 900…, 7 900….
+func normalizePhone(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	plus := strings.HasPrefix(s, "+")
+	var digits strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' || r == ' ' || r == '-' || r == '(' || r == ')':
+		default:
+			return "", false
+		}
+	}
+	d := digits.String()
+	switch {
+	case !plus && len(d) == 11 && (d[0] == '8' || d[0] == '7'):
+		d = "7" + d[1:]
+	case !plus && len(d) == 10 && d[0] == '9':
+		d = "7" + d
+	case !plus:
+		return "", false
+	}
+	if len(d) < 10 || len(d) > 15 || d[0] == '0' {
+		return "", false
+	}
+	return "+" + d, true
+}
+
+// normalizeEmail проверяет адрес и приводит его к нижнему регистру.
+func normalizeEmail(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s || !strings.Contains(s[strings.LastIndex(s, "@"):], ".") {
+		return "", false
+	}
+	return strings.ToLower(s), true
+}
+
+// parseContact разбирает контакт из веб-формы: это телефон или e-mail.
+func parseContact(contact string) (phone, email *string, err error) {
+	contact = strings.TrimSpace(contact)
+	if strings.Contains(contact, "@") {
+		if e, ok := normalizeEmail(contact); ok {
+			return nil, &e, nil
+		}
+		return nil, nil, ErrInvalidContact
+	}
+	if p, ok := normalizePhone(contact); ok {
+		return &p, nil, nil
+	}
+	return nil, nil, ErrInvalidContact
+}
+
+// UpsertCitizen находит жителя по телефону (а без него — по e-mail) или заводит
+// нового. Контакт из веб-формы никто не подтверждал, поэтому имя существующего
+// профиля не перезаписывается — только заполняется, если его не было.
+func (db *DB) UpsertCitizen(ctx context.Context, name, phone, email *string) (*Citizen, error) {
+	if phone == nil && email == nil {
+		return nil, ErrInvalidContact
+	}
+	conflict := "phone"
+	if phone == nil {
+		conflict = "email"
+	}
+	row := db.Pool.QueryRow(ctx, `
+		with c as (
+			insert into citizens (name, phone, email)
+			values ($1, $2, $3)
+			on conflict (`+conflict+`) do update set
+				name = coalesce(citizens.name, excluded.name),
+				updated_at = now()
+			returning *
+		)
+		select `+citizenColumns+`
+		from c left join users u on u.id = c.user_id
+	`, name, phone, email)
+
+	var c Citizen
+	if err := scanCitizen(row, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (db *DB) GetCitizen(ctx context.Context, id int64) (*Citizen, error) {
+	row := db.Pool.QueryRow(ctx, `
+		select `+citizenColumns+`
+		from citizens c left join users u on u.id = c.user_id
+		where c.id = $1
+	`, id)
+
+	var c Citizen
+	if err := scanCitizen(row, &c); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrCitizenNotFound
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ListCitizenIssues — заявки жителя, новые сверху.
+func (db *DB) ListCitizenIssues(ctx context.Context, citizenID int64, limit int) ([]Issue, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select `+issueColumns+`
+		from issues where citizen_id = $1 order by created_at desc limit $2
+	`, citizenID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Issue
+	for rows.Next() {
+		var iss Issue
+		if err := scanIssue(rows, &iss); err != nil {
+			return nil, err
+		}
+		res = append(res, iss)
+	}
+	return res, rows.Err()
+}
+
+// SetUserVerifiedPhone запоминает номер, который пользователь Telegram
+// подтвердил, поделившись собственным контактом.
+func (db *DB) SetUserVerifiedPhone(ctx context.Context, userID int64, phone string) error {
+	_, err := db.Pool.Exec(ctx, `
+		update users set phone = $2, phone_verified_at = now() where id = $1
+	`, userID, phone)
+	return err
+}
+
+// VerifiedUserByPhone — пользователь Telegram, последним подтвердивший номер phone.
+func (db *DB) VerifiedUserByPhone(ctx context.Context, phone string) (userID, tgUserID int64, err error) {
+	err = db.Pool.QueryRow(ctx, `
+		select id, tg_user_id from users
+		where phone = $1 and phone_verified_at is not null
+		order by phone_verified_at desc
+		limit 1
+	`, phone).Scan(&userID, &tgUserID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, ErrNoVerifiedTelegram
+	}
+	return userID, tgUserID, err
+}
+
+// CreateCitizenLinkCode выпускает код привязки Telegram userID к жителю.
+// Прежние неиспользованные коды жителя гасятся. Код в открытом виде
+// возвращается один раз — его отправляет бот.
+func (db *DB) CreateCitizenLinkCode(ctx context.Context, citizenID, userID int64) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// блокируем жителя, чтобы параллельные запросы не обошли ограничение частоты
+	if _, err := tx.Exec(ctx, `select 1 from citizens where id = $1 for update`, citizenID); err != nil {
+		return "", err
+	}
+	var recent bool
+	if err := tx.QueryRow(ctx, `
+		select exists(
+			select 1 from citizen_link_codes
+			where citizen_id = $1 and created_at > now() - make_interval(secs => $2)
+		)
+	`, citizenID, citizenLinkCodeInterval.Seconds()).Scan(&recent); err != nil {
+		return "", err
+	}
+	if recent {
+		return "", ErrLinkCodeTooSoon
+	}
+
+	if _, err := tx.Exec(ctx, `
+		update citizen_link_codes set used_at = now()
+		where citizen_id = $1 and used_at is null
+	`, citizenID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, `
+		insert into citizen_link_codes (citizen_id, user_id, code_hash, expires_at)
+		values ($1, $2, $3, $4)
+	`, citizenID, userID, citizenLinkCodeHash(citizenID, code), time.Now().Add(citizenLinkCodeTTL)); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// citizenLinkCodeHash — хэш кода вместе с жителем, чтобы одинаковые
+// коды разных жителей не совпадали в таблице.
+func citizenLinkCodeHash(citizenID int64, code string) string {
+	return hashSessionToken(fmt.Sprintf("%d:%s", citizenID, code))
+}
+
+// ConfirmCitizenLink проверяет код и привязывает Telegram, которому он был
+// отправлен, к жителю и к заявке issueID: она переходит к этому пользователю,
+// и уведомления по ней приходят в бот. Другие заявки жителя не трогаются —
+// их мог подать кто угодно, указав чужой контакт; каждую привязывает тот,
+// у кого есть её токен. Возвращает жителя и число перенесённых заявок.
+// После citizenLinkCodeAttempts неверных попыток код гасится.
+func (db *DB) ConfirmCitizenLink(ctx context.Context, citizenID, issueID int64, code string) (*Citizen, int64, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var codeID, userID int64
+	var hash string
+	var attempts int
+	err = tx.QueryRow(ctx, `
+		select id, user_id, code_hash, attempts
+		from citizen_link_codes
+		where citizen_id = $1 and used_at is null and expires_at > now()
+		order by created_at desc
+		limit 1
+		for update
+	`, citizenID).Scan(&codeID, &userID, &hash, &attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, 0, ErrInvalidLinkCode
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(citizenLinkCodeHash(citizenID, strings.TrimSpace(code)))) != 1 {
+		if _, err := tx.Exec(ctx, `
+			update citizen_link_codes
+			set attempts = attempts + 1,
+			    used_at = case when attempts + 1 >= $2 then now() end
+			where id = $1
+		`, codeID, citizenLinkCodeAttempts); err != nil {
+			return nil, 0, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, ErrInvalidLinkCode
+	}
+
+	if _, err := tx.Exec(ctx, `update citizen_link_codes set used_at = now() where id = $1`, codeID); err != nil {
+		return nil, 0, err
+	}
+	// один Telegram — один житель: прежняя привязка переходит к новому профилю
+	if _, err := tx.Exec(ctx, `
+		update citizens set user_id = null, linked_at = null, updated_at = now()
+		where user_id = $2 and id <> $1
+	`, citizenID, userID); err != nil {
+		return nil, 0, err
+	}
+	if _, err := tx.Exec(ctx, `
+		update citizens set user_id = $2, linked_at = now(), updated_at = now()
+		where id = $1
+	`, citizenID, userID); err != nil {
+		return nil, 0, err
+	}
+	// личный чат с ботом: туда уходят уведомления по заявкам
+	if _, err := tx.Exec(ctx, `
+		insert into chats (chat_id, type)
+		select tg_user_id, 'private' from users where id = $1
+		on conflict do nothing
+	`, userID); err != nil {
+		return nil, 0, err
+	}
+	cmd, err := tx.Exec(ctx, `
+		update issues
+		set user_id = u.id, chat_id = u.tg_user_id, updated_at = now(), version = version + 1
+		from users u
+		where u.id = $2 and issues.citizen_id = $1 and issues.id = $3
+	`, citizenID, userID, issueID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var c Citizen
+	if err := scanCitizen(tx.QueryRow(ctx, `
+		select `+citizenColumns+`
+		from citizens c left join users u on u.id = c.user_id
+		where c.id = $1
+	`, citizenID), &c); err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, 0, err
+	}
+	return &c, cmd.RowsAffected(), nil
+}
+
+// CreateEmailConfirmation выпускает токен для ссылки подтверждения e-mail
+// жителя. Если адрес уже подтверждён или письмо отправлялось меньше
+// citizenEmailConfirmPeriod назад, возвращает ErrEmailConfirmSent: форма
+// на сайте не должна превращаться в способ слать письма на чужие адреса.
+// Токен в открытом виде возвращается один раз, в базе только sha256.
+func (db *DB) CreateEmailConfirmation(ctx context.Context, citizenID int64) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	cmd, err := db.Pool.Exec(ctx, `
+		update citizens
+		set email_token_hash = $2, email_token_sent_at = now()
+		where id = $1 and email is not null and email_verified_at is null
+		  and (email_token_sent_at is null or email_token_sent_at < now() - make_interval(secs => $3))
+	`, citizenID, hashSessionToken(token), citizenEmailConfirmPeriod.Seconds())
+	if err != nil {
+		return "", err
+	}
+	if cmd.RowsAffected() == 0 {
+		return "", ErrEmailConfirmSent
+	}
+	return token, nil
+}
+
+// CancelEmailConfirmation отзывает токен, письмо с которым не ушло,
+// чтобы при повторе события письмо можно было отправить снова.
+func (db *DB) CancelEmailConfirmation(ctx context.Context, citizenID int64, token string) error {
+	_, err := db.Pool.Exec(ctx, `
+		update citizens set email_token_hash = null, email_token_sent_at = null
+		where id = $1 and email_token_hash = $2
+	`, citizenID, hashSessionToken(token))
+	return err
+}
+
+// ConfirmCitizenEmail отмечает e-mail жителя подтверждённым по токену из письма.
+func (db *DB) ConfirmCitizenEmail(ctx context.Context, token string) error {
+	cmd, err := db.Pool.Exec(ctx, `
+		update citizens
+		set email_verified_at = now(), email_token_hash = null, updated_at = now()
+		where email_token_hash = $1 and email_token_sent_at > now() - make_interval(secs => $2)
+	`, hashSessionToken(token), citizenEmailTokenTTL.Seconds())
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrInvalidEmailToken
+	}
+	return nil
+}
+
+// citizenCardLine — строка о жителе для карточки заявки в боте.
+func citizenCardLine(ctx context.Context, db *DB, citizenID int64) string {
+	c, err := db.GetCitizen(ctx, citizenID)
+	if err != nil {
+		log.Printf("житель %d: %v", citizenID, err)
+		return ""
+	}
+	var parts []string
+	for _, s := range []*string{c.Name, c.Phone, c.Email} {
+		if s != nil {
+			parts = append(parts, *s)
+		}
+	}
+	line := "\nЖитель: " + strings.Join(parts, ", ")
+	if c.UserID != nil {
+		line += " (Telegram привязан)"
+	}
+	return line
+}
+
+// RequestCitizenLink отправляет в Telegram с подтверждённым номером жителя
+// код для привязки. Привязать можно только по телефону: e-mail Telegram не подтверждает.
+func (b *Bot) RequestCitizenLink(ctx context.Context, citizenID int64) error {
+	c, err := b.DB.GetCitizen(ctx, citizenID)
+	if err != nil {
+		return err
+	}
+	if c.Phone == nil {
+		return ErrNoVerifiedTelegram
+	}
+	userID, tgUserID, err := b.DB.VerifiedUserByPhone(ctx, *c.Phone)
+	if err != nil {
+		return err
+	}
+	code, err := b.DB.CreateCitizenLinkCode(ctx, c.ID, userID)
+	if err != nil {
+		return err
+	}
+	msg := tgbotapi.NewMessage(tgUserID, fmt.Sprintf(
+		"Код для привязки заявок с сайта к этому Telegram: %s\nОн действует %d минут. Если вы его не запрашивали, просто не вводите его.",
+		code, int(citizenLinkCodeTTL.Minutes())))
+	if _, err := b.API.Send(msg); err != nil {
+		return fmt.Errorf("отправка кода в Telegram: %w", err)
+	}
+	return nil
+}
+
+// handleLinkCommand просит жителя поделиться своим контактом: так Telegram
+// подтверждает номер, по которому потом привязываются заявки с сайта.
+func (b *Bot) handleLinkCommand(m *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(m.Chat.ID,
+		"Чтобы получать в боте уведомления по заявкам с сайта, поделитесь своим номером телефона кнопкой ниже. "+
+			"Затем на странице заявки нажмите «Привязать Telegram» и введите код, который пришлёт бот.")
+	kb := tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButtonContact("📱 Поделиться номером")),
+	)
+	kb.ResizeKeyboard = true
+	kb.OneTimeKeyboard = true
+	msg.ReplyMarkup = kb
+	b.API.Send(msg)
+}
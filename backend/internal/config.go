@@ -4,36 +4,85 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
 	TelegramToken string
-	AdminSecret   string
 	DatabaseURL   string
 	Port          string
 	UseWebhook    bool
 	PublicBaseURL string
 	WebhookPath   string
-	APIToken      string
+	StateTTL      time.Duration // время жизни состояния диалогов бота
+	BotWorkers    int           // число воркеров обработки апдейтов
+	BotQueueSize  int           // размер очереди апдейтов на воркер
+	AlbumWindow   time.Duration // сколько ждать следующего сообщения альбома
+
+	StatusTransitions string        // граф переходов статусов, см. ParseStatusTransitions
+	SLACheckInterval  time.Duration // как часто искать заявки с нарушенным SLA
+	AdminSessionTTL   time.Duration // время жизни сессии веб-админки
+	StaffInviteTTL    time.Duration // срок действия приглашения сотрудника
+	TrustedProxies    []string      // адреса/сети прокси, которым верим X-Forwarded-For
+	FileURLSecret     string        // ключ подписи ссылок на вложения
+	FileURLTTL        time.Duration // срок действия подписанной ссылки
+	Uploads           UploadPolicy  // ограничения на загрузку файлов с сайта
+
+	// скачивание файлов из Telegram, см. MediaFetcher
+	MediaMaxFileSize   int64
+	MediaFetchTimeout  time.Duration
+	MediaMaxAttempts   int
+	MediaFetchInterval time.Duration
+
+	// хранилище вложений, см. NewBlobStore
+	BlobStore   string // local или s3
+	BlobDir     string // каталог для local
+	LegacyDir   string // от него считается local_path вложений, сохранённых до BlobStore
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// отправка уведомлений по e-mail, см. SMTPNotifier; пустой SMTPAddr — выключена
+	SMTPAddr     string // host:port
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	SMTPTimeout  time.Duration
+
+	// раздача доменных событий из outbox, см. EventBus
+	OutboxMaxAttempts int
+	OutboxInterval    time.Duration
+
+	// исходящие webhooks, см. WebhookSender
+	WebhookTimeout     time.Duration
+	WebhookMaxAttempts int
+	WebhookInterval    time.Duration
 }
 
+// defaultUploadTypes — что по умолчанию можно прикрепить к заявке с сайта.
+const defaultUploadTypes = "image/jpeg,image/png,image/gif,image/webp,video/mp4,video/webm,application/pdf"
+
 func LoadConfig() *Config {
 	_ = godotenv.Load()
 
 	cfg := &Config{
 		TelegramToken: os.Getenv("TELEGRAM_TOKEN"),
-		AdminSecret:   os.Getenv("ADMIN_SECRET"),
 		DatabaseURL:   os.Getenv("DATABASE_URL"),
 		Port:          getenvDefault("PORT", "8080"),
 		PublicBaseURL: os.Getenv("PUBLIC_BASE_URL"),
 		WebhookPath:   getenvDefault("WEBHOOK_PATH", "/webhook/telegram"),
-		APIToken:      getenvDefault("API_TOKEN", os.Getenv("ADMIN_SECRET")),
+
+		StatusTransitions: os.Getenv("STATUS_TRANSITIONS"),
+		FileURLSecret:     os.Getenv("FILE_URL_SECRET"),
 	}
 
-	if cfg.TelegramToken == "" || cfg.AdminSecret == "" || cfg.DatabaseURL == "" {
-		log.Fatal("TELEGRAM_TOKEN, ADMIN_SECRET, DATABASE_URL must be set")
+	if cfg.TelegramToken == "" || cfg.DatabaseURL == "" {
+		log.Fatal("TELEGRAM_TOKEN, DATABASE_URL must be set")
 	}
 
 	if v := os.Getenv("USE_WEBHOOK"); v != "" {
@@ -43,9 +92,73 @@ func LoadConfig() *Config {
 		}
 	}
 
+	cfg.StateTTL = getenvDuration("STATE_TTL", 72*time.Hour)
+	cfg.BotWorkers = getenvInt("BOT_WORKERS", 8)
+	cfg.BotQueueSize = getenvInt("BOT_QUEUE_SIZE", 100)
+	cfg.AlbumWindow = getenvDuration("ALBUM_WINDOW", 2*time.Second)
+	cfg.SLACheckInterval = getenvDuration("SLA_CHECK_INTERVAL", time.Minute)
+	cfg.AdminSessionTTL = getenvDuration("ADMIN_SESSION_TTL", 12*time.Hour)
+	cfg.StaffInviteTTL = getenvDuration("STAFF_INVITE_TTL", 72*time.Hour)
+	cfg.FileURLTTL = getenvDuration("FILE_URL_TTL", 15*time.Minute)
+	cfg.Uploads = UploadPolicy{
+		MaxFileSize:  int64(getenvInt("UPLOAD_MAX_FILE_MB", 20)) << 20,
+		MaxFiles:     getenvInt("UPLOAD_MAX_FILES", 10),
+		AllowedTypes: splitList(getenvDefault("UPLOAD_ALLOWED_TYPES", defaultUploadTypes)),
+	}
+
+	// Bot API отдаёт ботам файлы не больше 20 МБ
+	cfg.MediaMaxFileSize = int64(getenvInt("MEDIA_MAX_FILE_MB", 20)) << 20
+	cfg.MediaFetchTimeout = getenvDuration("MEDIA_FETCH_TIMEOUT", 2*time.Minute)
+	cfg.MediaMaxAttempts = getenvInt("MEDIA_MAX_ATTEMPTS", 8)
+	cfg.MediaFetchInterval = getenvDuration("MEDIA_FETCH_INTERVAL", 30*time.Second)
+
+	cfg.TrustedProxies = splitList(os.Getenv("TRUSTED_PROXIES"))
+	loadBlobConfig(cfg)
+
+	cfg.SMTPAddr = os.Getenv("SMTP_ADDR")
+	cfg.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	cfg.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	cfg.SMTPFrom = os.Getenv("SMTP_FROM")
+	cfg.SMTPTimeout = getenvDuration("SMTP_TIMEOUT", 10*time.Second)
+	if cfg.SMTPAddr != "" && cfg.SMTPFrom == "" {
+		log.Fatal("SMTP_FROM must be set together with SMTP_ADDR")
+	}
+
+	cfg.OutboxMaxAttempts = getenvInt("OUTBOX_MAX_ATTEMPTS", 10)
+	cfg.OutboxInterval = getenvDuration("OUTBOX_POLL_INTERVAL", 10*time.Second)
+
+	cfg.WebhookTimeout = getenvDuration("WEBHOOK_DELIVERY_TIMEOUT", 10*time.Second)
+	cfg.WebhookMaxAttempts = getenvInt("WEBHOOK_MAX_ATTEMPTS", 10)
+	cfg.WebhookInterval = getenvDuration("WEBHOOK_POLL_INTERVAL", 5*time.Second)
+
+	return cfg
+}
+
+// LoadDatabaseConfig загружает только то, что нужно для работы с БД
+// (например, для команд migrate и admin), не требуя токенов бота.
+func LoadDatabaseConfig() *Config {
+	_ = godotenv.Load()
+
+	cfg := &Config{DatabaseURL: os.Getenv("DATABASE_URL")}
+	if cfg.DatabaseURL == "" {
+		log.Fatal("DATABASE_URL must be set")
+	}
+	cfg.StaffInviteTTL = getenvDuration("STAFF_INVITE_TTL", 72*time.Hour)
+	loadBlobConfig(cfg)
 	return cfg
 }
 
+func loadBlobConfig(cfg *Config) {
+	cfg.BlobStore = getenvDefault("BLOB_STORE", "local")
+	cfg.BlobDir = getenvDefault("BLOB_DIR", "blobs")
+	cfg.LegacyDir = getenvDefault("LEGACY_FILES_DIR", ".")
+	cfg.S3Endpoint = os.Getenv("S3_ENDPOINT")
+	cfg.S3Region = os.Getenv("S3_REGION")
+	cfg.S3Bucket = os.Getenv("S3_BUCKET")
+	cfg.S3AccessKey = os.Getenv("S3_ACCESS_KEY")
+	cfg.S3SecretKey = os.Getenv("S3_SECRET_KEY")
+}
+
 func getenvDefault(key, def string) string {
 	v := os.Getenv(key)
 	if v == "" {
@@ -53,3 +166,40 @@ func getenvDefault(key, def string) string {
 	}
 	return v
 }
+
+// splitList разбирает список через запятую, пропуская пустые элементы.
+func splitList(s string) []string {
+	var res []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func getenvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("некорректное значение %s=%q, используется %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+func getenvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("некорректное значение %s=%q, используется %d", key, v, def)
+		return def
+	}
+	return n
+}
@@ -8,12 +8,15 @@ import (
 	"strings"
 	"time"
 
+	"backend/migrations"
+
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type DB struct {
-	Pool *pgxpool.Pool
+	Pool     *pgxpool.Pool
+	Statuses *StatusMachine // правила смены статусов заявок
 }
 
 func NewDB(ctx context.Context, url string) *DB {
@@ -27,157 +30,90 @@ func NewDB(ctx context.Context, url string) *DB {
 	}
 
 	log.Println("Подключение к базе данных успешно установлено")
-	return &DB{Pool: pool}
+	return &DB{Pool: pool, Statuses: DefaultStatusMachine()}
 }
 
 func (db *DB) Close() {
 	db.Pool.Close()
 }
 
-// создание таблиц если их нет
+// issueColumns — столбцы issues в порядке, который ожидает scanIssue.
+const issueColumns = `id, user_id, chat_id, text, latitude, longitude, status, district, category, created_at, updated_at, version,
+	response_overdue_at, resolution_overdue_at, department_id, assignee_id, priority, contact_phone, citizen_id, tracking_code`
+
+// attachmentColumns — столбцы attachments в порядке, который ожидает scanAttachment.
+const attachmentColumns = `id, issue_id, file_id, file_type, local_path, blob_key, size, created_at,
+	download_status, download_attempts`
+
+func scanAttachment(row pgx.Row, a *Attachment) error {
+	return row.Scan(&a.ID, &a.IssueID, &a.FileID, &a.FileType, &a.LocalPath, &a.BlobKey, &a.Size, &a.CreatedAt,
+		&a.DownloadStatus, &a.DownloadAttempts)
+}
+
+func scanIssue(row pgx.Row, x *Issue) error {
+	return row.Scan(
+		&x.ID, &x.UserID, &x.ChatID, &x.Text,
+		&x.Latitude, &x.Longitude, &x.Status,
+		&x.District, &x.Category,
+		&x.CreatedAt, &x.UpdatedAt, &x.Version,
+		&x.ResponseOverdueAt, &x.ResolutionOverdueAt,
+		&x.DepartmentID, &x.AssigneeID, &x.Priority, &x.ContactPhone, &x.CitizenID, &x.TrackingCode,
+	)
+}
+
+// InitSchema применяет недостающие миграции из migrations/ при старте приложения.
 func (db *DB) InitSchema(ctx context.Context) error {
 	if err := db.Pool.Ping(ctx); err != nil {
 		return fmt.Errorf("ошибка соединения с базой: %w", err)
 	}
 	log.Println("Проверка соединения с базой данных... OK")
 
-	schema := `
-	CREATE TABLE IF NOT EXISTS users (
-		id bigserial PRIMARY KEY,
-		tg_user_id bigint UNIQUE NOT NULL,
-		username text,
-		first_name text,
-		last_name text,
-		is_admin boolean NOT NULL DEFAULT false,
-		created_at timestamptz NOT NULL DEFAULT now()
-	);
-
-	CREATE TABLE IF NOT EXISTS chats (
-		chat_id bigint PRIMARY KEY,
-		type text NOT NULL,
-		title text,
-		created_at timestamptz NOT NULL DEFAULT now()
-	);
-
-	CREATE TABLE IF NOT EXISTS issues (
-		id bigserial PRIMARY KEY,
-		user_id bigint NOT NULL,
-		chat_id bigint NOT NULL,
-		text text,
-		latitude double precision,
-		longitude double precision,
-		status text NOT NULL DEFAULT 'Новая',
-		district text,
-		category text,
-		created_at timestamptz NOT NULL DEFAULT now(),
-		updated_at timestamptz NOT NULL DEFAULT now()
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_issues_status ON issues(status);
-	CREATE INDEX IF NOT EXISTS idx_issues_created_at ON issues(created_at);
-
-	CREATE TABLE IF NOT EXISTS attachments (
-		id bigserial PRIMARY KEY,
-		issue_id bigint NOT NULL,
-		file_id text NOT NULL,
-		file_type text NOT NULL,
-		local_path text NOT NULL,
-		created_at timestamptz NOT NULL DEFAULT now()
-	);
-
-	CREATE TABLE IF NOT EXISTS status_changes (
-		id bigserial PRIMARY KEY,
-		issue_id bigint NOT NULL,
-		old_status text,
-		new_status text NOT NULL,
-		changed_by bigint,
-		comment text,
-		created_at timestamptz NOT NULL DEFAULT now()
-	);
-
-	CREATE TABLE IF NOT EXISTS comments (
-		id bigserial PRIMARY KEY,
-		issue_id bigint NOT NULL,
-		admin_user_id bigint NOT NULL,
-		text text NOT NULL,
-		created_at timestamptz NOT NULL DEFAULT now()
-	);
-
-	CREATE TABLE IF NOT EXISTS broadcasts (
-		id bigserial PRIMARY KEY,
-		text text NOT NULL,
-		created_by bigint,
-		sent_count int NOT NULL DEFAULT 0,
-		created_at timestamptz NOT NULL DEFAULT now()
-	);
-	`
-
-	if _, err := db.Pool.Exec(ctx, schema); err != nil {
-		return fmt.Errorf("ошибка при инициализации схемы: %w", err)
-	}
-
-	if _, err := db.Pool.Exec(ctx, `
-		INSERT INTO users (id, tg_user_id, username, first_name, last_name, is_admin)
-		VALUES (1, 1, 'web_user', 'Web', 'User', false)
-		ON CONFLICT (id) DO NOTHING;
-	`); err != nil {
-		return fmt.Errorf("failed to create default user: %w", err)
-	}
-
-	if _, err := db.Pool.Exec(ctx, `
-		INSERT INTO chats (chat_id, type, title)
-		VALUES (1, 'web', 'Web Issues')
-		ON CONFLICT (chat_id) DO NOTHING;
-	`); err != nil {
-		return fmt.Errorf("failed to create default chat: %w", err)
+	m, err := NewMigrator(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+	if err := m.Up(ctx); err != nil {
+		return fmt.Errorf("ошибка при применении миграций: %w", err)
 	}
 
 	log.Println("Схема базы данных успешно инициализирована")
 	return nil
 }
 
-func (db *DB) CreateWebIssue(ctx context.Context, req *WebIssueRequest) (*Issue, error) {
-	webUserID := int64(1)
-	webChatID := int64(1)
-
-	name := strings.TrimSpace(req.Name)
-	contact := strings.TrimSpace(req.Contact)
-	desc := strings.TrimSpace(req.Description)
-
-	var lines []string
+// Служебные пользователь и чат web_user, за которыми числятся заявки
+// с сайта, пока житель не привязал Telegram.
+const (
+	webUserID int64 = 1
+	webChatID int64 = 1
+)
 
-	if name != "" {
-		lines = append(lines, "Имя: "+name)
+func (db *DB) CreateWebIssue(ctx context.Context, req *WebIssueRequest) (*Issue, error) {
+	phone, email, err := parseContact(req.Contact)
+	if err != nil {
+		return nil, err
 	}
-	if contact != "" {
-		lines = append(lines, "Контакт: "+contact)
+	citizen, err := db.UpsertCitizen(ctx, strPtrTrimToNil(&req.Name), phone, email)
+	if err != nil {
+		return nil, fmt.Errorf("create web issue: %w", err)
 	}
-
-	if desc != "" {
-		if len(lines) > 0 {
-			lines = append(lines, "")
-		}
-		lines = append(lines, "Описание проблемы:")
-		lines = append(lines, desc)
-	} else {
-		if len(lines) > 0 {
-			lines = append(lines, "")
-		}
-		lines = append(lines, "Описание проблемы:")
-		lines = append(lines, "(не заполнено)")
+	text := strings.TrimSpace(req.Description)
+	if text == "" {
+		text = "(не заполнено)"
 	}
 
-	text := strings.Join(lines, "\n")
-
+	// контакт в форме не подтверждён, поэтому заявка остаётся на служебном
+	// пользователе, даже если у жителя привязан Telegram: в бот она попадёт,
+	// только когда автор заявки подтвердит привязку кодом (ConfirmCitizenLink)
 	iss := &Issue{
 		UserID:    webUserID,
 		ChatID:    webChatID,
 		Text:      &text,
 		Latitude:  req.Latitude,
 		Longitude: req.Longitude,
-		Status:    "Новая",
+		Status:    string(StatusNew),
 		District:  &req.District,
 		Category:  &req.Category,
+		CitizenID: &citizen.ID,
 	}
 
 	issue, err := db.CreateIssue(ctx, iss)
@@ -185,34 +121,57 @@ func (db *DB) CreateWebIssue(ctx context.Context, req *WebIssueRequest) (*Issue,
 		return nil, fmt.Errorf("create web issue: %w", err)
 	}
 
-	log.Printf("Новая веб-заявка ID=%d (%s / %s)", issue.ID, req.District, req.Category)
+	log.Printf("Новая веб-заявка ID=%d (%s / %s), житель %d", issue.ID, req.District, req.Category, citizen.ID)
 	return issue, nil
 }
 
-func (db *DB) AddWebAttachment(ctx context.Context, issueID int64, fileName, fileType, fileURL string) error {
-	_, err := db.Pool.Exec(ctx, `
-		INSERT INTO attachments (issue_id, file_id, file_type, local_path)
-		VALUES ($1, $2, $3, $4)
-	`, issueID, fileName, fileType, fileURL)
-
+// AddWebAttachments добавляет к заявке файлы с сайта одной транзакцией и
+// возвращает id вложений в том же порядке. Строка заявки блокируется, пока
+// считаются уже прикреплённые файлы, поэтому параллельные загрузки не обойдут
+// maxFiles: если вместе их больше, не добавляется ни один (ErrUploadTooMany).
+func (db *DB) AddWebAttachments(ctx context.Context, issueID int64, files []WebAttachment, maxFiles int) ([]int64, error) {
+	tx, err := db.Pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("ошибка при добавлении вложения: %w", err)
+		return nil, err
 	}
+	defer tx.Rollback(ctx)
 
-	log.Printf("📎 Вложение добавлено: %s (%s)", fileName, fileType)
-	return nil
+	if _, err := tx.Exec(ctx, `select 1 from issues where id = $1 for update`, issueID); err != nil {
+		return nil, err
+	}
+	var existing int
+	if err := tx.QueryRow(ctx, `select count(*) from attachments where issue_id = $1`, issueID).Scan(&existing); err != nil {
+		return nil, err
+	}
+	if existing+len(files) > maxFiles {
+		return nil, fmt.Errorf("%w: к заявке можно прикрепить не больше %d", ErrUploadTooMany, maxFiles)
+	}
+
+	ids := make([]int64, 0, len(files))
+	for _, f := range files {
+		a := &Attachment{IssueID: issueID, FileID: f.FileName, FileType: f.FileType, BlobKey: &f.BlobKey, Size: &f.FileSize}
+		if err := insertAttachment(ctx, tx, a); err != nil {
+			return nil, fmt.Errorf("ошибка при добавлении вложения: %w", err)
+		}
+		ids = append(ids, a.ID)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		log.Printf("📎 Вложение добавлено: %s (%s)", f.FileName, f.FileType)
+	}
+	return ids, nil
 }
 
 func (db *DB) GetWebIssueByID(ctx context.Context, issueID int64) (*Issue, error) {
 	row := db.Pool.QueryRow(ctx, `
-		SELECT id, user_id, chat_id, text, latitude, longitude, status, district, category, created_at, updated_at
+		SELECT `+issueColumns+`
 		FROM issues WHERE id = $1
 	`, issueID)
 
 	var issue Issue
-	if err := row.Scan(&issue.ID, &issue.UserID, &issue.ChatID, &issue.Text,
-		&issue.Latitude, &issue.Longitude, &issue.Status, &issue.District,
-		&issue.Category, &issue.CreatedAt, &issue.UpdatedAt); err != nil {
+	if err := scanIssue(row, &issue); err != nil {
 		return nil, err
 	}
 	return &issue, nil
@@ -220,7 +179,7 @@ func (db *DB) GetWebIssueByID(ctx context.Context, issueID int64) (*Issue, error
 
 func (db *DB) GetAttachmentsByIssueID(ctx context.Context, issueID int64) ([]Attachment, error) {
 	rows, err := db.Pool.Query(ctx, `
-		SELECT id, issue_id, file_id, file_type, local_path, created_at
+		SELECT `+attachmentColumns+`
 		FROM attachments WHERE issue_id = $1 ORDER BY created_at
 	`, issueID)
 	if err != nil {
@@ -231,7 +190,7 @@ func (db *DB) GetAttachmentsByIssueID(ctx context.Context, issueID int64) ([]Att
 	var attachments []Attachment
 	for rows.Next() {
 		var att Attachment
-		if err := rows.Scan(&att.ID, &att.IssueID, &att.FileID, &att.FileType, &att.LocalPath, &att.CreatedAt); err != nil {
+		if err := scanAttachment(rows, &att); err != nil {
 			return nil, err
 		}
 		attachments = append(attachments, att)
@@ -241,14 +200,14 @@ func (db *DB) GetAttachmentsByIssueID(ctx context.Context, issueID int64) ([]Att
 
 func (db *DB) UpsertUser(ctx context.Context, u *User) (*User, error) {
 	row := db.Pool.QueryRow(ctx, `
-		INSERT INTO users (tg_user_id, username, first_name, last_name, is_admin)
-		VALUES ($1,$2,$3,$4,COALESCE($5,false))
+		INSERT INTO users (tg_user_id, username, first_name, last_name)
+		VALUES ($1,$2,$3,$4)
 		ON CONFLICT (tg_user_id) DO UPDATE SET
 			username=excluded.username,
 			first_name=excluded.first_name,
 			last_name=excluded.last_name
 		RETURNING id, is_admin, created_at
-	`, u.TGUserID, u.Username, u.FirstName, u.LastName, u.IsAdmin)
+	`, u.TGUserID, u.Username, u.FirstName, u.LastName)
 
 	if err := row.Scan(&u.ID, &u.IsAdmin, &u.CreatedAt); err != nil {
 		return nil, err
@@ -265,39 +224,23 @@ func (db *DB) UpsertChat(ctx context.Context, c *Chat) error {
 	return err
 }
 
-func (db *DB) PromoteToAdmin(ctx context.Context, tgUserID int64) error {
-	cmd, err := db.Pool.Exec(ctx, `UPDATE users SET is_admin=true WHERE tg_user_id=$1`, tgUserID)
-	if err != nil {
-		return err
-	}
-	if cmd.RowsAffected() == 0 {
-		return errors.New("user not found to promote")
-	}
-	return nil
-}
-
-func (db *DB) IsAdmin(ctx context.Context, tgUserID int64) (bool, error) {
-	row := db.Pool.QueryRow(ctx, `SELECT is_admin FROM users WHERE tg_user_id=$1`, tgUserID)
-	var isAdmin bool
-	switch err := row.Scan(&isAdmin); err {
-	case nil:
-		return isAdmin, nil
-	case pgx.ErrNoRows:
-		return false, nil
-	default:
-		return false, err
-	}
-}
-
+// CreateIssue сохраняет заявку и сразу прогоняет её через правила маршрутизации
+// (см. routeIssue) в той же транзакции.
 func (db *DB) CreateIssue(ctx context.Context, iss *Issue) (*Issue, error) {
 	if iss.Status == "" {
-		iss.Status = "Новая"
+		iss.Status = string(StatusNew)
 	}
 
-	row := db.Pool.QueryRow(ctx, `
-        insert into issues (user_id, chat_id, text, latitude, longitude, status, district, category)
-        values ($1,$2,$3,$4,$5,$6,$7,$8)
-        returning id, created_at, updated_at
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `
+        insert into issues (user_id, chat_id, text, latitude, longitude, status, district, category, citizen_id)
+        values ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+        returning `+issueColumns+`
     `,
 		iss.UserID,
 		iss.ChatID,
@@ -307,26 +250,54 @@ func (db *DB) CreateIssue(ctx context.Context, iss *Issue) (*Issue, error) {
 		iss.Status,
 		iss.District,
 		iss.Category,
+		iss.CitizenID,
 	)
 
-	if err := row.Scan(&iss.ID, &iss.CreatedAt, &iss.UpdatedAt); err != nil {
+	if err := scanIssue(row, iss); err != nil {
+		return nil, err
+	}
+
+	routeIssueSafely(ctx, tx, iss)
+
+	if err := publishEvent(ctx, tx, EventIssueCreated, iss.ID, newEventIssue(iss)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		return nil, err
 	}
 	return iss, nil
 }
 
 func (db *DB) AddAttachment(ctx context.Context, a *Attachment) error {
-	row := db.Pool.QueryRow(ctx, `
-        insert into attachments (issue_id, file_id, file_type, local_path)
-        values ($1,$2,$3,$4)
-        returning id, created_at
-    `, a.IssueID, a.FileID, a.FileType, a.LocalPath)
-	return row.Scan(&a.ID, &a.CreatedAt)
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertAttachment(ctx, tx, a); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// insertAttachment добавляет вложение и событие issue.attachment_added в транзакции tx.
+func insertAttachment(ctx context.Context, tx pgx.Tx, a *Attachment) error {
+	row := tx.QueryRow(ctx, `
+        insert into attachments (issue_id, file_id, file_type, local_path, blob_key, size, download_status)
+        values ($1,$2,$3,$4,$5,$6,coalesce(nullif($7, ''), 'done'))
+        returning id, created_at, download_status
+    `, a.IssueID, a.FileID, a.FileType, a.LocalPath, a.BlobKey, a.Size, a.DownloadStatus)
+	if err := row.Scan(&a.ID, &a.CreatedAt, &a.DownloadStatus); err != nil {
+		return err
+	}
+	return publishEvent(ctx, tx, EventIssueAttachmentAdded, a.IssueID, newEventAttachment(a))
 }
 
 func (db *DB) ListIssuesByUser(ctx context.Context, userID int64, limit int) ([]Issue, error) {
 	rows, err := db.Pool.Query(ctx, `
-		select id, user_id, chat_id, text, latitude, longitude, status, district, category created_at, updated_at
+		select `+issueColumns+`
 		from issues where user_id=$1 order by created_at desc limit $2
 	`, userID, limit)
 	if err != nil {
@@ -336,11 +307,7 @@ func (db *DB) ListIssuesByUser(ctx context.Context, userID int64, limit int) ([]
 	var res []Issue
 	for rows.Next() {
 		var x Issue
-		if err := rows.Scan(&x.ID, &x.UserID, &x.ChatID, &x.Text,
-			&x.Latitude, &x.Longitude, &x.Status,
-			&x.District, &x.Category,
-			&x.CreatedAt, &x.UpdatedAt,
-		); err != nil {
+		if err := scanIssue(rows, &x); err != nil {
 			return nil, err
 		}
 		res = append(res, x)
@@ -357,7 +324,7 @@ func (db *DB) ListIssuesByStatus(ctx context.Context, statuses []string, limit i
 	}
 	args[len(args)-1] = limit
 	q := fmt.Sprintf(`
-		select id, user_id, chat_id, text, latitude, longitude, status, district, category, created_at, updated_at
+		select `+issueColumns+`
 		from issues where status in (%s) order by created_at desc limit $%d
 	`, strings.Join(placeholders, ","), len(args))
 	rows, err := db.Pool.Query(ctx, q, args...)
@@ -368,11 +335,7 @@ func (db *DB) ListIssuesByStatus(ctx context.Context, statuses []string, limit i
 	var res []Issue
 	for rows.Next() {
 		var x Issue
-		if err := rows.Scan(&x.ID, &x.UserID, &x.ChatID, &x.Text,
-			&x.Latitude, &x.Longitude, &x.Status,
-			&x.District, &x.Category,
-			&x.CreatedAt, &x.UpdatedAt,
-		); err != nil {
+		if err := scanIssue(rows, &x); err != nil {
 			return nil, err
 		}
 		res = append(res, x)
@@ -380,64 +343,131 @@ func (db *DB) ListIssuesByStatus(ctx context.Context, statuses []string, limit i
 	return res, rows.Err()
 }
 
-func (db *DB) SetIssueStatus(ctx context.Context, issueID int64, newStatus string, changedByTG *int64, comment *string) error {
-	row := db.Pool.QueryRow(ctx, `select status from issues where id=$1`, issueID)
+// SetIssueStatus меняет статус заявки по правилам db.Statuses и пишет историю
+// в status_changes. Всё происходит в одной транзакции под блокировкой строки
+// заявки; если задан upd.ExpectedVersion и заявку уже изменили, возвращается
+// ErrVersionConflict. Возвращает новую версию заявки.
+func (db *DB) SetIssueStatus(ctx context.Context, upd StatusUpdate) (int, error) {
+	newStatus, err := ParseIssueStatus(upd.Status)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
 
-	var oldStatus *string
-	var os string
-	switch err := row.Scan(&os); err {
+	row := tx.QueryRow(ctx, `select status, version from issues where id=$1 for update`, upd.IssueID)
+
+	var oldStatus string
+	var version int
+	switch err := row.Scan(&oldStatus, &version); err {
 	case nil:
-		oldStatus = &os
 	case pgx.ErrNoRows:
-		return errors.New("issue not found")
+		return 0, ErrIssueNotFound
 	default:
-		return err
+		return 0, err
+	}
+
+	if err := checkVersion(upd.ExpectedVersion, version); err != nil {
+		return 0, err
+	}
+
+	reason := ""
+	if upd.Comment != nil {
+		reason = *upd.Comment
+	}
+	if err := db.Statuses.Check(IssueStatus(oldStatus), newStatus, upd.Reopen, reason); err != nil {
+		return 0, err
 	}
 
 	var changedByID *int64
-	if changedByTG != nil {
-		r2 := db.Pool.QueryRow(ctx, `select id from users where tg_user_id=$1`, *changedByTG)
+	if upd.ChangedByTG != nil {
+		r2 := tx.QueryRow(ctx, `select id from users where tg_user_id=$1`, *upd.ChangedByTG)
 		var id int64
 		if err := r2.Scan(&id); err == nil {
 			changedByID = &id
 		}
 	}
 
-	if _, err := db.Pool.Exec(ctx,
-		`update issues set status=$2, updated_at=now() where id=$1`,
-		issueID, newStatus,
-	); err != nil {
-		return err
+	var iss Issue
+	if err := scanIssue(tx.QueryRow(ctx,
+		`update issues set status=$2, updated_at=now(), version=version+1 where id=$1 returning `+issueColumns,
+		upd.IssueID, string(newStatus),
+	), &iss); err != nil {
+		return 0, err
 	}
+	version = iss.Version
 
-	if _, err := db.Pool.Exec(ctx, `
+	if _, err := tx.Exec(ctx, `
         insert into status_changes(issue_id, old_status, new_status, changed_by, comment)
         values ($1,$2,$3,$4,$5)
-    `, issueID, oldStatus, newStatus, changedByID, comment); err != nil {
-		return err
+    `, upd.IssueID, oldStatus, string(newStatus), changedByID, upd.Comment); err != nil {
+		return 0, err
 	}
 
-	return nil
+	if err := publishEvent(ctx, tx, EventIssueStatusChanged, upd.IssueID, eventStatusChange{
+		Issue:     newEventIssue(&iss),
+		OldStatus: oldStatus,
+		NewStatus: string(newStatus),
+		Comment:   upd.Comment,
+	}); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return version, nil
 }
 
-func (db *DB) AddComment(ctx context.Context, issueID int64, adminTGUserID int64, text string) error {
-	_, err := db.Pool.Exec(ctx, `
-        insert into comments(issue_id, admin_user_id, text)
-        select $1, id, $3
+var ErrCommentAuthorNotFound = errors.New("автор комментария не найден среди пользователей бота")
+
+// AddComment сохраняет комментарий администратора; visibility — CommentInternal
+// или CommentPublic. Вместе с комментарием пишется событие issue.commented,
+// по нему публичный комментарий уходит жителю (см. Notifications).
+func (db *DB) AddComment(ctx context.Context, issueID int64, adminTGUserID int64, text, visibility string) error {
+	if visibility != CommentInternal && visibility != CommentPublic {
+		return fmt.Errorf("неизвестная видимость комментария %q", visibility)
+	}
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	c := eventComment{IssueID: issueID, Text: text, Visibility: visibility}
+	err = tx.QueryRow(ctx, `
+        insert into comments(issue_id, admin_user_id, text, visibility)
+        select $1, id, $3, $4
         from users
         where tg_user_id = $2
-    `, issueID, adminTGUserID, text)
-	return err
+        returning id, created_at
+    `, issueID, adminTGUserID, text, visibility).Scan(&c.ID, &c.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrCommentAuthorNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := publishEvent(ctx, tx, EventIssueCommented, issueID, c); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
-func (db *DB) ExportIssues(ctx context.Context, from, to time.Time) ([]ExportRow, error) {
+func (db *DB) ExportIssues(ctx context.Context, from, to time.Time, scope IssueFilter) ([]ExportRow, error) {
 	rows, err := db.Pool.Query(ctx, `
 		select i.id, i.created_at, i.status, i.user_id, u.tg_user_id, coalesce(i.text,''), i.latitude, i.longitude
 		from issues i
 		join users u on u.id = i.user_id
 		where i.created_at >= $1 and i.created_at < $2
+		  and ($3::bigint is null or i.department_id = $3)
+		  and ($4::text is null or lower(i.district) = lower($4))
 		order by i.created_at asc
-	`, from, to)
+	`, from, to, scope.DepartmentID, scope.District)
 	if err != nil {
 		return nil, err
 	}
@@ -472,7 +502,7 @@ func (db *DB) ListAllChatIDs(ctx context.Context) ([]int64, error) {
 
 func (db *DB) ListAttachmentsByIssue(ctx context.Context, issueID int64) ([]Attachment, error) {
 	rows, err := db.Pool.Query(ctx, `
-		select id, issue_id, file_id, file_type, local_path, created_at
+		select `+attachmentColumns+`
 		from attachments
 		where issue_id = $1
 		order by id
@@ -485,14 +515,7 @@ func (db *DB) ListAttachmentsByIssue(ctx context.Context, issueID int64) ([]Atta
 	var res []Attachment
 	for rows.Next() {
 		var a Attachment
-		if err := rows.Scan(
-			&a.ID,
-			&a.IssueID,
-			&a.FileID,
-			&a.FileType,
-			&a.LocalPath,
-			&a.CreatedAt,
-		); err != nil {
+		if err := scanAttachment(rows, &a); err != nil {
 			return nil, err
 		}
 		res = append(res, a)
@@ -502,7 +525,7 @@ func (db *DB) ListAttachmentsByIssue(ctx context.Context, issueID int64) ([]Atta
 
 func (db *DB) ListIssuesByUserPage(ctx context.Context, userID int64, limit, offset int) ([]Issue, error) {
 	rows, err := db.Pool.Query(ctx, `
-		select id, user_id, chat_id, text, latitude, longitude, status, district, category, created_at, updated_at
+		select `+issueColumns+`
 		from issues
 		where user_id = $1
 		order by created_at desc
@@ -516,11 +539,7 @@ func (db *DB) ListIssuesByUserPage(ctx context.Context, userID int64, limit, off
 	var res []Issue
 	for rows.Next() {
 		var x Issue
-		if err := rows.Scan(&x.ID, &x.UserID, &x.ChatID, &x.Text,
-			&x.Latitude, &x.Longitude, &x.Status,
-			&x.District, &x.Category,
-			&x.CreatedAt, &x.UpdatedAt,
-		); err != nil {
+		if err := scanIssue(rows, &x); err != nil {
 			return nil, err
 		}
 		res = append(res, x)
@@ -542,7 +561,7 @@ func (db *DB) ListIssuesByStatusPage(ctx context.Context, statuses []string, lim
 	args[offsetPos-1] = offset
 
 	q := fmt.Sprintf(`
-		select id, user_id, chat_id, text, latitude, longitude, status, district, category, created_at, updated_at
+		select `+issueColumns+`
 		from issues
 		where status in (%s)
 		order by created_at desc
@@ -558,12 +577,7 @@ func (db *DB) ListIssuesByStatusPage(ctx context.Context, statuses []string, lim
 	var res []Issue
 	for rows.Next() {
 		var x Issue
-		if err := rows.Scan(
-			&x.ID, &x.UserID, &x.ChatID, &x.Text,
-			&x.Latitude, &x.Longitude, &x.Status,
-			&x.District, &x.Category,
-			&x.CreatedAt, &x.UpdatedAt,
-		); err != nil {
+		if err := scanIssue(rows, &x); err != nil {
 			return nil, err
 		}
 		res = append(res, x)
@@ -571,38 +585,50 @@ func (db *DB) ListIssuesByStatusPage(ctx context.Context, statuses []string, lim
 	return res, rows.Err()
 }
 
-func (db *DB) ListIssuesByStatusFilterPage(ctx context.Context, statuses []string, district, category *string, limit, offset int) ([]Issue, error) {
-	placeholders := make([]string, len(statuses))
-	args := make([]any, 0, len(statuses)+4)
+// ListIssues возвращает заявки по фильтру f, новые сверху.
+func (db *DB) ListIssues(ctx context.Context, f IssueFilter, limit, offset int) ([]Issue, error) {
+	var conds []string
+	var args []any
 
-	for i, s := range statuses {
-		placeholders[i] = fmt.Sprintf("$%d", i+1)
-		args = append(args, s)
+	if len(f.Statuses) > 0 {
+		args = append(args, f.Statuses)
+		conds = append(conds, fmt.Sprintf("status = any($%d)", len(args)))
 	}
-
-	where := fmt.Sprintf("status in (%s)", strings.Join(placeholders, ","))
-
-	if district != nil && *district != "" {
-		args = append(args, *district)
-		where += fmt.Sprintf(" and district = $%d", len(args))
+	if f.District != nil && *f.District != "" {
+		args = append(args, *f.District)
+		conds = append(conds, fmt.Sprintf("district = $%d", len(args)))
+	}
+	if f.Category != nil && *f.Category != "" {
+		args = append(args, *f.Category)
+		conds = append(conds, fmt.Sprintf("category = $%d", len(args)))
 	}
-	if category != nil && *category != "" {
-		args = append(args, *category)
-		where += fmt.Sprintf(" and category = $%d", len(args))
+	if f.DepartmentID != nil {
+		args = append(args, *f.DepartmentID)
+		conds = append(conds, fmt.Sprintf("department_id = $%d", len(args)))
+	}
+	if f.AssigneeID != nil {
+		args = append(args, *f.AssigneeID)
+		conds = append(conds, fmt.Sprintf("assignee_id = $%d", len(args)))
+	}
+	if f.OverdueOnly {
+		args = append(args, statusStrings([]IssueStatus{StatusDone, StatusRejected}))
+		conds = append(conds, fmt.Sprintf(
+			"status <> all($%d) and (response_overdue_at is not null or resolution_overdue_at is not null)", len(args)))
 	}
 
-	args = append(args, limit, offset)
-	limitPos := len(args) - 1
-	offsetPos := len(args)
+	where := "true"
+	if len(conds) > 0 {
+		where = strings.Join(conds, " and ")
+	}
 
+	args = append(args, limit, offset)
 	q := fmt.Sprintf(`
-		select id, user_id, chat_id, text, latitude, longitude,
-		       status, district, category, created_at, updated_at
+		select `+issueColumns+`
 		from issues
 		where %s
 		order by created_at desc
 		limit $%d offset $%d
-	`, where, limitPos, offsetPos)
+	`, where, len(args)-1, len(args))
 
 	rows, err := db.Pool.Query(ctx, q, args...)
 	if err != nil {
@@ -613,12 +639,7 @@ func (db *DB) ListIssuesByStatusFilterPage(ctx context.Context, statuses []strin
 	var res []Issue
 	for rows.Next() {
 		var x Issue
-		if err := rows.Scan(
-			&x.ID, &x.UserID, &x.ChatID, &x.Text,
-			&x.Latitude, &x.Longitude, &x.Status,
-			&x.District, &x.Category,
-			&x.CreatedAt, &x.UpdatedAt,
-		); err != nil {
+		if err := scanIssue(rows, &x); err != nil {
 			return nil, err
 		}
 		res = append(res, x)
@@ -626,13 +647,16 @@ func (db *DB) ListIssuesByStatusFilterPage(ctx context.Context, statuses []strin
 	return res, rows.Err()
 }
 
-func (db *DB) ListCommentsByIssue(ctx context.Context, issueID int64) ([]Comment, error) {
+// ListCommentsByIssue возвращает комментарии к заявке; publicOnly — только
+// те, что видит житель.
+func (db *DB) ListCommentsByIssue(ctx context.Context, issueID int64, publicOnly bool) ([]Comment, error) {
 	rows, err := db.Pool.Query(ctx, `
-		select id, issue_id, admin_user_id, text, created_at
+		select id, issue_id, admin_user_id, text, visibility, created_at
 		from comments
 		where issue_id = $1
+		  and ($2 = false or visibility = 'public')
 		order by created_at asc
-	`, issueID)
+	`, issueID, publicOnly)
 	if err != nil {
 		return nil, err
 	}
@@ -646,6 +670,7 @@ func (db *DB) ListCommentsByIssue(ctx context.Context, issueID int64) ([]Comment
 			&c.IssueID,
 			&c.AdminUserID,
 			&c.Text,
+			&c.Visibility,
 			&c.CreatedAt,
 		); err != nil {
 			return nil, err
@@ -655,6 +680,35 @@ func (db *DB) ListCommentsByIssue(ctx context.Context, issueID int64) ([]Comment
 	return res, rows.Err()
 }
 
+// SetLastIssueContactPhone записывает телефон в последнюю заявку жителя,
+// созданную не раньше 10 минут назад (как и геопозицию); nil — такой заявки нет.
+func (db *DB) SetLastIssueContactPhone(ctx context.Context, userID int64, phone string) (*Issue, error) {
+	row := db.Pool.QueryRow(ctx, `
+		update issues
+		set contact_phone = $1,
+		    updated_at = now(),
+		    version = version + 1
+		where id = (
+			select id
+			from issues
+			where user_id = $2
+			  and created_at > now() - interval '10 minutes'
+			order by created_at desc
+			limit 1
+		)
+		returning `+issueColumns+`
+	`, phone, userID)
+
+	var iss Issue
+	if err := scanIssue(row, &iss); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &iss, nil
+}
+
 // AttachLocationToLastIssue привязывает геопозицию к последней заявке пользователя,
 // у которой ещё нет координат и которая создана недавно (за последние 10 минут).
 func (db *DB) AttachLocationToLastIssue(ctx context.Context, userID int64, lat, lon float64) (*Issue, error) {
@@ -662,7 +716,8 @@ func (db *DB) AttachLocationToLastIssue(ctx context.Context, userID int64, lat,
 		update issues
 		set latitude = $1,
 		    longitude = $2,
-		    updated_at = now()
+		    updated_at = now(),
+		    version = version + 1
 		where id = (
 			select id
 			from issues
@@ -673,24 +728,11 @@ func (db *DB) AttachLocationToLastIssue(ctx context.Context, userID int64, lat,
 			order by created_at desc
 			limit 1
 		)
-		returning id, user_id, chat_id, text, latitude, longitude,
-		          status, district, category, created_at, updated_at
+		returning `+issueColumns+`
 	`, lat, lon, userID)
 
 	var iss Issue
-	if err := row.Scan(
-		&iss.ID,
-		&iss.UserID,
-		&iss.ChatID,
-		&iss.Text,
-		&iss.Latitude,
-		&iss.Longitude,
-		&iss.Status,
-		&iss.District,
-		&iss.Category,
-		&iss.CreatedAt,
-		&iss.UpdatedAt,
-	); err != nil {
+	if err := scanIssue(row, &iss); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var ErrDispatcherStopped = errors.New("dispatcher stopped")
+
+// UpdateDispatcher раскладывает задачи по фиксированному набору воркеров по ключу
+// (chat id): задачи одного чата выполняются строго по очереди, разных чатов — параллельно.
+type UpdateDispatcher struct {
+	queues []chan func(context.Context)
+	done   chan struct{} // закрыт — новые задачи не принимаются
+	stop   chan struct{} // закрыт — очереди больше не пополнятся, воркеры доделывают их и выходят
+	wg     sync.WaitGroup
+	once   sync.Once
+
+	// Submit держит mu.RLock, пока кладёт задачу; остановка берёт mu.Lock,
+	// поэтому после неё ни одна задача не попадёт в очередь мимо воркера
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewUpdateDispatcher(workers, queueSize int) *UpdateDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	d := &UpdateDispatcher{
+		queues: make([]chan func(context.Context), workers),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan func(context.Context), queueSize)
+	}
+	return d
+}
+
+// Start запускает воркеры. Задачи выполняются с контекстом ctx. После его
+// отмены новые задачи не принимаются, а уже принятые воркеры выполняют до
+// конца — с контекстом без отмены: апдейт к этому времени уже подтверждён
+// Telegram, и выбросить его значит потерять.
+func (d *UpdateDispatcher) Start(ctx context.Context) {
+	d.once.Do(func() {
+		for _, q := range d.queues {
+			d.wg.Add(1)
+			go d.worker(ctx, q)
+		}
+		go func() {
+			<-ctx.Done()
+			close(d.done) // будит Submit, ждущие места в очереди
+			d.mu.Lock()
+			d.closed = true
+			d.mu.Unlock()
+			close(d.stop)
+		}()
+	})
+}
+
+func (d *UpdateDispatcher) worker(ctx context.Context, q chan func(context.Context)) {
+	defer d.wg.Done()
+	drainCtx := context.WithoutCancel(ctx)
+	for {
+		select {
+		case job := <-q:
+			if ctx.Err() != nil {
+				job(drainCtx)
+			} else {
+				job(ctx)
+			}
+		case <-d.stop:
+			for {
+				select {
+				case job := <-q:
+					job(drainCtx)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Submit ставит задачу в очередь воркера, отвечающего за key. Если очередь
+// переполнена, ждёт освобождения места, пока не отменён ctx вызывающего.
+func (d *UpdateDispatcher) Submit(ctx context.Context, key int64, job func(context.Context)) error {
+	q := d.queues[d.slot(key)]
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrDispatcherStopped
+	}
+	select {
+	case <-d.done:
+		return ErrDispatcherStopped
+	default:
+	}
+	select {
+	case q <- job:
+		return nil
+	case <-d.done:
+		return ErrDispatcherStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait дожидается, пока после отмены контекста Start воркеры выполнят все
+// принятые задачи и завершатся.
+func (d *UpdateDispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func (d *UpdateDispatcher) slot(key int64) int {
+	u := uint64(key)
+	// перемешиваем биты, чтобы соседние chat id не попадали в один воркер
+	u ^= u >> 33
+	u *= 0xff51afd7ed558ccd
+	u ^= u >> 33
+	return int(u % uint64(len(d.queues)))
+}
+
+// updateChatKey возвращает chat id, по которому упорядочивается обработка апдейта.
+func updateChatKey(upd tgbotapi.Update) int64 {
+	switch {
+	case upd.Message != nil:
+		return upd.Message.Chat.ID
+	case upd.CallbackQuery != nil:
+		if upd.CallbackQuery.Message != nil {
+			return upd.CallbackQuery.Message.Chat.ID
+		}
+		if upd.CallbackQuery.From != nil {
+			return upd.CallbackQuery.From.ID
+		}
+	}
+	return 0
+}
+
+// quarterlyGate срабатывает один раз в начале каждой четверти часа
+// (0, 15, 30, 45 минут). Безопасен для конкурентного использования.
+type quarterlyGate struct {
+	mu         sync.Mutex
+	lastMinute int
+}
+
+func newQuarterlyGate() *quarterlyGate {
+	return &quarterlyGate{lastMinute: -1}
+}
+
+func (g *quarterlyGate) shouldFire(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	minute := now.Minute()
+	if minute%15 != 0 {
+		g.lastMinute = -1
+		return false
+	}
+	if minute == g.lastMinute {
+		return false
+	}
+	g.lastMinute = minute
+	return true
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Запускать с -race: задачи одного чата пишут в общий срез без блокировок,
+// и детектор поймает любое параллельное выполнение задач одного ключа.
+func TestUpdateDispatcherKeepsOrderPerChat(t *testing.T) {
+	const (
+		submitters  = 64
+		keysPerSub  = 4
+		jobsPerKey  = 50
+		keys        = submitters * keysPerSub
+		expectedAll = keys * jobsPerKey
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := NewUpdateDispatcher(8, 16)
+	d.Start(ctx)
+
+	got := make([][]int, keys)
+	var ran atomic.Int64
+
+	var wg sync.WaitGroup
+	for s := 0; s < submitters; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			// каждый ключ пополняет один отправитель, вперемешку с другими своими ключами
+			for seq := 0; seq < jobsPerKey; seq++ {
+				for k := 0; k < keysPerSub; k++ {
+					key := s + k*submitters
+					seq := seq
+					err := d.Submit(context.Background(), int64(key), func(context.Context) {
+						got[key] = append(got[key], seq)
+						ran.Add(1)
+					})
+					if err != nil {
+						t.Errorf("Submit: %v", err)
+						return
+					}
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+	cancel()
+	d.Wait()
+
+	if n := ran.Load(); n != expectedAll {
+		t.Fatalf("выполнено %d задач, ожидалось %d", n, expectedAll)
+	}
+	for key, seqs := range got {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Fatalf("чат %d: задача %d выполнена на месте %d", key, seq, i)
+			}
+		}
+	}
+}
+
+func TestUpdateDispatcherDrainsQueueOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := NewUpdateDispatcher(1, 100)
+	d.Start(ctx)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if err := d.Submit(context.Background(), 1, func(context.Context) {
+		close(started)
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	var ran, cancelled atomic.Int64
+	job := func(jobCtx context.Context) {
+		if jobCtx.Err() != nil {
+			cancelled.Add(1)
+		}
+		ran.Add(1)
+	}
+	accepted := int64(50)
+	for i := int64(0); i < accepted; i++ {
+		if err := d.Submit(context.Background(), 1, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+	// остановка асинхронная: пока она не дошла до диспетчера, задачи ещё
+	// принимаются (и должны быть выполнены), после — отклоняются
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := d.Submit(context.Background(), 1, job)
+		if errors.Is(err, ErrDispatcherStopped) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+		accepted++
+		if time.Now().After(deadline) {
+			t.Fatal("диспетчер не остановился")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	d.Wait()
+
+	if n := ran.Load(); n != accepted {
+		t.Fatalf("выполнено %d из %d принятых задач", n, accepted)
+	}
+	if n := cancelled.Load(); n != 0 {
+		t.Fatalf("%d задач получили отменённый контекст", n)
+	}
+}
+
+// Всё, что Submit принял, должно быть выполнено, даже если остановка
+// пришлась на середину отправки.
+func TestUpdateDispatcherSubmitRacingShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := NewUpdateDispatcher(4, 8)
+	d.Start(ctx)
+
+	var accepted, ran atomic.Int64
+	var wg sync.WaitGroup
+	for s := 0; s < 32; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				err := d.Submit(context.Background(), int64(s*1000+i%10), func(context.Context) { ran.Add(1) })
+				if errors.Is(err, ErrDispatcherStopped) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Submit: %v", err)
+					return
+				}
+				accepted.Add(1)
+			}
+		}(s)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	wg.Wait()
+	d.Wait()
+
+	if accepted.Load() == 0 {
+		t.Fatal("ни одна задача не принята")
+	}
+	if a, r := accepted.Load(), ran.Load(); a != r {
+		t.Fatalf("принято %d задач, выполнено %d", a, r)
+	}
+}
+
+func TestQuarterlyGateFiresOncePerQuarter(t *testing.T) {
+	g := newQuarterlyGate()
+	base := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+
+	fireConcurrently := func(now time.Time) int64 {
+		var fired atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if g.shouldFire(now) {
+					fired.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		return fired.Load()
+	}
+
+	if n := fireConcurrently(base); n != 1 {
+		t.Fatalf("10:15: сработал %d раз, ожидался 1", n)
+	}
+	if n := fireConcurrently(base.Add(30 * time.Second)); n != 0 {
+		t.Fatalf("10:15:30: сработал %d раз, ожидалось 0", n)
+	}
+	if n := fireConcurrently(base.Add(time.Minute)); n != 0 {
+		t.Fatalf("10:16: сработал %d раз, ожидалось 0", n)
+	}
+	if n := fireConcurrently(base.Add(15 * time.Minute)); n != 1 {
+		t.Fatalf("10:30: сработал %d раз, ожидался 1", n)
+	}
+}
@@ -0,0 +1,413 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Доменные события заявок.
+const (
+	EventIssueCreated         = "issue.created"
+	EventIssueStatusChanged   = "issue.status_changed"
+	EventIssueCommented       = "issue.commented"
+	EventIssueAttachmentAdded = "issue.attachment_added"
+	EventIssueAssigned        = "issue.assigned"
+	EventIssueOverdue         = "issue.overdue" // данные — OverdueIssue
+)
+
+// Состояние события в outbox.
+const (
+	EventPending = "pending"
+	EventDone    = "done"
+	EventFailed  = "failed" // попытки кончились, см. last_error
+)
+
+// outboxChannel — канал pg_notify, которым publishEvent будит EventBus.
+const outboxChannel = "outbox"
+
+// DomainEvent — событие из outbox.
+type DomainEvent struct {
+	ID        int64
+	Type      string
+	IssueID   int64
+	Payload   json.RawMessage // eventIssue, eventStatusChange, eventAssignment, eventComment, eventAttachment или OverdueIssue по Type
+	CreatedAt time.Time
+	Attempts  int
+}
+
+// EventHandler — подписчик EventBus. Name сохраняется в outbox_handled,
+// поэтому менять его нельзя. Handle может быть вызван повторно для того же
+// события (после сбоя или перезапуска) и должен это переносить.
+type EventHandler interface {
+	Name() string
+	Handle(ctx context.Context, ev *DomainEvent) error
+}
+
+// eventIssue — заявка в событиях. Контактов жителя и его идентификаторов
+// в Telegram здесь нет: события уходят и во внешние системы.
+type eventIssue struct {
+	ID           int64     `json:"id"`
+	Source       string    `json:"source"` // telegram или web
+	Status       string    `json:"status"`
+	District     *string   `json:"district"`
+	Category     *string   `json:"category"`
+	Text         *string   `json:"text"`
+	Latitude     *float64  `json:"latitude"`
+	Longitude    *float64  `json:"longitude"`
+	DepartmentID *int64    `json:"department_id"`
+	Priority     string    `json:"priority"`
+	Version      int       `json:"version"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func newEventIssue(iss *Issue) eventIssue {
+	source, text := "telegram", iss.Text
+	switch {
+	case iss.CitizenID != nil:
+		source = "web"
+	case iss.UserID == webUserID:
+		// заявка с сайта, поданная до профилей жителей: имя и контакт в тексте
+		source, text = "web", legacyWebIssueText(iss.Text)
+	}
+	return eventIssue{
+		ID:           iss.ID,
+		Source:       source,
+		Status:       iss.Status,
+		District:     iss.District,
+		Category:     iss.Category,
+		Text:         text,
+		Latitude:     iss.Latitude,
+		Longitude:    iss.Longitude,
+		DepartmentID: iss.DepartmentID,
+		Priority:     iss.Priority,
+		Version:      iss.Version,
+		CreatedAt:    iss.CreatedAt,
+		UpdatedAt:    iss.UpdatedAt,
+	}
+}
+
+// legacyWebIssueMarker отделял в старых заявках с сайта строки «Имя:» и
+// «Контакт:» от описания.
+const legacyWebIssueMarker = "Описание проблемы:\n"
+
+// legacyWebIssueText — описание из текста старой заявки с сайта без имени
+// и контакта жителя. Если разметки нет, текст не отдаётся совсем.
+func legacyWebIssueText(text *string) *string {
+	if text == nil {
+		return nil
+	}
+	_, desc, ok := strings.Cut(*text, legacyWebIssueMarker)
+	desc = strings.TrimSpace(desc)
+	if !ok || desc == "" || desc == "(не заполнено)" {
+		return nil
+	}
+	return &desc
+}
+
+// eventStatusChange — данные события issue.status_changed; Issue — уже с новым статусом.
+type eventStatusChange struct {
+	Issue     eventIssue `json:"issue"`
+	OldStatus string     `json:"old_status"`
+	NewStatus string     `json:"new_status"`
+	Comment   *string    `json:"comment"`
+}
+
+// eventAssignment — данные события issue.assigned; Issue — уже с новыми
+// службой и исполнителем (AssigneeID == nil — исполнитель снят).
+type eventAssignment struct {
+	Issue        eventIssue `json:"issue"`
+	AssigneeID   *int64     `json:"assignee_id"`
+	AssignedByTG *int64     `json:"assigned_by_tg"`
+}
+
+// eventComment — данные события issue.commented; приходят и внутренние
+// комментарии, различайте их по visibility.
+type eventComment struct {
+	ID         int64     `json:"id"`
+	IssueID    int64     `json:"issue_id"`
+	Text       string    `json:"text"`
+	Visibility string    `json:"visibility"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// eventAttachment — данные события issue.attachment_added. Сам файл не
+// передаётся: ссылки на него подписываются на короткий срок (см. URLSigner).
+type eventAttachment struct {
+	ID        int64     `json:"id"`
+	IssueID   int64     `json:"issue_id"`
+	FileType  string    `json:"file_type"`
+	Size      *int64    `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newEventAttachment(a *Attachment) eventAttachment {
+	return eventAttachment{ID: a.ID, IssueID: a.IssueID, FileType: a.FileType, Size: a.Size, CreatedAt: a.CreatedAt}
+}
+
+// publishEvent записывает событие в outbox. q — транзакция изменения заявки:
+// событие появится, только если изменение сохранилось, и не потеряется,
+// даже если процесс упадёт сразу после коммита.
+func publishEvent(ctx context.Context, q querier, event string, issueID int64, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	// уведомление уходит слушателям при коммите транзакции
+	_, err = q.Exec(ctx, `
+		with e as (
+			insert into outbox (event, issue_id, payload) values ($1, $2, $3) returning id
+		)
+		select pg_notify('`+outboxChannel+`', id::text) from e
+	`, event, issueID, payload)
+	return err
+}
+
+// claimEvents забирает до limit событий, которым пора обрабатываться, и
+// откладывает их повтор на lease (как ClaimPendingDownloads). События одной
+// заявки раздаются строго по очереди: пока более раннее ждёт повтора или
+// обрабатывается, следующие не выдаются. Окончательно не обработанное
+// (failed) очередь не держит.
+func (db *DB) claimEvents(ctx context.Context, limit int, lease time.Duration) ([]DomainEvent, error) {
+	rows, err := db.Pool.Query(ctx, `
+		update outbox
+		set next_attempt_at = now() + make_interval(secs => $2)
+		where id in (
+			select id from outbox
+			where status = 'pending' and next_attempt_at <= now()
+			  and not exists (
+			      select 1 from outbox o2
+			      where o2.issue_id = outbox.issue_id and o2.id < outbox.id and o2.status = 'pending')
+			order by next_attempt_at, id
+			limit $1
+			for update skip locked
+		)
+		returning id, event, issue_id, payload, created_at, attempts
+	`, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []DomainEvent
+	for rows.Next() {
+		var ev DomainEvent
+		if err := rows.Scan(&ev.ID, &ev.Type, &ev.IssueID, &ev.Payload, &ev.CreatedAt, &ev.Attempts); err != nil {
+			return nil, err
+		}
+		res = append(res, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// update ... returning не сохраняет порядок, а раздаём в порядке создания
+	slices.SortFunc(res, func(a, b DomainEvent) int { return cmp.Compare(a.ID, b.ID) })
+	return res, nil
+}
+
+// handledSubscribers — подписчики, уже обработавшие событие id.
+func (db *DB) handledSubscribers(ctx context.Context, id int64) ([]string, error) {
+	rows, err := db.Pool.Query(ctx, `select subscriber from outbox_handled where event_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) markEventHandled(ctx context.Context, id int64, subscriber string) error {
+	_, err := db.Pool.Exec(ctx, `
+		insert into outbox_handled (event_id, subscriber) values ($1, $2)
+		on conflict do nothing
+	`, id, subscriber)
+	return err
+}
+
+// finishEvent записывает итог обработки; retryAt == nil при ошибке — больше не пытаться.
+func (db *DB) finishEvent(ctx context.Context, id int64, handleErr error, retryAt *time.Time) error {
+	if handleErr == nil {
+		_, err := db.Pool.Exec(ctx, `
+			update outbox
+			set status = 'done', attempts = attempts + 1, last_error = null, processed_at = now()
+			where id = $1
+		`, id)
+		return err
+	}
+	_, err := db.Pool.Exec(ctx, `
+		update outbox
+		set status = case when $3::timestamptz is null then 'failed' else 'pending' end,
+		    attempts = attempts + 1, last_error = $2,
+		    next_attempt_at = coalesce($3, next_attempt_at)
+		where id = $1
+	`, id, trim(handleErr.Error(), 1000), retryAt)
+	return err
+}
+
+// EventBus раздаёт события из outbox подписчикам: уведомления жителю,
+// webhooks, сообщения сотрудникам о назначении и просрочке SLA, сводку
+// для администраторов. Каждый подписчик отмечается в
+// outbox_handled, и при повторе событие получают только те, у кого
+// обработка не удалась; повторы идут с растущей паузой, пока не кончатся
+// MaxAttempts. О новых событиях узнаёт через LISTEN сразу после коммита,
+// а раз в Interval на всякий случай проверяет очередь сам.
+type EventBus struct {
+	DB          *DB
+	MaxAttempts int
+	Interval    time.Duration
+
+	handlers map[string][]EventHandler
+}
+
+func NewEventBus(db *DB, cfg *Config) *EventBus {
+	return &EventBus{
+		DB:          db,
+		MaxAttempts: cfg.OutboxMaxAttempts,
+		Interval:    cfg.OutboxInterval,
+		handlers:    make(map[string][]EventHandler),
+	}
+}
+
+// Subscribe подписывает h на события events. Вызывать до Run.
+func (b *EventBus) Subscribe(h EventHandler, events ...string) {
+	for _, e := range events {
+		b.handlers[e] = append(b.handlers[e], h)
+	}
+}
+
+func (b *EventBus) Run(ctx context.Context) {
+	wake := make(chan struct{}, 1)
+	go b.listen(ctx, wake)
+
+	t := time.NewTicker(b.Interval)
+	defer t.Stop()
+	for {
+		b.drain(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-wake:
+		}
+	}
+}
+
+// listen будит Run по pg_notify из publishEvent. Если соединение
+// оборвалось, переподключается; до тех пор события подхватывает опрос.
+func (b *EventBus) listen(ctx context.Context, wake chan<- struct{}) {
+	for ctx.Err() == nil {
+		err := b.waitNotifications(ctx, wake)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("outbox: listen: %v", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(b.Interval):
+		}
+	}
+}
+
+func (b *EventBus) waitNotifications(ctx context.Context, wake chan<- struct{}) error {
+	c, err := b.DB.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// соединение с LISTEN не должно вернуться в пул
+	conn := c.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, `listen `+outboxChannel); err != nil {
+		return err
+	}
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *EventBus) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		events, err := b.DB.claimEvents(ctx, 50, 5*time.Minute)
+		if err != nil {
+			log.Printf("outbox: %v", err)
+			return
+		}
+		if len(events) == 0 {
+			return
+		}
+		for i := range events {
+			b.dispatch(ctx, &events[i])
+		}
+	}
+}
+
+func (b *EventBus) dispatch(ctx context.Context, ev *DomainEvent) {
+	done, err := b.DB.handledSubscribers(ctx, ev.ID)
+	if err != nil {
+		log.Printf("outbox: событие %d: %v", ev.ID, err)
+		return
+	}
+
+	var errs []string
+	for _, h := range b.handlers[ev.Type] {
+		if slices.Contains(done, h.Name()) {
+			continue
+		}
+		if err := h.Handle(ctx, ev); err != nil {
+			errs = append(errs, h.Name()+": "+err.Error())
+			continue
+		}
+		if err := b.DB.markEventHandled(ctx, ev.ID, h.Name()); err != nil {
+			errs = append(errs, h.Name()+": "+err.Error())
+		}
+	}
+	if ctx.Err() != nil {
+		// остановка сервера: событие вернётся в очередь по истечении lease
+		return
+	}
+
+	var handleErr error
+	var retryAt *time.Time
+	if len(errs) > 0 {
+		handleErr = errors.New(strings.Join(errs, "; "))
+		if attempt := ev.Attempts + 1; attempt < b.MaxAttempts {
+			at := time.Now().Add(eventBackoff(attempt))
+			retryAt = &at
+		} else {
+			log.Printf("outbox: событие %d (%s, заявка #%d) не обработано после %d попыток: %v",
+				ev.ID, ev.Type, ev.IssueID, attempt, handleErr)
+		}
+	}
+	if err := b.DB.finishEvent(ctx, ev.ID, handleErr, retryAt); err != nil {
+		log.Printf("outbox: событие %d: %v", ev.ID, err)
+	}
+}
+
+// eventBackoff — пауза перед попыткой attempt+1: 10 с, 20 с, 40 с… но не больше часа.
+func eventBackoff(attempt int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
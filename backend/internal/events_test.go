@@ -0,0 +1,54 @@
+package internal
+
+import "testing"
+
+func TestNewEventIssueStripsLegacyWebContacts(t *testing.T) {
+	str := func(s string) *string { return &s }
+	citizenID := int64(5)
+	cases := []struct {
+		name       string
+		iss        Issue
+		wantSource string
+		wantText   *string
+	}{
+		{
+			name:       "старая заявка с сайта",
+			iss:        Issue{UserID: webUserID, Text: str("Имя: Иван\nКонтакт: +79001234567\n\nОписание проблемы:\nЯма у подъезда")},
+			wantSource: "web",
+			wantText:   str("Яма у подъезда"),
+		},
+		{
+			name:       "старая заявка без описания",
+			iss:        Issue{UserID: webUserID, Text: str("Имя: Иван\nКонтакт: ivan@example.org\n\nОписание проблемы:\n(не заполнено)")},
+			wantSource: "web",
+		},
+		{
+			name:       "старая заявка без разметки",
+			iss:        Issue{UserID: webUserID, Text: str("Контакт: +79001234567, не горит фонарь")},
+			wantSource: "web",
+		},
+		{
+			name:       "заявка с сайта с профилем жителя",
+			iss:        Issue{UserID: webUserID, CitizenID: &citizenID, Text: str("Не горит фонарь")},
+			wantSource: "web",
+			wantText:   str("Не горит фонарь"),
+		},
+		{
+			name:       "заявка из Telegram",
+			iss:        Issue{UserID: 42, Text: str("Описание проблемы:\nтекст как есть")},
+			wantSource: "telegram",
+			wantText:   str("Описание проблемы:\nтекст как есть"),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ev := newEventIssue(&tc.iss)
+			if ev.Source != tc.wantSource {
+				t.Fatalf("source %q, ожидался %q", ev.Source, tc.wantSource)
+			}
+			if derefString(ev.Text) != derefString(tc.wantText) || (ev.Text == nil) != (tc.wantText == nil) {
+				t.Fatalf("text %v, ожидался %v", ev.Text, tc.wantText)
+			}
+		})
+	}
+}
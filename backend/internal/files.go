@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("вложение не найдено")
+	ErrUploadTooLarge     = errors.New("файл слишком большой")
+	ErrUploadTooMany      = errors.New("слишком много файлов")
+	ErrUploadType         = errors.New("недопустимый тип файла")
+)
+
+// UploadPolicy — ограничения на файлы, которые жители загружают с сайта.
+type UploadPolicy struct {
+	MaxFileSize  int64    // байт на файл
+	MaxFiles     int      // файлов на заявку всего
+	AllowedTypes []string // MIME-типы, определённые по содержимому
+}
+
+// SniffUpload определяет тип файла по первым байтам содержимого
+// (Content-Type от клиента не учитывается) и проверяет его и размер по политике.
+func (p UploadPolicy) SniffUpload(fh *multipart.FileHeader) (string, error) {
+	if fh.Size > p.MaxFileSize {
+		return "", fmt.Errorf("%w: %s больше %d МБ", ErrUploadTooLarge, sanitizeFileName(fh.Filename), p.MaxFileSize>>20)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	mimeType, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+	if !slices.Contains(p.AllowedTypes, mimeType) {
+		return "", fmt.Errorf("%w: %s (%s)", ErrUploadType, sanitizeFileName(fh.Filename), mimeType)
+	}
+	return mimeType, nil
+}
+
+// sanitizeFileName оставляет от присланного имени только базовое имя из букв,
+// цифр, пробелов и «._-», без ведущих точек и не длиннее 100 символов.
+// Используется только для показа: в хранилище файл лежит под ключом из содержимого.
+func sanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	var sb strings.Builder
+	n := 0
+	for _, r := range name {
+		if n >= 100 {
+			break
+		}
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '.', r == '-', r == '_':
+			sb.WriteRune(r)
+		case r == ' ':
+			sb.WriteRune('_')
+		default:
+			continue
+		}
+		n++
+	}
+	res := strings.TrimLeft(sb.String(), ".")
+	if res == "" {
+		return "file"
+	}
+	return res
+}
+
+func (db *DB) CountAttachments(ctx context.Context, issueID int64) (int, error) {
+	var n int
+	err := db.Pool.QueryRow(ctx, `select count(*) from attachments where issue_id = $1`, issueID).Scan(&n)
+	return n, err
+}
+
+// URLSigner выдаёт короткоживущие ссылки на вложения, подписанные HMAC-SHA256.
+// Ссылка работает без сессии, поэтому её можно вставить в <img> или открыть
+// в новой вкладке, но только до истечения срока.
+type URLSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewURLSigner создаёт подписчика с ключом secret. Без ключа он генерируется
+// при запуске: ссылки перестанут работать после перезапуска и не подойдут
+// другим экземплярам сервера.
+func NewURLSigner(secret string, ttl time.Duration) *URLSigner {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		log.Println("FILE_URL_SECRET не задан, ссылки на вложения подписываются случайным ключом")
+	}
+	return &URLSigner{key: key, ttl: ttl}
+}
+
+func (s *URLSigner) sign(attachmentID int64, exp int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "attachment:%d:%d", attachmentID, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AttachmentURL — подписанная ссылка на вложение, действует ttl.
+func (s *URLSigner) AttachmentURL(attachmentID int64) string {
+	exp := time.Now().Add(s.ttl).Unix()
+	return fmt.Sprintf("/attachments/%d?exp=%d&sig=%s", attachmentID, exp, s.sign(attachmentID, exp))
+}
+
+// Verify проверяет подпись и срок ссылки; возвращает, сколько ей ещё жить.
+func (s *URLSigner) Verify(attachmentID int64, expParam, sig string) (time.Duration, bool) {
+	exp, err := strconv.ParseInt(expParam, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	left := time.Until(time.Unix(exp, 0))
+	if left <= 0 {
+		return 0, false
+	}
+	return left, hmac.Equal([]byte(sig), []byte(s.sign(attachmentID, exp)))
+}
+
+// SignAttachments проставляет вложениям подписанные ссылки.
+func (s *URLSigner) SignAttachments(list []Attachment) {
+	for i := range list {
+		list[i].URL = s.AttachmentURL(list[i].ID)
+	}
+}
+
+// attachmentInline — вложение безопасно показывать в браузере на нашем домене.
+// Остальное (в том числе HTML и SVG) отдаётся только на скачивание.
+func attachmentInline(fileType string) bool {
+	switch fileType {
+	case "photo", "video", "video_note", "voice", "audio", "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return strings.HasPrefix(fileType, "video/") || strings.HasPrefix(fileType, "audio/")
+}
+
+// attachmentContentType — Content-Type для показа в браузере.
+func attachmentContentType(fileType string) string {
+	switch {
+	case strings.Contains(fileType, "/"):
+		return fileType
+	case fileType == "photo":
+		return "image/jpeg"
+	case fileType == "video", fileType == "video_note":
+		return "video/mp4"
+	case fileType == "voice":
+		return "audio/ogg"
+	case fileType == "audio":
+		return "audio/mpeg"
+	}
+	return "application/octet-stream"
+}
+
+// attachmentFileName — имя файла при скачивании. У файлов с сайта в file_id
+// лежит очищенное имя, у файлов из Telegram — только file_id.
+func attachmentFileName(a *Attachment) string {
+	if strings.Contains(a.FileType, "/") && a.FileID != "" {
+		return a.FileID
+	}
+	return fmt.Sprintf("attachment-%d", a.ID)
+}
+
+func (db *DB) GetAttachment(ctx context.Context, id int64) (*Attachment, error) {
+	var a Attachment
+	err := scanAttachment(db.Pool.QueryRow(ctx, `
+		select `+attachmentColumns+`
+		from attachments where id = $1
+	`, id), &a)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// NewIssueAccessToken выдаёт автору заявки токен доступа к ней (прежний перестаёт действовать).
+func (db *DB) NewIssueAccessToken(ctx context.Context, issueID int64) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	cmd, err := db.Pool.Exec(ctx,
+		`update issues set access_token_hash = $2 where id = $1`, issueID, hashSessionToken(token))
+	if err != nil {
+		return "", err
+	}
+	if cmd.RowsAffected() == 0 {
+		return "", ErrIssueNotFound
+	}
+	return token, nil
+}
+
+// CheckIssueAccessToken — token выдан автору заявки issueID.
+func (db *DB) CheckIssueAccessToken(ctx context.Context, issueID int64, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	var hash *string
+	err := db.Pool.QueryRow(ctx, `select access_token_hash from issues where id = $1`, issueID).Scan(&hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return hash != nil && subtle.ConstantTimeCompare([]byte(*hash), []byte(hashSessionToken(token))) == 1, nil
+}
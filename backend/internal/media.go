@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Состояние скачивания файла вложения из Telegram.
+const (
+	DownloadPending = "pending" // ждёт скачивания, бот отправляет его по file_id
+	DownloadDone    = "done"
+	DownloadFailed  = "failed" // попытки кончились или файл не подходит
+)
+
+var errMediaTooLarge = errors.New("файл больше допустимого размера")
+
+// ClaimPendingDownloads забирает до limit вложений, которым пора скачиваться,
+// и откладывает их повтор на lease. Если процесс упадёт посреди скачивания,
+// вложение вернётся в очередь, когда lease истечёт; другие экземпляры
+// за это время его не возьмут.
+func (db *DB) ClaimPendingDownloads(ctx context.Context, limit int, lease time.Duration) ([]Attachment, error) {
+	rows, err := db.Pool.Query(ctx, `
+		update attachments
+		set next_download_at = now() + make_interval(secs => $2)
+		where id in (
+			select id from attachments
+			where download_status = 'pending'
+			  and (next_download_at is null or next_download_at <= now())
+			order by id
+			limit $1
+			for update skip locked
+		)
+		returning `+attachmentColumns, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+// FinishDownload отмечает вложение скачанным в хранилище под ключом key.
+func (db *DB) FinishDownload(ctx context.Context, id int64, key string, size int64) error {
+	_, err := db.Pool.Exec(ctx, `
+		update attachments
+		set blob_key = $2, size = $3, download_status = 'done',
+		    download_attempts = download_attempts + 1, download_error = null, next_download_at = null
+		where id = $1
+	`, id, key, size)
+	return err
+}
+
+// FailDownload засчитывает неудачную попытку. retryAt == nil — больше не пытаться.
+func (db *DB) FailDownload(ctx context.Context, id int64, reason string, retryAt *time.Time) error {
+	_, err := db.Pool.Exec(ctx, `
+		update attachments
+		set download_attempts = download_attempts + 1, download_error = $2,
+		    download_status = case when $3::timestamptz is null then 'failed' else 'pending' end,
+		    next_download_at = $3
+		where id = $1
+	`, id, trim(reason, 500), retryAt)
+	return err
+}
+
+// MediaFetcher в фоне скачивает файлы вложений из Telegram в хранилище.
+// Очередь — сами строки attachments со статусом pending, поэтому она
+// переживает перезапуск. Неудачные попытки повторяются с растущей паузой,
+// пока не кончатся MaxAttempts.
+type MediaFetcher struct {
+	DB          *DB
+	API         *tgbotapi.BotAPI
+	Blobs       BlobStore
+	Client      *http.Client
+	MaxSize     int64         // больше скачивать не будем
+	Timeout     time.Duration // на одно скачивание
+	MaxAttempts int
+	Interval    time.Duration // как часто проверять очередь без Wake
+
+	wake chan struct{}
+}
+
+func NewMediaFetcher(db *DB, api *tgbotapi.BotAPI, blobs BlobStore, cfg *Config) *MediaFetcher {
+	return &MediaFetcher{
+		DB:          db,
+		API:         api,
+		Blobs:       blobs,
+		Client:      &http.Client{Timeout: cfg.MediaFetchTimeout},
+		MaxSize:     cfg.MediaMaxFileSize,
+		Timeout:     cfg.MediaFetchTimeout,
+		MaxAttempts: cfg.MediaMaxAttempts,
+		Interval:    cfg.MediaFetchInterval,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Wake просит не ждать следующей проверки очереди: появилось новое вложение.
+func (f *MediaFetcher) Wake() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *MediaFetcher) Run(ctx context.Context) {
+	t := time.NewTicker(f.Interval)
+	defer t.Stop()
+	for {
+		f.drain(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-f.wake:
+		}
+	}
+}
+
+// drain скачивает всё, чему пора, по несколько вложений за раз.
+func (f *MediaFetcher) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		list, err := f.DB.ClaimPendingDownloads(ctx, 10, f.Timeout+time.Minute)
+		if err != nil {
+			log.Printf("скачивание вложений: %v", err)
+			return
+		}
+		if len(list) == 0 {
+			return
+		}
+		for i := range list {
+			f.fetch(ctx, &list[i])
+		}
+	}
+}
+
+func (f *MediaFetcher) fetch(ctx context.Context, a *Attachment) {
+	key, size, err := f.download(ctx, a)
+	if err == nil {
+		if err := f.DB.FinishDownload(ctx, a.ID, key, size); err != nil {
+			log.Printf("вложение %d: %v", a.ID, err)
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		// остановка сервера: вложение вернётся в очередь по истечении lease
+		return
+	}
+
+	attempt := a.DownloadAttempts + 1
+	var retryAt *time.Time
+	if !permanentDownloadError(err) && attempt < f.MaxAttempts {
+		at := time.Now().Add(downloadBackoff(attempt))
+		retryAt = &at
+	}
+	if retryAt == nil {
+		log.Printf("вложение %d заявки #%d не скачано (попытка %d): %v", a.ID, a.IssueID, attempt, err)
+	}
+	if err := f.DB.FailDownload(ctx, a.ID, err.Error(), retryAt); err != nil {
+		log.Printf("вложение %d: %v", a.ID, err)
+	}
+}
+
+func (f *MediaFetcher) download(ctx context.Context, a *Attachment) (string, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+	defer cancel()
+
+	rc, err := f.Open(ctx, a.FileID)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+	return PutBlob(ctx, f.Blobs, rc, attachmentContentType(a.FileType))
+}
+
+// Open открывает файл Telegram по file_id. Читать из него больше MaxSize
+// нельзя: чтение вернёт ошибку, даже если Telegram не сообщил размер заранее.
+func (f *MediaFetcher) Open(ctx context.Context, fileID string) (io.ReadCloser, error) {
+	tgFile, err := f.API.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, err
+	}
+	if int64(tgFile.FileSize) > f.MaxSize {
+		return nil, fmt.Errorf("%w: %d байт", errMediaTooLarge, tgFile.FileSize)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tgFile.Link(f.API.Token), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("скачивание файла из Telegram: %s", resp.Status)
+	}
+	return &maxSizeReader{ReadCloser: resp.Body, left: f.MaxSize}, nil
+}
+
+// maxSizeReader обрывает чтение ошибкой errMediaTooLarge после left байт.
+type maxSizeReader struct {
+	io.ReadCloser
+	left int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 {
+		return n, errMediaTooLarge
+	}
+	return n, err
+}
+
+// permanentDownloadError — повтор не поможет: файл слишком большой
+// или Telegram отказал в запросе (например, file_id недействителен).
+func permanentDownloadError(err error) bool {
+	var tgErr *tgbotapi.Error
+	return errors.Is(err, errMediaTooLarge) || errors.As(err, &tgErr) && tgErr.Code == http.StatusBadRequest
+}
+
+// downloadBackoff — пауза перед попыткой attempt+1: 30 с, 1 мин, 2 мин… но не больше часа.
+func downloadBackoff(attempt int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ключ advisory-блокировки, под которой применяются миграции,
+// чтобы несколько одновременно стартующих экземпляров не гонялись друг с другом
+const migrationsLockKey int64 = 112_000_001
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_([a-zA-Z0-9_]+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt *time.Time
+}
+
+type Migrator struct {
+	DB         *DB
+	Migrations []Migration
+}
+
+func NewMigrator(db *DB, fsys fs.FS) (*Migrator, error) {
+	list, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Migrations: list}, nil
+}
+
+// LoadMigrations читает пары NNNN_name.up.sql / NNNN_name.down.sql из корня fsys.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("чтение каталога миграций: %w", err)
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("некорректный номер миграции %s: %w", e.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, path.Join(".", e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("чтение миграции %s: %w", e.Name(), err)
+		}
+
+		mg := byVersion[version]
+		if mg == nil {
+			mg = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mg
+		}
+		if mg.Name != m[2] {
+			return nil, fmt.Errorf("миграция %d: разные имена %q и %q", version, mg.Name, m[2])
+		}
+		if m[3] == "up" {
+			mg.Up = string(body)
+		} else {
+			mg.Down = string(body)
+		}
+	}
+
+	res := make([]Migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		if mg.Up == "" {
+			return nil, fmt.Errorf("миграция %d_%s: нет файла .up.sql", mg.Version, mg.Name)
+		}
+		res = append(res, *mg)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Version < res[j].Version })
+	return res, nil
+}
+
+// Up применяет все ещё не применённые миграции по порядку.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		count := 0
+		for _, mg := range m.Migrations {
+			if _, ok := applied[mg.Version]; ok {
+				continue
+			}
+			if err := applyMigration(ctx, conn, mg, true); err != nil {
+				return err
+			}
+			log.Printf("Миграция %04d_%s применена", mg.Version, mg.Name)
+			count++
+		}
+		if count == 0 {
+			log.Println("Схема базы данных актуальна, новых миграций нет")
+		}
+		return nil
+	})
+}
+
+// Down откатывает steps последних применённых миграций.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	if steps < 1 {
+		return errors.New("количество шагов отката должно быть не меньше 1")
+	}
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.Migrations) - 1; i >= 0 && steps > 0; i-- {
+			mg := m.Migrations[i]
+			if _, ok := applied[mg.Version]; !ok {
+				continue
+			}
+			if mg.Down == "" {
+				return fmt.Errorf("миграция %04d_%s не поддерживает откат", mg.Version, mg.Name)
+			}
+			if err := applyMigration(ctx, conn, mg, false); err != nil {
+				return err
+			}
+			log.Printf("Миграция %04d_%s откачена", mg.Version, mg.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// Status возвращает список известных миграций с отметкой о применении.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var res []MigrationStatus
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.Migrations {
+			st := MigrationStatus{Version: mg.Version, Name: mg.Name}
+			if at, ok := applied[mg.Version]; ok {
+				st.Applied = true
+				st.AppliedAt = &at
+			}
+			res = append(res, st)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.DB.Pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("получение соединения для миграций: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `select pg_advisory_lock($1)`, migrationsLockKey); err != nil {
+		return fmt.Errorf("блокировка миграций: %w", err)
+	}
+	defer func() {
+		// контекст мог быть уже отменён, снимаем блокировку в любом случае
+		if _, err := conn.Exec(context.Background(), `select pg_advisory_unlock($1)`, migrationsLockKey); err != nil {
+			log.Printf("снятие блокировки миграций: %v", err)
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, `
+		create table if not exists schema_migrations (
+			version bigint primary key,
+			name text not null,
+			applied_at timestamptz not null default now()
+		)
+	`); err != nil {
+		return fmt.Errorf("создание schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.Query(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := map[int64]time.Time{}
+	for rows.Next() {
+		var v int64
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		res[v] = at
+	}
+	return res, rows.Err()
+}
+
+func applyMigration(ctx context.Context, conn *pgxpool.Conn, mg Migration, up bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	body := mg.Up
+	if !up {
+		body = mg.Down
+	}
+	if _, err := tx.Exec(ctx, body); err != nil {
+		return fmt.Errorf("миграция %04d_%s: %w", mg.Version, mg.Name, err)
+	}
+
+	if up {
+		_, err = tx.Exec(ctx, `insert into schema_migrations (version, name) values ($1, $2)`, mg.Version, mg.Name)
+	} else {
+		_, err = tx.Exec(ctx, `delete from schema_migrations where version = $1`, mg.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("запись версии %d: %w", mg.Version, err)
+	}
+
+	return tx.Commit(ctx)
+}
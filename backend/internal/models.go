@@ -1,6 +1,9 @@
 package internal
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
 	ID        int64     `db:"id"`
@@ -31,6 +34,102 @@ type Issue struct {
 	Category  *string   `db:"category"`
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
+	Version   int       `db:"version"` // растёт при каждом изменении, для оптимистичной блокировки
+
+	// отметки о нарушении SLA, ставит SLAScheduler
+	ResponseOverdueAt   *time.Time `db:"response_overdue_at"`
+	ResolutionOverdueAt *time.Time `db:"resolution_overdue_at"`
+
+	DepartmentID *int64 `db:"department_id"` // ответственная служба
+	AssigneeID   *int64 `db:"assignee_id"`   // исполнитель, users.id
+	Priority     string `db:"priority"`      // см. IssuePriority
+
+	ContactPhone *string `db:"contact_phone"` // из контакта, которым житель поделился в боте
+	CitizenID    *int64  `db:"citizen_id"`    // профиль жителя, подавшего заявку с сайта
+	TrackingCode string  `db:"tracking_code"` // код публичной страницы заявки, см. TrackingURL
+}
+
+// IssueFilter — условия выборки заявок для списков в админке.
+type IssueFilter struct {
+	Statuses     []string
+	District     *string
+	Category     *string
+	DepartmentID *int64
+	AssigneeID   *int64 // users.id исполнителя
+	OverdueOnly  bool   // только открытые заявки с нарушенным SLA
+}
+
+// Department — служба, которой можно поручить заявку (ЖКХ, дороги и т.п.).
+type Department struct {
+	ID        int64     `db:"id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// StaffMember — администратор и службы, в которых он состоит.
+type StaffMember struct {
+	UserID      int64   `db:"user_id"`
+	TGUserID    int64   `db:"tg_user_id"`
+	Username    *string `db:"username"`
+	FirstName   *string `db:"first_name"`
+	LastName    *string `db:"last_name"`
+	Departments []int64 `db:"departments"`
+}
+
+// GeoPoint — вершина полигона правила маршрутизации.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// RoutingRule — правило автоматической маршрутизации новых заявок.
+// Все заданные условия должны совпасть; из Keywords достаточно одного слова.
+type RoutingRule struct {
+	ID           int64      `db:"id"`
+	Name         string     `db:"name"`
+	Position     int        `db:"position"`
+	Enabled      bool       `db:"enabled"`
+	District     *string    `db:"district"`
+	Category     *string    `db:"category"`
+	Keywords     []string   `db:"keywords"`
+	Polygon      []GeoPoint `db:"polygon"`
+	DepartmentID *int64     `db:"department_id"`
+	Priority     *string    `db:"priority"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UpdatedAt    time.Time  `db:"updated_at"`
+}
+
+// RoutingDecision — запись журнала маршрутизации заявки.
+type RoutingDecision struct {
+	ID           int64     `db:"id"`
+	IssueID      int64     `db:"issue_id"`
+	RuleID       *int64    `db:"rule_id"`
+	RuleName     *string   `db:"rule_name"`
+	DepartmentID *int64    `db:"department_id"`
+	Priority     *string   `db:"priority"`
+	Reason       string    `db:"reason"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+// IssueAssignment — запрос на назначение заявки службе и/или исполнителю.
+type IssueAssignment struct {
+	IssueID         int64
+	DepartmentID    *int64     // nil — оставить текущую службу или взять службу исполнителя
+	ClearDepartment bool       // снять службу (DepartmentID игнорируется)
+	AssigneeID      *int64     // users.id; nil — снять исполнителя
+	AssignedByTG    *int64     // кто назначил; самому себе уведомление не шлём
+	By              *Principal // права назначающего: заявка должна остаться в его области
+
+	ExpectedVersion *int
+}
+
+type SLARule struct {
+	ID                   int64     `db:"id"`
+	Category             string    `db:"category"`
+	District             *string   `db:"district"` // nil — для всех районов
+	FirstResponseMinutes int       `db:"first_response_minutes"`
+	ResolutionMinutes    int       `db:"resolution_minutes"`
+	CreatedAt            time.Time `db:"created_at"`
 }
 
 type Attachment struct {
@@ -38,8 +137,15 @@ type Attachment struct {
 	IssueID   int64     `db:"issue_id"`
 	FileID    string    `db:"file_id"`
 	FileType  string    `db:"file_type"`
-	LocalPath string    `db:"local_path"`
+	LocalPath string    `db:"local_path"` // только у вложений, сохранённых до BlobStore
+	BlobKey   *string   `db:"blob_key"`   // ключ в BlobStore
+	Size      *int64    `db:"size"`
 	CreatedAt time.Time `db:"created_at"`
+
+	DownloadStatus   string `db:"download_status"` // DownloadPending/Done/Failed, см. MediaFetcher
+	DownloadAttempts int    `db:"download_attempts"`
+
+	URL string `db:"-"` // подписанная ссылка на файл, см. URLSigner
 }
 
 type StatusChange struct {
@@ -52,14 +158,98 @@ type StatusChange struct {
 	CreatedAt time.Time `db:"created_at"`
 }
 
+// StatusUpdate — запрос на смену статуса заявки.
+type StatusUpdate struct {
+	IssueID     int64
+	Status      string
+	ChangedByTG *int64  // tg user id администратора, если известен
+	Comment     *string // причина; обязательна при отклонении
+	Reopen      bool    // явное переоткрытие закрытой заявки
+
+	ExpectedVersion *int // если задано, статус меняется только при совпадении версии
+}
+
+// Видимость комментария к заявке.
+const (
+	CommentInternal = "internal" // заметка только для сотрудников
+	CommentPublic   = "public"   // ответ, который получает житель
+)
+
 type Comment struct {
 	ID          int64     `db:"id"`
 	IssueID     int64     `db:"issue_id"`
 	AdminUserID int64     `db:"admin_user_id"`
 	Text        string    `db:"text"`
+	Visibility  string    `db:"visibility"` // CommentInternal или CommentPublic
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// NotificationDelivery — отправка уведомления жителю по одному каналу.
+type NotificationDelivery struct {
+	ID        int64      `db:"id"`
+	IssueID   int64      `db:"issue_id"`
+	EventID   *int64     `db:"event_id"`  // событие outbox, из-за которого отправлено
+	Kind      string     `db:"kind"`      // NotifyStatusChanged, NotifyComment
+	Channel   string     `db:"channel"`   // ChannelTelegram, ChannelEmail
+	Recipient string     `db:"recipient"` // chat id или e-mail
+	Subject   string     `db:"subject"`
+	Body      string     `db:"body"`
+	Status    string     `db:"status"` // DeliveryPending, DeliverySent, DeliveryFailed
+	Error     *string    `db:"error"`
+	CreatedAt time.Time  `db:"created_at"`
+	SentAt    *time.Time `db:"sent_at"`
+}
+
+// WebhookSubscription — подписка внешней системы на события заявок.
+type WebhookSubscription struct {
+	ID        int64     `db:"id"`
+	Name      string    `db:"name"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret" json:"-"` // отдаётся только при создании подписки и смене секрета
+	Events    []string  `db:"events"`
+	Enabled   bool      `db:"enabled"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// WebhookDelivery — доставка одного события одной подписке.
+type WebhookDelivery struct {
+	ID             int64           `db:"id"`
+	SubscriptionID int64           `db:"subscription_id"`
+	EventID        string          `db:"event_id"`
+	Event          string          `db:"event"`
+	Payload        json.RawMessage `db:"payload"`
+	Status         string          `db:"status"` // WebhookPending, WebhookDelivered, WebhookFailed
+	Attempts       int             `db:"attempts"`
+	NextAttemptAt  time.Time       `db:"next_attempt_at"`
+	ResponseCode   *int            `db:"response_code"`
+	LastError      *string         `db:"last_error"`
+	CreatedAt      time.Time       `db:"created_at"`
+	DeliveredAt    *time.Time      `db:"delivered_at"`
+}
+
+// IssueMessage — сообщение жителя по уже созданной заявке.
+type IssueMessage struct {
+	ID          int64     `db:"id"`
+	IssueID     int64     `db:"issue_id"`
+	UserID      *int64    `db:"user_id"`
+	Text        *string   `db:"text"`
+	TGChatID    *int64    `db:"tg_chat_id"`
+	TGMessageID *int      `db:"tg_message_id"`
 	CreatedAt   time.Time `db:"created_at"`
 }
 
+// ThreadEntry — запись переписки по заявке (сообщение жителя или комментарий администрации).
+type ThreadEntry struct {
+	Author     string    `db:"author"`     // ThreadAuthorCitizen или ThreadAuthorStaff
+	Visibility string    `db:"visibility"` // для сообщений жителя всегда CommentPublic
+	UserID     *int64    `db:"user_id"`
+	FirstName  *string   `db:"first_name"`
+	Username   *string   `db:"username"`
+	Text       string    `db:"text"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
 type ExportRow struct {
 	ID        int64     `db:"id"`
 	CreatedAt time.Time `db:"created_at"`
@@ -82,9 +272,121 @@ type WebIssueRequest struct {
 	Location    *string  `json:"location,omitempty"`
 }
 
+// WebAttachment — файл с сайта, уже сохранённый в BlobStore.
 type WebAttachment struct {
 	FileName string `json:"file_name"`
 	FileSize int64  `json:"file_size"`
 	FileType string `json:"file_type"`
-	FileURL  string `json:"file_url"`
+	BlobKey  string `json:"blob_key"`
+}
+
+// AdminAccount — учётная запись веб-админки. Хеш пароля наружу не отдаётся.
+type AdminAccount struct {
+	ID           int64      `db:"id"`
+	Login        string     `db:"login"`
+	Role         AdminRole  `db:"role"`
+	DepartmentID *int64     `db:"department_id"` // область: только заявки этой службы
+	District     *string    `db:"district"`      // область: только заявки этого района
+	TGUserID     *int64     `db:"tg_user_id"`    // Telegram-аккаунт сотрудника
+	DisabledAt   *time.Time `db:"disabled_at"`
+	LastLoginAt  *time.Time `db:"last_login_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+// AdminSession — сессия веб-админки; сам токен знает только клиент.
+type AdminSession struct {
+	ID         int64      `db:"id"`
+	AccountID  int64      `db:"account_id"`
+	UserAgent  *string    `db:"user_agent"`
+	IP         *string    `db:"ip"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastSeenAt time.Time  `db:"last_seen_at"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+}
+
+// Citizen — житель, подающий заявки с сайта. Заявки одного человека
+// собираются по телефону или e-mail; привязанный Telegram (UserID) получает
+// уведомления по ним и видит их в боте.
+type Citizen struct {
+	ID    int64   `db:"id"`
+	Name  *string `db:"name"`
+	Phone *string `db:"phone"` // +<цифры>
+	Email *string `db:"email"` // в нижнем регистре
+	// EmailVerifiedAt — житель перешёл по ссылке из письма; до этого писем с уведомлениями нет
+	EmailVerifiedAt *time.Time `db:"email_verified_at"`
+	UserID          *int64     `db:"user_id"`
+	TGUserID        *int64     `db:"tg_user_id"` // из users, для привязанного Telegram
+	LinkedAt        *time.Time `db:"linked_at"`
+	CreatedAt       time.Time  `db:"created_at"`
+	UpdatedAt       time.Time  `db:"updated_at"`
+}
+
+// IssueTracking — то, что видно по публичному коду заявки: ни текста обращения,
+// ни контактов, ни имён сотрудников.
+type IssueTracking struct {
+	ID        int64
+	Status    string
+	District  *string
+	Category  *string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Statuses  []TrackingStatus  // история статусов по порядку
+	Comments  []TrackingComment // только публичные ответы администрации
+}
+
+type TrackingStatus struct {
+	Status    string
+	CreatedAt time.Time
+}
+
+type TrackingComment struct {
+	Text      string
+	CreatedAt time.Time
+}
+
+// StaffUser — пользователь Telegram и его роль; Role == nil — не сотрудник.
+type StaffUser struct {
+	UserID       int64      `db:"id"`
+	TGUserID     int64      `db:"tg_user_id"`
+	Username     *string    `db:"username"`
+	FirstName    *string    `db:"first_name"`
+	LastName     *string    `db:"last_name"`
+	Role         *AdminRole `db:"role"`
+	DepartmentID *int64     `db:"scope_department_id"` // область: только заявки этой службы
+	District     *string    `db:"scope_district"`      // область: только заявки этого района
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+// StaffInvite — одноразовое приглашение сотрудника; сам токен знает только получатель ссылки.
+type StaffInvite struct {
+	ID                 int64      `db:"id"`
+	Role               AdminRole  `db:"role"`
+	DepartmentID       *int64     `db:"scope_department_id"`
+	District           *string    `db:"scope_district"`
+	CreatedByAccountID *int64     `db:"created_by_account_id"`
+	CreatedByTGUserID  *int64     `db:"created_by_tg_user_id"`
+	ExpiresAt          time.Time  `db:"expires_at"`
+	UsedAt             *time.Time `db:"used_at"`
+	UsedByUserID       *int64     `db:"used_by_user_id"`
+	RevokedAt          *time.Time `db:"revoked_at"`
+	CreatedAt          time.Time  `db:"created_at"`
+}
+
+// ThrottleLock — действующая блокировка после неудачных попыток входа.
+type ThrottleLock struct {
+	Scope       string    `db:"scope"`
+	Key         string    `db:"key"`
+	Lockouts    int       `db:"lockouts"` // блокировок подряд
+	LockedUntil time.Time `db:"locked_until"`
+}
+
+// SecurityEvent — запись журнала безопасности.
+type SecurityEvent struct {
+	ID        int64     `db:"id"`
+	Kind      string    `db:"kind"`
+	Subject   *string   `db:"subject"` // логин, tg id и т.п.
+	IP        *string   `db:"ip"`
+	Details   *string   `db:"details"`
+	CreatedAt time.Time `db:"created_at"`
 }
@@ -0,0 +1,491 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Виды уведомлений жителю.
+const (
+	NotifyStatusChanged = "status_changed"
+	NotifyComment       = "comment"       // публичный ответ администрации
+	NotifyEmailConfirm  = "email_confirm" // ссылка подтверждения адреса, см. SMTPNotifier.ConfirmRecipient
+)
+
+// Каналы доставки уведомлений.
+const (
+	ChannelTelegram = "telegram"
+	ChannelEmail    = "email"
+)
+
+// Состояние доставки уведомления.
+const (
+	DeliveryPending = "pending"
+	DeliverySent    = "sent"
+	DeliveryFailed  = "failed"
+)
+
+// Notification — готовое к отправке уведомление по заявке.
+type Notification struct {
+	IssueID int64
+	Kind    string
+	Subject string // тема письма; в Telegram не используется
+	Text    string
+}
+
+// Notifier доставляет уведомления жителю одним каналом.
+type Notifier interface {
+	Channel() string
+	// Recipient — куда слать уведомления по заявке; "" — этим каналом житель недоступен.
+	Recipient(ctx context.Context, iss *Issue) (string, error)
+	Send(ctx context.Context, to string, n *Notification) error
+}
+
+// RecipientConfirmer — канал, адрес в котором житель должен сперва подтвердить.
+// ConfirmRecipient вызывается по issue.created и при необходимости просит
+// автора заявки подтвердить адрес; до этого Recipient его не возвращает.
+type RecipientConfirmer interface {
+	ConfirmRecipient(ctx context.Context, iss *Issue) error
+}
+
+// NotificationData — то, что подставляется в шаблоны уведомлений.
+type NotificationData struct {
+	IssueID     int64
+	Status      string
+	Text        string // комментарий к смене статуса или текст ответа
+	TrackingURL string
+	ConfirmURL  string // ссылка подтверждения e-mail
+}
+
+type notificationTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func mustNotificationTemplate(name, subject, body string) notificationTemplate {
+	return notificationTemplate{
+		subject: template.Must(template.New(name + ".subject").Parse(subject)),
+		body:    template.Must(template.New(name + ".body").Parse(body)),
+	}
+}
+
+// notificationTemplates — тексты уведомлений по видам, одни для всех каналов.
+var notificationTemplates = map[string]notificationTemplate{
+	NotifyStatusChanged: mustNotificationTemplate(NotifyStatusChanged,
+		`Заявка №{{.IssueID}}: {{.Status}}`,
+		`Статус вашей заявки #{{.IssueID}} изменён на: {{.Status}}
+{{- if .Text}}
+Комментарий: {{.Text}}{{end}}
+{{- if .TrackingURL}}
+
+Следить за заявкой: {{.TrackingURL}}{{end}}`),
+	NotifyComment: mustNotificationTemplate(NotifyComment,
+		`Ответ по заявке №{{.IssueID}}`,
+		`Ответ по вашей заявке #{{.IssueID}}:
+
+{{.Text}}
+{{- if .TrackingURL}}
+
+Следить за заявкой: {{.TrackingURL}}{{end}}`),
+	NotifyEmailConfirm: mustNotificationTemplate(NotifyEmailConfirm,
+		`Подтвердите адрес для уведомлений по заявке №{{.IssueID}}`,
+		`Этот адрес указан для связи в заявке #{{.IssueID}}, поданной на сайте.
+Чтобы получать на него уведомления о ваших заявках, перейдите по ссылке:
+{{.ConfirmURL}}
+
+Если вы не подавали заявку, просто удалите это письмо: без подтверждения
+писем на этот адрес больше не будет.`),
+}
+
+// renderNotification собирает уведомление kind по шаблону.
+func renderNotification(kind string, data NotificationData) (*Notification, error) {
+	t, ok := notificationTemplates[kind]
+	if !ok {
+		return nil, fmt.Errorf("неизвестный вид уведомления %q", kind)
+	}
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := t.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	return &Notification{IssueID: data.IssueID, Kind: kind, Subject: subject.String(), Text: body.String()}, nil
+}
+
+// Notifications — подписчик EventBus: по событиям issue.status_changed и
+// публичным issue.commented рассылает уведомления жителю всеми каналами,
+// которыми он доступен, и записывает каждую доставку в notification_deliveries.
+// По issue.created каналы-RecipientConfirmer просят подтвердить адрес.
+type Notifications struct {
+	DB        *DB
+	Cfg       *Config
+	Notifiers []Notifier
+}
+
+func NewNotifications(db *DB, cfg *Config, notifiers ...Notifier) *Notifications {
+	return &Notifications{DB: db, Cfg: cfg, Notifiers: notifiers}
+}
+
+func (n *Notifications) Name() string { return "notifications" }
+
+func (n *Notifications) Handle(ctx context.Context, ev *DomainEvent) error {
+	switch ev.Type {
+	case EventIssueCreated:
+		return n.confirmRecipients(ctx, ev.IssueID)
+	case EventIssueStatusChanged:
+		var sc eventStatusChange
+		if err := json.Unmarshal(ev.Payload, &sc); err != nil {
+			return err
+		}
+		return n.notify(ctx, ev.ID, ev.IssueID, NotifyStatusChanged, derefString(sc.Comment))
+	case EventIssueCommented:
+		var c eventComment
+		if err := json.Unmarshal(ev.Payload, &c); err != nil {
+			return err
+		}
+		if c.Visibility != CommentPublic {
+			return nil
+		}
+		return n.notify(ctx, ev.ID, ev.IssueID, NotifyComment, c.Text)
+	}
+	return nil
+}
+
+// confirmRecipients просит автора новой заявки подтвердить адреса в каналах,
+// которым это нужно.
+func (n *Notifications) confirmRecipients(ctx context.Context, issueID int64) error {
+	iss, err := n.DB.GetIssueByID(ctx, issueID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, nt := range n.Notifiers {
+		if rc, ok := nt.(RecipientConfirmer); ok {
+			if err := rc.ConfirmRecipient(ctx, iss); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", nt.Channel(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// notify сообщает автору заявки issueID о событии eventID вида kind; text —
+// комментарий к смене статуса или текст ответа. Если хоть один канал не
+// сработал, возвращает ошибку, и EventBus повторит событие: уже отправленные
+// по нему уведомления при этом не дублируются.
+func (n *Notifications) notify(ctx context.Context, eventID, issueID int64, kind, text string) error {
+	iss, err := n.DB.GetIssueByID(ctx, issueID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil // заявку удалили, сообщать некому
+	}
+	if err != nil {
+		return err
+	}
+	msg, err := renderNotification(kind, NotificationData{
+		IssueID:     iss.ID,
+		Status:      iss.Status,
+		Text:        text,
+		TrackingURL: TrackingURL(n.Cfg, iss.TrackingCode),
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, nt := range n.Notifiers {
+		to, err := nt.Recipient(ctx, iss)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nt.Channel(), err))
+			continue
+		}
+		if to == "" {
+			continue
+		}
+		d := &NotificationDelivery{
+			IssueID:   iss.ID,
+			EventID:   &eventID,
+			Kind:      kind,
+			Channel:   nt.Channel(),
+			Recipient: to,
+			Subject:   msg.Subject,
+			Body:      msg.Text,
+		}
+		if err := n.DB.AddNotificationDelivery(ctx, d); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nt.Channel(), err))
+			continue
+		}
+		if d.Status == DeliverySent {
+			continue
+		}
+		sendErr := nt.Send(ctx, to, msg)
+		if sendErr != nil {
+			log.Printf("уведомление по заявке #%d (%s) не доставлено: %v", issueID, nt.Channel(), sendErr)
+			errs = append(errs, fmt.Errorf("%s: %w", nt.Channel(), sendErr))
+		}
+		if err := n.DB.FinishNotificationDelivery(ctx, d.ID, sendErr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nt.Channel(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AddNotificationDelivery записывает доставку. Если по тому же событию этим
+// каналом доставка уже есть, возвращает её, не создавая новой.
+func (db *DB) AddNotificationDelivery(ctx context.Context, d *NotificationDelivery) error {
+	return db.Pool.QueryRow(ctx, `
+		insert into notification_deliveries (issue_id, event_id, kind, channel, recipient, subject, body)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		on conflict (event_id, channel) do update set event_id = excluded.event_id
+		returning id, status, created_at
+	`, d.IssueID, d.EventID, d.Kind, d.Channel, d.Recipient, d.Subject, d.Body).Scan(&d.ID, &d.Status, &d.CreatedAt)
+}
+
+// FinishNotificationDelivery отмечает доставку отправленной или, если sendErr != nil, неудачной.
+func (db *DB) FinishNotificationDelivery(ctx context.Context, id int64, sendErr error) error {
+	if sendErr != nil {
+		_, err := db.Pool.Exec(ctx, `
+			update notification_deliveries set status = 'failed', error = $2 where id = $1
+		`, id, trim(sendErr.Error(), 500))
+		return err
+	}
+	_, err := db.Pool.Exec(ctx, `
+		update notification_deliveries set status = 'sent', error = null, sent_at = now() where id = $1
+	`, id)
+	return err
+}
+
+// ListNotificationDeliveries — доставки уведомлений по заявке в порядке отправки.
+func (db *DB) ListNotificationDeliveries(ctx context.Context, issueID int64) ([]NotificationDelivery, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select id, issue_id, event_id, kind, channel, recipient, subject, body, status, error, created_at, sent_at
+		from notification_deliveries
+		where issue_id = $1
+		order by created_at, id
+	`, issueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []NotificationDelivery
+	for rows.Next() {
+		var d NotificationDelivery
+		if err := rows.Scan(&d.ID, &d.IssueID, &d.EventID, &d.Kind, &d.Channel, &d.Recipient, &d.Subject, &d.Body,
+			&d.Status, &d.Error, &d.CreatedAt, &d.SentAt); err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+// TelegramNotifier шлёт уведомления в чат заявки с кнопкой ответа (см. sendToCitizen).
+// Заявки с сайта без привязанного Telegram живут в служебном чате, туда не пишем.
+type TelegramNotifier struct {
+	Bot *Bot
+}
+
+func (t *TelegramNotifier) Channel() string { return ChannelTelegram }
+
+func (t *TelegramNotifier) Recipient(ctx context.Context, iss *Issue) (string, error) {
+	if iss.ChatID == webChatID {
+		return "", nil
+	}
+	return strconv.FormatInt(iss.ChatID, 10), nil
+}
+
+func (t *TelegramNotifier) Send(ctx context.Context, to string, n *Notification) error {
+	chatID, err := strconv.ParseInt(to, 10, 64)
+	if err != nil {
+		return fmt.Errorf("неверный chat id %q", to)
+	}
+	return t.Bot.sendToCitizen(ctx, chatID, n.IssueID, n.Text)
+}
+
+// SMTPNotifier шлёт уведомления письмом на e-mail жителя, оставленный на сайте.
+// Адрес из формы никто не проверял, поэтому уведомления уходят только на
+// подтверждённый: по новой заявке на неподтверждённый адрес уходит одно письмо
+// со ссылкой (не чаще раза в сутки), без текста заявки. Без PUBLIC_BASE_URL
+// ссылку не собрать, и e-mail канал фактически выключен.
+// Если сервер умеет STARTTLS, соединение шифруется; логин и пароль
+// без шифрования net/smtp передаёт только на localhost.
+type SMTPNotifier struct {
+	DB       *DB
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+	Timeout  time.Duration
+	BaseURL  string // PUBLIC_BASE_URL, для ссылки подтверждения
+}
+
+func NewSMTPNotifier(db *DB, cfg *Config) *SMTPNotifier {
+	return &SMTPNotifier{
+		DB:       db,
+		Addr:     cfg.SMTPAddr,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.SMTPFrom,
+		Timeout:  cfg.SMTPTimeout,
+		BaseURL:  cfg.PublicBaseURL,
+	}
+}
+
+func (s *SMTPNotifier) Channel() string { return ChannelEmail }
+
+func (s *SMTPNotifier) Recipient(ctx context.Context, iss *Issue) (string, error) {
+	if iss.CitizenID == nil {
+		return "", nil
+	}
+	c, err := s.DB.GetCitizen(ctx, *iss.CitizenID)
+	if errors.Is(err, ErrCitizenNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return verifiedEmail(c), nil
+}
+
+// verifiedEmail — e-mail жителя, если он подтверждён, иначе "".
+func verifiedEmail(c *Citizen) string {
+	if c.Email == nil || c.EmailVerifiedAt == nil {
+		return ""
+	}
+	return *c.Email
+}
+
+// ConfirmRecipient отправляет автору заявки ссылку подтверждения e-mail,
+// если адрес ещё не подтверждён и письмо не отправлялось в последние сутки.
+// Письмо не записывается в notification_deliveries: в нём токен.
+func (s *SMTPNotifier) ConfirmRecipient(ctx context.Context, iss *Issue) error {
+	if iss.CitizenID == nil || s.BaseURL == "" {
+		return nil
+	}
+	c, err := s.DB.GetCitizen(ctx, *iss.CitizenID)
+	if errors.Is(err, ErrCitizenNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if c.Email == nil || c.EmailVerifiedAt != nil {
+		return nil
+	}
+	token, err := s.DB.CreateEmailConfirmation(ctx, c.ID)
+	if errors.Is(err, ErrEmailConfirmSent) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	msg, err := renderNotification(NotifyEmailConfirm, NotificationData{
+		IssueID:    iss.ID,
+		ConfirmURL: strings.TrimRight(s.BaseURL, "/") + "/api/email/confirm?token=" + token,
+	})
+	if err == nil {
+		err = s.Send(ctx, *c.Email, msg)
+	}
+	if err != nil {
+		if cerr := s.DB.CancelEmailConfirmation(ctx, c.ID, token); cerr != nil {
+			log.Printf("отзыв подтверждения e-mail жителя %d: %v", c.ID, cerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SMTPNotifier) Send(ctx context.Context, to string, n *Notification) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("недопустимый адрес %q", to)
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(buildMail(s.From, to, n.Subject, n.Text)); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMail собирает письмо text/plain в UTF-8; тело в base64, чтобы
+// кириллица и длинные строки проходили через любой сервер.
+func buildMail(from, to, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+
+	enc := base64.StdEncoding.EncodeToString([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	for len(enc) > 76 {
+		b.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc + "\r\n")
+	return b.Bytes()
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP — SMTP-сервер на net.Listener без STARTTLS и AUTH: принимает
+// письма и запоминает конверт и данные.
+type fakeSMTP struct {
+	ln net.Listener
+
+	rejectRcpt bool // отвечать 550 на RCPT TO
+	silent     bool // не присылать приветствие, чтобы клиент ждал до таймаута
+
+	mu    sync.Mutex
+	mails []fakeMail
+}
+
+type fakeMail struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// startFakeSMTP запускает f на свободном порту; настройки f задаются до запуска.
+func startFakeSMTP(t *testing.T, f *fakeSMTP) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ln = ln
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	if f.silent {
+		io.Copy(io.Discard, conn) // держим соединение, пока клиент не сдастся
+		return
+	}
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	var m fakeMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			tp.PrintfLine("250-fake")
+			tp.PrintfLine("250 8BITMIME")
+		case "HELO", "NOOP", "RSET":
+			tp.PrintfLine("250 ok")
+		case "MAIL":
+			m = fakeMail{From: envelopeAddr(arg, "FROM:")}
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			if f.rejectRcpt {
+				tp.PrintfLine("550 no such user")
+				continue
+			}
+			m.To = append(m.To, envelopeAddr(arg, "TO:"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.Data = data
+			f.mu.Lock()
+			f.mails = append(f.mails, m)
+			f.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// envelopeAddr достаёт адрес из аргумента MAIL/RCPT: "FROM:<a@b> BODY=8BITMIME" → "a@b".
+func envelopeAddr(arg, prefix string) string {
+	addr, _, _ := strings.Cut(strings.TrimPrefix(arg, prefix), " ")
+	return strings.Trim(addr, "<>")
+}
+
+func (f *fakeSMTP) received() []fakeMail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeMail(nil), f.mails...)
+}
+
+func testSMTPNotifier(addr string) *SMTPNotifier {
+	return &SMTPNotifier{Addr: addr, From: "noreply@example.org", Timeout: 2 * time.Second}
+}
+
+func TestSMTPNotifierSendWithoutStartTLS(t *testing.T) {
+	srv := startFakeSMTP(t, &fakeSMTP{})
+	s := testSMTPNotifier(srv.ln.Addr().String())
+	n := &Notification{
+		IssueID: 42,
+		Subject: "Заявка №42: В работе",
+		Text:    "Статус вашей заявки #42 изменён на: В работе\nКомментарий: " + strings.Repeat("очень длинный текст ", 10),
+	}
+	if err := s.Send(context.Background(), "citizen@example.org", n); err != nil {
+		t.Fatal(err)
+	}
+
+	mails := srv.received()
+	if len(mails) != 1 {
+		t.Fatalf("получено писем: %d", len(mails))
+	}
+	m := mails[0]
+	if m.From != "noreply@example.org" || len(m.To) != 1 || m.To[0] != "citizen@example.org" {
+		t.Fatalf("конверт: from %q, to %v", m.From, m.To)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(m.Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("From"); got != "noreply@example.org" {
+		t.Fatalf("From: %q", got)
+	}
+	if got := msg.Header.Get("To"); got != "citizen@example.org" {
+		t.Fatalf("To: %q", got)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != n.Subject {
+		t.Fatalf("Subject: %q, %v", subject, err)
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Fatalf("Date: %v", err)
+	}
+	if got := msg.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Fatalf("Content-Type: %q", got)
+	}
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != "base64" {
+		t.Fatalf("Content-Transfer-Encoding: %q", got)
+	}
+
+	raw, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := bufio.NewScanner(strings.NewReader(string(raw)))
+	var enc strings.Builder
+	for sc.Scan() {
+		if len(sc.Text()) > 76 {
+			t.Fatalf("строка base64 длиннее 76 символов: %d", len(sc.Text()))
+		}
+		enc.WriteString(sc.Text())
+	}
+	body, err := base64.StdEncoding.DecodeString(enc.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.ReplaceAll(n.Text, "\n", "\r\n"); string(body) != want {
+		t.Fatalf("тело письма:\n%q\nожидалось:\n%q", body, want)
+	}
+}
+
+func TestSMTPNotifierRejectedRecipient(t *testing.T) {
+	srv := startFakeSMTP(t, &fakeSMTP{rejectRcpt: true})
+	s := testSMTPNotifier(srv.ln.Addr().String())
+
+	err := s.Send(context.Background(), "nobody@example.org", &Notification{Subject: "x", Text: "x"})
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("ожидалась ошибка 550, получено %v", err)
+	}
+	if len(srv.received()) != 0 {
+		t.Fatal("письмо принято несмотря на отказ получателю")
+	}
+}
+
+func TestSMTPNotifierConnectionRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	if err := testSMTPNotifier(addr).Send(context.Background(), "a@example.org", &Notification{}); err == nil {
+		t.Fatal("отправка на закрытый порт прошла без ошибки")
+	}
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	srv := startFakeSMTP(t, &fakeSMTP{silent: true})
+	s := testSMTPNotifier(srv.ln.Addr().String())
+	s.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	err := s.Send(context.Background(), "a@example.org", &Notification{Subject: "x", Text: "x"})
+	if err == nil {
+		t.Fatal("сервер молчит, а отправка прошла без ошибки")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("таймаут не сработал: %v", elapsed)
+	}
+}
+
+func TestSMTPNotifierRejectsHeaderInjection(t *testing.T) {
+	srv := startFakeSMTP(t, &fakeSMTP{})
+	s := testSMTPNotifier(srv.ln.Addr().String())
+	err := s.Send(context.Background(), "a@example.org\r\nBcc: victim@example.org", &Notification{Subject: "x", Text: "x"})
+	if err == nil {
+		t.Fatal("адрес с переводом строки принят")
+	}
+	if len(srv.received()) != 0 {
+		t.Fatal("письмо отправлено")
+	}
+}
+
+func TestVerifiedEmail(t *testing.T) {
+	email := "citizen@example.org"
+	now := time.Now()
+	if got := verifiedEmail(&Citizen{Email: &email}); got != "" {
+		t.Fatalf("неподтверждённый адрес отдан как получатель: %q", got)
+	}
+	if got := verifiedEmail(&Citizen{Email: &email, EmailVerifiedAt: &now}); got != email {
+		t.Fatalf("подтверждённый адрес: %q", got)
+	}
+	if got := verifiedEmail(&Citizen{EmailVerifiedAt: &now}); got != "" {
+		t.Fatalf("без адреса: %q", got)
+	}
+}
+
+func TestEmailConfirmTemplateHasNoIssueText(t *testing.T) {
+	n, err := renderNotification(NotifyEmailConfirm, NotificationData{
+		IssueID:    7,
+		Text:       "текст заявки от кого угодно",
+		ConfirmURL: "https://example.org/api/email/confirm?token=abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(n.Text, "https://example.org/api/email/confirm?token=abc") {
+		t.Fatalf("в письме нет ссылки:\n%s", n.Text)
+	}
+	if strings.Contains(n.Text, "текст заявки") {
+		t.Fatal("в письмо-подтверждение попал текст, пришедший из формы")
+	}
+}
@@ -0,0 +1,380 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type IssuePriority string
+
+const (
+	PriorityLow    IssuePriority = "low"
+	PriorityNormal IssuePriority = "normal"
+	PriorityHigh   IssuePriority = "high"
+	PriorityUrgent IssuePriority = "urgent"
+)
+
+var priorityLabels = map[IssuePriority]string{
+	PriorityLow:    "Низкий",
+	PriorityNormal: "Обычный",
+	PriorityHigh:   "Высокий",
+	PriorityUrgent: "Срочный",
+}
+
+var ErrInvalidRoutingRule = errors.New("некорректное правило маршрутизации")
+
+func ParseIssuePriority(s string) (IssuePriority, error) {
+	p := IssuePriority(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := priorityLabels[p]; !ok {
+		return "", fmt.Errorf("%w: неизвестный приоритет %q", ErrInvalidRoutingRule, s)
+	}
+	return p, nil
+}
+
+// Label — название приоритета для людей.
+func (p IssuePriority) Label() string {
+	if l, ok := priorityLabels[p]; ok {
+		return l
+	}
+	return string(p)
+}
+
+// querier — общее у пула и транзакции, чтобы маршрутизацию можно было
+// выполнять внутри транзакции создания заявки.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+const routingRuleColumns = `id, name, position, enabled, district, category, keywords, polygon,
+	department_id, priority, created_at, updated_at`
+
+func scanRoutingRule(row pgx.Row, r *RoutingRule) error {
+	var polygon []byte
+	if err := row.Scan(
+		&r.ID, &r.Name, &r.Position, &r.Enabled, &r.District, &r.Category, &r.Keywords, &polygon,
+		&r.DepartmentID, &r.Priority, &r.CreatedAt, &r.UpdatedAt,
+	); err != nil {
+		return err
+	}
+	r.Polygon = nil
+	if len(polygon) > 0 {
+		if err := json.Unmarshal(polygon, &r.Polygon); err != nil {
+			return fmt.Errorf("правило %d: полигон: %w", r.ID, err)
+		}
+	}
+	return nil
+}
+
+// ListRoutingRules возвращает правила в порядке проверки.
+func (db *DB) ListRoutingRules(ctx context.Context) ([]RoutingRule, error) {
+	return listRoutingRules(ctx, db.Pool, false)
+}
+
+func listRoutingRules(ctx context.Context, q querier, enabledOnly bool) ([]RoutingRule, error) {
+	rows, err := q.Query(ctx, `
+		select `+routingRuleColumns+`
+		from routing_rules
+		where $1 = false or enabled
+		order by position, id
+	`, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []RoutingRule
+	for rows.Next() {
+		var r RoutingRule
+		if err := scanRoutingRule(rows, &r); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+func normalizeRoutingRule(r *RoutingRule) error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return fmt.Errorf("%w: не указано название", ErrInvalidRoutingRule)
+	}
+	r.District = strPtrTrimToNil(r.District)
+	r.Category = strPtrTrimToNil(r.Category)
+
+	var kws []string
+	for _, k := range r.Keywords {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			kws = append(kws, k)
+		}
+	}
+	r.Keywords = kws
+	if r.Keywords == nil {
+		r.Keywords = []string{}
+	}
+
+	if len(r.Polygon) > 0 && len(r.Polygon) < 3 {
+		return fmt.Errorf("%w: в полигоне должно быть не меньше трёх точек", ErrInvalidRoutingRule)
+	}
+
+	if r.Priority != nil {
+		p, err := ParseIssuePriority(*r.Priority)
+		if err != nil {
+			return err
+		}
+		s := string(p)
+		r.Priority = &s
+	}
+	if r.DepartmentID == nil && r.Priority == nil {
+		return fmt.Errorf("%w: правило должно назначать службу или приоритет", ErrInvalidRoutingRule)
+	}
+	return nil
+}
+
+func strPtrTrimToNil(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	return strPtrEmptyToNil(strings.TrimSpace(*s))
+}
+
+// SaveRoutingRule создаёт правило (r.ID == 0) или обновляет существующее.
+func (db *DB) SaveRoutingRule(ctx context.Context, r *RoutingRule) error {
+	if err := normalizeRoutingRule(r); err != nil {
+		return err
+	}
+	var polygon []byte
+	if len(r.Polygon) > 0 {
+		var err error
+		if polygon, err = json.Marshal(r.Polygon); err != nil {
+			return err
+		}
+	}
+
+	var row pgx.Row
+	if r.ID == 0 {
+		row = db.Pool.QueryRow(ctx, `
+			insert into routing_rules (name, position, enabled, district, category, keywords, polygon, department_id, priority)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			returning `+routingRuleColumns,
+			r.Name, r.Position, r.Enabled, r.District, r.Category, r.Keywords, polygon, r.DepartmentID, r.Priority)
+	} else {
+		row = db.Pool.QueryRow(ctx, `
+			update routing_rules set
+				name = $2, position = $3, enabled = $4, district = $5, category = $6,
+				keywords = $7, polygon = $8, department_id = $9, priority = $10, updated_at = now()
+			where id = $1
+			returning `+routingRuleColumns,
+			r.ID, r.Name, r.Position, r.Enabled, r.District, r.Category, r.Keywords, polygon, r.DepartmentID, r.Priority)
+	}
+	err := scanRoutingRule(row, r)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return fmt.Errorf("%w: служба не найдена", ErrInvalidRoutingRule)
+	}
+	return err
+}
+
+func (db *DB) DeleteRoutingRule(ctx context.Context, id int64) error {
+	cmd, err := db.Pool.Exec(ctx, `delete from routing_rules where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ListRoutingLog возвращает решения маршрутизации по заявке, старые сверху.
+func (db *DB) ListRoutingLog(ctx context.Context, issueID int64) ([]RoutingDecision, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select id, issue_id, rule_id, rule_name, department_id, priority, reason, created_at
+		from routing_log
+		where issue_id = $1
+		order by created_at, id
+	`, issueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []RoutingDecision
+	for rows.Next() {
+		var d RoutingDecision
+		if err := rows.Scan(&d.ID, &d.IssueID, &d.RuleID, &d.RuleName, &d.DepartmentID, &d.Priority, &d.Reason, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+// matchRule проверяет условия правила и возвращает описание совпадения.
+func matchRule(r *RoutingRule, iss *Issue) (bool, string) {
+	var why []string
+
+	if r.District != nil {
+		if iss.District == nil || !strings.EqualFold(*iss.District, *r.District) {
+			return false, ""
+		}
+		why = append(why, "район «"+*r.District+"»")
+	}
+	if r.Category != nil {
+		if iss.Category == nil || !strings.EqualFold(*iss.Category, *r.Category) {
+			return false, ""
+		}
+		why = append(why, "категория «"+*r.Category+"»")
+	}
+	if len(r.Keywords) > 0 {
+		if iss.Text == nil {
+			return false, ""
+		}
+		text := strings.ToLower(*iss.Text)
+		found := ""
+		for _, k := range r.Keywords {
+			if strings.Contains(text, k) {
+				found = k
+				break
+			}
+		}
+		if found == "" {
+			return false, ""
+		}
+		why = append(why, "слово «"+found+"»")
+	}
+	if len(r.Polygon) > 0 {
+		if iss.Latitude == nil || iss.Longitude == nil {
+			return false, ""
+		}
+		if !pointInPolygon(GeoPoint{Lat: *iss.Latitude, Lon: *iss.Longitude}, r.Polygon) {
+			return false, ""
+		}
+		why = append(why, "точка в зоне правила")
+	}
+
+	if len(why) == 0 {
+		why = append(why, "правило без условий")
+	}
+	return true, strings.Join(why, ", ")
+}
+
+// pointInPolygon — проверка лучом (even-odd); для городских масштабов
+// координаты можно считать плоскими.
+func pointInPolygon(p GeoPoint, poly []GeoPoint) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// routeIssue подбирает первое подходящее правило, выставляет заявке службу
+// (если её ещё нет) и приоритет, и записывает решение в routing_log.
+func routeIssue(ctx context.Context, q querier, iss *Issue) error {
+	rules, err := listRoutingRules(ctx, q, true)
+	if err != nil {
+		return err
+	}
+
+	var rule *RoutingRule
+	reason := "ни одно правило не подошло"
+	for i := range rules {
+		if ok, why := matchRule(&rules[i], iss); ok {
+			rule = &rules[i]
+			reason = why
+			break
+		}
+	}
+
+	if rule == nil {
+		_, err := q.Exec(ctx,
+			`insert into routing_log (issue_id, reason) values ($1, $2)`, iss.ID, reason)
+		return err
+	}
+
+	department := rule.DepartmentID
+	if iss.DepartmentID != nil {
+		department = iss.DepartmentID
+	}
+	priority := iss.Priority
+	if rule.Priority != nil {
+		priority = *rule.Priority
+	}
+
+	row := q.QueryRow(ctx, `
+		update issues
+		set department_id = $2,
+		    priority = $3,
+		    updated_at = now(),
+		    version = version + 1
+		where id = $1
+		returning `+issueColumns+`
+	`, iss.ID, department, priority)
+	if err := scanIssue(row, iss); err != nil {
+		return err
+	}
+
+	_, err = q.Exec(ctx, `
+		insert into routing_log (issue_id, rule_id, rule_name, department_id, priority, reason)
+		values ($1, $2, $3, $4, $5, $6)
+	`, iss.ID, rule.ID, rule.Name, rule.DepartmentID, rule.Priority, reason)
+	return err
+}
+
+// routeIssueSafely выполняет маршрутизацию в точке сохранения транзакции tx:
+// ошибка в правилах не должна мешать создать заявку.
+func routeIssueSafely(ctx context.Context, tx pgx.Tx, iss *Issue) {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		log.Printf("маршрутизация заявки #%d: %v", iss.ID, err)
+		return
+	}
+	before := *iss
+	if err := routeIssue(ctx, sp, iss); err != nil {
+		log.Printf("маршрутизация заявки #%d: %v", iss.ID, err)
+		*iss = before
+		_ = sp.Rollback(ctx)
+		return
+	}
+	if err := sp.Commit(ctx); err != nil {
+		log.Printf("маршрутизация заявки #%d: %v", iss.ID, err)
+		*iss = before
+	}
+}
+
+// RouteIssue повторно применяет правила к заявке, у которой ещё нет службы,
+// например после того как к ней привязали геопозицию.
+func (db *DB) RouteIssue(ctx context.Context, iss *Issue) error {
+	if iss.DepartmentID != nil {
+		return nil
+	}
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	before := *iss
+	if err := routeIssue(ctx, tx, iss); err != nil {
+		*iss = before
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		*iss = before
+		return err
+	}
+	return nil
+}
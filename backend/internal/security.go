@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Что считаем при защите от перебора.
+const (
+	ThrottleLogin    = "login"   // логин веб-админки
+	ThrottleIP       = "ip"      // адрес клиента: вход, коды привязки Telegram
+	ThrottleSession  = "session" // адрес клиента: неизвестные токены сессий
+	ThrottleTelegram = "tg"      // пользователь Telegram: приглашения
+)
+
+// Виды событий безопасности.
+const (
+	SecurityLoginFailed   = "login_failed"
+	SecuritySessionFailed = "session_invalid"
+	SecurityInviteFailed  = "invite_failed"
+	SecurityLinkFailed    = "citizen_link_failed" // неверный код привязки Telegram к жителю
+	SecurityLockout       = "lockout"
+	SecurityUnlock        = "unlock"
+)
+
+// ThrottlePolicy — сколько неудач за окно допустимо и на сколько блокировать.
+// Каждая следующая блокировка подряд вдвое дольше предыдущей, но не дольше MaxLock;
+// счёт блокировок обнуляется после успешного входа или ResetAfter без неудач.
+type ThrottlePolicy struct {
+	MaxFailures int
+	Window      time.Duration
+	BaseLock    time.Duration
+	MaxLock     time.Duration
+	ResetAfter  time.Duration
+}
+
+// throttlePolicies — политики по видам счётчиков. С одного адреса ходит
+// много сотрудников (офис, NAT), поэтому порог для адреса выше. Для токенов
+// сессий он ещё выше: вкладки с устаревшим токеном после перезапуска базы
+// или чистки сессий не должны блокировать вход всему офису, а подобрать
+// 256-битный токен не помогут ни 20, ни 100 попыток.
+var throttlePolicies = map[string]ThrottlePolicy{
+	ThrottleLogin:    {MaxFailures: 5, Window: 15 * time.Minute, BaseLock: time.Minute, MaxLock: 24 * time.Hour, ResetAfter: 24 * time.Hour},
+	ThrottleIP:       {MaxFailures: 20, Window: 15 * time.Minute, BaseLock: time.Minute, MaxLock: 24 * time.Hour, ResetAfter: 24 * time.Hour},
+	ThrottleSession:  {MaxFailures: 100, Window: 15 * time.Minute, BaseLock: time.Minute, MaxLock: time.Hour, ResetAfter: 24 * time.Hour},
+	ThrottleTelegram: {MaxFailures: 5, Window: 15 * time.Minute, BaseLock: 5 * time.Minute, MaxLock: 24 * time.Hour, ResetAfter: 24 * time.Hour},
+}
+
+// lockDuration — срок n-й блокировки подряд (n >= 1).
+func (p ThrottlePolicy) lockDuration(n int) time.Duration {
+	d := p.BaseLock
+	for i := 1; i < n && d < p.MaxLock; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxLock)
+}
+
+// ThrottleKey — один счётчик: вид и значение (логин, адрес, tg id).
+type ThrottleKey struct {
+	Scope string
+	Key   string
+}
+
+func (k ThrottleKey) String() string {
+	return k.Scope + ":" + k.Key
+}
+
+// ThrottleRemaining возвращает, сколько ещё заблокирован самый долгий из ключей; 0 — не заблокирован.
+func (db *DB) ThrottleRemaining(ctx context.Context, keys ...ThrottleKey) (time.Duration, error) {
+	var wait time.Duration
+	for _, k := range keys {
+		var until *time.Time
+		err := db.Pool.QueryRow(ctx,
+			`select locked_until from auth_throttle where scope = $1 and key = $2`, k.Scope, k.Key,
+		).Scan(&until)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if until != nil {
+			wait = max(wait, time.Until(*until))
+		}
+	}
+	return wait, nil
+}
+
+// RecordThrottleFailure засчитывает неудачу по ключу k. Если порог превышен,
+// ставит блокировку и возвращает её срок и номер подряд; иначе 0.
+func (db *DB) RecordThrottleFailure(ctx context.Context, k ThrottleKey) (time.Duration, int, error) {
+	p, ok := throttlePolicies[k.Scope]
+	if !ok {
+		return 0, 0, fmt.Errorf("неизвестный вид счётчика %q", k.Scope)
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		insert into auth_throttle (scope, key) values ($1, $2)
+		on conflict do nothing
+	`, k.Scope, k.Key); err != nil {
+		return 0, 0, err
+	}
+
+	var failures, lockouts int
+	var windowStarted time.Time
+	var lastFailure *time.Time
+	if err := tx.QueryRow(ctx, `
+		select failures, window_started_at, lockouts, last_failure_at
+		from auth_throttle
+		where scope = $1 and key = $2
+		for update
+	`, k.Scope, k.Key).Scan(&failures, &windowStarted, &lockouts, &lastFailure); err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now()
+	if now.Sub(windowStarted) > p.Window {
+		failures, windowStarted = 0, now
+	}
+	if lastFailure != nil && now.Sub(*lastFailure) > p.ResetAfter {
+		lockouts = 0
+	}
+	failures++
+
+	var lock time.Duration
+	var lockedUntil *time.Time
+	if failures >= p.MaxFailures {
+		lockouts++
+		lock = p.lockDuration(lockouts)
+		until := now.Add(lock)
+		lockedUntil = &until
+		failures, windowStarted = 0, now
+	}
+
+	if _, err := tx.Exec(ctx, `
+		update auth_throttle
+		set failures = $3, window_started_at = $4, lockouts = $5,
+		    locked_until = coalesce($6, locked_until), last_failure_at = $7
+		where scope = $1 and key = $2
+	`, k.Scope, k.Key, failures, windowStarted, lockouts, lockedUntil, now); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, err
+	}
+	return lock, lockouts, nil
+}
+
+// ResetThrottle снимает счётчик и блокировку по ключу (после успешного входа или вручную).
+func (db *DB) ResetThrottle(ctx context.Context, k ThrottleKey) (bool, error) {
+	cmd, err := db.Pool.Exec(ctx, `delete from auth_throttle where scope = $1 and key = $2`, k.Scope, k.Key)
+	if err != nil {
+		return false, err
+	}
+	return cmd.RowsAffected() > 0, nil
+}
+
+// ListThrottleLocks возвращает действующие блокировки.
+func (db *DB) ListThrottleLocks(ctx context.Context) ([]ThrottleLock, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select scope, key, lockouts, locked_until
+		from auth_throttle
+		where locked_until > now()
+		order by locked_until desc
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []ThrottleLock
+	for rows.Next() {
+		var l ThrottleLock
+		if err := rows.Scan(&l.Scope, &l.Key, &l.Lockouts, &l.LockedUntil); err != nil {
+			return nil, err
+		}
+		res = append(res, l)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) AddSecurityEvent(ctx context.Context, ev *SecurityEvent) error {
+	return db.Pool.QueryRow(ctx, `
+		insert into security_events (kind, subject, ip, details)
+		values ($1, $2, $3, $4)
+		returning id, created_at
+	`, ev.Kind, ev.Subject, ev.IP, ev.Details).Scan(&ev.ID, &ev.CreatedAt)
+}
+
+// ListSecurityEvents возвращает последние события, новые сверху; kind == "" — все.
+func (db *DB) ListSecurityEvents(ctx context.Context, kind string, limit int) ([]SecurityEvent, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select id, kind, subject, ip, details, created_at
+		from security_events
+		where $1 = '' or kind = $1
+		order by created_at desc, id desc
+		limit $2
+	`, kind, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []SecurityEvent
+	for rows.Next() {
+		var ev SecurityEvent
+		if err := rows.Scan(&ev.ID, &ev.Kind, &ev.Subject, &ev.IP, &ev.Details, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, ev)
+	}
+	return res, rows.Err()
+}
+
+// SuperadminTelegramIDs — tg id суперадминистраторов без ограничения области:
+// сотрудников в боте и активных учёток админки с привязанным Telegram.
+func (db *DB) SuperadminTelegramIDs(ctx context.Context) ([]int64, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select tg_user_id from users
+		where role = 'superadmin' and scope_department_id is null and scope_district is null
+		union
+		select tg_user_id from admin_accounts
+		where role = 'superadmin' and tg_user_id is not null and disabled_at is null
+		  and department_id is null and district is null
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+// AuthGuard считает неудачные попытки входа, блокирует перебор, пишет журнал
+// безопасности и предупреждает суперадминистраторов о блокировках.
+// Состояние хранится в базе и переживает перезапуск.
+type AuthGuard struct {
+	DB    *DB
+	Alert func(ctx context.Context, text string) // уведомление суперадминистраторов; может быть nil
+}
+
+func NewAuthGuard(db *DB, alert func(ctx context.Context, text string)) *AuthGuard {
+	return &AuthGuard{DB: db, Alert: alert}
+}
+
+// Locked — сколько ещё ждать, если хоть один из ключей заблокирован.
+// Сбой базы не должен закрывать вход, поэтому он только пишется в лог.
+func (g *AuthGuard) Locked(ctx context.Context, keys ...ThrottleKey) time.Duration {
+	wait, err := g.DB.ThrottleRemaining(ctx, keys...)
+	if err != nil {
+		log.Printf("защита от перебора: %v", err)
+		return 0
+	}
+	return wait
+}
+
+// Fail записывает неудачную попытку ev и засчитывает её по ключам keys.
+// Если по какому-то ключу сработала блокировка, это тоже попадает в журнал
+// и уходит суперадминистраторам.
+func (g *AuthGuard) Fail(ctx context.Context, ev SecurityEvent, keys ...ThrottleKey) {
+	if err := g.DB.AddSecurityEvent(ctx, &ev); err != nil {
+		log.Printf("журнал безопасности: %v", err)
+	}
+	for _, k := range keys {
+		lock, n, err := g.DB.RecordThrottleFailure(ctx, k)
+		if err != nil {
+			log.Printf("защита от перебора %s: %v", k, err)
+			continue
+		}
+		if lock == 0 {
+			continue
+		}
+		details := fmt.Sprintf("%s заблокирован на %s (блокировка №%d подряд) после: %s", k, lock, n, ev.Kind)
+		log.Printf("безопасность: %s", details)
+		lockEv := SecurityEvent{Kind: SecurityLockout, Subject: ev.Subject, IP: ev.IP, Details: &details}
+		if err := g.DB.AddSecurityEvent(ctx, &lockEv); err != nil {
+			log.Printf("журнал безопасности: %v", err)
+		}
+		if g.Alert != nil {
+			g.Alert(ctx, "🚨 Возможный перебор: "+details)
+		}
+	}
+}
+
+// Succeed сбрасывает счётчики после успешной проверки.
+func (g *AuthGuard) Succeed(ctx context.Context, keys ...ThrottleKey) {
+	for _, k := range keys {
+		if _, err := g.DB.ResetThrottle(ctx, k); err != nil {
+			log.Printf("защита от перебора %s: %v", k, err)
+		}
+	}
+}
+
+// retryAfter — текст о блокировке для ответа пользователю.
+func retryAfter(wait time.Duration) string {
+	return "Слишком много неудачных попыток, повторите через " + wait.Round(time.Second).String()
+}
+
+// retryAfterSeconds — значение заголовка Retry-After.
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(wait.Seconds()) + 1)
+}
+
+func loginThrottleKey(login string) ThrottleKey {
+	return ThrottleKey{Scope: ThrottleLogin, Key: strings.ToLower(strings.TrimSpace(login))}
+}
+
+// alertSuperadmins рассылает предупреждение суперадминистраторам в Telegram.
+func (b *Bot) alertSuperadmins(ctx context.Context, text string) {
+	ids, err := b.DB.SuperadminTelegramIDs(ctx)
+	if err != nil {
+		log.Printf("уведомление суперадминистраторов: %v", err)
+		return
+	}
+	for _, id := range ids {
+		b.reply(id, text)
+	}
+}
@@ -17,24 +17,27 @@ func NewServices(db *DB) *Services {
 	return &Services{DB: db}
 }
 
-func (s *Services) CreateWebIssue(ctx context.Context, req *WebIssueRequest) (*Issue, error) {
+// CreateWebIssue создаёт заявку из веб-формы и возвращает её вместе с токеном
+// доступа автора (см. NewIssueAccessToken).
+func (s *Services) CreateWebIssue(ctx context.Context, req *WebIssueRequest) (*Issue, string, error) {
 	log.Printf("Получен запрос из веб-формы: %s (%s, %s)", req.Name, req.District, req.Category)
 
 	issue, err := s.DB.CreateWebIssue(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка при создании заявки: %w", err)
+		return nil, "", fmt.Errorf("ошибка при создании заявки: %w", err)
+	}
+	token, err := s.DB.NewIssueAccessToken(ctx, issue.ID)
+	if err != nil {
+		return nil, "", fmt.Errorf("ошибка при создании заявки: %w", err)
 	}
 
-	return issue, nil
+	return issue, token, nil
 }
 
-func (s *Services) AddWebAttachments(ctx context.Context, issueID int64, attachments []WebAttachment) error {
-	for _, a := range attachments {
-		if err := s.DB.AddWebAttachment(ctx, issueID, a.FileName, a.FileType, a.FileURL); err != nil {
-			return fmt.Errorf("ошибка при добавлении вложения %s: %w", a.FileName, err)
-		}
-	}
-	return nil
+// AddWebAttachments прикрепляет к заявке уже сохранённые в BlobStore файлы:
+// все сразу или, если их больше maxFiles вместе с прежними, ни одного.
+func (s *Services) AddWebAttachments(ctx context.Context, issueID int64, attachments []WebAttachment, maxFiles int) ([]int64, error) {
+	return s.DB.AddWebAttachments(ctx, issueID, attachments, maxFiles)
 }
 
 func (s *Services) GetWebIssue(ctx context.Context, issueID int64) (*Issue, []Attachment, error) {
@@ -51,8 +54,10 @@ func (s *Services) GetWebIssue(ctx context.Context, issueID int64) (*Issue, []At
 	return issue, attachments, nil
 }
 
-func (s *Services) ExportCSV(ctx context.Context, from, to time.Time, w io.Writer) error {
-	rows, err := s.DB.ExportIssues(ctx, from, to)
+// ExportCSV выгружает заявки за период; scope ограничивает службу и район
+// (см. Principal.NarrowFilter), остальные поля фильтра не учитываются.
+func (s *Services) ExportCSV(ctx context.Context, from, to time.Time, scope IssueFilter, w io.Writer) error {
+	rows, err := s.DB.ExportIssues(ctx, from, to, scope)
 	if err != nil {
 		return fmt.Errorf("ошибка при экспорте: %w", err)
 	}
@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Виды нарушения SLA.
+const (
+	SLABreachResponse   = "response"   // нет первого ответа в срок
+	SLABreachResolution = "resolution" // заявка не закрыта в срок
+)
+
+// OverdueIssue — заявка, впервые нарушившая срок при очередной проверке;
+// это же данные события issue.overdue.
+type OverdueIssue struct {
+	IssueID      int64     `json:"issue_id"`
+	Kind         string    `json:"kind"` // SLABreachResponse или SLABreachResolution
+	DueAt        time.Time `json:"due_at"`
+	District     *string   `json:"district"`
+	Category     *string   `json:"category"`
+	DepartmentID *int64    `json:"department_id"`
+}
+
+func (db *DB) ListSLARules(ctx context.Context) ([]SLARule, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select id, category, district, first_response_minutes, resolution_minutes, created_at
+		from sla_rules
+		order by category, district nulls first
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []SLARule
+	for rows.Next() {
+		var r SLARule
+		if err := rows.Scan(&r.ID, &r.Category, &r.District, &r.FirstResponseMinutes, &r.ResolutionMinutes, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// UpsertSLARule создаёт правило или обновляет сроки существующего
+// для той же пары категория/район.
+func (db *DB) UpsertSLARule(ctx context.Context, r *SLARule) error {
+	r.Category = strings.TrimSpace(r.Category)
+	if r.District != nil && strings.TrimSpace(*r.District) == "" {
+		r.District = nil
+	}
+	if r.Category == "" {
+		return errors.New("не указана категория")
+	}
+	if r.FirstResponseMinutes <= 0 || r.ResolutionMinutes <= 0 {
+		return errors.New("сроки должны быть положительными")
+	}
+	if r.FirstResponseMinutes > r.ResolutionMinutes {
+		return errors.New("срок первого ответа не может быть больше срока решения")
+	}
+
+	return db.Pool.QueryRow(ctx, `
+		insert into sla_rules (category, district, first_response_minutes, resolution_minutes)
+		values ($1, $2, $3, $4)
+		on conflict (category, coalesce(district, '')) do update set
+			first_response_minutes = excluded.first_response_minutes,
+			resolution_minutes = excluded.resolution_minutes
+		returning id, created_at
+	`, r.Category, r.District, r.FirstResponseMinutes, r.ResolutionMinutes).Scan(&r.ID, &r.CreatedAt)
+}
+
+func (db *DB) DeleteSLARule(ctx context.Context, id int64) error {
+	cmd, err := db.Pool.Exec(ctx, `delete from sla_rules where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// MarkOverdueIssues помечает открытые заявки, у которых истёк срок первого ответа
+// или решения, и возвращает только те, что были помечены этим вызовом. На каждую
+// отметку в той же транзакции пишется событие issue.overdue: уведомление
+// сотрудников не потеряется, даже если процесс упадёт сразу после отметки.
+func (db *DB) MarkOverdueIssues(ctx context.Context) ([]OverdueIssue, error) {
+	final := statusStrings([]IssueStatus{StatusDone, StatusRejected})
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var res []OverdueIssue
+
+	rows, err := tx.Query(ctx, `
+		update issues i
+		set response_overdue_at = now()
+		from issue_sla s
+		where s.issue_id = i.id
+		  and i.response_overdue_at is null
+		  and i.status <> all($1)
+		  and s.first_response_at is null
+		  and s.response_due_at < now()
+		returning i.id, s.response_due_at, i.district, i.category, i.department_id
+	`, final)
+	if err != nil {
+		return nil, fmt.Errorf("проверка сроков первого ответа: %w", err)
+	}
+	res, err = appendOverdue(res, rows, SLABreachResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(ctx, `
+		update issues i
+		set resolution_overdue_at = now()
+		from issue_sla s
+		where s.issue_id = i.id
+		  and i.resolution_overdue_at is null
+		  and i.status <> all($1)
+		  and s.resolution_due_at < now()
+		returning i.id, s.resolution_due_at, i.district, i.category, i.department_id
+	`, final)
+	if err != nil {
+		return nil, fmt.Errorf("проверка сроков решения: %w", err)
+	}
+	res, err = appendOverdue(res, rows, SLABreachResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range res {
+		if err := publishEvent(ctx, tx, EventIssueOverdue, o.IssueID, o); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func appendOverdue(res []OverdueIssue, rows pgx.Rows, kind string) ([]OverdueIssue, error) {
+	defer rows.Close()
+	for rows.Next() {
+		o := OverdueIssue{Kind: kind}
+		if err := rows.Scan(&o.IssueID, &o.DueAt, &o.District, &o.Category, &o.DepartmentID); err != nil {
+			return nil, err
+		}
+		res = append(res, o)
+	}
+	return res, rows.Err()
+}
+
+// SLAScheduler периодически ищет и помечает просроченные заявки; сотрудников
+// уведомляет подписчик события issue.overdue (см. Bot.SLAAlerts). Отметка
+// ставится атомарным UPDATE, поэтому несколько экземпляров не уведомят
+// об одной заявке дважды.
+type SLAScheduler struct {
+	DB       *DB
+	Interval time.Duration
+}
+
+func NewSLAScheduler(db *DB, interval time.Duration) *SLAScheduler {
+	return &SLAScheduler{DB: db, Interval: interval}
+}
+
+func (s *SLAScheduler) Run(ctx context.Context) {
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.check(ctx)
+		}
+	}
+}
+
+func (s *SLAScheduler) check(ctx context.Context) {
+	list, err := s.DB.MarkOverdueIssues(ctx)
+	if err != nil {
+		log.Printf("SLA: %v", err)
+		return
+	}
+	if len(list) > 0 {
+		log.Printf("SLA: просрочено заявок: %d", len(list))
+	}
+}
+
+// SLAAlerts — подписчик EventBus на issue.overdue: сообщает о просрочке
+// сотрудникам, в чью область попадает заявка. Если не дошло ни одно сообщение
+// (например, недоступен Telegram), событие повторяется; если не дошло только
+// части сотрудников, сбой пишется в лог — повтор задублировал бы сообщение остальным.
+func (b *Bot) SLAAlerts() EventHandler { return slaAlerts{b} }
+
+type slaAlerts struct{ bot *Bot }
+
+func (a slaAlerts) Name() string { return "sla_alerts" }
+
+func (a slaAlerts) Handle(ctx context.Context, ev *DomainEvent) error {
+	var o OverdueIssue
+	if err := json.Unmarshal(ev.Payload, &o); err != nil {
+		return err
+	}
+	return a.bot.notifyAdminsOverdue(ctx, []OverdueIssue{o})
+}
+
+// notifyAdminsOverdue рассылает каждому сотруднику просроченные заявки из его
+// области. Ошибка — если не удалось отправить ни одного сообщения.
+func (b *Bot) notifyAdminsOverdue(ctx context.Context, list []OverdueIssue) error {
+	staff, err := b.Auth.ListStaffPrincipals(ctx)
+	if err != nil {
+		return fmt.Errorf("список сотрудников: %w", err)
+	}
+	var sent int
+	var lastErr error
+	for _, p := range staff {
+		var own []OverdueIssue
+		for _, o := range list {
+			if p.Covers(&Issue{ID: o.IssueID, District: o.District, DepartmentID: o.DepartmentID}) {
+				own = append(own, o)
+			}
+		}
+		if len(own) == 0 {
+			continue
+		}
+		if _, err := b.API.Send(tgbotapi.NewMessage(*p.TGUserID, overdueText(own))); err != nil {
+			log.Printf("SLA: уведомление %d: %v", *p.TGUserID, err)
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
+
+func overdueText(list []OverdueIssue) string {
+	var sb strings.Builder
+	sb.WriteString("⏰ Нарушены сроки по заявкам:\n")
+	for _, o := range list {
+		what := "не решена в срок"
+		if o.Kind == SLABreachResponse {
+			what = "нет первого ответа"
+		}
+		fmt.Fprintf(&sb, "\n#%d — %s (срок %s)", o.IssueID, what, o.DueAt.Local().Format("02.01 15:04"))
+		if o.Category != nil && *o.Category != "" {
+			sb.WriteString(", " + *o.Category)
+		}
+		if o.District != nil && *o.District != "" {
+			sb.WriteString(", " + *o.District)
+		}
+	}
+	return trim(sb.String(), 4000)
+}
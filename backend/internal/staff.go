@@ -0,0 +1,502 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// maxInviteTTL — дольше приглашение жить не может, чтобы забытые ссылки не копились.
+const maxInviteTTL = 30 * 24 * time.Hour
+
+// invitePrefix — префикс параметра /start в ссылке-приглашении.
+const invitePrefix = "invite_"
+
+var (
+	ErrUserNotFound    = errors.New("пользователь не найден, он должен хотя бы раз написать боту")
+	ErrAlreadyStaff    = errors.New("пользователь уже сотрудник")
+	ErrInvalidInvite   = errors.New("некорректное приглашение")
+	ErrInviteNotFound  = errors.New("приглашение не найдено")
+	ErrInviteNotActive = errors.New("приглашение недействительно: истёк срок, оно уже использовано или отозвано")
+)
+
+const staffUserColumns = `id, tg_user_id, username, first_name, last_name, role, scope_department_id, scope_district, created_at`
+
+func scanStaffUser(row pgx.Row, u *StaffUser) error {
+	return row.Scan(&u.UserID, &u.TGUserID, &u.Username, &u.FirstName, &u.LastName,
+		&u.Role, &u.DepartmentID, &u.District, &u.CreatedAt)
+}
+
+const staffInviteColumns = `id, role, scope_department_id, scope_district, created_by_account_id,
+	created_by_tg_user_id, expires_at, used_at, used_by_user_id, revoked_at, created_at`
+
+func scanStaffInvite(row pgx.Row, inv *StaffInvite) error {
+	return row.Scan(&inv.ID, &inv.Role, &inv.DepartmentID, &inv.District, &inv.CreatedByAccountID,
+		&inv.CreatedByTGUserID, &inv.ExpiresAt, &inv.UsedAt, &inv.UsedByUserID, &inv.RevokedAt, &inv.CreatedAt)
+}
+
+// DisplayName — имя пользователя для списков и уведомлений.
+func (u StaffUser) DisplayName() string {
+	return StaffMember{TGUserID: u.TGUserID, Username: u.Username, FirstName: u.FirstName, LastName: u.LastName}.DisplayName()
+}
+
+// ListUsers возвращает пользователей Telegram с их ролями, сотрудников сверху.
+// staffOnly — только с ролью; query ищет по имени, username или tg id.
+// Непустая scope оставляет только сотрудников этой области.
+func (db *DB) ListUsers(ctx context.Context, staffOnly bool, query string, scope StaffScope) ([]StaffUser, error) {
+	query = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(query), "@"))
+	rows, err := db.Pool.Query(ctx, `
+		select `+staffUserColumns+`
+		from users
+		where ($1 = false or role is not null)
+		  and ($2 = '' or tg_user_id::text = $2
+		       or username ilike '%' || $2 || '%'
+		       or first_name ilike '%' || $2 || '%'
+		       or last_name ilike '%' || $2 || '%')
+		  and ($3::bigint is null or (role is not null and scope_department_id = $3))
+		  and ($4::text is null or (role is not null and lower(scope_district) = lower($4)))
+		order by role is null, id
+		limit 200
+	`, staffOnly, query, scope.DepartmentID, scope.District)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []StaffUser
+	for rows.Next() {
+		var u StaffUser
+		if err := scanStaffUser(rows, &u); err != nil {
+			return nil, err
+		}
+		res = append(res, u)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) GetStaffUser(ctx context.Context, tgUserID int64) (*StaffUser, error) {
+	var u StaffUser
+	err := scanStaffUser(db.Pool.QueryRow(ctx,
+		`select `+staffUserColumns+` from users where tg_user_id = $1`, tgUserID), &u)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SetUserRole выдаёт пользователю Telegram роль с областью или, если role == nil,
+// отзывает права: область сбрасывается, пользователь выходит из всех служб.
+func (db *DB) SetUserRole(ctx context.Context, tgUserID int64, role *AdminRole, departmentID *int64, district *string) (*StaffUser, error) {
+	if role != nil {
+		r, err := ParseAdminRole(string(*role))
+		if err != nil {
+			return nil, err
+		}
+		role = &r
+		district = strPtrTrimToNil(district)
+	} else {
+		departmentID, district = nil, nil
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var u StaffUser
+	err = scanStaffUser(tx.QueryRow(ctx, `
+		update users
+		set role = $2, scope_department_id = $3, scope_district = $4
+		where tg_user_id = $1
+		returning `+staffUserColumns,
+		tgUserID, role, departmentID, district), &u)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAccount, ErrDepartmentNotFound)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		if _, err := tx.Exec(ctx, `delete from department_members where user_id = $1`, u.UserID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// NewStaffInvite — параметры приглашения; создатель — учётка админки или сотрудник в Telegram.
+type NewStaffInvite struct {
+	Role               AdminRole
+	DepartmentID       *int64
+	District           *string
+	TTL                time.Duration
+	CreatedByAccountID *int64
+	CreatedByTGUserID  *int64
+}
+
+// CreateStaffInvite создаёт одноразовое приглашение и возвращает его токен;
+// в базе остаётся только хеш.
+func (db *DB) CreateStaffInvite(ctx context.Context, in NewStaffInvite) (string, *StaffInvite, error) {
+	role, err := ParseAdminRole(string(in.Role))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: неизвестная роль %q", ErrInvalidInvite, in.Role)
+	}
+	if in.TTL <= 0 || in.TTL > maxInviteTTL {
+		return "", nil, fmt.Errorf("%w: срок действия должен быть от минуты до %d дней", ErrInvalidInvite, int(maxInviteTTL.Hours()/24))
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var inv StaffInvite
+	err = scanStaffInvite(db.Pool.QueryRow(ctx, `
+		insert into staff_invites (token_hash, role, scope_department_id, scope_district,
+			created_by_account_id, created_by_tg_user_id, expires_at)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		returning `+staffInviteColumns,
+		hashSessionToken(token), role, in.DepartmentID, strPtrTrimToNil(in.District),
+		in.CreatedByAccountID, in.CreatedByTGUserID, time.Now().Add(in.TTL)), &inv)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidInvite, ErrDepartmentNotFound)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &inv, nil
+}
+
+// ListStaffInvites возвращает приглашения, новые сверху; activeOnly — только
+// действующие. Непустая scope оставляет только приглашения в эту область.
+func (db *DB) ListStaffInvites(ctx context.Context, activeOnly bool, scope StaffScope) ([]StaffInvite, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select `+staffInviteColumns+`
+		from staff_invites
+		where ($1 = false or (used_at is null and revoked_at is null and expires_at > now()))
+		  and ($2::bigint is null or scope_department_id = $2)
+		  and ($3::text is null or lower(scope_district) = lower($3))
+		order by created_at desc
+		limit 200
+	`, activeOnly, scope.DepartmentID, scope.District)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []StaffInvite
+	for rows.Next() {
+		var inv StaffInvite
+		if err := scanStaffInvite(rows, &inv); err != nil {
+			return nil, err
+		}
+		res = append(res, inv)
+	}
+	return res, rows.Err()
+}
+
+func (db *DB) GetStaffInvite(ctx context.Context, id int64) (*StaffInvite, error) {
+	var inv StaffInvite
+	err := scanStaffInvite(db.Pool.QueryRow(ctx,
+		`select `+staffInviteColumns+` from staff_invites where id = $1`, id), &inv)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// RevokeStaffInvite отзывает ещё не использованное приглашение.
+func (db *DB) RevokeStaffInvite(ctx context.Context, id int64) error {
+	cmd, err := db.Pool.Exec(ctx, `
+		update staff_invites set revoked_at = now()
+		where id = $1 and used_at is null and revoked_at is null
+	`, id)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// RedeemStaffInvite выдаёт пользователю роль и область из приглашения.
+// Приглашение гасится тем же UPDATE, что его проверяет, поэтому второй раз
+// по той же ссылке роль не получить. Сотруднику приглашение не нужно
+// и не тратится: менять роль надо явно.
+func (db *DB) RedeemStaffInvite(ctx context.Context, token string, tgUserID int64) (*StaffUser, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var u StaffUser
+	err = scanStaffUser(tx.QueryRow(ctx,
+		`select `+staffUserColumns+` from users where tg_user_id = $1 for update`, tgUserID), &u)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Role != nil {
+		return nil, ErrAlreadyStaff
+	}
+
+	var role AdminRole
+	var departmentID *int64
+	var district *string
+	err = tx.QueryRow(ctx, `
+		update staff_invites
+		set used_at = now(), used_by_user_id = $2
+		where token_hash = $1 and used_at is null and revoked_at is null and expires_at > now()
+		returning role, scope_department_id, scope_district
+	`, hashSessionToken(token), u.UserID).Scan(&role, &departmentID, &district)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInviteNotActive
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanStaffUser(tx.QueryRow(ctx, `
+		update users
+		set role = $2, scope_department_id = $3, scope_district = $4
+		where id = $1
+		returning `+staffUserColumns,
+		u.UserID, role, departmentID, district), &u)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// IsStaffValidationError — запрос отклонён по правилам, а не из-за сбоя базы.
+func IsStaffValidationError(err error) bool {
+	return errors.Is(err, ErrInvalidInvite) || IsAccountValidationError(err)
+}
+
+// inviteLink — ссылка, открывающая бота с командой /start invite_<token>.
+func (b *Bot) inviteLink(token string) string {
+	return "https://t.me/" + b.API.Self.UserName + "?start=" + invitePrefix + token
+}
+
+// scopeLabel — описание роли и области для сообщений бота.
+func scopeLabel(role AdminRole, departmentID *int64, district *string) string {
+	s := string(role)
+	if departmentID != nil {
+		s += fmt.Sprintf(", служба #%d", *departmentID)
+	}
+	if district != nil {
+		s += ", район " + *district
+	}
+	return s
+}
+
+// handleInviteStart обрабатывает переход по ссылке-приглашению.
+func (b *Bot) handleInviteStart(ctx context.Context, m *tgbotapi.Message, token string) {
+	if !m.Chat.IsPrivate() {
+		b.reply(m.Chat.ID, "Приглашение можно принять только в личном чате с ботом.")
+		return
+	}
+	key := ThrottleKey{Scope: ThrottleTelegram, Key: strconv.FormatInt(m.From.ID, 10)}
+	if wait := b.Guard.Locked(ctx, key); wait > 0 {
+		b.reply(m.Chat.ID, retryAfter(wait))
+		return
+	}
+	u, err := b.DB.RedeemStaffInvite(ctx, token, m.From.ID)
+	switch {
+	case err == nil:
+		b.Guard.Succeed(ctx, key)
+	case errors.Is(err, ErrInviteNotActive):
+		b.Guard.Fail(ctx, SecurityEvent{Kind: SecurityInviteFailed, Subject: &key.Key}, key)
+		b.reply(m.Chat.ID, err.Error())
+		return
+	case errors.Is(err, ErrAlreadyStaff), errors.Is(err, ErrUserNotFound):
+		b.reply(m.Chat.ID, err.Error())
+		return
+	default:
+		log.Printf("приглашение для %d: %v", m.From.ID, err)
+		b.reply(m.Chat.ID, "Не удалось принять приглашение, попробуйте позже.")
+		return
+	}
+	log.Printf("пользователь %d стал сотрудником по приглашению: %s", m.From.ID, *u.Role)
+	b.reply(m.Chat.ID, "Приглашение принято, ваша роль: "+scopeLabel(*u.Role, u.DepartmentID, u.District)+
+		".\nДоступные команды — в /help. Новые заявки будут приходить автоматически.")
+}
+
+// handleStaffCommand обрабатывает /staff, /invite, /setrole и /revoke.
+func (b *Bot) handleStaffCommand(ctx context.Context, m *tgbotapi.Message) {
+	p, ok := b.can(ctx, m.From.ID, PermManageUsers)
+	if !ok {
+		b.reply(m.Chat.ID, "Недостаточно прав")
+		return
+	}
+	args := strings.Fields(m.CommandArguments())
+
+	switch m.Command() {
+	case "staff":
+		b.sendStaffList(ctx, m.Chat.ID, p)
+	case "invite":
+		if len(args) < 1 || len(args) > 2 {
+			b.reply(m.Chat.ID, "Использование: /invite <operator|department_head|superadmin> [id службы]")
+			return
+		}
+		role, err := ParseAdminRole(args[0])
+		if err != nil {
+			b.reply(m.Chat.ID, err.Error())
+			return
+		}
+		// по умолчанию приглашённый получает область того, кто приглашает
+		departmentID, district := p.DepartmentID, p.District
+		if len(args) == 2 {
+			id, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil || id <= 0 {
+				b.reply(m.Chat.ID, "Некорректный id службы")
+				return
+			}
+			departmentID = &id
+		}
+		if err := p.Grants(role, departmentID, district); err != nil {
+			b.reply(m.Chat.ID, err.Error())
+			return
+		}
+		token, inv, err := b.DB.CreateStaffInvite(ctx, NewStaffInvite{
+			Role:              role,
+			DepartmentID:      departmentID,
+			District:          district,
+			TTL:               b.Cfg.StaffInviteTTL,
+			CreatedByTGUserID: &m.From.ID,
+		})
+		if err != nil {
+			b.reply(m.Chat.ID, "Не удалось создать приглашение: "+err.Error())
+			return
+		}
+		b.reply(m.Chat.ID, fmt.Sprintf("Приглашение #%d (%s), действует до %s. Ссылка одноразовая, передайте её только сотруднику:\n%s",
+			inv.ID, scopeLabel(inv.Role, inv.DepartmentID, inv.District), inv.ExpiresAt.Local().Format("02.01 15:04"), b.inviteLink(token)))
+	case "setrole", "revoke":
+		usage := "Использование: /setrole <tg id> <operator|department_head|superadmin>"
+		want := 2
+		if m.Command() == "revoke" {
+			usage, want = "Использование: /revoke <tg id>", 1
+		}
+		if len(args) != want {
+			b.reply(m.Chat.ID, usage)
+			return
+		}
+		tgID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			b.reply(m.Chat.ID, usage)
+			return
+		}
+		var role *AdminRole
+		if m.Command() == "setrole" {
+			r, err := ParseAdminRole(args[1])
+			if err != nil {
+				b.reply(m.Chat.ID, err.Error())
+				return
+			}
+			role = &r
+		}
+		target, err := b.DB.GetStaffUser(ctx, tgID)
+		if err != nil {
+			b.reply(m.Chat.ID, err.Error())
+			return
+		}
+		// область сотрудника сохраняется; новичок получает область того, кто выдаёт роль
+		departmentID, district := target.DepartmentID, target.District
+		if target.Role == nil {
+			departmentID, district = p.DepartmentID, p.District
+		}
+		u, err := b.changeUserRole(ctx, p, target, role, departmentID, district)
+		if err != nil {
+			b.reply(m.Chat.ID, err.Error())
+			return
+		}
+		if u.Role == nil {
+			b.reply(m.Chat.ID, fmt.Sprintf("Права пользователя %s отозваны.", u.DisplayName()))
+		} else {
+			b.reply(m.Chat.ID, fmt.Sprintf("%s: роль %s.", u.DisplayName(), scopeLabel(*u.Role, u.DepartmentID, u.District)))
+		}
+	}
+}
+
+// changeUserRole выдаёт сотруднику target роль role с областью departmentID/district
+// или, если role == nil, отзывает права, и сообщает ему об этом. Сотрудник p должен
+// иметь право и на прежнюю роль target, и на новую. Свою роль менять нельзя,
+// чтобы не остаться без администратора.
+func (b *Bot) changeUserRole(ctx context.Context, p *Principal, target *StaffUser, role *AdminRole, departmentID *int64, district *string) (*StaffUser, error) {
+	if p.TGUserID != nil && *p.TGUserID == target.TGUserID {
+		return nil, fmt.Errorf("%w: нельзя изменить свою роль", ErrForbidden)
+	}
+	if target.Role != nil {
+		if err := p.Grants(*target.Role, target.DepartmentID, target.District); err != nil {
+			return nil, err
+		}
+	}
+	if role != nil {
+		if err := p.Grants(*role, departmentID, district); err != nil {
+			return nil, err
+		}
+	}
+	u, err := b.DB.SetUserRole(ctx, target.TGUserID, role, departmentID, district)
+	if err != nil {
+		return nil, err
+	}
+	b.notifyRoleChanged(u)
+	return u, nil
+}
+
+// notifyRoleChanged сообщает пользователю о выдаче или отзыве прав.
+func (b *Bot) notifyRoleChanged(u *StaffUser) {
+	text := "Ваши права сотрудника отозваны."
+	if u.Role != nil {
+		text = "Ваша роль изменена: " + scopeLabel(*u.Role, u.DepartmentID, u.District) + "."
+	}
+	b.reply(u.TGUserID, text)
+}
+
+// sendStaffList показывает сотрудников области p в Telegram с ролями и областью.
+func (b *Bot) sendStaffList(ctx context.Context, chatID int64, p *Principal) {
+	list, err := b.DB.ListUsers(ctx, true, "", p.StaffScope())
+	if err != nil {
+		b.reply(chatID, "Не удалось загрузить сотрудников: "+err.Error())
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("👥 Сотрудники:\n")
+	for _, u := range list {
+		fmt.Fprintf(&sb, "\n%d · %s · %s", u.TGUserID, u.DisplayName(), scopeLabel(*u.Role, u.DepartmentID, u.District))
+	}
+	if len(list) == 0 {
+		sb.WriteString("\nпока никого")
+	}
+	sb.WriteString("\n\n/invite <роль> [id службы] — одноразовая ссылка-приглашение\n/setrole <tg id> <роль> — сменить роль\n/revoke <tg id> — отозвать права")
+	b.reply(chatID, trim(sb.String(), 4000))
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// области (scope) состояния диалогов бота; ключ — tg user id или chat id
+const (
+	stateWizard             = "wizard"               // tgUserID -> issueWizardState
+	statePendingComment     = "pending_comment"      // tgUserID -> pendingComment
+	statePendingBroadcast   = "pending_broadcast"    // tgUserID -> текст рассылки
+	statePendingReject      = "pending_reject"       // tgUserID -> pendingStatusChange, ждём причину отклонения
+	statePendingReply       = "pending_reply"        // tgUserID жителя -> issueID, следующее сообщение идёт в переписку
+	stateMyPage             = "my_page"              // chatID -> текущая страница /my
+	stateIssuesPage         = "issues_page"          // chatID -> текущая страница /issues
+	stateLastMode           = "last_mode"            // chatID -> "my" или "issues"
+	stateIssuesFilter       = "issues_filter"        // chatID -> issuesFilterState
+	stateLastMyMessages     = "last_my_messages"     // chatID -> сообщения /my для удаления при смене страницы
+	stateLastIssuesMessages = "last_issues_messages" // chatID -> сообщения /issues для удаления при смене страницы
+)
+
+// StateStore хранит состояние диалогов бота между апдейтами.
+// Значения сериализуются в JSON и живут не дольше ttl.
+type StateStore interface {
+	// Load читает значение в dst; false — значения нет или оно истекло.
+	Load(ctx context.Context, scope string, key int64, dst any) (bool, error)
+	Save(ctx context.Context, scope string, key int64, value any, ttl time.Duration) error
+	Delete(ctx context.Context, scope string, key int64) error
+}
+
+// PgStateStore — StateStore поверх таблицы bot_state. Переживает рестарты
+// и общий для нескольких реплик бота.
+type PgStateStore struct {
+	DB *DB
+}
+
+func NewPgStateStore(db *DB) *PgStateStore {
+	return &PgStateStore{DB: db}
+}
+
+func (s *PgStateStore) Load(ctx context.Context, scope string, key int64, dst any) (bool, error) {
+	var raw []byte
+	err := s.DB.Pool.QueryRow(ctx, `
+		select value from bot_state
+		where scope = $1 and key = $2 and expires_at > now()
+	`, scope, key).Scan(&raw)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return false, fmt.Errorf("state %s/%d: %w", scope, key, err)
+	}
+	return true, nil
+}
+
+func (s *PgStateStore) Save(ctx context.Context, scope string, key int64, value any, ttl time.Duration) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("state %s/%d: %w", scope, key, err)
+	}
+	_, err = s.DB.Pool.Exec(ctx, `
+		insert into bot_state (scope, key, value, expires_at)
+		values ($1, $2, $3, now() + $4 * interval '1 second')
+		on conflict (scope, key) do update set
+			value = excluded.value,
+			expires_at = excluded.expires_at,
+			updated_at = now()
+	`, scope, key, raw, ttl.Seconds())
+	return err
+}
+
+func (s *PgStateStore) Delete(ctx context.Context, scope string, key int64) error {
+	_, err := s.DB.Pool.Exec(ctx, `delete from bot_state where scope = $1 and key = $2`, scope, key)
+	return err
+}
+
+// PurgeExpired удаляет истёкшие записи и возвращает их количество.
+func (s *PgStateStore) PurgeExpired(ctx context.Context) (int64, error) {
+	cmd, err := s.DB.Pool.Exec(ctx, `delete from bot_state where expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
+
+// RunJanitor периодически чистит истёкшее состояние, пока не отменён ctx.
+func (s *PgStateStore) RunJanitor(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n, err := s.PurgeExpired(ctx); err != nil {
+				log.Printf("очистка состояния бота: %v", err)
+			} else if n > 0 {
+				log.Printf("Удалено истёкших записей состояния бота: %d", n)
+			}
+		}
+	}
+}
+
+// loadState читает состояние диалога; ошибки хранилища логируются
+// и трактуются как отсутствие состояния.
+func (b *Bot) loadState(ctx context.Context, scope string, key int64, dst any) bool {
+	ok, err := b.State.Load(ctx, scope, key, dst)
+	if err != nil {
+		log.Printf("load state %s/%d: %v", scope, key, err)
+		return false
+	}
+	return ok
+}
+
+func (b *Bot) saveState(ctx context.Context, scope string, key int64, value any) {
+	if err := b.State.Save(ctx, scope, key, value, b.Cfg.StateTTL); err != nil {
+		log.Printf("save state %s/%d: %v", scope, key, err)
+	}
+}
+
+func (b *Bot) clearState(ctx context.Context, scope string, key int64) {
+	if err := b.State.Delete(ctx, scope, key); err != nil {
+		log.Printf("delete state %s/%d: %v", scope, key, err)
+	}
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type IssueStatus string
+
+const (
+	StatusNew        IssueStatus = "Новая"
+	StatusInProgress IssueStatus = "В обработке"
+	StatusDone       IssueStatus = "Завершено"
+	StatusRejected   IssueStatus = "Отклонено"
+)
+
+// AllStatuses — все статусы в порядке жизненного цикла заявки.
+var AllStatuses = []IssueStatus{StatusNew, StatusInProgress, StatusDone, StatusRejected}
+
+var (
+	ErrIssueNotFound        = errors.New("заявка не найдена")
+	ErrUnknownStatus        = errors.New("неизвестный статус")
+	ErrTransitionNotAllowed = errors.New("переход между статусами запрещён")
+	ErrReopenRequired       = errors.New("заявка закрыта, для смены статуса её нужно явно переоткрыть")
+	ErrReasonRequired       = errors.New("для отклонения заявки нужно указать причину")
+	ErrVersionConflict      = errors.New("заявка была изменена другим пользователем, обновите данные")
+)
+
+// checkVersion — ErrVersionConflict, если ожидаемая версия заявки expected
+// задана и не совпадает с текущей version. nil expected — без проверки.
+func checkVersion(expected *int, version int) error {
+	if expected != nil && *expected != version {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// ParseIssueStatus проверяет, что s — один из известных статусов.
+func ParseIssueStatus(s string) (IssueStatus, error) {
+	s = strings.TrimSpace(s)
+	for _, st := range AllStatuses {
+		if string(st) == s {
+			return st, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownStatus, s)
+}
+
+// IsFinal — заявка закрыта (выполнена или отклонена).
+func (s IssueStatus) IsFinal() bool {
+	return s == StatusDone || s == StatusRejected
+}
+
+func statusStrings(list []IssueStatus) []string {
+	res := make([]string, len(list))
+	for i, s := range list {
+		res[i] = string(s)
+	}
+	return res
+}
+
+// StatusMachine описывает допустимые переходы между статусами заявки.
+// Выход из закрытого статуса (Завершено/Отклонено) считается переоткрытием
+// и разрешён только при явном запросе reopen.
+type StatusMachine struct {
+	allowed map[IssueStatus][]IssueStatus
+}
+
+// DefaultStatusMachine — граф переходов по умолчанию.
+func DefaultStatusMachine() *StatusMachine {
+	return &StatusMachine{allowed: map[IssueStatus][]IssueStatus{
+		StatusNew:        {StatusInProgress, StatusDone, StatusRejected},
+		StatusInProgress: {StatusDone, StatusRejected},
+		StatusDone:       {StatusInProgress},
+		StatusRejected:   {StatusNew, StatusInProgress},
+	}}
+}
+
+// ParseStatusTransitions разбирает граф переходов из строки вида
+// "Новая>В обработке,Новая>Отклонено,Завершено>В обработке".
+// Пустая строка означает граф по умолчанию.
+func ParseStatusTransitions(spec string) (*StatusMachine, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return DefaultStatusMachine(), nil
+	}
+	m := &StatusMachine{allowed: map[IssueStatus][]IssueStatus{}}
+	for _, pair := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(pair, ">")
+		if !ok {
+			return nil, fmt.Errorf("переход %q: ожидается формат <из>><в>", pair)
+		}
+		f, err := ParseIssueStatus(from)
+		if err != nil {
+			return nil, err
+		}
+		t, err := ParseIssueStatus(to)
+		if err != nil {
+			return nil, err
+		}
+		if f == t {
+			return nil, fmt.Errorf("переход %q: статусы совпадают", pair)
+		}
+		m.allowed[f] = append(m.allowed[f], t)
+	}
+	return m, nil
+}
+
+// Next возвращает статусы, в которые можно перевести заявку из from.
+func (m *StatusMachine) Next(from IssueStatus) []IssueStatus {
+	return m.allowed[from]
+}
+
+// Check проверяет переход from -> to. reason — комментарий к смене статуса,
+// обязателен при отклонении заявки.
+func (m *StatusMachine) Check(from, to IssueStatus, reopen bool, reason string) error {
+	if from == to {
+		return fmt.Errorf("%w: заявка уже в статусе «%s»", ErrTransitionNotAllowed, to)
+	}
+	allowed := false
+	for _, s := range m.allowed[from] {
+		if s == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: «%s» → «%s»", ErrTransitionNotAllowed, from, to)
+	}
+	if from.IsFinal() && !reopen {
+		return ErrReopenRequired
+	}
+	if to == StatusRejected && strings.TrimSpace(reason) == "" {
+		return ErrReasonRequired
+	}
+	return nil
+}
+
+// IsStatusValidationError — ошибка вызвана нарушением правил смены статуса,
+// а не сбоем базы.
+func IsStatusValidationError(err error) bool {
+	return errors.Is(err, ErrUnknownStatus) ||
+		errors.Is(err, ErrTransitionNotAllowed) ||
+		errors.Is(err, ErrReopenRequired) ||
+		errors.Is(err, ErrReasonRequired)
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCheckVersion(t *testing.T) {
+	v := func(n int) *int { return &n }
+	cases := []struct {
+		name     string
+		expected *int
+		version  int
+		wantErr  error
+	}{
+		{name: "без ожидаемой версии", expected: nil, version: 3},
+		{name: "версия совпала", expected: v(3), version: 3},
+		{name: "заявку уже изменили", expected: v(3), version: 4, wantErr: ErrVersionConflict},
+		{name: "версия из будущего", expected: v(5), version: 4, wantErr: ErrVersionConflict},
+		{name: "нулевая версия", expected: v(0), version: 1, wantErr: ErrVersionConflict},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkVersion(tc.expected, tc.version); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("ошибка %v, ожидалась %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// Конфликт версий показывается сотруднику как есть, а не общей ошибкой.
+func TestVersionConflictErrorText(t *testing.T) {
+	err := fmt.Errorf("заявка #7: %w", ErrVersionConflict)
+	for name, text := range map[string]func(error) string{
+		"статус":     statusErrorText,
+		"назначение": assignmentErrorText,
+	} {
+		if got := text(err); got != err.Error() {
+			t.Fatalf("%s: %q, ожидалось %q", name, got, err.Error())
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Авторы сообщений в переписке по заявке.
+const (
+	ThreadAuthorCitizen = "citizen"
+	ThreadAuthorStaff   = "staff"
+)
+
+// AddIssueMessage сохраняет сообщение жителя по заявке.
+func (db *DB) AddIssueMessage(ctx context.Context, msg *IssueMessage) error {
+	return db.Pool.QueryRow(ctx, `
+		insert into issue_messages (issue_id, user_id, text, tg_chat_id, tg_message_id)
+		values ($1, $2, $3, $4, $5)
+		returning id, created_at
+	`, msg.IssueID, msg.UserID, msg.Text, msg.TGChatID, msg.TGMessageID).Scan(&msg.ID, &msg.CreatedAt)
+}
+
+// LinkIssueMessage запоминает, что сообщение бота messageID в чате chatID относится к заявке.
+func (db *DB) LinkIssueMessage(ctx context.Context, chatID int64, messageID int, issueID int64) error {
+	_, err := db.Pool.Exec(ctx, `
+		insert into issue_message_links (chat_id, message_id, issue_id)
+		values ($1, $2, $3)
+		on conflict (chat_id, message_id) do update set issue_id = excluded.issue_id
+	`, chatID, messageID, issueID)
+	return err
+}
+
+// IssueIDByMessage возвращает заявку, к которой относится сообщение бота; 0 — не найдено.
+func (db *DB) IssueIDByMessage(ctx context.Context, chatID int64, messageID int) (int64, error) {
+	var id int64
+	err := db.Pool.QueryRow(ctx,
+		`select issue_id from issue_message_links where chat_id = $1 and message_id = $2`,
+		chatID, messageID,
+	).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// ListIssueThread возвращает всю переписку по заявке: сообщения жителя
+// и комментарии администрации (включая внутренние заметки), по времени.
+func (db *DB) ListIssueThread(ctx context.Context, issueID int64) ([]ThreadEntry, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select 'citizen', 'public', m.user_id, u.first_name, u.username, coalesce(m.text, ''), m.created_at
+		from issue_messages m
+		left join users u on u.id = m.user_id
+		where m.issue_id = $1
+		union all
+		select 'staff', c.visibility, c.admin_user_id, u.first_name, u.username, c.text, c.created_at
+		from comments c
+		left join users u on u.id = c.admin_user_id
+		where c.issue_id = $1
+		order by 7
+	`, issueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []ThreadEntry
+	for rows.Next() {
+		var e ThreadEntry
+		if err := rows.Scan(&e.Author, &e.Visibility, &e.UserID, &e.FirstName, &e.Username, &e.Text, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+// citizenIssueKeyboard — кнопка, после которой следующее сообщение жителя
+// попадёт в переписку по заявке.
+func citizenIssueKeyboard(issueID int64) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("✉️ Ответить по заявке #%d", issueID), fmt.Sprintf("reply:%d", issueID)),
+	))
+}
+
+// sendToCitizen отправляет жителю сообщение по заявке с кнопкой ответа
+// и запоминает связь сообщения с заявкой, чтобы принять ответ (reply) на него.
+func (b *Bot) sendToCitizen(ctx context.Context, chatID int64, issueID int64, text string) error {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = citizenIssueKeyboard(issueID)
+	sent, err := b.API.Send(msg)
+	if err != nil {
+		return err
+	}
+	b.linkIssueMessage(ctx, chatID, sent.MessageID, issueID)
+	return nil
+}
+
+func (b *Bot) linkIssueMessage(ctx context.Context, chatID int64, messageID int, issueID int64) {
+	if messageID == 0 {
+		return
+	}
+	if err := b.DB.LinkIssueMessage(ctx, chatID, messageID, issueID); err != nil {
+		log.Printf("link message %d/%d -> #%d: %v", chatID, messageID, issueID, err)
+	}
+}
+
+// threadIssueForMessage определяет, к какой заявке относится сообщение жителя:
+// ответ (reply) на сообщение бота по заявке или сообщение после кнопки «Ответить».
+func (b *Bot) threadIssueForMessage(ctx context.Context, m *tgbotapi.Message) int64 {
+	if m.ReplyToMessage != nil {
+		id, err := b.DB.IssueIDByMessage(ctx, m.Chat.ID, m.ReplyToMessage.MessageID)
+		if err != nil {
+			log.Printf("issue by message: %v", err)
+		}
+		if id != 0 {
+			return id
+		}
+	}
+	var id int64
+	if b.loadState(ctx, statePendingReply, m.From.ID, &id) {
+		b.clearState(ctx, statePendingReply, m.From.ID)
+		return id
+	}
+	return 0
+}
+
+// addCitizenReply прикрепляет сообщение жителя к заявке issueID и уведомляет администрацию.
+func (b *Bot) addCitizenReply(ctx context.Context, m *tgbotapi.Message, u *User, issueID int64) {
+	iss, err := b.DB.GetIssueByID(ctx, issueID)
+	if err != nil || u == nil || iss.UserID != u.ID {
+		b.reply(m.Chat.ID, "Не удалось найти вашу заявку для ответа.")
+		return
+	}
+
+	text := strings.TrimSpace(m.Text)
+	if text == "" {
+		text = strings.TrimSpace(m.Caption)
+	}
+	msgID := m.MessageID
+	entry := &IssueMessage{
+		IssueID:     iss.ID,
+		UserID:      &u.ID,
+		TGChatID:    &m.Chat.ID,
+		TGMessageID: &msgID,
+	}
+	if text != "" {
+		entry.Text = &text
+	}
+	if err := b.DB.AddIssueMessage(ctx, entry); err != nil {
+		b.reply(m.Chat.ID, "Не удалось сохранить сообщение: "+err.Error())
+		return
+	}
+	b.saveMessageAttachments(ctx, iss.ID, m)
+
+	b.reply(m.Chat.ID, fmt.Sprintf("Сообщение добавлено к заявке #%d", iss.ID))
+	b.notifyStaffCitizenReply(ctx, iss, text)
+}
+
+// notifyStaffCitizenReply сообщает о новом сообщении жителя исполнителю заявки,
+// а если исполнителя нет — всем сотрудникам, в чью область попадает заявка.
+func (b *Bot) notifyStaffCitizenReply(ctx context.Context, iss *Issue, text string) {
+	var recipients []int64
+	var err error
+	if iss.AssigneeID != nil {
+		var tg int64
+		err = b.DB.Pool.QueryRow(ctx, `SELECT tg_user_id FROM users WHERE id = $1`, *iss.AssigneeID).Scan(&tg)
+		recipients = []int64{tg}
+	} else {
+		recipients, err = b.Auth.StaffFor(ctx, PermViewIssues, iss)
+	}
+	if err != nil {
+		log.Printf("notify citizen reply: %v", err)
+		return
+	}
+
+	if text == "" {
+		text = "(вложение без текста)"
+	}
+	body := fmt.Sprintf("✉️ Новое сообщение жителя по заявке #%d:\n\n%s", iss.ID, trim(text, 3500))
+	kb := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🧵 Переписка", fmt.Sprintf("thread:%d", iss.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("✉️ Ответить жителю", fmt.Sprintf("comment:%d:%s", iss.ID, CommentPublic)),
+	))
+	for _, adminTG := range recipients {
+		msg := tgbotapi.NewMessage(adminTG, body)
+		msg.ReplyMarkup = kb
+		b.API.Send(msg)
+	}
+}
+
+// addStaffComment сохраняет комментарий администрации; публичный комментарий
+// уйдёт жителю по событию issue.commented (см. Notifications), внутренняя
+// заметка остаётся только у сотрудников.
+func (b *Bot) addStaffComment(ctx context.Context, issueID int64, adminTG int64, text, visibility string) error {
+	return b.DB.AddComment(ctx, issueID, adminTG, text, visibility)
+}
+
+// sendIssueThread показывает администратору переписку по заявке.
+func (b *Bot) sendIssueThread(ctx context.Context, chatID int64, issueID int64) {
+	entries, err := b.DB.ListIssueThread(ctx, issueID)
+	if err != nil {
+		b.reply(chatID, "Не удалось загрузить переписку: "+err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		b.reply(chatID, fmt.Sprintf("По заявке #%d переписки пока нет.", issueID))
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🧵 Переписка по заявке #%d\n", issueID)
+	for _, e := range entries {
+		who := "Житель"
+		if e.Author == ThreadAuthorStaff {
+			who = "Администрация"
+			if e.FirstName != nil && *e.FirstName != "" {
+				who += " (" + *e.FirstName + ")"
+			}
+			if e.Visibility == CommentInternal {
+				who = "🔒 " + who + ", заметка"
+			}
+		}
+		text := e.Text
+		if text == "" {
+			text = "(вложение без текста)"
+		}
+		fmt.Fprintf(&sb, "\n%s · %s:\n%s\n", e.CreatedAt.Local().Format("02.01 15:04"), who, text)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, trim(sb.String(), 4000))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("✉️ Ответить жителю", fmt.Sprintf("comment:%d:%s", issueID, CommentPublic)),
+		tgbotapi.NewInlineKeyboardButtonData("🔒 Заметка", fmt.Sprintf("comment:%d:%s", issueID, CommentInternal)),
+	))
+	b.API.Send(msg)
+}
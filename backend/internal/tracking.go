@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// trackingCodeRe — формат кода отслеживания (см. миграцию 0019): 32 hex-символа.
+var trackingCodeRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// TrackingURL — публичная ссылка на страницу заявки; пусто, если PUBLIC_BASE_URL не задан.
+func TrackingURL(cfg *Config, code string) string {
+	if cfg.PublicBaseURL == "" || code == "" {
+		return ""
+	}
+	return strings.TrimRight(cfg.PublicBaseURL, "/") + "/track/" + code
+}
+
+// trackingLine — строка со ссылкой на страницу заявки для подтверждения в боте.
+func (b *Bot) trackingLine(iss *Issue) string {
+	url := TrackingURL(b.Cfg, iss.TrackingCode)
+	if url == "" {
+		return ""
+	}
+	return "Следить за статусом: " + url
+}
+
+// GetIssueTracking собирает публичную информацию о заявке по коду отслеживания.
+// Незнакомый или неверный по формату код — ErrIssueNotFound.
+func (db *DB) GetIssueTracking(ctx context.Context, code string) (*IssueTracking, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if !trackingCodeRe.MatchString(code) {
+		return nil, ErrIssueNotFound
+	}
+
+	var t IssueTracking
+	err := db.Pool.QueryRow(ctx, `
+		select id, status, district, category, created_at, updated_at
+		from issues where tracking_code = $1
+	`, code).Scan(&t.ID, &t.Status, &t.District, &t.Category, &t.CreatedAt, &t.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrIssueNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// создание заявки — первый пункт истории
+	t.Statuses = []TrackingStatus{{Status: string(StatusNew), CreatedAt: t.CreatedAt}}
+	rows, err := db.Pool.Query(ctx, `
+		select new_status, created_at
+		from status_changes where issue_id = $1
+		order by created_at, id
+	`, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var s TrackingStatus
+		if err := rows.Scan(&s.Status, &s.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.Statuses = append(t.Statuses, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Pool.Query(ctx, `
+		select text, created_at
+		from comments where issue_id = $1 and visibility = 'public'
+		order by created_at, id
+	`, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c TrackingComment
+		if err := rows.Scan(&c.Text, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.Comments = append(t.Comments, c)
+	}
+	return &t, rows.Err()
+}
@@ -2,17 +2,21 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"net/http"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jackc/pgx/v5"
 )
 
 // структура HTTP-сервера (интерфейса и API)
@@ -21,6 +25,10 @@ type Web struct {
 	DB       *DB
 	Services *Services
 	Bot      *Bot
+	Auth     *Authorizer
+	Guard    *AuthGuard
+	Files    *URLSigner // подписанные ссылки на вложения
+	Blobs    BlobStore  // файлы вложений
 }
 
 func NewWeb(cfg *Config, db *DB, svc *Services, bot *Bot) *Web {
@@ -29,11 +37,19 @@ func NewWeb(cfg *Config, db *DB, svc *Services, bot *Bot) *Web {
 		DB:       db,
 		Services: svc,
 		Bot:      bot,
+		Auth:     NewAuthorizer(db),
+		Guard:    bot.Guard,
+		Files:    NewURLSigner(cfg.FileURLSecret, cfg.FileURLTTL),
+		Blobs:    bot.Blobs,
 	}
 }
 
 func (w *Web) StartHTTP(ctx context.Context) error {
 	r := gin.Default()
+	// адрес клиента нужен защите от перебора: X-Forwarded-For принимаем только от своих прокси
+	if err := r.SetTrustedProxies(w.Cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
 
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
@@ -48,11 +64,10 @@ func (w *Web) StartHTTP(ctx context.Context) error {
 		c.Next()
 	})
 
-	// Определяем пути до frontend и uploads
+	// Определяем путь до frontend
 	_, b, _, _ := runtime.Caller(0)
 	basePath := filepath.Join(filepath.Dir(b), "..")    // backend/
 	frontendPath := filepath.Join(basePath, "frontend") // backend/frontend
-	uploadsPath := filepath.Join(basePath, "uploads")   // backend/uploads
 
 	// API
 
@@ -64,7 +79,11 @@ func (w *Web) StartHTTP(ctx context.Context) error {
 			return
 		}
 
-		issue, err := w.Services.CreateWebIssue(c.Request.Context(), &req)
+		issue, token, err := w.Services.CreateWebIssue(c.Request.Context(), &req)
+		if errors.Is(err, ErrInvalidContact) {
+			c.JSON(422, gin.H{"error": "Укажите телефон или e-mail для связи"})
+			return
+		}
 		if err != nil {
 			c.JSON(500, gin.H{"error": "Ошибка при создании заявки"})
 			return
@@ -74,21 +93,103 @@ func (w *Web) StartHTTP(ctx context.Context) error {
 			"message": "Заявка успешно создана",
 			"id":      issue.ID,
 			"status":  issue.Status,
+			// токен автора: по нему житель видит свои вложения, больше он нигде не показывается
+			"access_token":  token,
+			"tracking_code": issue.TrackingCode,
 		})
 	})
 
-	// Загрузка вложений к заявке
+	// Вложения заявки для её автора: токен из ответа на создание заявки
+	// передаётся в заголовке X-Issue-Token. Чужим — 404, как будто заявки нет.
+	r.GET("/api/issues/:id/attachments", func(c *gin.Context) {
+		issueID, ok := w.authorIssueID(c)
+		if !ok {
+			return
+		}
+		atts, err := w.DB.GetAttachmentsByIssueID(c, issueID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		w.Files.SignAttachments(atts)
+		res := make([]gin.H, 0, len(atts))
+		for _, a := range atts {
+			res = append(res, gin.H{"id": a.ID, "type": a.FileType, "url": a.URL, "created_at": a.CreatedAt})
+		}
+		c.JSON(200, res)
+	})
+
+	// Файл вложения по подписанной ссылке (см. URLSigner). Любая ошибка — 404,
+	// чтобы по ответу нельзя было перебирать существующие вложения.
+	r.GET("/attachments/:id", func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.String(404, "not found")
+			return
+		}
+		left, ok := w.Files.Verify(id, c.Query("exp"), c.Query("sig"))
+		if !ok {
+			c.String(404, "not found")
+			return
+		}
+		a, err := w.DB.GetAttachment(c, id)
+		if err != nil {
+			if !errors.Is(err, ErrAttachmentNotFound) {
+				log.Printf("вложение %d: %v", id, err)
+			}
+			c.String(404, "not found")
+			return
+		}
+		rc, err := OpenAttachment(c, w.Blobs, w.Cfg.LegacyDir, a)
+		if errors.Is(err, ErrBlobNotFound) && a.DownloadStatus == DownloadPending && w.Bot.Media != nil {
+			// файл ещё не скачан в хранилище — отдаём прямо из Telegram
+			rc, err = w.Bot.Media.Open(c, a.FileID)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrBlobNotFound) {
+				log.Printf("вложение %d: %v", id, err)
+			}
+			c.String(404, "not found")
+			return
+		}
+		defer rc.Close()
+
+		size := int64(-1)
+		if a.Size != nil {
+			size = *a.Size
+		}
+		headers := map[string]string{
+			"Cache-Control":          fmt.Sprintf("private, max-age=%d", int(left.Seconds())),
+			"X-Content-Type-Options": "nosniff",
+		}
+		if attachmentInline(a.FileType) {
+			c.DataFromReader(200, size, attachmentContentType(a.FileType), rc, headers)
+			return
+		}
+		headers["Content-Disposition"] = fmt.Sprintf("attachment; filename=%q", attachmentFileName(a))
+		c.DataFromReader(200, size, "application/octet-stream", rc, headers)
+	})
+
+	// Загрузка вложений к заявке. Загружать может только автор: токен из ответа
+	// POST /api/issues передаётся в заголовке X-Issue-Token, иначе 404.
 	r.POST("/api/issues/:id/attachments", func(c *gin.Context) {
-		idStr := c.Param("id")
-		issueID, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil || issueID <= 0 {
-			c.JSON(400, gin.H{"error": "invalid issue id"})
+		issueID, ok := w.authorIssueID(c)
+		if !ok {
 			return
 		}
 
+		policy := w.Cfg.Uploads
+		// тело не больше, чем все разрешённые файлы плюс запас на заголовки частей
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(policy.MaxFiles)*policy.MaxFileSize+1<<20)
+
 		// читаем файлы из поля "attachments"
 		form, err := c.MultipartForm()
 		if err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				c.JSON(413, gin.H{"error": ErrUploadTooLarge.Error()})
+				return
+			}
 			c.JSON(400, gin.H{"error": "failed to read multipart form"})
 			return
 		}
@@ -97,62 +198,203 @@ func (w *Web) StartHTTP(ctx context.Context) error {
 			c.JSON(400, gin.H{"error": "no files"})
 			return
 		}
-
-		if err := os.MkdirAll(uploadsPath, 0o755); err != nil {
-			c.JSON(500, gin.H{"error": "failed to create upload dir"})
+		// предварительно, чтобы не сохранять файлы зря; окончательно лимит
+		// проверяется при записи (см. DB.AddWebAttachments)
+		existing, err := w.DB.CountAttachments(c, issueID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		if existing+len(files) > policy.MaxFiles {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("%s: к заявке можно прикрепить не больше %d", ErrUploadTooMany, policy.MaxFiles)})
 			return
 		}
 
-		var uploaded []gin.H
+		// сначала проверяем все файлы, чтобы не сохранить половину
+		types := make([]string, len(files))
+		for i, fh := range files {
+			mimeType, err := policy.SniffUpload(fh)
+			switch {
+			case err == nil:
+				types[i] = mimeType
+			case errors.Is(err, ErrUploadTooLarge):
+				c.JSON(413, gin.H{"error": err.Error()})
+				return
+			case errors.Is(err, ErrUploadType):
+				c.JSON(415, gin.H{"error": err.Error()})
+				return
+			default:
+				c.JSON(400, gin.H{"error": "failed to read uploaded file"})
+				return
+			}
+		}
 
-		for _, fh := range files {
+		saved := make([]WebAttachment, len(files))
+		for i, fh := range files {
 			src, err := fh.Open()
 			if err != nil {
 				c.JSON(500, gin.H{"error": "failed to open uploaded file"})
 				return
 			}
 
-			// делаем уникальное имя файла
-			safeName := fmt.Sprintf("issue_%d_%d_%s", issueID, time.Now().Unix(), fh.Filename)
-
-			// путь на диске
-			dstPath := filepath.Join(uploadsPath, safeName)
-			dst, err := os.Create(dstPath)
+			// в хранилище файл лежит под ключом из содержимого, присланное имя только показываем
+			displayName := sanitizeFileName(fh.Filename)
+			key, size, err := PutBlob(c, w.Blobs, io.LimitReader(src, policy.MaxFileSize), types[i])
+			src.Close()
 			if err != nil {
-				src.Close()
-				c.JSON(500, gin.H{"error": "failed to create file"})
-				return
-			}
-
-			if _, err := io.Copy(dst, src); err != nil {
-				src.Close()
-				dst.Close()
+				log.Printf("вложение к заявке #%d: %v", issueID, err)
 				c.JSON(500, gin.H{"error": "failed to save file"})
 				return
 			}
+			saved[i] = WebAttachment{FileName: displayName, FileSize: size, FileType: types[i], BlobKey: key}
+		}
 
-			src.Close()
-			dst.Close()
-
-			fileType := fh.Header.Get("Content-Type")
+		// файлы без записи в attachments никто не увидит; одинаковые хранятся один раз
+		ids, err := w.Services.AddWebAttachments(c, issueID, saved, policy.MaxFiles)
+		if errors.Is(err, ErrUploadTooMany) {
+			c.JSON(422, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("вложения к заявке #%d: %v", issueID, err)
+			c.JSON(500, gin.H{"error": "failed to save attachment meta"})
+			return
+		}
+		uploaded := make([]gin.H, 0, len(ids))
+		for i, id := range ids {
+			uploaded = append(uploaded, gin.H{
+				"name": saved[i].FileName,
+				"type": saved[i].FileType,
+				"url":  w.Files.AttachmentURL(id),
+			})
+		}
 
-			localPath := filepath.Join("uploads", safeName)
+		c.JSON(200, gin.H{"uploaded": uploaded})
+	})
 
-			if err := w.DB.AddWebAttachment(c, issueID, safeName, fileType, localPath); err != nil {
-				c.JSON(500, gin.H{"error": "failed to save attachment meta"})
-				return
-			}
+	// Привязка Telegram к жителю: бот присылает код в Telegram, где подтверждён
+	// телефон жителя (см. /link в боте), а житель вводит его на сайте.
+	r.POST("/api/issues/:id/link-telegram", func(c *gin.Context) {
+		issueID, ok := w.authorIssueID(c)
+		if !ok {
+			return
+		}
+		iss, err := w.DB.GetWebIssueByID(c, issueID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		if iss.CitizenID == nil {
+			c.JSON(409, gin.H{"error": "Заявка подана не с сайта"})
+			return
+		}
+		err = w.Bot.RequestCitizenLink(c, *iss.CitizenID)
+		switch {
+		case err == nil:
+			c.JSON(200, gin.H{"sent": true})
+		case errors.Is(err, ErrNoVerifiedTelegram):
+			c.JSON(409, gin.H{"error": "Сначала отправьте боту команду /link и поделитесь номером, указанным в заявке"})
+		case errors.Is(err, ErrLinkCodeTooSoon):
+			c.JSON(429, gin.H{"error": err.Error()})
+		default:
+			log.Printf("привязка Telegram к заявке #%d: %v", issueID, err)
+			c.JSON(500, gin.H{"error": "internal error"})
+		}
+	})
 
-			urlPath := "/uploads/" + safeName
+	r.POST("/api/issues/:id/link-telegram/confirm", func(c *gin.Context) {
+		issueID, ok := w.authorIssueID(c)
+		if !ok {
+			return
+		}
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "Некорректные данные"})
+			return
+		}
+		ip := c.ClientIP()
+		ipKey := ThrottleKey{Scope: ThrottleIP, Key: ip}
+		if wait := w.Guard.Locked(c, ipKey); wait > 0 {
+			c.Header("Retry-After", retryAfterSeconds(wait))
+			c.JSON(429, gin.H{"error": retryAfter(wait)})
+			return
+		}
+		iss, err := w.DB.GetWebIssueByID(c, issueID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		if iss.CitizenID == nil {
+			c.JSON(409, gin.H{"error": "Заявка подана не с сайта"})
+			return
+		}
+		citizen, n, err := w.DB.ConfirmCitizenLink(c, *iss.CitizenID, issueID, req.Code)
+		if errors.Is(err, ErrInvalidLinkCode) {
+			subject := fmt.Sprintf("citizen:%d", *iss.CitizenID)
+			w.Guard.Fail(c, SecurityEvent{Kind: SecurityLinkFailed, Subject: &subject, IP: &ip}, ipKey)
+			c.JSON(422, gin.H{"error": "Неверный или просроченный код"})
+			return
+		}
+		if err != nil {
+			log.Printf("привязка Telegram к заявке #%d: %v", issueID, err)
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		if citizen.TGUserID != nil {
+			w.Bot.reply(*citizen.TGUserID, fmt.Sprintf("Заявка #%d с сайта привязана к этому Telegram. Уведомления по ней будут приходить сюда, список — в /my.", issueID))
+		}
+		c.JSON(200, gin.H{"linked": true, "issues": n})
+	})
 
-			uploaded = append(uploaded, gin.H{
-				"name": safeName,
-				"type": fileType,
-				"url":  urlPath,
-			})
+	// Подтверждение e-mail по ссылке из письма (см. SMTPNotifier.ConfirmRecipient).
+	// Открывается из почты в браузере, поэтому ответ — текст, а не JSON.
+	r.GET("/api/email/confirm", func(c *gin.Context) {
+		err := w.DB.ConfirmCitizenEmail(c, c.Query("token"))
+		if errors.Is(err, ErrInvalidEmailToken) {
+			c.String(404, "Ссылка недействительна или устарела.")
+			return
+		}
+		if err != nil {
+			log.Printf("подтверждение e-mail: %v", err)
+			c.String(500, "internal error")
+			return
 		}
+		c.String(200, "Адрес подтверждён: уведомления о ваших заявках будут приходить на эту почту.")
+	})
 
-		c.JSON(200, gin.H{"uploaded": uploaded})
+	// Публичная страница заявки по коду отслеживания: статус, история статусов,
+	// ответы администрации. Ни текста обращения, ни контактов — ссылкой могут поделиться.
+	r.GET("/api/track/:code", func(c *gin.Context) {
+		t, err := w.DB.GetIssueTracking(c, c.Param("code"))
+		if errors.Is(err, ErrIssueNotFound) {
+			c.JSON(404, gin.H{"error": "not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		statuses := make([]gin.H, 0, len(t.Statuses))
+		for _, s := range t.Statuses {
+			statuses = append(statuses, gin.H{"status": s.Status, "at": s.CreatedAt})
+		}
+		comments := make([]gin.H, 0, len(t.Comments))
+		for _, cm := range t.Comments {
+			comments = append(comments, gin.H{"text": cm.Text, "at": cm.CreatedAt})
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(200, gin.H{
+			"id":         t.ID,
+			"status":     t.Status,
+			"district":   t.District,
+			"category":   t.Category,
+			"created_at": t.CreatedAt,
+			"updated_at": t.UpdatedAt,
+			"statuses":   statuses,
+			"comments":   comments,
+		})
 	})
 
 	r.GET("/api/categories", func(c *gin.Context) {
@@ -164,180 +406,1223 @@ func (w *Web) StartHTTP(ctx context.Context) error {
 
 	// Админ
 
-	r.GET("/admin/ping", func(c *gin.Context) {
-		if !w.auth(c.Query("token")) {
-			c.String(401, "unauthorized")
-			return
-		}
+	r.GET("/admin/ping", w.require(PermViewIssues), func(c *gin.Context) {
 		c.String(200, "ok")
 	})
 
-	r.GET("/export", func(c *gin.Context) {
-		if !w.auth(c.Query("token")) {
-			c.String(401, "unauthorized")
+	// вход, выход и учётные записи админки
+
+	r.POST("/admin/login", func(c *gin.Context) {
+		var req struct {
+			Login    string `json:"login"`
+			Password string `json:"password"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
 			return
 		}
-		fromS := c.Query("from")
-		toS := c.Query("to")
-		from, err1 := time.Parse("2006-01-02", fromS)
-		to, err2 := time.Parse("2006-01-02", toS)
-		if err1 != nil || err2 != nil {
-			c.String(400, "bad period")
+		ip := c.ClientIP()
+		loginKey, ipKey := loginThrottleKey(req.Login), ThrottleKey{Scope: ThrottleIP, Key: ip}
+		if wait := w.Guard.Locked(c, loginKey, ipKey); wait > 0 {
+			c.Header("Retry-After", retryAfterSeconds(wait))
+			c.String(429, retryAfter(wait))
 			return
 		}
-		to = to.Add(24 * time.Hour)
-		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=export_%s..%s.csv", fromS, toS))
-		c.Header("Content-Type", "text/csv; charset=utf-8")
-		if err := w.Services.ExportCSV(c, from, to, c.Writer); err != nil {
+		token, acc, sess, err := w.DB.AdminLogin(c, req.Login, req.Password, w.Cfg.AdminSessionTTL, c.Request.UserAgent(), ip)
+		if err != nil {
+			if errors.Is(err, ErrInvalidCredentials) {
+				w.Guard.Fail(c, SecurityEvent{Kind: SecurityLoginFailed, Subject: &loginKey.Key, IP: &ip}, loginKey, ipKey)
+				c.String(401, err.Error())
+				return
+			}
 			c.String(500, err.Error())
 			return
 		}
+		w.Guard.Succeed(c, loginKey)
+		c.JSON(200, gin.H{
+			"token":      token,
+			"expires_at": sess.ExpiresAt,
+			"account":    acc,
+		})
 	})
 
-	r.GET("/admin/issues", func(c *gin.Context) {
-		if !w.auth(c.Query("token")) {
-			c.String(401, "unauthorized")
+	r.POST("/admin/logout", w.require(), func(c *gin.Context) {
+		if err := w.DB.RevokeAdminSession(c, adminSession(c).ID); err != nil {
+			c.String(500, err.Error())
 			return
 		}
-		status := c.Query("status")
-		statuses := []string{"Новая", "В обработке", "Завершено", "Отклонено"}
-		if status != "" {
-			statuses = []string{status}
-		}
-		items, err := w.DB.ListIssuesByStatus(c, statuses, 100)
+		c.String(200, "ok")
+	})
+
+	r.GET("/admin/me", w.require(), func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"account":    adminAccount(c),
+			"expires_at": adminSession(c).ExpiresAt,
+		})
+	})
+
+	r.GET("/admin/accounts", w.require(PermManageUsers), func(c *gin.Context) {
+		items, err := w.DB.ListAdminAccounts(c)
 		if err != nil {
 			c.String(500, err.Error())
 			return
 		}
+		// только те, кем сотрудник может распоряжаться: роль не выше, область не шире
+		p := principal(c)
+		items = slices.DeleteFunc(items, func(a AdminAccount) bool {
+			return p.Grants(a.Role, a.DepartmentID, a.District) != nil
+		})
 		c.JSON(200, items)
 	})
 
-	r.POST("/admin/status", func(c *gin.Context) {
+	r.POST("/admin/accounts", w.require(PermManageUsers), func(c *gin.Context) {
 		var req struct {
-			Token   string  `json:"token"`
-			IssueID int64   `json:"issue_id"`
-			Status  string  `json:"status"`
-			Comment *string `json:"comment"`
-			AdminTG *int64  `json:"admin_tg"`
+			Login        string  `json:"login"`
+			Password     string  `json:"password"`
+			Role         string  `json:"role"`
+			DepartmentID *int64  `json:"department_id"`
+			District     *string `json:"district"`
+			TGUserID     *int64  `json:"tg_user_id"`
 		}
 		if err := c.BindJSON(&req); err != nil {
 			c.String(400, err.Error())
 			return
 		}
-		if !w.auth(req.Token) {
-			c.String(401, "unauthorized")
+		role, err := ParseAdminRole(req.Role)
+		if err != nil {
+			c.String(422, err.Error())
+			return
+		}
+		district := strPtrTrimToNil(req.District)
+		if err := principal(c).Grants(role, req.DepartmentID, district); err != nil {
+			c.String(403, err.Error())
 			return
 		}
-		if err := w.DB.SetIssueStatus(c, req.IssueID, req.Status, req.AdminTG, req.Comment); err != nil {
+		acc, err := w.DB.CreateAdminAccount(c, NewAdminAccount{
+			Login:        req.Login,
+			Password:     req.Password,
+			Role:         role,
+			DepartmentID: req.DepartmentID,
+			District:     district,
+			TGUserID:     req.TGUserID,
+		})
+		if err != nil {
+			if IsAccountValidationError(err) {
+				c.String(422, err.Error())
+				return
+			}
 			c.String(500, err.Error())
 			return
 		}
-		c.String(200, "ok")
+		c.JSON(200, acc)
 	})
 
-	r.POST("/admin/comment", func(c *gin.Context) {
+	r.PUT("/admin/accounts/:id", w.require(PermManageUsers), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad account id")
+			return
+		}
 		var req struct {
-			Token   string `json:"token"`
-			IssueID int64  `json:"issue_id"`
-			Text    string `json:"text"`
+			Role         string  `json:"role"`
+			DepartmentID *int64  `json:"department_id"`
+			District     *string `json:"district"`
+			TGUserID     *int64  `json:"tg_user_id"`
+			// непустой пароль заменяет текущий и завершает сессии учётки
+			Password string `json:"password"`
+			Disabled *bool  `json:"disabled"`
 		}
 		if err := c.BindJSON(&req); err != nil {
 			c.String(400, err.Error())
 			return
 		}
-		if !w.auth(req.Token) {
-			c.String(401, "unauthorized")
+		if id == adminAccount(c).ID && req.Disabled != nil && *req.Disabled {
+			c.String(422, "нельзя заблокировать свою учётную запись")
 			return
 		}
-		if req.IssueID <= 0 || req.Text == "" {
-			c.String(400, "bad request")
+		acc, err := w.DB.UpdateAdminAccount(c, principal(c), id, AdminAccountUpdate{
+			Role:         AdminRole(req.Role),
+			DepartmentID: req.DepartmentID,
+			District:     req.District,
+			TGUserID:     req.TGUserID,
+			Password:     req.Password,
+			Disabled:     req.Disabled,
+		})
+		switch {
+		case err == nil:
+			c.JSON(200, acc)
+		case errors.Is(err, ErrAccountNotFound):
+			c.String(404, err.Error())
+		case errors.Is(err, ErrForbidden):
+			c.String(403, err.Error())
+		case errors.Is(err, ErrLastSuperadmin):
+			c.String(409, err.Error())
+		case IsAccountValidationError(err):
+			c.String(422, err.Error())
+		default:
+			c.String(500, err.Error())
+		}
+	})
+
+	r.GET("/admin/accounts/:id/sessions", w.require(PermManageUsers), func(c *gin.Context) {
+		id, ok := w.authorizeAccount(c)
+		if !ok {
 			return
 		}
-		var adminTG int64
-		rowAdmin := w.DB.Pool.QueryRow(c.Request.Context(), `select tg_user_id from users where is_admin = true order by id limit 1`)
-		_ = rowAdmin.Scan(&adminTG)
-		if adminTG != 0 {
-			_ = w.DB.AddComment(c.Request.Context(), req.IssueID, adminTG, req.Text)
+		items, err := w.DB.ListAdminSessions(c, id)
+		if err != nil {
+			c.String(500, err.Error())
+			return
 		}
+		c.JSON(200, items)
+	})
 
-		var chatID int64
-		rowUser := w.DB.Pool.QueryRow(c.Request.Context(), `select chat_id from issues where id = $1`, req.IssueID)
-		if err := rowUser.Scan(&chatID); err == nil && chatID != 0 && w.Bot != nil && w.Bot.API != nil {
-			msgText := fmt.Sprintf("Комментарий по вашей заявке #%d:\n\n%s", req.IssueID, req.Text)
-			_, _ = w.Bot.API.Send(tgbotapi.NewMessage(chatID, msgText))
+	// завершить все сессии учётки (например, при утере ноутбука)
+	r.DELETE("/admin/accounts/:id/sessions", w.require(PermManageUsers), func(c *gin.Context) {
+		id, ok := w.authorizeAccount(c)
+		if !ok {
+			return
 		}
-
-		c.String(200, "ok")
+		n, err := w.DB.RevokeAdminSessions(c, id)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, gin.H{"revoked": n})
 	})
 
-	r.GET("/admin/issues/:id/attachments", func(c *gin.Context) {
-		if !w.auth(c.Query("token")) {
-			c.String(401, "unauthorized")
+	// журнал безопасности и блокировки после неудачных попыток входа
+
+	r.GET("/admin/security/events", w.require(PermManageUsers), func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit <= 0 || limit > 1000 {
+			c.String(400, "bad limit")
 			return
 		}
-		idStr := c.Param("id")
-		issueID, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil || issueID <= 0 {
-			c.String(400, "bad issue id")
+		items, err := w.DB.ListSecurityEvents(c, c.Query("kind"), limit)
+		if err != nil {
+			c.String(500, err.Error())
 			return
 		}
-		atts, err := w.DB.GetAttachmentsByIssueID(c, issueID)
+		c.JSON(200, items)
+	})
+
+	r.GET("/admin/security/locks", w.require(PermManageUsers), func(c *gin.Context) {
+		items, err := w.DB.ListThrottleLocks(c)
 		if err != nil {
 			c.String(500, err.Error())
 			return
 		}
-		c.JSON(200, atts)
+		c.JSON(200, items)
 	})
 
-	// Webhook
-
-	if w.Cfg.UseWebhook {
-		r.POST(w.Cfg.WebhookPath, func(c *gin.Context) {
-			var update tgbotapi.Update
-			if err := c.BindJSON(&update); err != nil {
-				c.String(400, err.Error())
-				return
-			}
-			w.Bot.HandleWebhookUpdate(c, update)
-			c.Status(200)
-		})
-		log.Printf("📡 Webhook включен: %s", w.Cfg.WebhookPath)
-	}
-
-	// Health check
-	r.GET("/healthz", func(c *gin.Context) {
+	// снять блокировку досрочно, например когда сотрудник сам забыл пароль
+	r.DELETE("/admin/security/locks/:scope/:key", w.require(PermManageUsers), func(c *gin.Context) {
+		k := ThrottleKey{Scope: c.Param("scope"), Key: c.Param("key")}
+		ok, err := w.DB.ResetThrottle(c, k)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		if !ok {
+			c.String(404, "блокировка не найдена")
+			return
+		}
+		details := k.String() + " разблокирован учёткой " + adminAccount(c).Login
+		ip := c.ClientIP()
+		if err := w.DB.AddSecurityEvent(c, &SecurityEvent{Kind: SecurityUnlock, Subject: &k.Key, IP: &ip, Details: &details}); err != nil {
+			log.Printf("журнал безопасности: %v", err)
+		}
 		c.String(200, "ok")
 	})
 
-	// Статика
-	r.Static("/static", frontendPath)
-	r.Static("/uploads", uploadsPath)
+	// сотрудники в Telegram: роли, отзыв прав и одноразовые приглашения
 
-	// Страница веб‑админки
-	r.GET("/admin", func(c *gin.Context) {
-		c.File(filepath.Join(frontendPath, "admin.html"))
+	r.GET("/admin/users", w.require(PermManageUsers), func(c *gin.Context) {
+		items, err := w.DB.ListUsers(c, c.Query("staff") == "1", c.Query("q"), principal(c).StaffScope())
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
 	})
 
-	// остальные пути
-	r.NoRoute(func(c *gin.Context) {
-		c.File(filepath.Join(frontendPath, "index.html"))
+	// выдать или сменить роль; область заменяется целиком
+	r.PUT("/admin/users/:tg_user_id/role", w.require(PermManageUsers), func(c *gin.Context) {
+		var req struct {
+			Role         string  `json:"role"`
+			DepartmentID *int64  `json:"department_id"`
+			District     *string `json:"district"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		role, err := ParseAdminRole(req.Role)
+		if err != nil {
+			c.String(422, err.Error())
+			return
+		}
+		w.changeUserRole(c, &role, req.DepartmentID, strPtrTrimToNil(req.District))
 	})
 
-	addr := ":" + w.Cfg.Port
-	log.Printf("🌐 HTTP сервер запущен на http://localhost%s", addr)
-	return r.Run(addr)
-}
+	r.DELETE("/admin/users/:tg_user_id/role", w.require(PermManageUsers), func(c *gin.Context) {
+		w.changeUserRole(c, nil, nil, nil)
+	})
 
-// Проверка токена администратора
-func (w *Web) auth(token string) bool {
-	if token == "" {
-		return false
-	}
-	if w.Cfg.APIToken != "" && token == w.Cfg.APIToken {
-		return true
+	r.GET("/admin/invites", w.require(PermManageUsers), func(c *gin.Context) {
+		items, err := w.DB.ListStaffInvites(c, c.Query("all") != "1", principal(c).StaffScope())
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	r.POST("/admin/invites", w.require(PermManageUsers), func(c *gin.Context) {
+		var req struct {
+			Role         string  `json:"role"`
+			DepartmentID *int64  `json:"department_id"`
+			District     *string `json:"district"`
+			TTLHours     int     `json:"ttl_hours"` // 0 — STAFF_INVITE_TTL
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		role, err := ParseAdminRole(req.Role)
+		if err != nil {
+			c.String(422, err.Error())
+			return
+		}
+		district := strPtrTrimToNil(req.District)
+		if err := principal(c).Grants(role, req.DepartmentID, district); err != nil {
+			c.String(403, err.Error())
+			return
+		}
+		ttl := w.Cfg.StaffInviteTTL
+		if req.TTLHours != 0 {
+			ttl = time.Duration(req.TTLHours) * time.Hour
+		}
+		token, inv, err := w.DB.CreateStaffInvite(c, NewStaffInvite{
+			Role:               role,
+			DepartmentID:       req.DepartmentID,
+			District:           district,
+			TTL:                ttl,
+			CreatedByAccountID: &adminAccount(c).ID,
+		})
+		if err != nil {
+			if IsStaffValidationError(err) {
+				c.String(422, err.Error())
+				return
+			}
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, gin.H{
+			"invite": inv,
+			"start":  "/start " + invitePrefix + token,
+			"link":   w.Bot.inviteLink(token),
+		})
+	})
+
+	r.DELETE("/admin/invites/:id", w.require(PermManageUsers), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad invite id")
+			return
+		}
+		inv, err := w.DB.GetStaffInvite(c, id)
+		if err == nil {
+			if err := principal(c).Grants(inv.Role, inv.DepartmentID, inv.District); err != nil {
+				c.String(403, err.Error())
+				return
+			}
+			err = w.DB.RevokeStaffInvite(c, id)
+		}
+		switch {
+		case err == nil:
+			c.String(200, "ok")
+		case errors.Is(err, ErrInviteNotFound):
+			c.String(404, err.Error())
+		default:
+			c.String(500, err.Error())
+		}
+	})
+
+	r.GET("/export", w.require(PermExport), func(c *gin.Context) {
+		fromS := c.Query("from")
+		toS := c.Query("to")
+		from, err1 := time.Parse("2006-01-02", fromS)
+		to, err2 := time.Parse("2006-01-02", toS)
+		if err1 != nil || err2 != nil {
+			c.String(400, "bad period")
+			return
+		}
+		to = to.Add(24 * time.Hour)
+		var scope IssueFilter
+		principal(c).NarrowFilter(&scope)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=export_%s..%s.csv", fromS, toS))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		if err := w.Services.ExportCSV(c, from, to, scope, c.Writer); err != nil {
+			c.String(500, err.Error())
+			return
+		}
+	})
+
+	r.GET("/admin/issues", w.require(PermViewIssues), func(c *gin.Context) {
+		statuses := statusStrings(AllStatuses)
+		if status := c.Query("status"); status != "" {
+			st, err := ParseIssueStatus(status)
+			if err != nil {
+				c.String(400, err.Error())
+				return
+			}
+			statuses = []string{string(st)}
+		}
+		f := IssueFilter{Statuses: statuses}
+		f.OverdueOnly, _ = strconv.ParseBool(c.Query("overdue"))
+		var err error
+		if f.DepartmentID, err = queryID(c, "department_id"); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		if f.AssigneeID, err = queryID(c, "assignee_id"); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		if !principal(c).NarrowFilter(&f) {
+			c.JSON(200, []Issue{})
+			return
+		}
+		items, err := w.DB.ListIssues(c, f, 100, 0)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	// службы, сотрудники и назначение заявок
+
+	r.GET("/admin/departments", w.require(PermViewIssues), func(c *gin.Context) {
+		items, err := w.DB.ListDepartments(c)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	r.POST("/admin/departments", w.require(PermManageSettings), func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		d, err := w.DB.CreateDepartment(c, req.Name)
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		c.JSON(200, d)
+	})
+
+	r.DELETE("/admin/departments/:id", w.require(PermManageSettings), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad department id")
+			return
+		}
+		if err := w.DB.DeleteDepartment(c, id); err != nil {
+			if errors.Is(err, ErrDepartmentNotFound) {
+				c.String(404, err.Error())
+				return
+			}
+			if errors.Is(err, ErrDepartmentInUse) {
+				c.String(409, err.Error())
+				return
+			}
+			c.String(500, err.Error())
+			return
+		}
+		c.String(200, "ok")
+	})
+
+	r.POST("/admin/departments/:id/members", w.require(PermManageStaff), func(c *gin.Context) {
+		var req struct {
+			TGUserID int64 `json:"tg_user_id"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad department id")
+			return
+		}
+		if !principal(c).CoversDepartment(id) {
+			c.String(403, "forbidden")
+			return
+		}
+		switch err := w.DB.AddDepartmentMember(c, id, req.TGUserID); {
+		case err == nil:
+			c.String(200, "ok")
+		case errors.Is(err, ErrDepartmentNotFound):
+			c.String(404, err.Error())
+		case IsAssignmentValidationError(err):
+			c.String(422, err.Error())
+		default:
+			c.String(500, err.Error())
+		}
+	})
+
+	r.DELETE("/admin/departments/:id/members/:tg_user_id", w.require(PermManageStaff), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad department id")
+			return
+		}
+		tgUserID, err := strconv.ParseInt(c.Param("tg_user_id"), 10, 64)
+		if err != nil {
+			c.String(400, "bad tg_user_id")
+			return
+		}
+		if !principal(c).CoversDepartment(id) {
+			c.String(403, "forbidden")
+			return
+		}
+		if err := w.DB.RemoveDepartmentMember(c, id, tgUserID); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.String(404, "member not found")
+				return
+			}
+			c.String(500, err.Error())
+			return
+		}
+		c.String(200, "ok")
+	})
+
+	r.GET("/admin/staff", w.require(PermViewIssues), func(c *gin.Context) {
+		departmentID, err := queryID(c, "department_id")
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		if p := principal(c); p.DepartmentID != nil {
+			departmentID = p.DepartmentID
+		}
+		items, err := w.DB.ListStaff(c, departmentID)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	r.POST("/admin/assign", w.require(PermAssign), func(c *gin.Context) {
+		var req struct {
+			IssueID int64 `json:"issue_id"`
+			// 0 — снять службу, отсутствие поля — оставить текущую
+			DepartmentID *int64 `json:"department_id"`
+			// users.id исполнителя; null — снять исполнителя
+			AssigneeID      *int64 `json:"assignee_id"`
+			ExpectedVersion *int   `json:"expected_version"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		a := IssueAssignment{
+			IssueID:         req.IssueID,
+			DepartmentID:    req.DepartmentID,
+			AssigneeID:      req.AssigneeID,
+			ExpectedVersion: req.ExpectedVersion,
+		}
+		if req.DepartmentID != nil && *req.DepartmentID == 0 {
+			a.DepartmentID = nil
+			a.ClearDepartment = true
+		}
+		if _, ok := w.authorizeIssue(c, PermAssign, req.IssueID); !ok {
+			return
+		}
+		a.AssignedByTG = adminAccount(c).TGUserID
+		a.By = principal(c)
+		iss, err := w.DB.AssignIssue(c, a)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrForbidden):
+			c.String(403, "forbidden")
+			return
+		case errors.Is(err, ErrIssueNotFound):
+			c.String(404, err.Error())
+			return
+		case errors.Is(err, ErrVersionConflict):
+			c.String(409, err.Error())
+			return
+		case IsAssignmentValidationError(err):
+			c.String(422, err.Error())
+			return
+		default:
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, gin.H{
+			"department_id": iss.DepartmentID,
+			"assignee_id":   iss.AssigneeID,
+			"version":       iss.Version,
+		})
+	})
+
+	// правила автоматической маршрутизации новых заявок
+
+	r.GET("/admin/routing-rules", w.require(PermViewIssues), func(c *gin.Context) {
+		items, err := w.DB.ListRoutingRules(c)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	r.POST("/admin/routing-rules", w.require(PermManageSettings), func(c *gin.Context) {
+		var req struct {
+			// id существующего правила для изменения; 0 — новое
+			ID           int64      `json:"id"`
+			Name         string     `json:"name"`
+			Position     int        `json:"position"`
+			Enabled      *bool      `json:"enabled"`
+			District     *string    `json:"district"`
+			Category     *string    `json:"category"`
+			Keywords     []string   `json:"keywords"`
+			Polygon      []GeoPoint `json:"polygon"`
+			DepartmentID *int64     `json:"department_id"`
+			Priority     *string    `json:"priority"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		rule := RoutingRule{
+			ID:           req.ID,
+			Name:         req.Name,
+			Position:     req.Position,
+			Enabled:      req.Enabled == nil || *req.Enabled,
+			District:     req.District,
+			Category:     req.Category,
+			Keywords:     req.Keywords,
+			Polygon:      req.Polygon,
+			DepartmentID: req.DepartmentID,
+			Priority:     req.Priority,
+		}
+		switch err := w.DB.SaveRoutingRule(c, &rule); {
+		case err == nil:
+			c.JSON(200, rule)
+		case errors.Is(err, ErrInvalidRoutingRule):
+			c.String(422, err.Error())
+		case errors.Is(err, pgx.ErrNoRows):
+			c.String(404, "rule not found")
+		default:
+			c.String(500, err.Error())
+		}
+	})
+
+	r.DELETE("/admin/routing-rules/:id", w.require(PermManageSettings), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad rule id")
+			return
+		}
+		if err := w.DB.DeleteRoutingRule(c, id); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.String(404, "rule not found")
+				return
+			}
+			c.String(500, err.Error())
+			return
+		}
+		c.String(200, "ok")
+	})
+
+	// SLA: сроки первого ответа и решения по категориям/районам
+
+	r.GET("/admin/sla-rules", w.require(PermViewIssues), func(c *gin.Context) {
+		rules, err := w.DB.ListSLARules(c)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, rules)
+	})
+
+	r.POST("/admin/sla-rules", w.require(PermManageSettings), func(c *gin.Context) {
+		var req struct {
+			Category             string  `json:"category"`
+			District             *string `json:"district"`
+			FirstResponseMinutes int     `json:"first_response_minutes"`
+			ResolutionMinutes    int     `json:"resolution_minutes"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		rule := SLARule{
+			Category:             req.Category,
+			District:             req.District,
+			FirstResponseMinutes: req.FirstResponseMinutes,
+			ResolutionMinutes:    req.ResolutionMinutes,
+		}
+		if err := w.DB.UpsertSLARule(c, &rule); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		c.JSON(200, rule)
+	})
+
+	r.DELETE("/admin/sla-rules/:id", w.require(PermManageSettings), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad rule id")
+			return
+		}
+		if err := w.DB.DeleteSLARule(c, id); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.String(404, "rule not found")
+				return
+			}
+			c.String(500, err.Error())
+			return
+		}
+		c.String(200, "ok")
+	})
+
+	// исходящие webhooks: подписки внешних систем и журнал доставок.
+	// Секрет подписи показывается только при создании и смене секрета.
+
+	r.GET("/admin/webhooks", w.require(PermManageSettings), func(c *gin.Context) {
+		items, err := w.DB.ListWebhookSubscriptions(c)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	r.POST("/admin/webhooks", w.require(PermManageSettings), func(c *gin.Context) {
+		var req struct {
+			// id существующей подписки для изменения; 0 — новая
+			ID      int64    `json:"id"`
+			Name    string   `json:"name"`
+			URL     string   `json:"url"`
+			Events  []string `json:"events"`
+			Enabled *bool    `json:"enabled"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		sub := WebhookSubscription{
+			ID:      req.ID,
+			Name:    req.Name,
+			URL:     req.URL,
+			Events:  req.Events,
+			Enabled: req.Enabled == nil || *req.Enabled,
+		}
+		switch err := w.DB.SaveWebhookSubscription(c, &sub); {
+		case err == nil && req.ID == 0:
+			c.JSON(200, gin.H{"subscription": sub, "secret": sub.Secret})
+		case err == nil:
+			c.JSON(200, sub)
+		case errors.Is(err, ErrInvalidWebhook):
+			c.String(422, err.Error())
+		case errors.Is(err, pgx.ErrNoRows):
+			c.String(404, "webhook not found")
+		default:
+			c.String(500, err.Error())
+		}
+	})
+
+	r.POST("/admin/webhooks/:id/secret", w.require(PermManageSettings), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad webhook id")
+			return
+		}
+		sub, err := w.DB.RotateWebhookSecret(c, id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.String(404, "webhook not found")
+				return
+			}
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, gin.H{"subscription": sub, "secret": sub.Secret})
+	})
+
+	r.DELETE("/admin/webhooks/:id", w.require(PermManageSettings), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad webhook id")
+			return
+		}
+		if err := w.DB.DeleteWebhookSubscription(c, id); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.String(404, "webhook not found")
+				return
+			}
+			c.String(500, err.Error())
+			return
+		}
+		c.String(200, "ok")
+	})
+
+	r.GET("/admin/webhooks/:id/deliveries", w.require(PermManageSettings), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad webhook id")
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit <= 0 || limit > 1000 {
+			c.String(400, "bad limit")
+			return
+		}
+		items, err := w.DB.ListWebhookDeliveries(c, id, c.Query("status"), limit)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	r.POST("/admin/webhook-deliveries/:id/retry", w.require(PermManageSettings), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || id <= 0 {
+			c.String(400, "bad delivery id")
+			return
+		}
+		if err := w.DB.RetryWebhookDelivery(c, id); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.String(404, "failed delivery not found")
+				return
+			}
+			c.String(500, err.Error())
+			return
+		}
+		c.String(200, "ok")
+	})
+
+	r.POST("/admin/status", w.require(PermChangeStatus), func(c *gin.Context) {
+		var req struct {
+			IssueID int64   `json:"issue_id"`
+			Status  string  `json:"status"`
+			Comment *string `json:"comment"`
+			Reopen  bool    `json:"reopen"`
+			// версия заявки, которую видел админ; при расхождении — 409
+			ExpectedVersion *int `json:"expected_version"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		if _, ok := w.authorizeIssue(c, PermChangeStatus, req.IssueID); !ok {
+			return
+		}
+		version, err := w.DB.SetIssueStatus(c, StatusUpdate{
+			IssueID:         req.IssueID,
+			Status:          req.Status,
+			ChangedByTG:     adminAccount(c).TGUserID,
+			Comment:         req.Comment,
+			Reopen:          req.Reopen,
+			ExpectedVersion: req.ExpectedVersion,
+		})
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrIssueNotFound):
+			c.String(404, err.Error())
+			return
+		case errors.Is(err, ErrVersionConflict):
+			c.String(409, err.Error())
+			return
+		case IsStatusValidationError(err):
+			c.String(422, err.Error())
+			return
+		default:
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, gin.H{"status": req.Status, "version": version})
+	})
+
+	r.POST("/admin/comment", w.require(PermComment), func(c *gin.Context) {
+		var req struct {
+			IssueID int64  `json:"issue_id"`
+			Text    string `json:"text"`
+			// internal — заметка только для сотрудников, public (по умолчанию) — ответ жителю
+			Visibility string `json:"visibility"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		if req.IssueID <= 0 || req.Text == "" {
+			c.String(400, "bad request")
+			return
+		}
+		if req.Visibility == "" {
+			req.Visibility = CommentPublic
+		}
+		if req.Visibility != CommentPublic && req.Visibility != CommentInternal {
+			c.String(400, "visibility must be internal or public")
+			return
+		}
+		if _, ok := w.authorizeIssue(c, PermComment, req.IssueID); !ok {
+			return
+		}
+		// комментарий пишется от Telegram-аккаунта сотрудника: автор должен
+		// быть настоящим, от чужого имени не пишем
+		acc := adminAccount(c)
+		if acc.TGUserID == nil {
+			c.String(422, "к учётной записи не привязан Telegram, комментировать нельзя")
+			return
+		}
+		// публичный комментарий уйдёт жителю по событию issue.commented
+		switch err := w.DB.AddComment(c.Request.Context(), req.IssueID, *acc.TGUserID, req.Text, req.Visibility); {
+		case err == nil:
+			c.String(200, "ok")
+		case errors.Is(err, ErrCommentAuthorNotFound):
+			c.String(409, err.Error())
+		default:
+			c.String(500, err.Error())
+		}
+	})
+
+	r.GET("/admin/issues/:id/attachments", w.require(PermViewIssues), func(c *gin.Context) {
+		idStr := c.Param("id")
+		issueID, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || issueID <= 0 {
+			c.String(400, "bad issue id")
+			return
+		}
+		if _, ok := w.authorizeIssue(c, PermViewIssues, issueID); !ok {
+			return
+		}
+		atts, err := w.DB.GetAttachmentsByIssueID(c, issueID)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		w.Files.SignAttachments(atts)
+		c.JSON(200, atts)
+	})
+
+	r.GET("/admin/issues/:id/routing", w.require(PermViewIssues), func(c *gin.Context) {
+		issueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || issueID <= 0 {
+			c.String(400, "bad issue id")
+			return
+		}
+		if _, ok := w.authorizeIssue(c, PermViewIssues, issueID); !ok {
+			return
+		}
+		items, err := w.DB.ListRoutingLog(c, issueID)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	// Житель, подавший заявку с сайта, и другие его заявки в пределах области сотрудника.
+	r.GET("/admin/issues/:id/citizen", w.require(PermViewIssues), func(c *gin.Context) {
+		issueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || issueID <= 0 {
+			c.String(400, "bad issue id")
+			return
+		}
+		iss, ok := w.authorizeIssue(c, PermViewIssues, issueID)
+		if !ok {
+			return
+		}
+		if iss.CitizenID == nil {
+			c.String(404, ErrCitizenNotFound.Error())
+			return
+		}
+		citizen, err := w.DB.GetCitizen(c, *iss.CitizenID)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		all, err := w.DB.ListCitizenIssues(c, citizen.ID, 50)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		p := principal(c)
+		issues := make([]Issue, 0, len(all))
+		for _, x := range all {
+			if p.Covers(&x) {
+				issues = append(issues, x)
+			}
+		}
+		c.JSON(200, gin.H{"citizen": citizen, "issues": issues})
+	})
+
+	r.GET("/admin/issues/:id/notifications", w.require(PermViewIssues), func(c *gin.Context) {
+		issueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || issueID <= 0 {
+			c.String(400, "bad issue id")
+			return
+		}
+		if _, ok := w.authorizeIssue(c, PermViewIssues, issueID); !ok {
+			return
+		}
+		items, err := w.DB.ListNotificationDeliveries(c, issueID)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	r.GET("/admin/issues/:id/thread", w.require(PermViewIssues), func(c *gin.Context) {
+		issueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || issueID <= 0 {
+			c.String(400, "bad issue id")
+			return
+		}
+		if _, ok := w.authorizeIssue(c, PermViewIssues, issueID); !ok {
+			return
+		}
+		items, err := w.DB.ListIssueThread(c, issueID)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.JSON(200, items)
+	})
+
+	// Webhook
+
+	if w.Cfg.UseWebhook {
+		r.POST(w.Cfg.WebhookPath, func(c *gin.Context) {
+			var update tgbotapi.Update
+			if err := c.BindJSON(&update); err != nil {
+				c.String(400, err.Error())
+				return
+			}
+			if err := w.Bot.HandleWebhookUpdate(c.Request.Context(), update); err != nil {
+				// Telegram повторит доставку апдейта
+				log.Printf("webhook update %d: %v", update.UpdateID, err)
+				c.Status(503)
+				return
+			}
+			c.Status(200)
+		})
+		log.Printf("📡 Webhook включен: %s", w.Cfg.WebhookPath)
+	}
+
+	// Health check
+	r.GET("/healthz", func(c *gin.Context) {
+		c.String(200, "ok")
+	})
+
+	// Статика
+	r.Static("/static", frontendPath)
+
+	// Страница веб‑админки
+	r.GET("/admin", func(c *gin.Context) {
+		c.File(filepath.Join(frontendPath, "admin.html"))
+	})
+
+	// Публичная страница заявки, данные берёт из /api/track/:code
+	r.GET("/track/:code", func(c *gin.Context) {
+		c.File(filepath.Join(frontendPath, "track.html"))
+	})
+
+	// остальные пути
+	r.NoRoute(func(c *gin.Context) {
+		c.File(filepath.Join(frontendPath, "index.html"))
+	})
+
+	addr := ":" + w.Cfg.Port
+	log.Printf("🌐 HTTP сервер запущен на http://localhost%s", addr)
+	return r.Run(addr)
+}
+
+const (
+	ctxAdminAccount = "admin_account"
+	ctxAdminSession = "admin_session"
+	ctxPrincipal    = "principal"
+)
+
+// require пропускает запрос только с действующей сессией
+// (заголовок Authorization: Bearer <token>) и всеми правами perms.
+// Проверку области (служба, район) делают обработчики через Authorizer.
+func (w *Web) require(perms ...Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			c.String(401, "unauthorized")
+			c.Abort()
+			return
+		}
+		token = strings.TrimSpace(token)
+		// токены не перебрать, но с заблокированного адреса их даже не проверяем.
+		// Счётчик свой, не ThrottleIP: неудачи входа не выкидывают вошедших, и наоборот.
+		sessKey := ThrottleKey{Scope: ThrottleSession, Key: c.ClientIP()}
+		if wait := w.Guard.Locked(c, sessKey); wait > 0 {
+			c.Header("Retry-After", retryAfterSeconds(wait))
+			c.String(429, retryAfter(wait))
+			c.Abort()
+			return
+		}
+		acc, sess, err := w.DB.SessionAccount(c, token)
+		if err != nil {
+			if errors.Is(err, ErrSessionInvalid) {
+				// засчитываем только похожие на настоящие, но неизвестные токены:
+				// истёкшая сессия или мусор в заголовке — не попытка подбора
+				if !errors.Is(err, ErrSessionExpired) && sessionTokenRe.MatchString(token) {
+					ip := c.ClientIP()
+					w.Guard.Fail(c, SecurityEvent{Kind: SecuritySessionFailed, IP: &ip}, sessKey)
+				}
+				c.String(401, "unauthorized")
+				c.Abort()
+				return
+			}
+			c.String(500, err.Error())
+			c.Abort()
+			return
+		}
+		p := AccountPrincipal(acc)
+		for _, perm := range perms {
+			if !p.Can(perm) {
+				c.String(403, "forbidden")
+				c.Abort()
+				return
+			}
+		}
+		c.Set(ctxAdminAccount, acc)
+		c.Set(ctxAdminSession, sess)
+		c.Set(ctxPrincipal, p)
+		c.Next()
+	}
+}
+
+// adminAccount — учётка текущего запроса; есть только за require.
+func adminAccount(c *gin.Context) *AdminAccount {
+	return c.MustGet(ctxAdminAccount).(*AdminAccount)
+}
+
+func adminSession(c *gin.Context) *AdminSession {
+	return c.MustGet(ctxAdminSession).(*AdminSession)
+}
+
+func principal(c *gin.Context) *Principal {
+	return c.MustGet(ctxPrincipal).(*Principal)
+}
+
+// authorIssueID проверяет, что запрос пришёл от автора заявки из пути :id
+// (токен в заголовке X-Issue-Token), и при отказе сам пишет ответ. Чужим — 404,
+// как будто заявки нет.
+func (w *Web) authorIssueID(c *gin.Context) (int64, bool) {
+	issueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || issueID <= 0 {
+		c.JSON(404, gin.H{"error": "not found"})
+		return 0, false
+	}
+	ok, err := w.DB.CheckIssueAccessToken(c, issueID, c.GetHeader("X-Issue-Token"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return 0, false
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": "not found"})
+		return 0, false
+	}
+	return issueID, true
+}
+
+// authorizeIssue проверяет право perm на заявку issueID и при отказе сам пишет ответ.
+func (w *Web) authorizeIssue(c *gin.Context, perm Permission, issueID int64) (*Issue, bool) {
+	iss, err := w.Auth.AuthorizeIssue(c, principal(c), perm, issueID)
+	switch {
+	case err == nil:
+		return iss, true
+	case errors.Is(err, ErrIssueNotFound):
+		c.String(404, err.Error())
+	case errors.Is(err, ErrForbidden):
+		c.String(403, "forbidden")
+	default:
+		c.String(500, err.Error())
+	}
+	return nil, false
+}
+
+// authorizeAccount разбирает :id и проверяет, что сотрудник может
+// распоряжаться этой учётной записью; при отказе сам пишет ответ.
+func (w *Web) authorizeAccount(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.String(400, "bad account id")
+		return 0, false
+	}
+	acc, err := w.DB.GetAdminAccount(c, id)
+	if err == nil {
+		err = principal(c).Grants(acc.Role, acc.DepartmentID, acc.District)
+	}
+	switch {
+	case err == nil:
+		return id, true
+	case errors.Is(err, ErrAccountNotFound):
+		c.String(404, err.Error())
+	case errors.Is(err, ErrForbidden):
+		c.String(403, err.Error())
+	default:
+		c.String(500, err.Error())
+	}
+	return 0, false
+}
+
+// changeUserRole выдаёт сотруднику из пути :tg_user_id роль role с областью
+// или, если role == nil, отзывает права, и сам пишет ответ.
+func (w *Web) changeUserRole(c *gin.Context, role *AdminRole, departmentID *int64, district *string) {
+	tgUserID, err := strconv.ParseInt(c.Param("tg_user_id"), 10, 64)
+	if err != nil || tgUserID <= 0 {
+		c.String(400, "bad tg_user_id")
+		return
+	}
+	target, err := w.DB.GetStaffUser(c, tgUserID)
+	if err == nil {
+		target, err = w.Bot.changeUserRole(c, principal(c), target, role, departmentID, district)
+	}
+	switch {
+	case err == nil:
+		c.JSON(200, target)
+	case errors.Is(err, ErrUserNotFound):
+		c.String(404, err.Error())
+	case errors.Is(err, ErrForbidden):
+		c.String(403, err.Error())
+	case IsStaffValidationError(err):
+		c.String(422, err.Error())
+	default:
+		c.String(500, err.Error())
+	}
+}
+
+// queryID читает необязательный положительный id из query-параметра name.
+func queryID(c *gin.Context, name string) (*int64, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, nil
 	}
-	if w.Cfg.AdminSecret != "" && token == w.Cfg.AdminSecret {
-		return true
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("bad %s", name)
 	}
-	return false
+	return &id, nil
 }
@@ -0,0 +1,469 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// webhookEvents — события, на которые можно подписать внешнюю систему.
+var webhookEvents = []string{EventIssueCreated, EventIssueStatusChanged, EventIssueCommented, EventIssueAttachmentAdded}
+
+// Состояние доставки webhook.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed" // попытки кончились
+)
+
+var ErrInvalidWebhook = errors.New("некорректная подписка на webhooks")
+
+// webhookEnvelope — тело запроса: одно событие.
+type webhookEnvelope struct {
+	ID        string          `json:"id"` // id события в outbox, общий у доставок разным подпискам
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// WebhookHandler — подписчик EventBus: ставит событие в очередь доставки
+// всем включённым подпискам на него. Повтор того же события ничего не
+// добавляет: доставка уникальна по паре «подписка — событие».
+type WebhookHandler struct {
+	DB *DB
+}
+
+func (h *WebhookHandler) Name() string { return "webhooks" }
+
+func (h *WebhookHandler) Handle(ctx context.Context, ev *DomainEvent) error {
+	id := strconv.FormatInt(ev.ID, 10)
+	payload, err := json.Marshal(webhookEnvelope{ID: id, Event: ev.Type, CreatedAt: ev.CreatedAt.UTC(), Data: ev.Payload})
+	if err != nil {
+		return err
+	}
+	_, err = h.DB.Pool.Exec(ctx, `
+		insert into webhook_deliveries (subscription_id, event_id, event, payload)
+		select id, $1, $2, $3 from webhook_subscriptions
+		where enabled and $2 = any(events)
+		on conflict (subscription_id, event_id) do nothing
+	`, id, ev.Type, payload)
+	return err
+}
+
+const webhookSubscriptionColumns = `id, name, url, secret, events, enabled, created_at, updated_at`
+
+func scanWebhookSubscription(row pgx.Row, s *WebhookSubscription) error {
+	return row.Scan(&s.ID, &s.Name, &s.URL, &s.Secret, &s.Events, &s.Enabled, &s.CreatedAt, &s.UpdatedAt)
+}
+
+func normalizeWebhookSubscription(ctx context.Context, s *WebhookSubscription) error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return fmt.Errorf("%w: не указано название", ErrInvalidWebhook)
+	}
+	s.URL = strings.TrimSpace(s.URL)
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%w: адрес должен быть http(s)-ссылкой", ErrInvalidWebhook)
+	}
+	if err := checkWebhookHost(ctx, u.Hostname()); err != nil {
+		return err
+	}
+	var events []string
+	for _, e := range s.Events {
+		e = strings.TrimSpace(e)
+		if !slices.Contains(webhookEvents, e) {
+			return fmt.Errorf("%w: неизвестное событие %q", ErrInvalidWebhook, e)
+		}
+		if !slices.Contains(events, e) {
+			events = append(events, e)
+		}
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("%w: не выбрано ни одного события", ErrInvalidWebhook)
+	}
+	s.Events = events
+	return nil
+}
+
+// cgnatNet — общий адрес провайдерского NAT (RFC 6598), снаружи недоступен.
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webhookIPAllowed — адрес во внешней сети. Loopback, частные сети, link-local
+// (в том числе метаданные облака 169.254.169.254) и прочие служебные адреса
+// запрещены: иначе через подписку можно слать запросы во внутренние сервисы.
+func webhookIPAllowed(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsMulticast() && !cgnatNet.Contains(ip)
+}
+
+// checkWebhookHost проверяет, что все адреса host — внешние. Это подсказка
+// при сохранении подписки; DNS может измениться, поэтому WebhookSender ещё
+// раз проверяет адрес при каждом соединении (см. webhookDialControl).
+func checkWebhookHost(ctx context.Context, host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("%w: не удалось найти адрес %s", ErrInvalidWebhook, host)
+		}
+		ips = ips[:0]
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !webhookIPAllowed(ip) {
+			return fmt.Errorf("%w: адрес %s ведёт во внутреннюю сеть (%s)", ErrInvalidWebhook, host, ip)
+		}
+	}
+	return nil
+}
+
+// SaveWebhookSubscription создаёт подписку (s.ID == 0) со случайным секретом
+// или изменяет существующую; секрет при изменении остаётся прежним.
+func (db *DB) SaveWebhookSubscription(ctx context.Context, s *WebhookSubscription) error {
+	if err := normalizeWebhookSubscription(ctx, s); err != nil {
+		return err
+	}
+	var row pgx.Row
+	if s.ID == 0 {
+		secret, err := newSessionToken()
+		if err != nil {
+			return err
+		}
+		row = db.Pool.QueryRow(ctx, `
+			insert into webhook_subscriptions (name, url, secret, events, enabled)
+			values ($1, $2, $3, $4, $5)
+			returning `+webhookSubscriptionColumns,
+			s.Name, s.URL, secret, s.Events, s.Enabled)
+	} else {
+		row = db.Pool.QueryRow(ctx, `
+			update webhook_subscriptions
+			set name = $2, url = $3, events = $4, enabled = $5, updated_at = now()
+			where id = $1
+			returning `+webhookSubscriptionColumns,
+			s.ID, s.Name, s.URL, s.Events, s.Enabled)
+	}
+	return scanWebhookSubscription(row, s)
+}
+
+// RotateWebhookSecret выдаёт подписке новый секрет.
+func (db *DB) RotateWebhookSecret(ctx context.Context, id int64) (*WebhookSubscription, error) {
+	secret, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	var s WebhookSubscription
+	err = scanWebhookSubscription(db.Pool.QueryRow(ctx, `
+		update webhook_subscriptions set secret = $2, updated_at = now()
+		where id = $1
+		returning `+webhookSubscriptionColumns, id, secret), &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (db *DB) ListWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	rows, err := db.Pool.Query(ctx, `select `+webhookSubscriptionColumns+` from webhook_subscriptions order by id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []WebhookSubscription
+	for rows.Next() {
+		var s WebhookSubscription
+		if err := scanWebhookSubscription(rows, &s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// DeleteWebhookSubscription удаляет подписку вместе с её журналом доставок.
+func (db *DB) DeleteWebhookSubscription(ctx context.Context, id int64) error {
+	cmd, err := db.Pool.Exec(ctx, `delete from webhook_subscriptions where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `id, subscription_id, event_id, event, payload, status, attempts, next_attempt_at,
+	response_code, last_error, created_at, delivered_at`
+
+func scanWebhookDelivery(row pgx.Row, d *WebhookDelivery) error {
+	return row.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.ResponseCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+}
+
+// ListWebhookDeliveries — журнал доставок подписки, новые сверху; status == "" — все.
+func (db *DB) ListWebhookDeliveries(ctx context.Context, subscriptionID int64, status string, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.Pool.Query(ctx, `
+		select `+webhookDeliveryColumns+`
+		from webhook_deliveries
+		where subscription_id = $1 and ($2 = '' or status = $2)
+		order by created_at desc, id desc
+		limit $3
+	`, subscriptionID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+// RetryWebhookDelivery возвращает неудавшуюся доставку в очередь с новым запасом попыток.
+func (db *DB) RetryWebhookDelivery(ctx context.Context, id int64) error {
+	cmd, err := db.Pool.Exec(ctx, `
+		update webhook_deliveries
+		set status = 'pending', attempts = 0, next_attempt_at = now()
+		where id = $1 and status = 'failed'
+	`, id)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// claimWebhookDeliveries забирает до limit доставок, которым пора уходить, вместе
+// с адресом и секретом подписки и откладывает их повтор на lease (как ClaimPendingDownloads).
+func (db *DB) claimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookJob, error) {
+	rows, err := db.Pool.Query(ctx, `
+		with claimed as (
+			update webhook_deliveries
+			set next_attempt_at = now() + make_interval(secs => $2)
+			where id in (
+				select id from webhook_deliveries
+				where status = 'pending' and next_attempt_at <= now()
+				order by next_attempt_at, id
+				limit $1
+				for update skip locked
+			)
+			returning id, subscription_id, event_id, event, payload, attempts
+		)
+		select c.id, c.event_id, c.event, c.payload, c.attempts, s.url, s.secret
+		from claimed c join webhook_subscriptions s on s.id = c.subscription_id
+	`, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []webhookJob
+	for rows.Next() {
+		var j webhookJob
+		if err := rows.Scan(&j.ID, &j.EventID, &j.Event, &j.Payload, &j.Attempts, &j.URL, &j.Secret); err != nil {
+			return nil, err
+		}
+		res = append(res, j)
+	}
+	return res, rows.Err()
+}
+
+// finishWebhookDelivery записывает итог попытки; retryAt == nil при неудаче — больше не пытаться.
+func (db *DB) finishWebhookDelivery(ctx context.Context, id int64, code *int, sendErr error, retryAt *time.Time) error {
+	if sendErr == nil {
+		_, err := db.Pool.Exec(ctx, `
+			update webhook_deliveries
+			set status = 'delivered', attempts = attempts + 1, response_code = $2, last_error = null, delivered_at = now()
+			where id = $1
+		`, id, code)
+		return err
+	}
+	_, err := db.Pool.Exec(ctx, `
+		update webhook_deliveries
+		set status = case when $4::timestamptz is null then 'failed' else 'pending' end,
+		    attempts = attempts + 1, response_code = $2, last_error = $3,
+		    next_attempt_at = coalesce($4, next_attempt_at)
+		where id = $1
+	`, id, code, trim(sendErr.Error(), 500), retryAt)
+	return err
+}
+
+type webhookJob struct {
+	ID       int64
+	EventID  string
+	Event    string
+	Payload  []byte
+	Attempts int
+	URL      string
+	Secret   string
+}
+
+// WebhookSender в фоне доставляет события из webhook_deliveries подписчикам.
+// Очередь живёт в базе и переживает перезапуск; неудачные попытки повторяются
+// с экспоненциальной паузой, пока не кончатся MaxAttempts.
+//
+// Запрос подписан: X-Webhook-Signature = "sha256=" + hex(HMAC-SHA256(secret,
+// X-Webhook-Timestamp + "." + тело)). Успех — любой ответ 2xx.
+type WebhookSender struct {
+	DB          *DB
+	Client      *http.Client
+	MaxAttempts int
+	Interval    time.Duration // как часто проверять очередь
+}
+
+// errWebhookAddrForbidden — соединение с внутренним адресом, см. webhookIPAllowed.
+var errWebhookAddrForbidden = errors.New("адрес во внутренней сети запрещён")
+
+// webhookDialControl пропускает только соединения с внешними адресами. Проверяется
+// уже разрешённый IP, поэтому смена DNS после сохранения подписки не поможет.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookIPAllowed(ip) {
+		return fmt.Errorf("%s: %w", host, errWebhookAddrForbidden)
+	}
+	return nil
+}
+
+func NewWebhookSender(db *DB, cfg *Config) *WebhookSender {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// напрямую, без HTTP(S)_PROXY: иначе проверялся бы адрес прокси, а не получателя
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: webhookDialControl}).DialContext
+	return &WebhookSender{
+		DB: db,
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.WebhookTimeout,
+			// переадресация увела бы подписанное тело на чужой адрес
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		MaxAttempts: cfg.WebhookMaxAttempts,
+		Interval:    cfg.WebhookInterval,
+	}
+}
+
+func (s *WebhookSender) Run(ctx context.Context) {
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+	for {
+		s.drain(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *WebhookSender) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		jobs, err := s.DB.claimWebhookDeliveries(ctx, 20, s.Client.Timeout+time.Minute)
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+			return
+		}
+		if len(jobs) == 0 {
+			return
+		}
+		for i := range jobs {
+			s.deliver(ctx, &jobs[i])
+		}
+	}
+}
+
+func (s *WebhookSender) deliver(ctx context.Context, j *webhookJob) {
+	code, err := s.post(ctx, j)
+	if ctx.Err() != nil {
+		// остановка сервера: доставка вернётся в очередь по истечении lease
+		return
+	}
+	var retryAt *time.Time
+	attempt := j.Attempts + 1
+	if err != nil && attempt < s.MaxAttempts {
+		at := time.Now().Add(webhookBackoff(attempt))
+		retryAt = &at
+	}
+	if err != nil && retryAt == nil {
+		log.Printf("webhook %s (доставка %d) не доставлен после %d попыток: %v", j.Event, j.ID, attempt, err)
+	}
+	if err := s.DB.finishWebhookDelivery(ctx, j.ID, code, err, retryAt); err != nil {
+		log.Printf("webhook (доставка %d): %v", j.ID, err)
+	}
+}
+
+func (s *WebhookSender) post(ctx context.Context, j *webhookJob) (*int, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.URL, bytes.NewReader(j.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "city-112-webhooks")
+	req.Header.Set("X-Webhook-Event", j.Event)
+	req.Header.Set("X-Webhook-ID", j.EventID)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(j.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(j.Secret, ts, j.Payload))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	code := resp.StatusCode
+	if code < 200 || code > 299 {
+		return &code, fmt.Errorf("ответ %s", resp.Status)
+	}
+	return &code, nil
+}
+
+// webhookSignature — подпись тела body с отметкой времени ts; отметка
+// входит в подпись, чтобы перехваченный запрос нельзя было повторить позже.
+func webhookSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff — пауза перед попыткой attempt+1: 30 с, 1 мин, 2 мин… но не больше 6 часов.
+func webhookBackoff(attempt int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempt && d < 6*time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, 6*time.Hour)
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookIPAllowed(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.10":     false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+		"224.0.0.1":        false,
+	} {
+		if got := webhookIPAllowed(net.ParseIP(addr)); got != want {
+			t.Errorf("%s: %v, ожидалось %v", addr, got, want)
+		}
+	}
+}
+
+func TestNormalizeWebhookSubscriptionRejectsInternalHosts(t *testing.T) {
+	for _, u := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"https://10.0.0.5/hook",
+	} {
+		s := &WebhookSubscription{Name: "crm", URL: u, Events: []string{EventIssueCreated}}
+		if err := normalizeWebhookSubscription(context.Background(), s); !errors.Is(err, ErrInvalidWebhook) {
+			t.Errorf("%s: %v, ожидался ErrInvalidWebhook", u, err)
+		}
+	}
+	s := &WebhookSubscription{Name: "crm", URL: "https://93.184.216.34/hook", Events: []string{EventIssueCreated}}
+	if err := normalizeWebhookSubscription(context.Background(), s); err != nil {
+		t.Fatalf("внешний адрес отклонён: %v", err)
+	}
+}
+
+// Даже если подписка указывает на внутренний адрес (DNS сменился после
+// сохранения), WebhookSender не соединится с ним.
+func TestWebhookSenderRefusesInternalAddress(t *testing.T) {
+	hit := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit <- struct{}{}
+	}))
+	defer srv.Close()
+
+	s := NewWebhookSender(nil, &Config{WebhookTimeout: 2 * time.Second})
+	_, err := s.post(context.Background(), &webhookJob{URL: srv.URL, Event: EventIssueCreated, Payload: []byte("{}")})
+	if !errors.Is(err, errWebhookAddrForbidden) {
+		t.Fatalf("ожидался отказ в соединении, получено %v", err)
+	}
+	select {
+	case <-hit:
+		t.Fatal("запрос дошёл до внутреннего адреса")
+	default:
+	}
+}
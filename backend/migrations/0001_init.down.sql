@@ -0,0 +1,7 @@
+drop table if exists broadcasts;
+drop table if exists comments;
+drop table if exists status_changes;
+drop table if exists attachments;
+drop table if exists issues;
+drop table if exists chats;
+drop table if exists users;
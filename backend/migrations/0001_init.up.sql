@@ -24,8 +24,8 @@ create table if not exists issues (
     latitude double precision,
     longitude double precision,
     status text not null default 'Новая',
-    district text,          
-    category text,          
+    district text,
+    category text,
     created_at timestamptz not null default now(),
     updated_at timestamptz not null default now()
 );
@@ -67,3 +67,15 @@ create table if not exists broadcasts (
     sent_count int not null default 0,
     created_at timestamptz not null default now()
 );
+
+
+-- служебные пользователь и чат для заявок с сайта
+insert into users (id, tg_user_id, username, first_name, last_name, is_admin)
+values (1, 1, 'web_user', 'Web', 'User', false)
+on conflict (id) do nothing;
+
+insert into chats (chat_id, type, title)
+values (1, 'web', 'Web Issues')
+on conflict (chat_id) do nothing;
+
+select setval(pg_get_serial_sequence('users', 'id'), greatest((select max(id) from users), 1));
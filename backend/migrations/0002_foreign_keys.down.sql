@@ -0,0 +1,4 @@
+-- внешние ключи не снимаем: в новых базах их создаёт миграция 0001
+drop index if exists idx_comments_issue_id;
+drop index if exists idx_status_changes_issue_id;
+drop index if exists idx_attachments_issue_id;
@@ -0,0 +1,43 @@
+-- Базы, созданные старым DB.InitSchema, не содержат внешних ключей.
+-- Добавляем их как NOT VALID, чтобы не упасть на уже существующих
+-- "осиротевших" строках; новые строки проверяются сразу.
+do $$
+begin
+    if not exists (select 1 from pg_constraint where conname = 'issues_user_id_fkey') then
+        alter table issues add constraint issues_user_id_fkey
+            foreign key (user_id) references users(id) on delete cascade not valid;
+    end if;
+    if not exists (select 1 from pg_constraint where conname = 'issues_chat_id_fkey') then
+        alter table issues add constraint issues_chat_id_fkey
+            foreign key (chat_id) references chats(chat_id) on delete cascade not valid;
+    end if;
+    if not exists (select 1 from pg_constraint where conname = 'attachments_issue_id_fkey') then
+        alter table attachments add constraint attachments_issue_id_fkey
+            foreign key (issue_id) references issues(id) on delete cascade not valid;
+    end if;
+    if not exists (select 1 from pg_constraint where conname = 'status_changes_issue_id_fkey') then
+        alter table status_changes add constraint status_changes_issue_id_fkey
+            foreign key (issue_id) references issues(id) on delete cascade not valid;
+    end if;
+    if not exists (select 1 from pg_constraint where conname = 'status_changes_changed_by_fkey') then
+        alter table status_changes add constraint status_changes_changed_by_fkey
+            foreign key (changed_by) references users(id) not valid;
+    end if;
+    if not exists (select 1 from pg_constraint where conname = 'comments_issue_id_fkey') then
+        alter table comments add constraint comments_issue_id_fkey
+            foreign key (issue_id) references issues(id) on delete cascade not valid;
+    end if;
+    if not exists (select 1 from pg_constraint where conname = 'comments_admin_user_id_fkey') then
+        alter table comments add constraint comments_admin_user_id_fkey
+            foreign key (admin_user_id) references users(id) on delete cascade not valid;
+    end if;
+    if not exists (select 1 from pg_constraint where conname = 'broadcasts_created_by_fkey') then
+        alter table broadcasts add constraint broadcasts_created_by_fkey
+            foreign key (created_by) references users(id) not valid;
+    end if;
+end
+$$;
+
+create index if not exists idx_attachments_issue_id on attachments(issue_id);
+create index if not exists idx_status_changes_issue_id on status_changes(issue_id);
+create index if not exists idx_comments_issue_id on comments(issue_id);
@@ -0,0 +1,10 @@
+create table if not exists bot_state (
+    scope text not null,             -- wizard, pending_comment, my_page, ...
+    key bigint not null,             -- tg user id или chat id
+    value jsonb not null,
+    expires_at timestamptz not null,
+    updated_at timestamptz not null default now(),
+    primary key (scope, key)
+);
+
+create index if not exists idx_bot_state_expires_at on bot_state(expires_at);
@@ -0,0 +1,2 @@
+-- версия заявки для оптимистичной блокировки при параллельном редактировании
+alter table issues add column if not exists version int not null default 1;
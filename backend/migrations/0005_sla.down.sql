@@ -0,0 +1,4 @@
+drop view if exists issue_sla;
+alter table issues drop column if exists resolution_overdue_at;
+alter table issues drop column if exists response_overdue_at;
+drop table if exists sla_rules;
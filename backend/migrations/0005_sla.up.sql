@@ -0,0 +1,37 @@
+-- SLA: сроки первого ответа и решения по категории (и, при необходимости, району)
+create table if not exists sla_rules (
+    id bigserial primary key,
+    category text not null,
+    district text,                              -- null — правило для всех районов
+    first_response_minutes int not null check (first_response_minutes > 0),
+    resolution_minutes int not null check (resolution_minutes > 0),
+    created_at timestamptz not null default now()
+);
+
+create unique index if not exists uq_sla_rules_category_district
+    on sla_rules(category, coalesce(district, ''));
+
+-- отметки о нарушении сроков ставит фоновый планировщик
+alter table issues add column if not exists response_overdue_at timestamptz;
+alter table issues add column if not exists resolution_overdue_at timestamptz;
+
+-- сроки по заявкам: правило района важнее общего правила категории;
+-- первым ответом считается первая смена статуса или первый комментарий
+create or replace view issue_sla as
+select i.id as issue_id,
+       r.id as rule_id,
+       i.created_at + make_interval(mins => r.first_response_minutes) as response_due_at,
+       i.created_at + make_interval(mins => r.resolution_minutes) as resolution_due_at,
+       least(
+           (select min(sc.created_at) from status_changes sc where sc.issue_id = i.id),
+           (select min(c.created_at) from comments c where c.issue_id = i.id)
+       ) as first_response_at
+from issues i
+join lateral (
+    select r.*
+    from sla_rules r
+    where r.category = i.category
+      and (r.district is null or r.district = i.district)
+    order by (r.district is null)
+    limit 1
+) r on true;
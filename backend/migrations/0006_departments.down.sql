@@ -0,0 +1,6 @@
+drop index if exists idx_issues_assignee;
+drop index if exists idx_issues_department;
+alter table issues drop column if exists assignee_id;
+alter table issues drop column if exists department_id;
+drop table if exists department_members;
+drop table if exists departments;
@@ -0,0 +1,22 @@
+-- службы (ЖКХ, дороги и т.п.) и их сотрудники
+create table if not exists departments (
+    id bigserial primary key,
+    name text not null unique,
+    created_at timestamptz not null default now()
+);
+
+create table if not exists department_members (
+    department_id bigint not null references departments(id) on delete cascade,
+    user_id bigint not null references users(id) on delete cascade,
+    created_at timestamptz not null default now(),
+    primary key (department_id, user_id)
+);
+
+create index if not exists idx_department_members_user on department_members(user_id);
+
+-- ответственная служба и исполнитель заявки
+alter table issues add column if not exists department_id bigint references departments(id) on delete set null;
+alter table issues add column if not exists assignee_id bigint references users(id) on delete set null;
+
+create index if not exists idx_issues_department on issues(department_id);
+create index if not exists idx_issues_assignee on issues(assignee_id);
@@ -0,0 +1,3 @@
+drop table if exists routing_log;
+drop table if exists routing_rules;
+alter table issues drop column if exists priority;
@@ -0,0 +1,36 @@
+-- приоритет заявки, выставляется правилами маршрутизации или вручную
+alter table issues add column if not exists priority text not null default 'normal';
+
+-- правила автоматической маршрутизации новых заявок; проверяются по position,
+-- срабатывает первое, у которого совпали все заданные условия
+create table if not exists routing_rules (
+    id bigserial primary key,
+    name text not null,
+    position int not null default 0,
+    enabled boolean not null default true,
+    district text,                            -- null — любой район
+    category text,                            -- null — любая категория
+    keywords text[] not null default '{}',    -- достаточно одного слова из списка
+    polygon jsonb,                            -- [{"lat":..,"lon":..}, ...]; null — без гео-условия
+    department_id bigint references departments(id) on delete cascade,
+    priority text,
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now(),
+    check (department_id is not null or priority is not null)
+);
+
+create index if not exists idx_routing_rules_position on routing_rules(position, id) where enabled;
+
+-- журнал решений маршрутизации по заявкам
+create table if not exists routing_log (
+    id bigserial primary key,
+    issue_id bigint not null references issues(id) on delete cascade,
+    rule_id bigint references routing_rules(id) on delete set null,
+    rule_name text,
+    department_id bigint references departments(id) on delete set null,
+    priority text,
+    reason text not null,
+    created_at timestamptz not null default now()
+);
+
+create index if not exists idx_routing_log_issue on routing_log(issue_id, created_at);
@@ -0,0 +1,2 @@
+drop table if exists issue_message_links;
+drop table if exists issue_messages;
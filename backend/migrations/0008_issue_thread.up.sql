@@ -0,0 +1,24 @@
+-- сообщения жителя по уже созданной заявке (ответы администрации хранятся в comments)
+create table if not exists issue_messages (
+    id bigserial primary key,
+    issue_id bigint not null references issues(id) on delete cascade,
+    user_id bigint references users(id) on delete set null,
+    text text,
+    tg_chat_id bigint,
+    tg_message_id int,
+    created_at timestamptz not null default now()
+);
+
+create index if not exists idx_issue_messages_issue on issue_messages(issue_id, created_at);
+
+-- какие сообщения бота относятся к какой заявке: ответ (reply) жителя
+-- на такое сообщение попадает в переписку по заявке
+create table if not exists issue_message_links (
+    chat_id bigint not null,
+    message_id int not null,
+    issue_id bigint not null references issues(id) on delete cascade,
+    created_at timestamptz not null default now(),
+    primary key (chat_id, message_id)
+);
+
+create index if not exists idx_issue_message_links_issue on issue_message_links(issue_id);
@@ -0,0 +1,20 @@
+create or replace view issue_sla as
+select i.id as issue_id,
+       r.id as rule_id,
+       i.created_at + make_interval(mins => r.first_response_minutes) as response_due_at,
+       i.created_at + make_interval(mins => r.resolution_minutes) as resolution_due_at,
+       least(
+           (select min(sc.created_at) from status_changes sc where sc.issue_id = i.id),
+           (select min(c.created_at) from comments c where c.issue_id = i.id)
+       ) as first_response_at
+from issues i
+join lateral (
+    select r.*
+    from sla_rules r
+    where r.category = i.category
+      and (r.district is null or r.district = i.district)
+    order by (r.district is null)
+    limit 1
+) r on true;
+
+alter table comments drop column if exists visibility;
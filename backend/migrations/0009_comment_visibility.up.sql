@@ -0,0 +1,25 @@
+-- видимость комментария: internal — заметка только для сотрудников, public — ответ жителю.
+-- Раньше бот не пересылал комментарии жителю, а админка пересылала; отличить их нельзя,
+-- поэтому существующие комментарии считаем внутренними, чтобы ничего не раскрыть лишнего.
+alter table comments add column if not exists visibility text not null default 'internal'
+    check (visibility in ('internal', 'public'));
+
+-- внутренняя заметка жителю не видна, поэтому первым ответом по SLA не считается
+create or replace view issue_sla as
+select i.id as issue_id,
+       r.id as rule_id,
+       i.created_at + make_interval(mins => r.first_response_minutes) as response_due_at,
+       i.created_at + make_interval(mins => r.resolution_minutes) as resolution_due_at,
+       least(
+           (select min(sc.created_at) from status_changes sc where sc.issue_id = i.id),
+           (select min(c.created_at) from comments c where c.issue_id = i.id and c.visibility = 'public')
+       ) as first_response_at
+from issues i
+join lateral (
+    select r.*
+    from sla_rules r
+    where r.category = i.category
+      and (r.district is null or r.district = i.district)
+    order by (r.district is null)
+    limit 1
+) r on true;
@@ -0,0 +1,2 @@
+drop table if exists admin_sessions;
+drop table if exists admin_accounts;
@@ -0,0 +1,29 @@
+-- учётные записи веб-админки вместо общего API_TOKEN
+create table if not exists admin_accounts (
+    id bigserial primary key,
+    login text not null,
+    password_hash text not null,                -- bcrypt
+    role text not null check (role in ('operator', 'department_head', 'superadmin')),
+    department_id bigint references departments(id) on delete set null,
+    tg_user_id bigint,                          -- Telegram-аккаунт сотрудника, от его имени пишутся комментарии
+    disabled_at timestamptz,
+    last_login_at timestamptz,
+    created_at timestamptz not null default now()
+);
+
+create unique index if not exists uq_admin_accounts_login on admin_accounts(lower(login));
+
+-- сессии: в базе хранится только sha256 от токена
+create table if not exists admin_sessions (
+    id bigserial primary key,
+    account_id bigint not null references admin_accounts(id) on delete cascade,
+    token_hash text not null unique,
+    user_agent text,
+    ip text,
+    created_at timestamptz not null default now(),
+    last_seen_at timestamptz not null default now(),
+    expires_at timestamptz not null,
+    revoked_at timestamptz
+);
+
+create index if not exists idx_admin_sessions_account on admin_sessions(account_id);
@@ -0,0 +1,12 @@
+alter table admin_accounts drop constraint if exists admin_accounts_department_id_fkey;
+alter table admin_accounts add constraint admin_accounts_department_id_fkey
+    foreign key (department_id) references departments(id) on delete set null;
+alter table admin_accounts drop column if exists district;
+
+alter table users drop column if exists is_admin;
+alter table users add column is_admin boolean not null default false;
+update users set is_admin = true where role is not null;
+
+alter table users drop column if exists scope_district;
+alter table users drop column if exists scope_department_id;
+alter table users drop column if exists role;
@@ -0,0 +1,20 @@
+-- роль сотрудника в Telegram вместо флага is_admin; права по ролям описаны в internal/authz.go.
+-- Все, кто был администратором, становятся суперадминистраторами.
+alter table users add column if not exists role text
+    check (role in ('operator', 'department_head', 'superadmin'));
+update users set role = 'superadmin' where is_admin and role is null;
+
+-- область видимости: только заявки службы и/или района; null — без ограничения.
+-- Удалять службу, пока она чья-то область, нельзя: иначе область молча расширится до всех заявок.
+alter table users add column if not exists scope_department_id bigint references departments(id);
+alter table users add column if not exists scope_district text;
+
+-- is_admin остаётся для совместимости запросов, но вычисляется из роли
+alter table users drop column if exists is_admin;
+alter table users add column is_admin boolean generated always as (role is not null) stored;
+
+-- у учёток админки department_id теперь задаёт область службы, добавляем район
+alter table admin_accounts add column if not exists district text;
+alter table admin_accounts drop constraint if exists admin_accounts_department_id_fkey;
+alter table admin_accounts add constraint admin_accounts_department_id_fkey
+    foreign key (department_id) references departments(id);
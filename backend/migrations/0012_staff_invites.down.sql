@@ -0,0 +1 @@
+drop table if exists staff_invites;
@@ -0,0 +1,19 @@
+-- одноразовые приглашения сотрудников вместо /admin <секрет>;
+-- в базе хранится только sha256 от токена из ссылки t.me/<бот>?start=invite_<токен>
+create table if not exists staff_invites (
+    id bigserial primary key,
+    token_hash text not null unique,
+    role text not null check (role in ('operator', 'department_head', 'superadmin')),
+    scope_department_id bigint references departments(id) on delete cascade,
+    scope_district text,
+    created_by_account_id bigint references admin_accounts(id) on delete set null,
+    created_by_tg_user_id bigint,
+    expires_at timestamptz not null,
+    used_at timestamptz,
+    used_by_user_id bigint references users(id) on delete set null,
+    revoked_at timestamptz,
+    created_at timestamptz not null default now()
+);
+
+create index if not exists idx_staff_invites_active on staff_invites(expires_at)
+    where used_at is null and revoked_at is null;
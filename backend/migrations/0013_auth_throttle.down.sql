@@ -0,0 +1,2 @@
+drop table if exists security_events;
+drop table if exists auth_throttle;
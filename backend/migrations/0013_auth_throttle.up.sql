@@ -0,0 +1,24 @@
+-- счётчики неудачных попыток входа с нарастающей блокировкой;
+-- scope — что считаем ('login', 'ip', 'tg'), key — логин, адрес или tg id
+create table if not exists auth_throttle (
+    scope text not null,
+    key text not null,
+    failures int not null default 0,             -- неудач в текущем окне
+    window_started_at timestamptz not null default now(),
+    lockouts int not null default 0,             -- блокировок подряд, от них растёт срок следующей
+    locked_until timestamptz,
+    last_failure_at timestamptz,
+    primary key (scope, key)
+);
+
+-- журнал событий безопасности: неудачные попытки, блокировки
+create table if not exists security_events (
+    id bigserial primary key,
+    kind text not null,
+    subject text,                                -- логин, tg id и т.п.
+    ip text,
+    details text,
+    created_at timestamptz not null default now()
+);
+
+create index if not exists idx_security_events_created on security_events(created_at desc);
@@ -0,0 +1 @@
+alter table issues drop column if exists access_token_hash;
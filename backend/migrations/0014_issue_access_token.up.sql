@@ -0,0 +1,3 @@
+-- токен доступа автора веб-заявки к её вложениям; в базе только sha256,
+-- сам токен отдаётся один раз в ответе POST /api/issues
+alter table issues add column if not exists access_token_hash text;
@@ -0,0 +1,4 @@
+drop index if exists attachments_blob_key_idx;
+
+alter table attachments drop column if exists size;
+alter table attachments drop column if exists blob_key;
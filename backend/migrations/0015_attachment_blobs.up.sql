@@ -0,0 +1,6 @@
+-- Файлы вложений лежат в хранилище (локальный диск или S3) под ключом,
+-- вычисленным из содержимого. local_path остаётся только у старых вложений.
+alter table attachments add column if not exists blob_key text;
+alter table attachments add column if not exists size bigint;
+
+create index if not exists attachments_blob_key_idx on attachments (blob_key);
@@ -0,0 +1,7 @@
+drop index if exists attachments_download_pending_idx;
+
+alter table attachments
+    drop column if exists next_download_at,
+    drop column if exists download_error,
+    drop column if exists download_attempts,
+    drop column if exists download_status;
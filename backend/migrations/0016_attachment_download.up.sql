@@ -0,0 +1,11 @@
+-- Файлы из Telegram скачиваются в хранилище фоновой задачей (см. MediaFetcher):
+-- вложение сразу записывается как pending, а ключ появляется после скачивания.
+alter table attachments
+    add column if not exists download_status text not null default 'done'
+        check (download_status in ('pending', 'done', 'failed')),
+    add column if not exists download_attempts int not null default 0,
+    add column if not exists download_error text,
+    add column if not exists next_download_at timestamptz;
+
+create index if not exists attachments_download_pending_idx
+    on attachments (next_download_at) where download_status = 'pending';
@@ -0,0 +1 @@
+alter table issues drop column if exists contact_phone;
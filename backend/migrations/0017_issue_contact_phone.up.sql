@@ -0,0 +1,2 @@
+-- телефон для связи, которым житель поделился в боте (контакт Telegram)
+alter table issues add column if not exists contact_phone text;
@@ -0,0 +1,10 @@
+drop table if exists citizen_link_codes;
+
+drop index if exists users_phone_idx;
+alter table users drop column if exists phone_verified_at;
+alter table users drop column if exists phone;
+
+drop index if exists issues_citizen_id_idx;
+alter table issues drop column if exists citizen_id;
+
+drop table if exists citizens;
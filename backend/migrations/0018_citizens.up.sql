@@ -0,0 +1,35 @@
+-- Профили жителей, подающих заявки с сайта. Телефон хранится как +<цифры>,
+-- e-mail — в нижнем регистре; по ним заявки одного человека собираются вместе.
+create table if not exists citizens (
+    id bigserial primary key,
+    name text,
+    phone text unique,
+    email text unique,
+    -- привязанный Telegram: его заявки с сайта видны в боте, туда же идут уведомления
+    user_id bigint unique references users(id) on delete set null,
+    linked_at timestamptz,
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now(),
+    check (phone is not null or email is not null)
+);
+
+alter table issues add column if not exists citizen_id bigint references citizens(id) on delete set null;
+create index if not exists issues_citizen_id_idx on issues (citizen_id);
+
+-- телефон, подтверждённый Telegram: житель поделился собственным контактом
+alter table users add column if not exists phone text;
+alter table users add column if not exists phone_verified_at timestamptz;
+create index if not exists users_phone_idx on users (phone);
+
+-- коды привязки Telegram, которые бот присылает жителю; в базе только sha256
+create table if not exists citizen_link_codes (
+    id bigserial primary key,
+    citizen_id bigint not null references citizens(id) on delete cascade,
+    user_id bigint not null references users(id) on delete cascade,
+    code_hash text not null,
+    attempts int not null default 0,
+    expires_at timestamptz not null,
+    used_at timestamptz,
+    created_at timestamptz not null default now()
+);
+create index if not exists citizen_link_codes_citizen_idx on citizen_link_codes (citizen_id, created_at desc);
@@ -0,0 +1,2 @@
+drop index if exists issues_tracking_code_idx;
+alter table issues drop column if exists tracking_code;
@@ -0,0 +1,6 @@
+-- публичный код отслеживания заявки: по ссылке /track/<код> видны статус и ответы
+-- без персональных данных. gen_random_uuid — криптостойкий, есть в PostgreSQL 13+;
+-- существующие заявки получают свой код при добавлении столбца.
+alter table issues add column if not exists tracking_code text not null
+    default replace(gen_random_uuid()::text, '-', '');
+create unique index if not exists issues_tracking_code_idx on issues (tracking_code);
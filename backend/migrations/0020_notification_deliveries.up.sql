@@ -0,0 +1,15 @@
+-- доставки уведомлений жителю по заявке: одна строка на канал (telegram, email)
+create table if not exists notification_deliveries (
+    id bigserial primary key,
+    issue_id bigint not null references issues(id) on delete cascade,
+    kind text not null,             -- status_changed, comment
+    channel text not null,          -- telegram, email
+    recipient text not null,        -- chat id или адрес
+    subject text not null default '',
+    body text not null,
+    status text not null default 'pending' check (status in ('pending', 'sent', 'failed')),
+    error text,
+    created_at timestamptz not null default now(),
+    sent_at timestamptz
+);
+create index if not exists notification_deliveries_issue_idx on notification_deliveries (issue_id, created_at);
@@ -0,0 +1,31 @@
+-- исходящие webhooks: подписки внешних систем на события заявок
+create table if not exists webhook_subscriptions (
+    id bigserial primary key,
+    name text not null,
+    url text not null,
+    secret text not null,           -- ключ HMAC-подписи, нужен в открытом виде
+    events text[] not null,         -- issue.created, issue.status_changed, ...
+    enabled boolean not null default true,
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now()
+);
+
+-- очередь и журнал доставок: строка на пару «событие — подписка»,
+-- пишется в той же транзакции, что и само изменение заявки
+create table if not exists webhook_deliveries (
+    id bigserial primary key,
+    subscription_id bigint not null references webhook_subscriptions(id) on delete cascade,
+    event_id text not null,         -- общий у доставок одного события
+    event text not null,
+    payload jsonb not null,
+    status text not null default 'pending' check (status in ('pending', 'delivered', 'failed')),
+    attempts int not null default 0,
+    next_attempt_at timestamptz not null default now(),
+    response_code int,
+    last_error text,
+    created_at timestamptz not null default now(),
+    delivered_at timestamptz
+);
+create index if not exists webhook_deliveries_pending_idx on webhook_deliveries (next_attempt_at)
+    where status = 'pending';
+create index if not exists webhook_deliveries_subscription_idx on webhook_deliveries (subscription_id, created_at desc);
@@ -0,0 +1,5 @@
+drop index if exists webhook_deliveries_event_idx;
+drop index if exists notification_deliveries_event_idx;
+alter table notification_deliveries drop column if exists event_id;
+drop table if exists outbox_handled;
+drop table if exists outbox;
@@ -0,0 +1,28 @@
+-- transactional outbox: доменные события пишутся в той же транзакции, что и
+-- изменение заявки, и раздаются подписчикам фоновым EventBus
+create table if not exists outbox (
+    id bigserial primary key,
+    event text not null,            -- issue.created, issue.status_changed, ...
+    issue_id bigint not null,
+    payload jsonb not null,
+    status text not null default 'pending' check (status in ('pending', 'done', 'failed')),
+    attempts int not null default 0,
+    next_attempt_at timestamptz not null default now(),
+    last_error text,
+    created_at timestamptz not null default now(),
+    processed_at timestamptz
+);
+create index if not exists outbox_pending_idx on outbox (next_attempt_at, id) where status = 'pending';
+
+-- какие подписчики уже обработали событие: при повторе их не вызываем снова
+create table if not exists outbox_handled (
+    event_id bigint not null references outbox(id) on delete cascade,
+    subscriber text not null,
+    handled_at timestamptz not null default now(),
+    primary key (event_id, subscriber)
+);
+
+-- повторная обработка события не должна дублировать уведомления и webhooks
+alter table notification_deliveries add column if not exists event_id bigint;
+create unique index if not exists notification_deliveries_event_idx on notification_deliveries (event_id, channel);
+create unique index if not exists webhook_deliveries_event_idx on webhook_deliveries (subscription_id, event_id);
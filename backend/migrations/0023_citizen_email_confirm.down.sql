@@ -0,0 +1,4 @@
+drop index if exists citizens_email_token_hash_idx;
+alter table citizens drop column if exists email_token_sent_at;
+alter table citizens drop column if exists email_token_hash;
+alter table citizens drop column if exists email_verified_at;
@@ -0,0 +1,7 @@
+-- e-mail из формы на сайте никто не проверял: уведомления туда уходят только
+-- после того, как житель перешёл по ссылке из письма-подтверждения
+alter table citizens add column if not exists email_verified_at timestamptz;
+-- sha256 токена из ссылки и время отправки письма (не чаще раза в сутки)
+alter table citizens add column if not exists email_token_hash text;
+alter table citizens add column if not exists email_token_sent_at timestamptz;
+create unique index if not exists citizens_email_token_hash_idx on citizens (email_token_hash);
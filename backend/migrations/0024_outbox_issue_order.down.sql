@@ -0,0 +1 @@
+drop index if exists outbox_pending_issue_idx;
@@ -0,0 +1,3 @@
+-- событие заявки не раздаётся, пока не обработаны её более ранние события
+-- (см. claimEvents): ищем их по этому индексу
+create index if not exists outbox_pending_issue_idx on outbox (issue_id, id) where status = 'pending';
@@ -0,0 +1,10 @@
+// Package migrations содержит SQL-миграции схемы базы данных.
+//
+// Файлы именуются как NNNN_описание.up.sql / NNNN_описание.down.sql,
+// где NNNN — номер версии. Применяются по возрастанию номера.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS